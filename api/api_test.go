@@ -1,15 +1,36 @@
 package api
 
 import (
+	"archive/zip"
+	"bytes"
+	"context"
 	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"maps"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"slices"
 	"strings"
 	"testing"
+	"time"
 
+	"github.com/htol/bopds/book"
+	"github.com/htol/bopds/config"
 	"github.com/htol/bopds/logger"
+	"github.com/htol/bopds/mailer/mailtest"
+	"github.com/htol/bopds/opds"
 	"github.com/htol/bopds/repo"
 	"github.com/htol/bopds/service"
+	"github.com/htol/bopds/tracing"
+	"go.opentelemetry.io/otel"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
 )
 
 func init() {
@@ -164,15 +185,15 @@ func TestGetGenresHandler_Success(t *testing.T) {
 		t.Errorf("Expected Content-Type to start with 'application/json', got %q", contentType)
 	}
 
-	// Check response is an array
-	var resp []interface{}
+	// Check response is a list page
+	var resp listResponse[book.Genre]
 	if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
 		t.Fatalf("Failed to decode JSON response: %v", err)
 	}
 
 	// Empty genres array is expected (no data in :memory: db)
-	if len(resp) != 0 {
-		t.Errorf("Expected empty genres array, got %d items", len(resp))
+	if resp.Items == nil || len(resp.Items) != 0 || resp.Total != 0 || resp.Next != nil {
+		t.Errorf("Expected an empty genres page, got %+v", resp)
 	}
 }
 
@@ -270,15 +291,15 @@ func TestGetBooksByLetterHandler_Success(t *testing.T) {
 		t.Errorf("Expected Content-Type 'application/json', got %q", contentType)
 	}
 
-	// Check response is an array
-	var resp []interface{}
+	// Check response is an empty page
+	var resp listResponse[book.Book]
 	if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
 		t.Fatalf("Failed to decode JSON response: %v", err)
 	}
 
 	// Empty books array is expected (no data in :memory: db)
-	if len(resp) != 0 {
-		t.Errorf("Expected empty books array, got %d items", len(resp))
+	if resp.Items == nil || len(resp.Items) != 0 || resp.Total != 0 || resp.Next != nil {
+		t.Errorf("Expected an empty page of books, got %+v", resp)
 	}
 }
 
@@ -290,3 +311,1582 @@ type testError struct {
 func (e *testError) Error() string {
 	return e.msg
 }
+
+func TestLibraryScopedRoutes(t *testing.T) {
+	storage := repo.GetStorage(":memory:")
+	defer func() {
+		if err := storage.Close(); err != nil {
+			t.Logf("Error closing storage: %v", err)
+		}
+	}()
+	cfg := &config.Config{
+		Libraries: []config.LibraryConfig{
+			{Name: "flibusta", Path: "/library/flibusta"},
+			{Name: "librusec", Path: "/library/librusec"},
+		},
+	}
+	handler := NewHandler(service.NewWithConfig(storage, cfg))
+
+	tests := []struct {
+		name         string
+		path         string
+		expectStatus int
+		expectBody   string
+	}{
+		{"root links libraries", "/opds", http.StatusOK, "/opds/library/librusec"},
+		{"library root", "/opds/library/flibusta", http.StatusOK, "/opds/library/flibusta/authors"},
+		{"library feed", "/opds/library/flibusta/genres", http.StatusOK, "/opds/library/flibusta/genres"},
+		{"unknown library root", "/opds/library/unknown", http.StatusNotFound, ""},
+		{"unknown library feed", "/opds/library/unknown/new", http.StatusNotFound, ""},
+		{"rest filter", "/api/genres?library=librusec", http.StatusOK, "[]"},
+		{"rest unknown library", "/api/genres?library=unknown", http.StatusBadRequest, "unknown library"},
+		{"library list", "/api/libraries", http.StatusOK, `["flibusta","librusec"]`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, httptest.NewRequest("GET", tt.path, nil))
+
+			if w.Code != tt.expectStatus {
+				t.Errorf("Expected status %d, got %d", tt.expectStatus, w.Code)
+			}
+			if !strings.Contains(w.Body.String(), tt.expectBody) {
+				t.Errorf("Expected body to contain %q, got %q", tt.expectBody, w.Body.String())
+			}
+		})
+	}
+}
+
+func TestMetricsEndpoint(t *testing.T) {
+	storage := repo.GetStorage(":memory:")
+	defer func() {
+		if err := storage.Close(); err != nil {
+			t.Logf("Error closing storage: %v", err)
+		}
+	}()
+	handler := NewHandler(service.New(storage))
+
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/api/genres", nil))
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/opds/authors/42", nil))
+
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d", w.Code)
+	}
+
+	body := w.Body.String()
+	for _, want := range []string{
+		`bopds_http_requests_total{method="GET",route="/api/genres",status="200"}`,
+		`bopds_http_request_duration_seconds_count{method="GET",route="/opds/authors/{id}"}`,
+		"go_goroutines",
+	} {
+		if !strings.Contains(body, want) {
+			t.Errorf("Expected metrics output to contain %q", want)
+		}
+	}
+}
+
+func TestTracingSpans(t *testing.T) {
+	recorder := tracetest.NewSpanRecorder()
+	tp := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder))
+	prev := otel.GetTracerProvider()
+	otel.SetTracerProvider(tp)
+	defer otel.SetTracerProvider(prev)
+	if _, err := tracing.Init(context.Background(), config.TracingConfig{}); err != nil {
+		t.Fatalf("tracing.Init failed: %v", err)
+	}
+
+	storage := repo.GetStorage(":memory:")
+	defer func() {
+		if err := storage.Close(); err != nil {
+			t.Logf("Error closing storage: %v", err)
+		}
+	}()
+	handler := NewHandler(service.New(storage))
+
+	const traceID = "4bf92f3577b34da6a3ce929d0e0e4736"
+	req := httptest.NewRequest("GET", "/api/genres", nil)
+	req.Header.Set("X-Request-ID", "req-123")
+	req.Header.Set("traceparent", "00-"+traceID+"-00f067aa0ba902b7-01")
+	handler.ServeHTTP(httptest.NewRecorder(), req)
+
+	spans := map[string]sdktrace.ReadOnlySpan{}
+	for _, span := range recorder.Ended() {
+		spans[span.Name()] = span
+	}
+
+	server, ok := spans["GET /api/genres"]
+	if !ok {
+		t.Fatalf("Expected server span named after the route, got %v", spans)
+	}
+	if got := server.SpanContext().TraceID().String(); got != traceID {
+		t.Errorf("Expected propagated trace ID %s, got %s", traceID, got)
+	}
+	var requestID string
+	for _, attr := range server.Attributes() {
+		if attr.Key == "request.id" {
+			requestID = attr.Value.AsString()
+		}
+	}
+	if requestID != "req-123" {
+		t.Errorf("Expected request.id attribute 'req-123', got %q", requestID)
+	}
+
+	// Handler -> service -> repository spans form one chain
+	parents := map[string]string{
+		"Service.GetGenres": "GET /api/genres",
+		"repo.GetGenres":    "Service.GetGenres",
+	}
+	for child, parent := range parents {
+		span, ok := spans[child]
+		if !ok {
+			t.Errorf("Expected span %q", child)
+			continue
+		}
+		if span.Parent().SpanID() != spans[parent].SpanContext().SpanID() {
+			t.Errorf("Expected %q to be a child of %q", child, parent)
+		}
+	}
+}
+
+// testFB2 is a minimal FictionBook document that fb2c can convert
+const testFB2 = `<?xml version="1.0" encoding="utf-8"?>
+<FictionBook xmlns="http://www.gribuser.ru/xml/fictionbook/2.0">
+  <description>
+    <title-info>
+      <genre>prose</genre>
+      <author><first-name>Test</first-name><last-name>Author</last-name></author>
+      <book-title>Test Book</book-title>
+      <lang>en</lang>
+    </title-info>
+  </description>
+  <body><section><title><p>Chapter</p></title><p>Hello, world.</p></section></body>
+</FictionBook>`
+
+// addTestBook stores testFB2 in a ZIP archive under libDir and records it in storage
+func addTestBook(t *testing.T, storage *repo.Repo, libDir string) int64 {
+	t.Helper()
+	f, err := os.Create(filepath.Join(libDir, "books.zip"))
+	if err != nil {
+		t.Fatalf("create archive: %v", err)
+	}
+	zw := zip.NewWriter(f)
+	w, err := zw.Create("1.fb2")
+	if err != nil {
+		t.Fatalf("create archive entry: %v", err)
+	}
+	if _, err := io.WriteString(w, testFB2); err != nil {
+		t.Fatalf("write archive entry: %v", err)
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatalf("close archive: %v", err)
+	}
+	f.Close()
+
+	b := &book.Book{
+		Title:    "Test Book",
+		Author:   []book.Author{{FirstName: "Test", LastName: "Author"}},
+		Lang:     "en",
+		Archive:  "books.zip",
+		FileName: "1.fb2",
+		Library:  config.DefaultLibraryName,
+	}
+	if err := storage.Add(b); err != nil {
+		t.Fatalf("add book: %v", err)
+	}
+	books, _, err := storage.GetBooksByLetter("T", "", repo.ListOptions{})
+	if err != nil || len(books) != 1 {
+		t.Fatalf("expected the test book to be stored, got %v (%v)", books, err)
+	}
+	return books[0].BookID
+}
+
+func TestConversionJobs(t *testing.T) {
+	storage := repo.GetStorage(":memory:")
+	defer func() {
+		if err := storage.Close(); err != nil {
+			t.Logf("Error closing storage: %v", err)
+		}
+	}()
+	libDir := t.TempDir()
+	cfg := config.Default()
+	cfg.Libraries = []config.LibraryConfig{{Name: config.DefaultLibraryName, Path: libDir}}
+	cfg.Conversion.JobsDir = t.TempDir()
+	svc := service.NewWithConfig(storage, cfg)
+	handler := NewHandler(svc)
+	id := addTestBook(t, storage, libDir)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer func() {
+		cancel()
+		svc.WaitJobs()
+	}()
+	if err := svc.StartJobs(ctx); err != nil {
+		t.Fatalf("StartJobs failed: %v", err)
+	}
+
+	for _, tt := range []struct {
+		name         string
+		path         string
+		expectStatus int
+	}{
+		{"unsupported format", fmt.Sprintf("/api/books/%d/convert?format=pdf", id), http.StatusBadRequest},
+		{"unknown book", "/api/books/999/convert?format=epub", http.StatusNotFound},
+		{"invalid book ID", "/api/books/abc/convert?format=epub", http.StatusBadRequest},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, httptest.NewRequest("POST", tt.path, nil))
+			if w.Code != tt.expectStatus {
+				t.Errorf("Expected status %d, got %d: %s", tt.expectStatus, w.Code, w.Body.String())
+			}
+		})
+	}
+
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("POST", fmt.Sprintf("/api/books/%d/convert?format=epub", id), nil))
+	if w.Code != http.StatusAccepted {
+		t.Fatalf("Expected status 202, got %d: %s", w.Code, w.Body.String())
+	}
+	location := w.Header().Get("Location")
+
+	var job struct {
+		Status      string `json:"status"`
+		Progress    int    `json:"progress"`
+		Error       string `json:"error"`
+		DownloadURL string `json:"download_url"`
+	}
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest("GET", location, nil))
+		if w.Code != http.StatusOK {
+			t.Fatalf("Expected status 200 polling %s, got %d", location, w.Code)
+		}
+		if err := json.NewDecoder(w.Body).Decode(&job); err != nil {
+			t.Fatalf("Failed to decode job: %v", err)
+		}
+		if job.Status == "done" || job.Status == "failed" {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("job did not finish, last status %q", job.Status)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if job.Status != "done" || job.Progress != 100 {
+		t.Fatalf("Expected finished job, got %+v", job)
+	}
+
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("GET", job.DownloadURL, nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected status 200 downloading result, got %d", w.Code)
+	}
+	if ct := w.Header().Get("Content-Type"); ct != "application/epub+zip" {
+		t.Errorf("Expected EPUB content type, got %q", ct)
+	}
+	if !strings.Contains(w.Header().Get("Content-Disposition"), "Author%20Test%20-%20Test%20Book.epub") {
+		t.Errorf("Unexpected Content-Disposition %q", w.Header().Get("Content-Disposition"))
+	}
+	if !bytes.HasPrefix(w.Body.Bytes(), []byte("PK")) {
+		t.Errorf("Expected a ZIP-based EPUB, got %q", w.Body.Bytes()[:min(16, w.Body.Len())])
+	}
+
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("GET", "/api/jobs/999", nil))
+	if w.Code != http.StatusNotFound {
+		t.Errorf("Expected status 404 for unknown job, got %d", w.Code)
+	}
+}
+
+func TestDownloadFormats(t *testing.T) {
+	storage := repo.GetStorage(":memory:")
+	defer func() {
+		if err := storage.Close(); err != nil {
+			t.Logf("Error closing storage: %v", err)
+		}
+	}()
+	libDir := t.TempDir()
+	cfg := config.Default()
+	cfg.Libraries = []config.LibraryConfig{{Name: config.DefaultLibraryName, Path: libDir}}
+	handler := NewHandler(service.NewWithConfig(storage, cfg))
+	id := addTestBook(t, storage, libDir)
+
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("GET", "/api/formats", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected status 200 for formats, got %d", w.Code)
+	}
+	var formats listResponse[formatInfo]
+	if err := json.NewDecoder(w.Body).Decode(&formats); err != nil {
+		t.Fatalf("Failed to decode formats: %v", err)
+	}
+	var names []string
+	for _, f := range formats.Items {
+		names = append(names, f.Name)
+	}
+	if got := strings.Join(names, ","); got != "fb2,fb2.zip,epub,mobi,azw3,txt,html" {
+		t.Errorf("Unexpected formats %q", got)
+	}
+
+	tests := []struct {
+		format       string
+		expectStatus int
+		expectType   string
+		expectBody   string
+	}{
+		{"fb2.zip", http.StatusOK, "application/zip", "PK\x03\x04"},
+		{"txt", http.StatusOK, "text/plain; charset=utf-8", "Test Book\n"},
+		{"html", http.StatusOK, "text/html; charset=utf-8", "<title>Test Book</title>"},
+		{"pdf", http.StatusBadRequest, "", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.format, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, httptest.NewRequest("GET", fmt.Sprintf("/api/books/%d/download?format=%s", id, tt.format), nil))
+			if w.Code != tt.expectStatus {
+				t.Fatalf("Expected status %d, got %d: %s", tt.expectStatus, w.Code, w.Body.String())
+			}
+			if tt.expectType == "" {
+				return
+			}
+			if ct := w.Header().Get("Content-Type"); ct != tt.expectType {
+				t.Errorf("Expected content type %q, got %q", tt.expectType, ct)
+			}
+			if !strings.Contains(w.Body.String(), tt.expectBody) {
+				t.Errorf("Expected body to contain %q, got %q", tt.expectBody, w.Body.String())
+			}
+		})
+	}
+}
+
+func TestDownloadStoredFormats(t *testing.T) {
+	storage := repo.GetStorage(":memory:")
+	defer func() {
+		if err := storage.Close(); err != nil {
+			t.Logf("Error closing storage: %v", err)
+		}
+	}()
+	libDir := t.TempDir()
+	cfg := config.Default()
+	cfg.Libraries = []config.LibraryConfig{{Name: config.DefaultLibraryName, Path: libDir}}
+	handler := NewHandler(service.NewWithConfig(storage, cfg))
+
+	// EPUB and PDF books are stored directly and served as they are
+	stored := map[string]string{"epub": "PK\x03\x04 stored EPUB", "pdf": "%PDF-1.4 stored PDF"}
+	ids := make(map[string]int64)
+	for format, content := range stored {
+		if err := os.WriteFile(filepath.Join(libDir, "book."+format), []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		b := &book.Book{
+			Title:    "Stored " + format,
+			Author:   []book.Author{{FirstName: "Test", LastName: "Author"}},
+			Archive:  "book." + format,
+			FileName: "book." + format,
+			Format:   format,
+			Library:  config.DefaultLibraryName,
+		}
+		if err := storage.Add(b); err != nil {
+			t.Fatalf("add book: %v", err)
+		}
+	}
+	books, _, err := storage.GetBooksByLetter("S", "", repo.ListOptions{})
+	if err != nil || len(books) != 2 {
+		t.Fatalf("expected the test books to be stored, got %v (%v)", books, err)
+	}
+	for _, b := range books {
+		ids[b.Format] = b.BookID
+	}
+
+	tests := []struct {
+		book, format      string
+		expectStatus      int
+		expectContentType string
+	}{
+		{"epub", "epub", http.StatusOK, "application/epub+zip"},
+		{"epub", "", http.StatusOK, "application/epub+zip"},
+		{"epub", "fb2", http.StatusBadRequest, ""},
+		{"epub", "fb2.zip", http.StatusBadRequest, ""},
+		{"epub", "mobi", http.StatusBadRequest, ""},
+		{"pdf", "pdf", http.StatusOK, "application/pdf"},
+		{"pdf", "", http.StatusOK, "application/pdf"},
+		{"pdf", "epub", http.StatusBadRequest, ""},
+		{"pdf", "djvu", http.StatusBadRequest, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.book+"/"+tt.format, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, httptest.NewRequest("GET", fmt.Sprintf("/api/books/%d/download?format=%s", ids[tt.book], tt.format), nil))
+			if w.Code != tt.expectStatus {
+				t.Fatalf("Expected status %d, got %d: %s", tt.expectStatus, w.Code, w.Body.String())
+			}
+			if tt.expectStatus != http.StatusOK {
+				return
+			}
+			if w.Body.String() != stored[tt.book] {
+				t.Errorf("Expected the stored book, got %q", w.Body.String())
+			}
+			if ct := w.Header().Get("Content-Type"); ct != tt.expectContentType {
+				t.Errorf("Expected content type %s, got %s", tt.expectContentType, ct)
+			}
+			if cd := w.Header().Get("Content-Disposition"); !strings.HasSuffix(cd, "."+tt.book) {
+				t.Errorf("Expected a .%s file name, got %s", tt.book, cd)
+			}
+		})
+	}
+
+	// Only FB2 books are converted
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("POST", fmt.Sprintf("/api/books/%d/convert?format=mobi", ids["epub"]), nil))
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("Expected status 400 converting an EPUB book, got %d: %s", w.Code, w.Body.String())
+	}
+
+	// OPDS offers the stored format alone
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("GET", "/opds/new", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected status 200 for the OPDS feed, got %d", w.Code)
+	}
+	feed := w.Body.String()
+	for _, want := range []string{
+		fmt.Sprintf(`href="http://example.com/api/books/%d/download?format=pdf" type="application/pdf"`, ids["pdf"]),
+		fmt.Sprintf(`href="http://example.com/api/books/%d/download?format=epub" type="application/epub+zip"`, ids["epub"]),
+	} {
+		if !strings.Contains(feed, want) {
+			t.Errorf("Expected the feed to link %s", want)
+		}
+	}
+	if strings.Contains(feed, "application/fb2+zip") {
+		t.Error("Expected no FB2 links for books stored in other formats")
+	}
+}
+
+func TestNeedsConversion(t *testing.T) {
+	tests := []struct {
+		name   string
+		stored string
+		format string
+		expect bool
+	}{
+		{"fb2 as stored", "", "fb2", false},
+		{"fb2 zipped", "fb2", "fb2.zip", false},
+		{"fb2 to epub", "", "epub", true},
+		{"fb2 to mobi", "fb2", "mobi", true},
+		{"epub as stored", "epub", "epub", false},
+		{"pdf as stored", "pdf", "pdf", false},
+		{"pdf to epub is refused, not converted", "pdf", "epub", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := needsConversion(&book.Book{Format: tt.stored}, tt.format); got != tt.expect {
+				t.Errorf("expected %v, got %v", tt.expect, got)
+			}
+		})
+	}
+}
+
+func TestConversionProfiles(t *testing.T) {
+	storage := repo.GetStorage(":memory:")
+	defer func() {
+		if err := storage.Close(); err != nil {
+			t.Logf("Error closing storage: %v", err)
+		}
+	}()
+	libDir := t.TempDir()
+	cfg := config.Default()
+	cfg.Libraries = []config.LibraryConfig{{Name: config.DefaultLibraryName, Path: libDir}}
+	cfg.Conversion.JobsDir = t.TempDir()
+	cfg.Conversion.Profiles = []config.ProfileConfig{{Name: "plain", NoCover: true, InlineNotes: true, Hyphenation: true}}
+	cfg.Conversion.UserProfiles = map[string]string{"alice": "plain"}
+	cfg.RateLimit.UserHeader = "X-Remote-User"
+	svc := service.NewWithConfig(storage, cfg)
+	handler := NewHandler(svc)
+	id := addTestBook(t, storage, libDir)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer func() {
+		cancel()
+		svc.WaitJobs()
+	}()
+	if err := svc.StartJobs(ctx); err != nil {
+		t.Fatalf("StartJobs failed: %v", err)
+	}
+
+	t.Run("download", func(t *testing.T) {
+		for _, tt := range []struct {
+			query        string
+			user         string
+			expectStatus int
+			expectStyle  bool
+		}{
+			{"format=html", "", http.StatusOK, false},
+			{"format=html&profile=plain", "", http.StatusOK, true},
+			{"format=html", "alice", http.StatusOK, true},
+			{"format=html&profile=large", "", http.StatusBadRequest, false},
+		} {
+			req := httptest.NewRequest("GET", fmt.Sprintf("/api/books/%d/download?%s", id, tt.query), nil)
+			if tt.user != "" {
+				req.Header.Set("X-Remote-User", tt.user)
+			}
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, req)
+			if w.Code != tt.expectStatus {
+				t.Errorf("%s as %q: expected status %d, got %d: %s", tt.query, tt.user, tt.expectStatus, w.Code, w.Body.String())
+				continue
+			}
+			if got := strings.Contains(w.Body.String(), "hyphens:auto"); w.Code == http.StatusOK && got != tt.expectStyle {
+				t.Errorf("%s as %q: expected profile styles %v, got %v", tt.query, tt.user, tt.expectStyle, got)
+			}
+		}
+	})
+
+	t.Run("jobs are cached per profile", func(t *testing.T) {
+		convert := func(user string) (int, map[string]any) {
+			req := httptest.NewRequest("POST", fmt.Sprintf("/api/books/%d/convert?format=txt", id), nil)
+			if user != "" {
+				req.Header.Set("X-Remote-User", user)
+			}
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, req)
+			var job map[string]any
+			if err := json.NewDecoder(w.Body).Decode(&job); err != nil {
+				t.Fatalf("Failed to decode job: %v", err)
+			}
+			return w.Code, job
+		}
+		waitDone := func(job map[string]any) {
+			deadline := time.Now().Add(10 * time.Second)
+			for job["status"] != "done" {
+				if job["status"] == "failed" || time.Now().After(deadline) {
+					t.Fatalf("job did not finish: %+v", job)
+				}
+				time.Sleep(10 * time.Millisecond)
+				w := httptest.NewRecorder()
+				handler.ServeHTTP(w, httptest.NewRequest("GET", fmt.Sprintf("/api/jobs/%v", job["id"]), nil))
+				job = map[string]any{}
+				json.NewDecoder(w.Body).Decode(&job)
+			}
+		}
+
+		_, first := convert("alice")
+		if first["profile"] != "plain" {
+			t.Errorf("expected alice's default profile, got %v", first["profile"])
+		}
+		waitDone(first)
+
+		status, again := convert("alice")
+		if status != http.StatusOK || again["id"] != first["id"] {
+			t.Errorf("expected finished job %v to be reused, got status %d and job %v", first["id"], status, again["id"])
+		}
+		status, other := convert("")
+		if status != http.StatusAccepted || other["id"] == first["id"] {
+			t.Errorf("expected a new job without a profile, got status %d and job %v", status, other["id"])
+		}
+	})
+}
+
+func TestSendBook(t *testing.T) {
+	storage := repo.GetStorage(":memory:")
+	defer func() {
+		if err := storage.Close(); err != nil {
+			t.Logf("Error closing storage: %v", err)
+		}
+	}()
+	smtpServer := mailtest.NewServer(t)
+	libDir := t.TempDir()
+	cfg := config.Default()
+	cfg.Libraries = []config.LibraryConfig{{Name: config.DefaultLibraryName, Path: libDir}}
+	cfg.Conversion.JobsDir = t.TempDir()
+	cfg.Mail.Host = smtpServer.Host()
+	cfg.Mail.Port = smtpServer.Port()
+	cfg.Mail.From = "library@example.com"
+	cfg.Mail.TLS = "none"
+	cfg.Mail.RetryDelay = 0
+	cfg.Mail.Recipients = map[string]config.RecipientConfig{"alice": {Address: "alice@kindle.com"}}
+	cfg.RateLimit.UserHeader = "X-Remote-User"
+	svc := service.NewWithConfig(storage, cfg)
+	handler := NewHandler(svc)
+	id := addTestBook(t, storage, libDir)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer func() {
+		cancel()
+		svc.WaitJobs()
+	}()
+	if err := svc.StartJobs(ctx); err != nil {
+		t.Fatalf("StartJobs failed: %v", err)
+	}
+
+	send := func(path, user string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("POST", path, nil)
+		if user != "" {
+			req.Header.Set("X-Remote-User", user)
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		return w
+	}
+
+	for _, tt := range []struct {
+		name         string
+		path         string
+		user         string
+		expectStatus int
+	}{
+		{"no recipient", fmt.Sprintf("/api/books/%d/send", id), "bob", http.StatusForbidden},
+		{"anonymous", fmt.Sprintf("/api/books/%d/send", id), "", http.StatusForbidden},
+		{"unknown book", "/api/books/999/send", "alice", http.StatusNotFound},
+		{"unknown profile", fmt.Sprintf("/api/books/%d/send?profile=large", id), "alice", http.StatusBadRequest},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			if w := send(tt.path, tt.user); w.Code != tt.expectStatus {
+				t.Errorf("Expected status %d, got %d: %s", tt.expectStatus, w.Code, w.Body.String())
+			}
+		})
+	}
+
+	// The first delivery is rejected temporarily and retried
+	smtpServer.Reject("451 4.3.0 try again later")
+	w := send(fmt.Sprintf("/api/books/%d/send", id), "alice")
+	if w.Code != http.StatusAccepted {
+		t.Fatalf("Expected status 202, got %d: %s", w.Code, w.Body.String())
+	}
+	location := w.Header().Get("Location")
+
+	var job map[string]any
+	deadline := time.Now().Add(10 * time.Second)
+	for job["status"] != "done" {
+		if job["status"] == "failed" || time.Now().After(deadline) {
+			t.Fatalf("job did not finish: %+v", job)
+		}
+		time.Sleep(10 * time.Millisecond)
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest("GET", location, nil))
+		job = map[string]any{}
+		json.NewDecoder(w.Body).Decode(&job)
+	}
+	if job["kind"] != "send" || job["attempts"] != float64(1) || job["download_url"] != nil {
+		t.Errorf("unexpected finished job %+v", job)
+	}
+	if _, hasRecipient := job["recipient"]; hasRecipient {
+		t.Error("the recipient address must not be exposed")
+	}
+
+	msgs := smtpServer.Messages()
+	if len(msgs) != 1 || len(msgs[0].To) != 1 || msgs[0].To[0] != "alice@kindle.com" {
+		t.Fatalf("expected one message to alice@kindle.com, got %+v", msgs)
+	}
+	if !bytes.Contains(msgs[0].Data, []byte("application/epub+zip")) {
+		t.Error("expected an EPUB attachment")
+	}
+
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("GET", location+"/download", nil))
+	if w.Code != http.StatusNotFound {
+		t.Errorf("Expected status 404 downloading a send job, got %d", w.Code)
+	}
+}
+
+func TestSendBookWithoutUserHeader(t *testing.T) {
+	storage := repo.GetStorage(":memory:")
+	defer func() {
+		if err := storage.Close(); err != nil {
+			t.Logf("Error closing storage: %v", err)
+		}
+	}()
+	libDir := t.TempDir()
+	cfg := config.Default()
+	cfg.Libraries = []config.LibraryConfig{{Name: config.DefaultLibraryName, Path: libDir}}
+	cfg.Conversion.JobsDir = t.TempDir()
+	cfg.Mail.Host = "localhost"
+	cfg.Mail.From = "library@example.com"
+	cfg.Mail.Recipients = map[string]config.RecipientConfig{"alice": {Address: "alice@kindle.com"}}
+	svc := service.NewWithConfig(storage, cfg)
+	handler := NewHandler(svc)
+	id := addTestBook(t, storage, libDir)
+
+	// The header is not trusted, so nobody may claim alice's address
+	req := httptest.NewRequest("POST", fmt.Sprintf("/api/books/%d/send", id), nil)
+	req.Header.Set("X-Remote-User", "alice")
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+	if w.Code != http.StatusForbidden {
+		t.Errorf("Expected status 403, got %d: %s", w.Code, w.Body.String())
+	}
+	if _, err := svc.EnqueueSend(context.Background(), id, "alice", ""); !errors.Is(err, service.ErrNoRecipient) {
+		t.Errorf("expected ErrNoRecipient, got %v", err)
+	}
+}
+
+func TestBulkDownload(t *testing.T) {
+	storage := repo.GetStorage(":memory:")
+	defer func() {
+		if err := storage.Close(); err != nil {
+			t.Logf("Error closing storage: %v", err)
+		}
+	}()
+	libDir := t.TempDir()
+	cfg := config.Default()
+	cfg.Libraries = []config.LibraryConfig{{Name: config.DefaultLibraryName, Path: libDir}}
+	svc := service.NewWithConfig(storage, cfg)
+	handler := NewHandler(svc)
+
+	f, err := os.Create(filepath.Join(libDir, "books.zip"))
+	if err != nil {
+		t.Fatalf("create archive: %v", err)
+	}
+	zw := zip.NewWriter(f)
+	for _, name := range []string{"1.fb2", "2.fb2", "4.fb2"} {
+		w, _ := zw.Create(name)
+		io.WriteString(w, testFB2)
+	}
+	zw.Close()
+	f.Close()
+
+	author := book.Author{FirstName: "Test", LastName: "Author"}
+	for _, b := range []*book.Book{
+		{Title: "Second", FileName: "2.fb2", Series: &book.SeriesInfo{Name: "Saga", SeriesNo: 2}},
+		{Title: "First", FileName: "1.fb2", Series: &book.SeriesInfo{Name: "Saga", SeriesNo: 1}},
+		{Title: "Lost", FileName: "3.fb2", Series: &book.SeriesInfo{Name: "Saga", SeriesNo: 3}},
+		{Title: "Standalone", FileName: "4.fb2"},
+	} {
+		b.Author = []book.Author{author}
+		b.Archive = "books.zip"
+		b.Library = config.DefaultLibraryName
+		if err := storage.Add(b); err != nil {
+			t.Fatalf("add book: %v", err)
+		}
+	}
+	books, _, err := storage.GetBooksByLetter("F", "", repo.ListOptions{})
+	if err != nil || len(books) != 1 || books[0].Series == nil {
+		t.Fatalf("expected the first book of the series, got %v (%v)", books, err)
+	}
+	seriesID, authorID := books[0].Series.ID, int64(1)
+
+	download := func(path string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest("GET", path, nil))
+		return w
+	}
+	entries := func(t *testing.T, w *httptest.ResponseRecorder) map[string]*zip.File {
+		t.Helper()
+		zr, err := zip.NewReader(bytes.NewReader(w.Body.Bytes()), int64(w.Body.Len()))
+		if err != nil {
+			t.Fatalf("response is not a ZIP archive: %v", err)
+		}
+		files := make(map[string]*zip.File)
+		for _, f := range zr.File {
+			files[f.Name] = f
+		}
+		return files
+	}
+
+	t.Run("series", func(t *testing.T) {
+		w := download(fmt.Sprintf("/api/series/%d/download?format=epub", seriesID))
+		if w.Code != http.StatusOK {
+			t.Fatalf("Expected status 200, got %d: %s", w.Code, w.Body.String())
+		}
+		if ct := w.Header().Get("Content-Type"); ct != "application/zip" {
+			t.Errorf("Expected application/zip, got %q", ct)
+		}
+		if cd := w.Header().Get("Content-Disposition"); !strings.Contains(cd, "Saga.zip") {
+			t.Errorf("Unexpected Content-Disposition %q", cd)
+		}
+
+		files := entries(t, w)
+		for _, name := range []string{"01 - Author Test - First.epub", "02 - Author Test - Second.epub", "missing.txt"} {
+			if files[name] == nil {
+				t.Errorf("archive lacks %q, has %v", name, slices.Collect(maps.Keys(files)))
+			}
+		}
+		if len(files) != 3 {
+			t.Errorf("expected 3 entries, got %v", slices.Collect(maps.Keys(files)))
+		}
+		if f := files["01 - Author Test - First.epub"]; f != nil && f.Method != zip.Store {
+			t.Error("EPUB files should be stored uncompressed")
+		}
+		if f := files["missing.txt"]; f != nil {
+			r, _ := f.Open()
+			note, _ := io.ReadAll(r)
+			r.Close()
+			if !strings.Contains(string(note), "03 - Author Test - Lost.epub") {
+				t.Errorf("missing.txt does not list the unreadable book: %s", note)
+			}
+		}
+	})
+
+	t.Run("author", func(t *testing.T) {
+		w := download(fmt.Sprintf("/api/authors/%d/download", authorID))
+		if w.Code != http.StatusOK {
+			t.Fatalf("Expected status 200, got %d: %s", w.Code, w.Body.String())
+		}
+		files := entries(t, w)
+		for _, name := range []string{"Saga/01 - Author Test - First.fb2", "Saga/02 - Author Test - Second.fb2", "Author Test - Standalone.fb2"} {
+			if files[name] == nil {
+				t.Errorf("archive lacks %q, has %v", name, slices.Collect(maps.Keys(files)))
+			}
+		}
+	})
+
+	for _, tt := range []struct {
+		name         string
+		path         string
+		expectStatus int
+	}{
+		{"unknown series", "/api/series/999/download", http.StatusNotFound},
+		{"unknown author", "/api/authors/999/download", http.StatusNotFound},
+		{"invalid ID", "/api/series/abc/download", http.StatusBadRequest},
+		{"unsupported format", fmt.Sprintf("/api/series/%d/download?format=pdf", seriesID), http.StatusBadRequest},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			if w := download(tt.path); w.Code != tt.expectStatus {
+				t.Errorf("Expected status %d, got %d: %s", tt.expectStatus, w.Code, w.Body.String())
+			}
+		})
+	}
+
+	t.Run("quota", func(t *testing.T) {
+		quotaCfg := *cfg
+		quotaCfg.RateLimit.Enabled = true
+		quotaCfg.RateLimit.DailyDownloadQuota = 4
+		handler := NewHandler(service.NewWithConfig(storage, &quotaCfg))
+		download := func(path string) int {
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, httptest.NewRequest("GET", path, nil))
+			return w.Code
+		}
+
+		// The series has three books, of which two are written and count
+		series := fmt.Sprintf("/api/series/%d/download", seriesID)
+		if code := download(series); code != http.StatusOK {
+			t.Fatalf("Expected status 200, got %d", code)
+		}
+		if code := download(series); code != http.StatusTooManyRequests {
+			t.Errorf("Expected the second archive to exceed the quota, got %d", code)
+		}
+		for i, expect := range []int{http.StatusOK, http.StatusOK, http.StatusTooManyRequests} {
+			if code := download(fmt.Sprintf("/api/books/%d/download", books[0].BookID)); code != expect {
+				t.Errorf("download %d: expected status %d, got %d", i, expect, code)
+			}
+		}
+	})
+
+	t.Run("size cap", func(t *testing.T) {
+		cfg.BulkDownload.MaxSize = 1
+		defer func() { cfg.BulkDownload.MaxSize = config.Default().BulkDownload.MaxSize }()
+		if err := storage.Add(&book.Book{
+			Title: "Huge", Author: []book.Author{author}, Archive: "books.zip", FileName: "5.fb2",
+			FileSize: 2 << 20, Library: config.DefaultLibraryName,
+		}); err != nil {
+			t.Fatalf("add book: %v", err)
+		}
+		if w := download(fmt.Sprintf("/api/authors/%d/download", authorID)); w.Code != http.StatusRequestEntityTooLarge {
+			t.Errorf("Expected status 413, got %d: %s", w.Code, w.Body.String())
+		}
+	})
+}
+
+func TestOPDSBookEntry(t *testing.T) {
+	storage := repo.GetStorage(":memory:")
+	defer func() {
+		if err := storage.Close(); err != nil {
+			t.Logf("Error closing storage: %v", err)
+		}
+	}()
+	libDir := t.TempDir()
+	cfg := config.Default()
+	cfg.Libraries = []config.LibraryConfig{{Name: config.DefaultLibraryName, Path: libDir}}
+	handler := NewHandler(service.NewWithConfig(storage, cfg))
+
+	annotated := strings.Replace(testFB2, "<lang>en</lang>",
+		"<lang>en</lang><annotation><p>A stalker goes into   the Zone.</p><p>Twice.</p></annotation>", 1)
+	f, err := os.Create(filepath.Join(libDir, "books.zip"))
+	if err != nil {
+		t.Fatalf("create archive: %v", err)
+	}
+	zw := zip.NewWriter(f)
+	w, _ := zw.Create("1.fb2")
+	io.WriteString(w, annotated)
+	zw.Close()
+	f.Close()
+
+	for _, b := range []*book.Book{
+		{Title: "Annotated", FileName: "1.fb2", FileSize: 1536, DateAdded: "2024-03-01",
+			Genres: []string{"sf"}, Keywords: []string{"zone"}, Series: &book.SeriesInfo{Name: "Noon", SeriesNo: 2}},
+		{Title: "Prequel", FileName: "0.fb2", Series: &book.SeriesInfo{Name: "Noon", SeriesNo: 1}},
+	} {
+		b.Author = []book.Author{{FirstName: "Test", LastName: "Author"}}
+		b.Archive = "books.zip"
+		b.Library = config.DefaultLibraryName
+		if err := storage.Add(b); err != nil {
+			t.Fatalf("add book: %v", err)
+		}
+	}
+	books, _, err := storage.GetBooksByLetter("A", "", repo.ListOptions{})
+	if err != nil || len(books) != 1 || books[0].Series == nil || len(books[0].Author) != 1 {
+		t.Fatalf("expected the annotated book, got %v (%v)", books, err)
+	}
+	b := books[0]
+
+	get := func(path string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest("GET", path, nil))
+		return w
+	}
+
+	rec := get(fmt.Sprintf("/opds/books/%d", b.BookID))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d: %s", rec.Code, rec.Body.String())
+	}
+	if ct := rec.Header().Get("Content-Type"); !strings.HasPrefix(ct, opds.TypeEntry) {
+		t.Errorf("Expected an entry document, got %s", ct)
+	}
+	entry := rec.Body.String()
+	for _, want := range []string{
+		"<entry xmlns=",
+		"<summary>A stalker goes into the Zone.&#xA;Twice.</summary>",
+		"Series: Noon #2",
+		"Keywords: zone",
+		"<dc:extent>1 KB</dc:extent>",
+		"Added: 2024-03-01",
+		"<updated>2024-03-01T00:00:00Z</updated>",
+		fmt.Sprintf(`rel="related" href="http://example.com/opds/authors/%d/books"`, b.Author[0].ID),
+		fmt.Sprintf(`rel="related" href="http://example.com/opds/series/%d"`, b.Series.ID),
+		`rel="related" href="http://example.com/opds/genres/sf"`,
+		fmt.Sprintf(`href="http://example.com/api/books/%d/download?format=fb2.zip"`, b.BookID),
+	} {
+		if !strings.Contains(entry, want) {
+			t.Errorf("Expected the entry to contain %q, got\n%s", want, entry)
+		}
+	}
+
+	// Feeds link partial entries to the complete ones
+	rec = get(fmt.Sprintf("/opds/series/%d", b.Series.ID))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("Expected status 200 for the series feed, got %d: %s", rec.Code, rec.Body.String())
+	}
+	feed := rec.Body.String()
+	if prequel, annotated := strings.Index(feed, "Prequel"), strings.Index(feed, "Annotated"); prequel < 0 || annotated < prequel {
+		t.Errorf("Expected the series books in series order, got\n%s", feed)
+	}
+	if want := fmt.Sprintf(`rel="alternate" href="http://example.com/opds/books/%d"`, b.BookID); !strings.Contains(feed, want) {
+		t.Errorf("Expected the feed to link %s", want)
+	}
+
+	for path, status := range map[string]int{
+		"/opds/books/999":  http.StatusNotFound,
+		"/opds/books/x":    http.StatusBadRequest,
+		"/opds/series/999": http.StatusNotFound,
+		fmt.Sprintf("/opds/library/other/books/%d", b.BookID): http.StatusNotFound,
+	} {
+		if rec := get(path); rec.Code != status {
+			t.Errorf("%s: expected status %d, got %d", path, status, rec.Code)
+		}
+	}
+}
+
+func TestOPDSAuthorPages(t *testing.T) {
+	storage := repo.GetStorage(":memory:")
+	defer func() {
+		if err := storage.Close(); err != nil {
+			t.Logf("Error closing storage: %v", err)
+		}
+	}()
+	handler := NewHandler(service.NewWithConfig(storage, config.Default()))
+
+	for i, b := range []*book.Book{
+		{Title: "Beetle in the Anthill", DateAdded: "2024-01-01", Series: &book.SeriesInfo{Name: "Noon", SeriesNo: 2}},
+		{Title: "Antkind", DateAdded: "2024-02-01", Series: &book.SeriesInfo{Name: "Noon", SeriesNo: 1}},
+		{Title: "Definitely Maybe", DateAdded: "2024-03-01"},
+	} {
+		b.Author = []book.Author{{FirstName: "Test", LastName: "Author"}}
+		b.Archive = "books.zip"
+		b.FileName = fmt.Sprintf("%d.fb2", i)
+		b.Library = config.DefaultLibraryName
+		if err := storage.Add(b); err != nil {
+			t.Fatalf("add book: %v", err)
+		}
+	}
+	books, _, err := storage.GetBooksByLetter("D", "", repo.ListOptions{})
+	if err != nil || len(books) != 1 || len(books[0].Author) != 1 {
+		t.Fatalf("expected the standalone book, got %v (%v)", books, err)
+	}
+	author := fmt.Sprintf("/opds/authors/%d", books[0].Author[0].ID)
+	series, _, err := storage.GetBooksByLetter("A", "", repo.ListOptions{})
+	if err != nil || len(series) != 1 || series[0].Series == nil {
+		t.Fatalf("expected a book in the series, got %v (%v)", series, err)
+	}
+
+	get := func(path string) string {
+		t.Helper()
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest("GET", path, nil))
+		if w.Code != http.StatusOK {
+			t.Fatalf("%s: expected status 200, got %d: %s", path, w.Code, w.Body.String())
+		}
+		return w.Body.String()
+	}
+	// titles returns the entry titles of a feed in order
+	titles := func(feed string) []string {
+		var doc struct {
+			Entries []struct {
+				Title string `xml:"title"`
+			} `xml:"entry"`
+		}
+		if err := xml.Unmarshal([]byte(feed), &doc); err != nil {
+			t.Fatalf("parse feed: %v", err)
+		}
+		var titles []string
+		for _, e := range doc.Entries {
+			titles = append(titles, e.Title)
+		}
+		return titles
+	}
+
+	nav := get(author)
+	if got := titles(nav); !slices.Equal(got, []string{"All books", "By series", "Without series", "Recently added"}) {
+		t.Errorf("unexpected author navigation %v", got)
+	}
+	if !strings.Contains(nav, `href="http://example.com`+author+`/series" type="`+opds.TypeNavigation+`"`) {
+		t.Errorf("expected a navigation link to the author's series, got\n%s", nav)
+	}
+
+	tests := []struct {
+		path   string
+		expect []string
+	}{
+		{"/books", []string{"Antkind", "Beetle in the Anthill", "Definitely Maybe"}},
+		{"/books?pageSize=2&page=2", []string{"Definitely Maybe"}},
+		{"/noseries", []string{"Definitely Maybe"}},
+		{"/new", []string{"Definitely Maybe", "Antkind", "Beetle in the Anthill"}},
+		{"/series", []string{"Noon"}},
+		{fmt.Sprintf("/series/%d", series[0].Series.ID), []string{"Antkind", "Beetle in the Anthill"}},
+	}
+	for _, tt := range tests {
+		if got := titles(get(author + tt.path)); !slices.Equal(got, tt.expect) {
+			t.Errorf("%s: expected %v, got %v", tt.path, tt.expect, got)
+		}
+	}
+
+	first := get(author + "/books?pageSize=2")
+	if !strings.Contains(first, `rel="next" href="http://example.com`+author+`/books?page=2&amp;pageSize=2"`) {
+		t.Errorf("expected a next page link, got\n%s", first)
+	}
+}
+
+func TestOPDSLanguageFilter(t *testing.T) {
+	storage := repo.GetStorage(":memory:")
+	defer func() {
+		if err := storage.Close(); err != nil {
+			t.Logf("Error closing storage: %v", err)
+		}
+	}()
+	cfg := config.Default()
+	cfg.Catalog.UserBookLanguages = map[string][]string{"alice": {"uk"}}
+	cfg.RateLimit.UserHeader = "X-Remote-User"
+	handler := NewHandler(service.NewWithConfig(storage, cfg))
+
+	for i, b := range []*book.Book{
+		{Title: "Piknik", Lang: "ru", DateAdded: "2024-01-01"},
+		{Title: "Roadside Picnic", Lang: "en", DateAdded: "2024-02-01"},
+		{Title: "Zhuk", DateAdded: "2024-03-01"},
+		{Title: "Pikník", Lang: "uk", DateAdded: "2024-04-01"},
+	} {
+		b.Author = []book.Author{{FirstName: "Arkady", LastName: "Strugatsky"}}
+		b.Genres = []string{"sf"}
+		b.Archive = "books.zip"
+		b.FileName = fmt.Sprintf("%d.fb2", i)
+		b.Library = config.DefaultLibraryName
+		if err := storage.Add(b); err != nil {
+			t.Fatalf("add book: %v", err)
+		}
+	}
+	if err := storage.RebuildFTSIndex(); err != nil {
+		t.Fatalf("rebuild FTS index: %v", err)
+	}
+	books, _, err := storage.GetBooksByLetter("R", "", repo.ListOptions{})
+	if err != nil || len(books) != 1 || len(books[0].Author) != 1 {
+		t.Fatalf("expected the english book, got %v (%v)", books, err)
+	}
+	author := fmt.Sprintf("/authors/%d/books", books[0].Author[0].ID)
+
+	get := func(path, user string) string {
+		t.Helper()
+		req := httptest.NewRequest("GET", path, nil)
+		if user != "" {
+			req.Header.Set("X-Remote-User", user)
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		if w.Code != http.StatusOK {
+			t.Fatalf("%s: expected status 200, got %d: %s", path, w.Code, w.Body.String())
+		}
+		return w.Body.String()
+	}
+	// titles returns the entry titles of a feed, sorted
+	titles := func(feed string) []string {
+		var doc struct {
+			Entries []struct {
+				Title string `xml:"title"`
+			} `xml:"entry"`
+		}
+		if err := xml.Unmarshal([]byte(feed), &doc); err != nil {
+			t.Fatalf("parse feed: %v", err)
+		}
+		var titles []string
+		for _, e := range doc.Entries {
+			titles = append(titles, e.Title)
+		}
+		slices.Sort(titles)
+		return titles
+	}
+
+	all := []string{"Piknik", "Pikník", "Roadside Picnic", "Zhuk"}
+	tests := []struct {
+		name   string
+		path   string
+		user   string
+		expect []string
+	}{
+		{"new books", "/opds/new", "", all},
+		{"new books in russian", "/opds/lang/ru/new", "", []string{"Piknik", "Zhuk"}},
+		{"new books in several languages", "/opds/lang/en,uk/new", "", []string{"Pikník", "Roadside Picnic"}},
+		{"library catalog", "/opds/library/default/lang/en/new", "", []string{"Roadside Picnic"}},
+		{"genre", "/opds/lang/en/genres/sf", "", []string{"Roadside Picnic"}},
+		{"author", "/opds/lang/ru" + author, "", []string{"Piknik", "Zhuk"}},
+		{"search", "/opds/lang/en/search?q=Strugatsky", "", []string{"Roadside Picnic"}},
+		{"user preference", "/opds/new", "alice", []string{"Pikník"}},
+		{"url overrides user preference", "/opds/lang/all/new", "alice", all},
+		{"other user", "/opds/new", "bob", all},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := titles(get(tt.path, tt.user)); !slices.Equal(got, tt.expect) {
+				t.Errorf("expected %v, got %v", tt.expect, got)
+			}
+		})
+	}
+
+	feed := get("/opds/lang/ru/new?page=1", "")
+	for _, want := range []string{
+		`rel="http://opds-spec.org/facet" href="http://example.com/opds/lang/all/new" type="` + opds.TypeAcquisition + `" title="All languages" opds:facetGroup="Language"></link>`,
+		`href="http://example.com/opds/lang/ru/new" type="` + opds.TypeAcquisition + `" title="Russian" opds:facetGroup="Language" opds:activeFacet="true"`,
+		`href="http://example.com/opds/lang/uk/new" type="` + opds.TypeAcquisition + `" title="Ukrainian" opds:facetGroup="Language"></link>`,
+		`<link rel="up" href="http://example.com/opds/lang/ru"`,
+	} {
+		if !strings.Contains(feed, want) {
+			t.Errorf("expected %s in\n%s", want, feed)
+		}
+	}
+
+	root := get("/opds/lang/uk", "")
+	if !strings.Contains(root, `href="http://example.com/opds/lang/uk/new"`) {
+		t.Errorf("expected the root to link to feeds in the language, got\n%s", root)
+	}
+}
+
+func TestPrefixNavigation(t *testing.T) {
+	storage := repo.GetStorage(":memory:")
+	defer func() {
+		if err := storage.Close(); err != nil {
+			t.Logf("Error closing storage: %v", err)
+		}
+	}()
+	handler := NewHandler(service.NewWithConfig(storage, config.Default()))
+
+	// 120 authors starting with "Ст" drill down to three letters
+	var books []*book.Book
+	for i := range 120 {
+		last := fmt.Sprintf("Ста%03d", i)
+		if i%2 == 1 {
+			last = fmt.Sprintf("Сте%03d", i)
+		}
+		books = append(books, &book.Book{Title: fmt.Sprintf("Book %d", i), Author: []book.Author{{LastName: last}}})
+	}
+	books = append(books, &book.Book{Title: "Solaris", Author: []book.Author{{LastName: "Lem"}}, Series: &book.SeriesInfo{Name: "Space"}})
+	for _, b := range books {
+		b.Archive = "books.zip"
+		b.FileName = b.Title + ".fb2"
+		b.Library = config.DefaultLibraryName
+		if err := storage.Add(b); err != nil {
+			t.Fatalf("add book: %v", err)
+		}
+	}
+
+	get := func(path string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest("GET", path, nil))
+		return w
+	}
+	type entry struct {
+		Title   string `xml:"title"`
+		Content string `xml:"content"`
+		Link    struct {
+			Href string `xml:"href,attr"`
+		} `xml:"link"`
+	}
+	entries := func(path string) []entry {
+		t.Helper()
+		w := get(path)
+		if w.Code != http.StatusOK {
+			t.Fatalf("%s: expected status 200, got %d: %s", path, w.Code, w.Body.String())
+		}
+		var feed struct {
+			Entries []entry `xml:"entry"`
+		}
+		if err := xml.Unmarshal(w.Body.Bytes(), &feed); err != nil {
+			t.Fatalf("%s: parse feed: %v", path, err)
+		}
+		return feed.Entries
+	}
+
+	tests := []struct {
+		path   string
+		expect []entry
+	}{
+		{"/opds/authors", []entry{
+			{Title: "L", Content: "1 author"},
+			{Title: "С", Content: "120 authors"},
+		}},
+		{"/opds/authors?prefix=" + url.QueryEscape("С"), []entry{
+			{Title: "Ст", Content: "120 authors"},
+		}},
+		{"/opds/authors?prefix=" + url.QueryEscape("Ст"), []entry{
+			{Title: "Ста", Content: "60 authors"},
+			{Title: "Сте", Content: "60 authors"},
+		}},
+		{"/opds/series", []entry{
+			{Title: "S", Content: "1 series"},
+		}},
+	}
+	for _, tt := range tests {
+		got := entries(tt.path)
+		for i := range got {
+			got[i].Link.Href = ""
+		}
+		if !slices.Equal(got, tt.expect) {
+			t.Errorf("%s: expected %v, got %v", tt.path, tt.expect, got)
+		}
+	}
+
+	// Narrow prefixes are listed, a page at a time
+	w := get("/opds/authors?prefix=" + url.QueryEscape("Ста"))
+	if got := entries("/opds/authors?prefix=" + url.QueryEscape("Ста")); len(got) != defaultPageSize || got[0].Title != "Ста000" {
+		t.Errorf("expected the first page of authors, got %v", got)
+	}
+	if want := `rel="next" href="http://example.com/opds/authors?prefix=` + url.QueryEscape("Ста") + `&amp;page=2&amp;pageSize=50"`; !strings.Contains(w.Body.String(), want) {
+		t.Errorf("expected a next page link %s", want)
+	}
+	if got := entries("/opds/authors?letter=L"); len(got) != 1 || got[0].Title != "Lem" {
+		t.Errorf("expected the author listed by letter, got %v", got)
+	}
+	if got := entries("/opds/titles?prefix=S"); len(got) != 1 || got[0].Title != "Solaris" {
+		t.Errorf("expected the book listed by title, got %v", got)
+	}
+	if got := entries("/opds/series?prefix=S"); len(got) != 1 || got[0].Title != "Space" || !strings.HasSuffix(got[0].Link.Href, "/opds/series/1") {
+		t.Errorf("expected the series listed, got %v", got)
+	}
+
+	// REST
+	w = get("/api/prefixes?index=authors&prefix=" + url.QueryEscape("Ст"))
+	var prefixes listResponse[book.Prefix]
+	if err := json.Unmarshal(w.Body.Bytes(), &prefixes); err != nil {
+		t.Fatalf("parse prefixes: %v (%s)", err, w.Body.String())
+	}
+	expect := []book.Prefix{{Prefix: "Ста", Count: 60, Leaf: true}, {Prefix: "Сте", Count: 60, Leaf: true}}
+	if !slices.Equal(prefixes.Items, expect) || prefixes.Total != 2 || prefixes.Next != nil {
+		t.Errorf("expected prefixes %v on a single page, got %+v", expect, prefixes)
+	}
+	w = get("/api/prefixes?index=authors&limit=1&prefix=" + url.QueryEscape("Ст"))
+	prefixes = listResponse[book.Prefix]{}
+	if err := json.Unmarshal(w.Body.Bytes(), &prefixes); err != nil {
+		t.Fatalf("parse prefixes: %v (%s)", err, w.Body.String())
+	}
+	if !slices.Equal(prefixes.Items, expect[:1]) || prefixes.Total != 2 || prefixes.Next == nil {
+		t.Errorf("expected the first prefix and a next page, got %+v", prefixes)
+	}
+	for _, path := range []string{"/api/prefixes?index=genres", "/api/prefixes?index=titles&prefix=abc", "/api/series"} {
+		if w := get(path); w.Code != http.StatusBadRequest {
+			t.Errorf("%s: expected status 400, got %d", path, w.Code)
+		}
+	}
+	w = get("/api/series?startsWith=s")
+	if !strings.Contains(w.Body.String(), `"name":"Space","book_count":1`) {
+		t.Errorf("expected the series by letter, got %s", w.Body.String())
+	}
+}
+
+func TestListPaging(t *testing.T) {
+	storage := repo.GetStorage(":memory:")
+	defer func() {
+		if err := storage.Close(); err != nil {
+			t.Logf("Error closing storage: %v", err)
+		}
+	}()
+	handler := NewHandler(service.NewWithConfig(storage, config.Default()))
+
+	books := []*book.Book{
+		{Title: "Antkind", Author: []book.Author{{FirstName: "Charlie", LastName: "Kaufman"}}},
+		{Title: "Anathem", Author: []book.Author{{FirstName: "Neal", LastName: "Stephenson"}}},
+		{Title: "Aelita", Author: []book.Author{{FirstName: "Alexei", LastName: "Tolstoy"}}},
+		{Title: "Annihilation", Author: []book.Author{{FirstName: "Jeff", LastName: "VanderMeer"}}},
+		{Title: "Another World", Author: []book.Author{{FirstName: "Arkady", LastName: "Strugatsky"}, {FirstName: "Boris", LastName: "Strugatsky"}}},
+	}
+	for _, b := range books {
+		b.Archive = "books.zip"
+		b.FileName = b.Title + ".fb2"
+		b.Library = config.DefaultLibraryName
+		if err := storage.Add(b); err != nil {
+			t.Fatalf("add book: %v", err)
+		}
+	}
+
+	get := func(path string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest("GET", path, nil))
+		return w
+	}
+	page := func(path string) listResponse[book.Book] {
+		t.Helper()
+		w := get(path)
+		var resp listResponse[book.Book]
+		if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+			t.Fatalf("%s: parse page: %v (%s)", path, err, w.Body.String())
+		}
+		return resp
+	}
+	titles := func(books []book.Book) []string {
+		var titles []string
+		for _, b := range books {
+			titles = append(titles, b.Title)
+		}
+		return titles
+	}
+
+	// Following next walks the whole list, a book with two authors once
+	var got []string
+	path := "/api/books?startsWith=a&sort=title&limit=2"
+	for pages := 0; path != ""; pages++ {
+		if pages == 3 {
+			t.Fatalf("expected three pages, still at %s", path)
+		}
+		resp := page(path)
+		if resp.Total != len(books) {
+			t.Errorf("%s: expected total %d, got %d", path, len(books), resp.Total)
+		}
+		got = append(got, titles(resp.Items)...)
+		path = ""
+		if resp.Next != nil {
+			path = *resp.Next
+		}
+	}
+	expect := []string{"Aelita", "Anathem", "Annihilation", "Another World", "Antkind"}
+	if !slices.Equal(got, expect) {
+		t.Errorf("expected %v, got %v", expect, got)
+	}
+	if next := page("/api/books?startsWith=a&sort=title&limit=2").Next; next == nil || *next != "/api/books?limit=2&offset=2&sort=title&startsWith=a" {
+		t.Errorf("expected a link to the second page, got %v", next)
+	}
+
+	tests := []struct {
+		path   string
+		expect []string
+	}{
+		{"/api/books?startsWith=a&sort=-title&limit=2", []string{"Antkind", "Another World"}},
+		{"/api/books?startsWith=a&limit=2", []string{"Antkind", "Anathem"}},
+		{"/api/books?startsWith=a&offset=4", []string{"Annihilation"}},
+		{"/api/books?startsWith=a&offset=10", nil},
+	}
+	for _, tt := range tests {
+		if got := titles(page(tt.path).Items); !slices.Equal(got, tt.expect) {
+			t.Errorf("%s: expected %v, got %v", tt.path, tt.expect, got)
+		}
+	}
+
+	w := get("/api/authors?startsWith=s&sort=-name&limit=1")
+	var authors listResponse[book.AuthorWithBookCount]
+	if err := json.Unmarshal(w.Body.Bytes(), &authors); err != nil {
+		t.Fatalf("parse authors: %v (%s)", err, w.Body.String())
+	}
+	if authors.Total != 3 || len(authors.Items) != 1 || authors.Items[0].LastName != "Strugatsky" || authors.Items[0].FirstName != "Boris" || authors.Next == nil {
+		t.Errorf("expected the last of three authors first, got %+v", authors)
+	}
+	if resp := page(fmt.Sprintf("/api/authors/%d/books", authors.Items[0].ID)); resp.Total != 1 || resp.Next != nil || len(resp.Items) != 1 || len(resp.Items[0].Author) != 2 {
+		t.Errorf("expected the author's book with both authors, got %+v", resp)
+	}
+
+	for _, path := range []string{
+		"/api/books?startsWith=a&sort=size",
+		"/api/books?startsWith=a&limit=0",
+		"/api/books?startsWith=a&limit=501",
+		"/api/authors?startsWith=a&offset=-1",
+		"/api/series?startsWith=a&sort=title",
+		"/api/search?q=a&sort=name",
+	} {
+		if w := get(path); w.Code != http.StatusBadRequest {
+			t.Errorf("%s: expected status 400, got %d (%s)", path, w.Code, w.Body.String())
+		}
+	}
+}
+
+func TestLocalizedOutput(t *testing.T) {
+	storage := repo.GetStorage(":memory:")
+	defer func() {
+		if err := storage.Close(); err != nil {
+			t.Logf("Error closing storage: %v", err)
+		}
+	}()
+	cfg := config.Default()
+	handler := NewHandler(service.NewWithConfig(storage, cfg))
+
+	b := &book.Book{Title: "Solaris", FileName: "1.fb2", Archive: "books.zip", Library: config.DefaultLibraryName,
+		Genres: []string{"sf"}, Author: []book.Author{{FirstName: "Stanislaw", LastName: "Lem"}}}
+	if err := storage.Add(b); err != nil {
+		t.Fatalf("add book: %v", err)
+	}
+	storage.SyncGenreDisplayNames()
+
+	get := func(path, accept string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", path, nil)
+		if accept != "" {
+			req.Header.Set("Accept-Language", accept)
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		return w
+	}
+
+	tests := []struct {
+		name     string
+		path     string
+		accept   string
+		lang     string
+		contains []string
+	}{
+		{"english root", "/opds", "", "en", []string{"<title>bopds Library</title>", ">Browse by author<"}},
+		{"russian root by header", "/opds", "ru-RU,ru;q=0.9", "ru", []string{"<title>Библиотека bopds</title>", "<title>Авторы</title>"}},
+		{"russian root by parameter", "/opds?lang=ru", "en", "ru", []string{"<title>Новые книги</title>"}},
+		{"russian plurals", "/opds/authors?lang=ru", "", "ru", []string{"1 автор"}},
+		{"english genres", "/opds/genres?category=sf", "", "en", []string{"<title>Genres: Science Fiction and Fantasy</title>", "<title>Science Fiction</title>"}},
+		{"russian genres", "/opds/genres?category=sf&lang=ru", "", "ru", []string{"<title>Жанры: Фантастика</title>", "<title>Научная фантастика</title>"}},
+		{"russian genre feed", "/opds/genres/sf?lang=ru", "", "ru", []string{"<title>Научная фантастика</title>", "Все книги автора Stanislaw Lem"}},
+		{"english rest genres", "/api/genres", "", "en", []string{`"display_name":"Science Fiction"`, `"translit_name":"Nauchnaya fantastika"`}},
+		{"russian rest genres", "/api/genres", "ru", "ru", []string{`"display_name":"Научная фантастика"`}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := get(tt.path, tt.accept)
+			if w.Code != http.StatusOK {
+				t.Fatalf("expected status 200, got %d: %s", w.Code, w.Body.String())
+			}
+			if got := w.Header().Get("Content-Language"); got != tt.lang {
+				t.Errorf("expected Content-Language %q, got %q", tt.lang, got)
+			}
+			for _, want := range tt.contains {
+				if !strings.Contains(w.Body.String(), want) {
+					t.Errorf("expected %q in\n%s", want, w.Body.String())
+				}
+			}
+		})
+	}
+
+	// A configured title and language replace the defaults
+	cfg.Catalog = config.CatalogConfig{Title: "Home Books", Language: "ru"}
+	w := get("/opds", "")
+	if body := w.Body.String(); !strings.Contains(body, "<title>Home Books</title>") || !strings.Contains(body, "<title>Авторы</title>") {
+		t.Errorf("expected the configured title in Russian, got\n%s", body)
+	}
+}
+
+func TestGenreNavigation(t *testing.T) {
+	storage := repo.GetStorage(":memory:")
+	defer func() {
+		if err := storage.Close(); err != nil {
+			t.Logf("Error closing storage: %v", err)
+		}
+	}()
+	handler := NewHandler(service.New(storage))
+
+	for i, genres := range [][]string{{"sf_space"}, {"sf_space", "sf_fantasy"}, {"det_police"}, {"made_up"}} {
+		b := &book.Book{Title: fmt.Sprintf("Book %d", i), FileName: fmt.Sprintf("%d.fb2", i), Archive: "books.zip",
+			Library: config.DefaultLibraryName, Genres: genres, Author: []book.Author{{LastName: "Author"}}}
+		if err := storage.Add(b); err != nil {
+			t.Fatalf("add book: %v", err)
+		}
+	}
+
+	get := func(path string) string {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest("GET", path, nil))
+		if w.Code != http.StatusOK {
+			t.Fatalf("%s: expected status 200, got %d: %s", path, w.Code, w.Body.String())
+		}
+		return w.Body.String()
+	}
+	type entry struct {
+		Title   string `xml:"title"`
+		Content string `xml:"content"`
+		Link    struct {
+			Href string `xml:"href,attr"`
+		} `xml:"link"`
+	}
+	entries := func(path string) []entry {
+		var feed struct {
+			Entries []entry `xml:"entry"`
+		}
+		if err := xml.Unmarshal([]byte(get(path)), &feed); err != nil {
+			t.Fatalf("%s: parse feed: %v", path, err)
+		}
+		return feed.Entries
+	}
+
+	// Categories in listing order, counting each book once
+	got := entries("/opds/genres")
+	want := []entry{{Title: "Science Fiction and Fantasy", Content: "2 books"}, {Title: "Mysteries and Thrillers", Content: "1 book"}, {Title: "Other", Content: "1 book"}}
+	if len(got) != len(want) {
+		t.Fatalf("expected categories %v, got %v", want, got)
+	}
+	for i := range want {
+		if got[i].Title != want[i].Title || got[i].Content != want[i].Content {
+			t.Errorf("category %d: expected %v, got %v", i, want[i], got[i])
+		}
+	}
+	if href := got[0].Link.Href; href != "http://example.com/opds/genres?category=sf" {
+		t.Errorf("expected a link to the category's genres, got %s", href)
+	}
+
+	got = entries("/opds/genres?category=sf")
+	if len(got) != 2 || got[0].Title != "Fantasy" || got[1].Title != "Space Fiction" || got[1].Content != "2 books" {
+		t.Errorf("expected the science fiction genres, got %v", got)
+	}
+	if feed := get("/opds/genres/sf_space"); !strings.Contains(feed, `rel="up" href="http://example.com/opds/genres?category=sf"`) {
+		t.Errorf("expected the genre feed to lead up to its category, got\n%s", feed)
+	}
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("GET", "/opds/genres?category=cooking", nil))
+	if w.Code != http.StatusNotFound {
+		t.Errorf("expected status 404 for an unknown category, got %d", w.Code)
+	}
+
+	// REST
+	var categories listResponse[book.GenreCategory]
+	if err := json.Unmarshal([]byte(get("/api/genres/categories")), &categories); err != nil {
+		t.Fatalf("parse categories: %v", err)
+	}
+	if c := categories.Items; len(c) != 3 || categories.Total != 3 || c[0].Name != "sf" || c[0].GenreCount != 2 || c[0].BookCount != 2 {
+		t.Errorf("expected the categories with counts, got %+v", categories)
+	}
+	var genres listResponse[book.Genre]
+	if err := json.Unmarshal([]byte(get("/api/genres?category=detective")), &genres); err != nil {
+		t.Fatalf("parse genres: %v", err)
+	}
+	if g := genres.Items; len(g) != 1 || g[0].Name != "det_police" || g[0].Category != "detective" || g[0].BookCount != 1 {
+		t.Errorf("expected the detective genres, got %+v", genres)
+	}
+}
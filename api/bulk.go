@@ -0,0 +1,131 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/htol/bopds/book"
+	"github.com/htol/bopds/logger"
+	"github.com/htol/bopds/metrics"
+	"github.com/htol/bopds/middleware"
+	"github.com/htol/bopds/repo"
+	"github.com/htol/bopds/service"
+)
+
+// bulkDownloadHandler streams every book of an author or a series as one ZIP
+// archive: GET /api/authors/{id}/download?format=epub and
+// GET /api/series/{id}/download?format=epub
+func bulkDownloadHandler(svc *service.Service, limiter *middleware.RateLimiter, kind string, bundleOf func(context.Context, int64) (*service.Bundle, error)) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := r.Context()
+
+		id, err := strconv.ParseInt(r.PathValue("id"), 10, 64)
+		if err != nil || id <= 0 {
+			respondWithValidationError(w, "invalid "+kind+" ID")
+			return
+		}
+
+		format := r.URL.Query().Get("format")
+		if format == "" {
+			format = "fb2"
+		}
+		if !slices.Contains(downloadFormats(), format) {
+			respondWithValidationError(w, "format must be one of: "+strings.Join(downloadFormats(), ", "))
+			return
+		}
+		profile, err := requestProfile(svc, r)
+		if err != nil {
+			respondWithValidationError(w, err.Error())
+			return
+		}
+
+		bundle, err := bundleOf(ctx, id)
+		if err != nil {
+			switch {
+			case errors.Is(err, repo.ErrNotFound):
+				respondWithError(w, kind+" not found", err, http.StatusNotFound)
+			case errors.Is(err, service.ErrBundleTooLarge):
+				respondWithError(w, err.Error(), err, http.StatusRequestEntityTooLarge)
+			default:
+				respondWithError(w, "failed to prepare download", err, http.StatusInternalServerError)
+			}
+			return
+		}
+		if len(bundle.Books) == 0 {
+			respondWithError(w, kind+" has no books", repo.ErrNotFound, http.StatusNotFound)
+			return
+		}
+
+		// Every book counts against the daily quota; those left out of the
+		// archive are given back once it is written
+		refund, ok := limiter.ReserveDownloads(w, r, len(bundle.Books))
+		if !ok {
+			return
+		}
+
+		// The books are converted one at a time, under a single slot
+		if slices.ContainsFunc(bundle.Books, func(b book.Book) bool { return needsConversion(&b, format) }) {
+			release, ok := limiter.AcquireConversion(w, r)
+			if !ok {
+				refund(len(bundle.Books))
+				return
+			}
+			defer release()
+		}
+
+		w.Header().Set("Content-Type", "application/zip")
+		w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename*=UTF-8''%s", url.PathEscape(bundle.Filename())))
+
+		// Each book gets the time budget of a single download; the archive
+		// as a whole may take much longer than the server's WriteTimeout
+		var out io.Writer = w
+		if cfg := svc.Config(); cfg.Server.WriteTimeout > 0 {
+			dw := &deadlineWriter{
+				w:      w,
+				rc:     http.NewResponseController(w),
+				budget: time.Duration(cfg.Conversion.Timeout+cfg.Server.WriteTimeout) * time.Second,
+			}
+			dw.extend()
+			out = dw
+		}
+
+		written, err := svc.WriteBundle(ctx, out, bundle, format, profile)
+		refund(len(bundle.Books) - written)
+		metrics.Downloads.WithLabelValues(format).Add(float64(written))
+		if err != nil {
+			if ctx.Err() != nil {
+				logger.Info("bulk download cancelled by client", kind+"_id", id, "format", format, "books_written", written)
+			} else {
+				// The status line is gone; the client sees a truncated archive
+				logger.Error("failed to stream bulk download", "error", err, kind+"_id", id, "format", format)
+			}
+		}
+	})
+}
+
+// deadlineWriter pushes the connection's write deadline forward on every
+// write, bounding the time between writes instead of the whole response
+type deadlineWriter struct {
+	w      io.Writer
+	rc     *http.ResponseController
+	budget time.Duration
+}
+
+func (d *deadlineWriter) extend() {
+	if err := d.rc.SetWriteDeadline(time.Now().Add(d.budget)); err != nil {
+		logger.Debug("cannot extend write deadline", "error", err)
+	}
+}
+
+func (d *deadlineWriter) Write(p []byte) (int, error) {
+	d.extend()
+	return d.w.Write(p)
+}
@@ -3,6 +3,7 @@ package api
 import (
 	"net/http"
 
+	"github.com/htol/bopds/metrics"
 	"github.com/htol/bopds/middleware"
 	"github.com/htol/bopds/service"
 )
@@ -11,33 +12,77 @@ import (
 func NewHandler(svc *service.Service) http.Handler {
 	mux := http.NewServeMux()
 
-	// OPDS Catalog routes
-	mux.Handle("GET /opds", opdsRootHandler(svc))
-	mux.Handle("GET /opds/", opdsRootHandler(svc))
-	mux.Handle("GET /opds/opensearch.xml", opdsOpenSearchHandler(svc))
-	mux.Handle("GET /opds/search", opdsSearchHandler(svc))
-	mux.Handle("GET /opds/new", opdsNewBooksHandler(svc))
-	mux.Handle("GET /opds/authors", opdsAuthorsHandler(svc))
-	mux.Handle("GET /opds/authors/{id}", opdsAuthorBooksHandler(svc))
-	mux.Handle("GET /opds/genres", opdsGenresHandler(svc))
-	mux.Handle("GET /opds/genres/{name}", opdsGenreBooksHandler(svc))
+	// Rate limits apply per route group; downloads additionally count against
+	// the daily quota, bulk downloads once per book, and synchronous
+	// conversions share a global concurrency cap, taken by the download
+	// handlers once they know a book is converted.
+	// Queued conversions are bounded by the conversion worker pool.
+	limiter := middleware.NewRateLimiter(svc.Config().RateLimit)
+	opdsLimit := limiter.Limit(middleware.GroupOPDS)
+	apiLimit := limiter.Limit(middleware.GroupAPI)
+	downloadLimit := middleware.Chain(
+		limiter.Limit(middleware.GroupDownload),
+		limiter.Quota,
+	)
+
+	// OPDS Catalog routes. Every catalog is also served per library under
+	// /opds/library/{library}, scoping all feeds to that library's books, and
+	// per book language under /lang/{lang} below either, e.g. /opds/lang/ru.
+	mux.Handle("GET /opds", opdsLimit(opdsRootHandler(svc)))
+	mux.Handle("GET /opds/", opdsLimit(opdsRootHandler(svc)))
+	for _, prefix := range []string{"/opds/library/{library}", "/opds/lang/{lang}", "/opds/library/{library}/lang/{lang}"} {
+		mux.Handle("GET "+prefix, opdsLimit(opdsRootHandler(svc)))
+		mux.Handle("GET "+prefix+"/{$}", opdsLimit(opdsRootHandler(svc)))
+	}
+	for _, prefix := range []string{"/opds", "/opds/library/{library}", "/opds/lang/{lang}", "/opds/library/{library}/lang/{lang}"} {
+		mux.Handle("GET "+prefix+"/opensearch.xml", opdsLimit(opdsOpenSearchHandler(svc)))
+		mux.Handle("GET "+prefix+"/search", opdsLimit(opdsSearchHandler(svc)))
+		mux.Handle("GET "+prefix+"/new", opdsLimit(opdsNewBooksHandler(svc)))
+		mux.Handle("GET "+prefix+"/authors", opdsLimit(opdsAuthorsHandler(svc)))
+		mux.Handle("GET "+prefix+"/authors/{id}", opdsLimit(opdsAuthorHandler(svc)))
+		for _, v := range authorViews {
+			mux.Handle("GET "+prefix+"/authors/{id}/"+v.path, opdsLimit(opdsAuthorBooksHandler(svc, v.path)))
+		}
+		mux.Handle("GET "+prefix+"/authors/{id}/series", opdsLimit(opdsAuthorSeriesHandler(svc)))
+		mux.Handle("GET "+prefix+"/authors/{id}/series/{series}", opdsLimit(opdsAuthorSeriesBooksHandler(svc)))
+		mux.Handle("GET "+prefix+"/titles", opdsLimit(opdsTitlesHandler(svc)))
+		mux.Handle("GET "+prefix+"/series", opdsLimit(opdsSeriesHandler(svc)))
+		mux.Handle("GET "+prefix+"/genres", opdsLimit(opdsGenresHandler(svc)))
+		mux.Handle("GET "+prefix+"/genres/{name}", opdsLimit(opdsGenreBooksHandler(svc)))
+		mux.Handle("GET "+prefix+"/series/{id}", opdsLimit(opdsSeriesBooksHandler(svc)))
+		mux.Handle("GET "+prefix+"/books/{id}", opdsLimit(opdsBookHandler(svc)))
+	}
 
 	// Frontend and JSON API routes
 	mux.Handle("/", indexHandler())
-	mux.Handle("/api/authors", withCORS(getAuthorsByLetterHandler(svc)))
-	mux.Handle("/api/authors/", withCORS(authorsAPIHandler(svc)))
-	mux.Handle("/api/books", withCORS(getBooksByLetterHandler(svc)))
-	mux.Handle("/api/books/", withCORS(downloadBookHandler(svc)))
-	mux.Handle("/api/genres", withCORS(getGenresHandler(svc)))
-	mux.Handle("/api/languages", withCORS(getLanguagesHandler(svc)))
-	mux.Handle("/api/search", withCORS(searchBooksHandler(svc)))
+	mux.Handle("/api/authors", withCORS(apiLimit(getAuthorsByLetterHandler(svc))))
+	mux.Handle("/api/authors/", withCORS(apiLimit(authorsAPIHandler(svc))))
+	mux.Handle("GET /api/authors/{id}/download", withCORS(limiter.Limit(middleware.GroupDownload)(bulkDownloadHandler(svc, limiter, "author", svc.AuthorBundle))))
+	mux.Handle("/api/books", withCORS(apiLimit(getBooksByLetterHandler(svc))))
+	mux.Handle("/api/books/", withCORS(downloadLimit(downloadBookHandler(svc, limiter))))
+	mux.Handle("POST /api/books/{id}/convert", withCORS(limiter.Limit(middleware.GroupDownload)(convertBookHandler(svc))))
+	mux.Handle("POST /api/books/{id}/send", withCORS(limiter.Limit(middleware.GroupDownload)(limiter.Quota(sendBookHandler(svc)))))
+	mux.Handle("GET /api/formats", withCORS(apiLimit(getFormatsHandler())))
+	mux.Handle("/api/genres", withCORS(apiLimit(getGenresHandler(svc))))
+	mux.Handle("GET /api/genres/categories", withCORS(apiLimit(getGenreCategoriesHandler(svc))))
+	mux.Handle("GET /api/jobs/{id}", withCORS(apiLimit(getJobHandler(svc))))
+	mux.Handle("GET /api/jobs/{id}/download", withCORS(apiLimit(limiter.Quota(downloadJobHandler(svc)))))
+	mux.Handle("/api/languages", withCORS(apiLimit(getLanguagesHandler(svc))))
+	mux.Handle("/api/libraries", withCORS(apiLimit(getLibrariesHandler(svc))))
+	mux.Handle("GET /api/prefixes", withCORS(apiLimit(getPrefixesHandler(svc))))
+	mux.Handle("/api/search", withCORS(apiLimit(searchBooksHandler(svc))))
+	mux.Handle("GET /api/series", withCORS(apiLimit(getSeriesByLetterHandler(svc))))
+	mux.Handle("GET /api/series/{id}/download", withCORS(limiter.Limit(middleware.GroupDownload)(bulkDownloadHandler(svc, limiter, "series", svc.SeriesBundle))))
 	mux.HandleFunc("/health", healthCheckHandler(svc))
+	mux.Handle("GET /metrics", metrics.Handler())
 
 	// Apply middleware chain
 	chain := middleware.Chain(
 		middleware.Recovery,
 		middleware.Logger,
 		middleware.RequestID,
+		middleware.Tracing,
+		middleware.RoutePattern,
 	)
 
 	return chain(mux)
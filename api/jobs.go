@@ -0,0 +1,184 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/htol/bopds/book"
+	"github.com/htol/bopds/converter"
+	"github.com/htol/bopds/logger"
+	"github.com/htol/bopds/metrics"
+	"github.com/htol/bopds/middleware"
+	"github.com/htol/bopds/repo"
+	"github.com/htol/bopds/service"
+)
+
+// jobResponse is a job as reported by the API, with the result URL once the
+// job is done
+type jobResponse struct {
+	*book.Job
+	DownloadURL string `json:"download_url,omitempty"`
+}
+
+func newJobResponse(job *book.Job) jobResponse {
+	resp := jobResponse{Job: job}
+	if job.Status == book.JobDone && job.Kind == book.JobConvert {
+		resp.DownloadURL = fmt.Sprintf("/api/jobs/%d/download", job.ID)
+	}
+	return resp
+}
+
+func respondWithJob(w http.ResponseWriter, status int, job *book.Job) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(newJobResponse(job)); err != nil {
+		logger.Error("Failed to encode job response", "error", err)
+	}
+}
+
+// convertBookHandler queues an asynchronous conversion:
+// POST /api/books/{id}/convert?format=epub
+func convertBookHandler(svc *service.Service) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id, err := strconv.ParseInt(r.PathValue("id"), 10, 64)
+		if err != nil || id <= 0 {
+			respondWithValidationError(w, "invalid book ID")
+			return
+		}
+
+		format := r.URL.Query().Get("format")
+		profile, err := requestProfile(svc, r)
+		if err != nil {
+			respondWithValidationError(w, err.Error())
+			return
+		}
+		job, err := svc.EnqueueConversion(r.Context(), id, format, profile)
+		if err != nil {
+			switch {
+			case errors.Is(err, service.ErrUnsupportedFormat):
+				respondWithValidationError(w, "format must be one of: "+strings.Join(converter.FormatNames(), ", "))
+			case errors.Is(err, service.ErrUnknownProfile), errors.Is(err, service.ErrFormatUnavailable):
+				respondWithValidationError(w, err.Error())
+			case errors.Is(err, repo.ErrNotFound):
+				respondWithError(w, "book not found", err, http.StatusNotFound)
+			default:
+				respondWithError(w, "failed to queue conversion", err, http.StatusInternalServerError)
+			}
+			return
+		}
+
+		// A reused job may already be done
+		status := http.StatusAccepted
+		if job.Status == book.JobDone {
+			status = http.StatusOK
+		}
+		w.Header().Set("Location", fmt.Sprintf("/api/jobs/%d", job.ID))
+		respondWithJob(w, status, job)
+	})
+}
+
+// sendBookHandler queues e-mailing a book to the requesting user's
+// configured address, e.g. their Send to Kindle address:
+// POST /api/books/{id}/send
+func sendBookHandler(svc *service.Service) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id, err := strconv.ParseInt(r.PathValue("id"), 10, 64)
+		if err != nil || id <= 0 {
+			respondWithValidationError(w, "invalid book ID")
+			return
+		}
+
+		profile, err := requestProfile(svc, r)
+		if err != nil {
+			respondWithValidationError(w, err.Error())
+			return
+		}
+		user := middleware.UserName(r, svc.Config().RateLimit.UserHeader)
+		job, err := svc.EnqueueSend(r.Context(), id, user, profile)
+		if err != nil {
+			switch {
+			case errors.Is(err, service.ErrMailDisabled):
+				respondWithError(w, "sending books by e-mail is not configured", err, http.StatusServiceUnavailable)
+			case errors.Is(err, service.ErrNoRecipient):
+				respondWithError(w, "no delivery address is configured for this user", err, http.StatusForbidden)
+			case errors.Is(err, service.ErrUnsupportedFormat), errors.Is(err, service.ErrUnknownProfile), errors.Is(err, service.ErrFormatUnavailable):
+				respondWithValidationError(w, err.Error())
+			case errors.Is(err, repo.ErrNotFound):
+				respondWithError(w, "book not found", err, http.StatusNotFound)
+			default:
+				respondWithError(w, "failed to queue delivery", err, http.StatusInternalServerError)
+			}
+			return
+		}
+
+		w.Header().Set("Location", fmt.Sprintf("/api/jobs/%d", job.ID))
+		respondWithJob(w, http.StatusAccepted, job)
+	})
+}
+
+// requestProfile resolves the conversion profile of a request from its
+// profile query parameter and the user's default
+func requestProfile(svc *service.Service, r *http.Request) (string, error) {
+	user := middleware.UserName(r, svc.Config().RateLimit.UserHeader)
+	return svc.ResolveProfile(r.URL.Query().Get("profile"), user)
+}
+
+// getJobHandler reports a job's status and progress: GET /api/jobs/{id}
+func getJobHandler(svc *service.Service) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id, err := strconv.ParseInt(r.PathValue("id"), 10, 64)
+		if err != nil || id <= 0 {
+			respondWithValidationError(w, "invalid job ID")
+			return
+		}
+
+		job, err := svc.GetJob(r.Context(), id)
+		if err != nil {
+			if errors.Is(err, repo.ErrNotFound) {
+				respondWithError(w, "job not found", err, http.StatusNotFound)
+			} else {
+				respondWithError(w, "failed to get job", err, http.StatusInternalServerError)
+			}
+			return
+		}
+		respondWithJob(w, http.StatusOK, job)
+	})
+}
+
+// downloadJobHandler streams the result of a finished job:
+// GET /api/jobs/{id}/download
+func downloadJobHandler(svc *service.Service) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id, err := strconv.ParseInt(r.PathValue("id"), 10, 64)
+		if err != nil || id <= 0 {
+			respondWithValidationError(w, "invalid job ID")
+			return
+		}
+
+		reader, job, size, err := svc.OpenJobResult(r.Context(), id)
+		if err != nil {
+			switch {
+			case errors.Is(err, repo.ErrNotFound):
+				respondWithError(w, "job not found", err, http.StatusNotFound)
+			case errors.Is(err, service.ErrJobNotReady):
+				respondWithError(w, fmt.Sprintf("job is %s", job.Status), err, http.StatusConflict)
+			default:
+				respondWithError(w, "failed to open job result", err, http.StatusInternalServerError)
+			}
+			return
+		}
+		defer reader.Close()
+		metrics.Downloads.WithLabelValues(job.Format).Inc()
+
+		w.Header().Set("Content-Length", strconv.FormatInt(size, 10))
+		setDownloadHeaders(w, job.Format, job.FileName)
+		if _, err := io.Copy(w, reader); err != nil {
+			logger.Error("failed to stream job result", "error", err, "job_id", id)
+		}
+	})
+}
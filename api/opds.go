@@ -1,29 +1,52 @@
 package api
 
 import (
+	"cmp"
 	"encoding/xml"
+	"errors"
 	"fmt"
 	"net/http"
+	"net/url"
+	"slices"
 	"strconv"
 	"strings"
+	"unicode/utf8"
 
+	"github.com/htol/bopds/book"
+	"github.com/htol/bopds/i18n"
 	"github.com/htol/bopds/logger"
+	"github.com/htol/bopds/middleware"
 	"github.com/htol/bopds/opds"
+	"github.com/htol/bopds/repo"
 	"github.com/htol/bopds/service"
 )
 
 const (
-	defaultPageSize    = 50
-	maxPageSize        = 500
-	opdsRootURL        = "/opds"
-	opdsSearchURL      = "/opds/opensearch.xml"
-	catalogTitle       = "bopds Library"
-	catalogDescription = "OPDS Catalog for bopds eBook Library"
+	defaultPageSize = 50
+	maxPageSize     = 500
+	opdsRootURL     = "/opds"
 )
 
-// respondWithOPDS writes an OPDS feed response with proper content type
-func respondWithOPDS(w http.ResponseWriter, feed *opds.Feed, contentType string) {
-	output, err := xml.MarshalIndent(feed, "", "  ")
+// opdsPrinter returns the printer for the language the request asks for,
+// by the lang parameter or Accept-Language, defaulting to the catalog's
+// language. The response is marked as varying by it.
+func opdsPrinter(w http.ResponseWriter, r *http.Request, svc *service.Service) *i18n.Printer {
+	p := i18n.FromRequest(r, svc.Config().Catalog.Language)
+	w.Header().Set("Content-Language", p.Lang)
+	w.Header().Add("Vary", "Accept-Language")
+	return p
+}
+
+// catalogTitle returns the configured catalog title, or the default one
+// in the language of p
+func catalogTitle(p *i18n.Printer, svc *service.Service) string {
+	return cmp.Or(svc.Config().Catalog.Title, p.Sprintf("bopds Library"))
+}
+
+// respondWithOPDS writes an OPDS feed or entry document response with proper
+// content type
+func respondWithOPDS(w http.ResponseWriter, doc any, contentType string) {
+	output, err := xml.MarshalIndent(doc, "", "  ")
 	if err != nil {
 		http.Error(w, "Failed to generate feed", http.StatusInternalServerError)
 		return
@@ -53,56 +76,199 @@ func getBaseURL(r *http.Request) string {
 	return fmt.Sprintf("%s://%s", scheme, r.Host)
 }
 
+// opdsPrefix returns the catalog root path for the request. Catalogs scoped to
+// a single library live under /opds/library/{library}, catalogs of books in
+// chosen languages under /lang/{lang} below that.
+func opdsPrefix(r *http.Request) string {
+	return opdsLibraryPrefix(r) + opdsLanguagePath(r)
+}
+
+// opdsLibraryPrefix returns the catalog root path for the request's library,
+// in every language
+func opdsLibraryPrefix(r *http.Request) string {
+	if library := r.PathValue("library"); library != "" {
+		return opdsRootURL + "/library/" + url.PathEscape(library)
+	}
+	return opdsRootURL
+}
+
+// opdsLibrary returns the library the catalog is scoped to, or "" for all libraries
+func opdsLibrary(r *http.Request) string {
+	return r.PathValue("library")
+}
+
+// opdsLanguagePath returns the /lang/{lang} path of a catalog of books in
+// chosen languages, or ""
+func opdsLanguagePath(r *http.Request) string {
+	if lang := r.PathValue("lang"); lang != "" {
+		return "/lang/" + url.PathEscape(lang)
+	}
+	return ""
+}
+
+// opdsLanguages returns the languages the catalog's books are filtered by:
+// those in the URL, else the user's, else the configured ones
+func opdsLanguages(r *http.Request, svc *service.Service) []string {
+	user := middleware.UserName(r, svc.Config().RateLimit.UserHeader)
+	return svc.ResolveBookLanguages(r.PathValue("lang"), user)
+}
+
+// addLanguageFacets links an acquisition feed at path under the catalog root
+// to the same feed in each language the catalog has books in, and in every
+// language
+func addLanguageFacets(feed *opds.Feed, r *http.Request, svc *service.Service, p *i18n.Printer, path string, languages []string) {
+	available, err := svc.GetLanguages(r.Context())
+	if err != nil {
+		logger.Warn("OPDS language facets failed", "error", err)
+		return
+	}
+	root := getBaseURL(r) + opdsLibraryPrefix(r) + "/lang/"
+	group := p.Sprintf("Language")
+	feed.AddFacetLink(root+service.AllLanguages+path, p.Sprintf("All languages"), group, len(languages) == 0)
+	for _, lang := range available {
+		active := len(languages) == 1 && strings.EqualFold(languages[0], lang)
+		feed.AddFacetLink(root+url.PathEscape(lang)+path, p.LanguageName(lang), group, active)
+	}
+}
+
+// languageURNSuffix keeps feed IDs distinct between catalogs of books in
+// different languages
+func languageURNSuffix(languages []string) string {
+	if len(languages) == 0 {
+		return ""
+	}
+	return "-lang-" + strings.Join(languages, ",")
+}
+
+// opdsPage returns the page number and page size requested, defaulting to
+// the first page of defaultPageSize entries
+func opdsPage(r *http.Request) (page, pageSize int) {
+	page, pageSize = 1, defaultPageSize
+	if p := r.URL.Query().Get("page"); p != "" {
+		if parsed, err := strconv.Atoi(p); err == nil && parsed > 0 {
+			page = parsed
+		}
+	}
+	if ps := r.URL.Query().Get("pageSize"); ps != "" {
+		if parsed, err := strconv.Atoi(ps); err == nil && parsed > 0 && parsed <= maxPageSize {
+			pageSize = parsed
+		}
+	}
+	return page, pageSize
+}
+
+// respondWithOPDSError maps service errors to plain-text OPDS error responses
+func respondWithOPDSError(w http.ResponseWriter, message string, err error) {
+	if errors.Is(err, service.ErrUnknownLibrary) {
+		http.Error(w, "Library not found", http.StatusNotFound)
+		return
+	}
+	http.Error(w, message, http.StatusInternalServerError)
+}
+
 // opdsRootHandler returns the OPDS catalog root (navigation feed)
 func opdsRootHandler(svc *service.Service) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		baseURL := getBaseURL(r)
+		root := baseURL + opdsPrefix(r)
+		library := opdsLibrary(r)
+		p := opdsPrinter(w, r, svc)
+
+		title := catalogTitle(p, svc)
+		if library != "" {
+			if !slices.Contains(svc.GetLibraries(r.Context()), library) {
+				http.Error(w, "Library not found", http.StatusNotFound)
+				return
+			}
+			title = fmt.Sprintf("%s: %s", title, library)
+		}
 
 		feed := opds.NewNavigationFeed(
-			"urn:uuid:bopds-root",
-			catalogTitle,
-			baseURL+opdsRootURL,
+			"urn:uuid:bopds-root"+libraryURNSuffix(library),
+			title,
+			root,
 			baseURL+opdsRootURL,
 		)
 
 		// Add search link
-		feed.AddSearchLink(baseURL + opdsSearchURL)
+		feed.AddSearchLink(root + "/opensearch.xml")
+		if library != "" {
+			feed.AddUpLink(baseURL+opdsRootURL+opdsLanguagePath(r), true)
+		}
 
 		// Add navigation entries
 		feed.AddAcquisitionNavigationEntry(
-			"urn:uuid:bopds-new",
-			"New Books",
-			baseURL+"/opds/new",
+			"urn:uuid:bopds-new"+libraryURNSuffix(library),
+			p.Sprintf("New Books"),
+			root+"/new",
 			opds.RelSortNew,
-			"Recently added publications",
+			p.Sprintf("Recently added publications"),
+		)
+
+		feed.AddNavigationEntry(
+			"urn:uuid:bopds-authors"+libraryURNSuffix(library),
+			p.Sprintf("Authors"),
+			root+"/authors",
+			opds.RelSubsection,
+			p.Sprintf("Browse by author"),
 		)
 
 		feed.AddNavigationEntry(
-			"urn:uuid:bopds-authors",
-			"Authors",
-			baseURL+"/opds/authors",
+			"urn:uuid:bopds-titles"+libraryURNSuffix(library),
+			p.Sprintf("Titles"),
+			root+"/titles",
 			opds.RelSubsection,
-			"Browse by author",
+			p.Sprintf("Browse by title"),
 		)
 
 		feed.AddNavigationEntry(
-			"urn:uuid:bopds-genres",
-			"Genres",
-			baseURL+"/opds/genres",
+			"urn:uuid:bopds-series"+libraryURNSuffix(library),
+			p.Sprintf("Series"),
+			root+"/series",
 			opds.RelSubsection,
-			"Browse by genre",
+			p.Sprintf("Browse by series"),
 		)
 
+		feed.AddNavigationEntry(
+			"urn:uuid:bopds-genres"+libraryURNSuffix(library),
+			p.Sprintf("Genres"),
+			root+"/genres",
+			opds.RelSubsection,
+			p.Sprintf("Browse by genre"),
+		)
+
+		// Offer per-library catalogs when more than one library is served
+		if libraries := svc.GetLibraries(r.Context()); library == "" && len(libraries) > 1 {
+			for _, name := range libraries {
+				feed.AddNavigationEntry(
+					"urn:uuid:bopds-library-"+name,
+					name,
+					fmt.Sprintf("%s%s/library/%s%s", baseURL, opdsRootURL, url.PathEscape(name), opdsLanguagePath(r)),
+					opds.RelSubsection,
+					p.Sprintf("Browse the %s library", name),
+				)
+			}
+		}
+
 		respondWithOPDS(w, feed, opds.TypeNavigation)
 	})
 }
 
+// libraryURNSuffix keeps feed IDs distinct between per-library catalogs
+func libraryURNSuffix(library string) string {
+	if library == "" {
+		return ""
+	}
+	return "-library-" + library
+}
+
 // opdsOpenSearchHandler returns the OpenSearch description XML
 func opdsOpenSearchHandler(svc *service.Service) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		baseURL := getBaseURL(r)
+		root := getBaseURL(r) + opdsPrefix(r)
+		p := opdsPrinter(w, r, svc)
 
-		desc := opds.NewOpenSearchDescription(baseURL, catalogTitle, catalogDescription)
+		desc := opds.NewOpenSearchDescription(root+"/search", catalogTitle(p, svc), p.Sprintf("OPDS Catalog for bopds eBook Library"))
 		output, err := desc.Marshal()
 		if err != nil {
 			http.Error(w, "Failed to generate OpenSearch description", http.StatusInternalServerError)
@@ -126,37 +292,34 @@ func opdsSearchHandler(svc *service.Service) http.Handler {
 		}
 
 		baseURL := getBaseURL(r)
+		root := baseURL + opdsPrefix(r)
 		ctx := r.Context()
+		p := opdsPrinter(w, r, svc)
 
-		// Parse pagination
-		page := 1
-		pageSize := defaultPageSize
-		if p := r.URL.Query().Get("page"); p != "" {
-			if parsed, err := strconv.Atoi(p); err == nil && parsed > 0 {
-				page = parsed
-			}
-		}
-		if ps := r.URL.Query().Get("pageSize"); ps != "" {
-			if parsed, err := strconv.Atoi(ps); err == nil && parsed > 0 && parsed <= maxPageSize {
-				pageSize = parsed
-			}
+		page, pageSize := opdsPage(r)
+
+		var libraries []string
+		if library := opdsLibrary(r); library != "" {
+			libraries = []string{library}
 		}
 
-		offset := (page - 1) * pageSize
-		results, err := svc.SearchBooks(ctx, query, pageSize, offset, nil, nil)
+		languages := opdsLanguages(r, svc)
+		results, _, err := svc.SearchBooks(ctx, query, pageOptions(page, pageSize), nil, languages, libraries)
 		if err != nil {
 			logger.Error("OPDS search failed", "query", query, "error", err)
-			http.Error(w, "Search failed", http.StatusInternalServerError)
+			respondWithOPDSError(w, "Search failed", err)
 			return
 		}
 
+		searchPath := "/search?q=" + url.QueryEscape(query)
 		feed := opds.NewAcquisitionFeed(
-			fmt.Sprintf("urn:uuid:bopds-search-%s", query),
-			fmt.Sprintf("Search: %s", query),
-			fmt.Sprintf("%s/opds/search?q=%s", baseURL, query),
+			fmt.Sprintf("urn:uuid:bopds-search-%s%s", query, languageURNSuffix(languages)),
+			p.Sprintf("Search: %s", query),
+			root+searchPath,
 			baseURL+opdsRootURL,
 		)
-		feed.AddUpLink(baseURL+opdsRootURL, true)
+		feed.AddUpLink(root, true)
+		addLanguageFacets(feed, r, svc, p, searchPath, languages)
 
 		// Convert search results to book entries
 		for _, result := range results {
@@ -165,7 +328,9 @@ func opdsSearchHandler(svc *service.Service) http.Handler {
 				Title:    result.Title,
 				Updated:  feed.Updated,
 				Language: result.Lang,
-				Links:    []opds.Link{},
+				Links: []opds.Link{
+					{Rel: opds.RelAlternate, Href: fmt.Sprintf("%s/books/%d", root, result.BookID), Type: opds.TypeEntry, Title: p.Sprintf("Full entry")},
+				},
 			}
 
 			// Add author
@@ -179,10 +344,7 @@ func opdsSearchHandler(svc *service.Service) http.Handler {
 			}
 
 			// Add acquisition links
-			entry.Links = append(entry.Links,
-				opds.Link{Rel: opds.RelAcquisitionOpen, Href: fmt.Sprintf("%s/api/books/%d/download?format=fb2.zip", baseURL, result.BookID), Type: "application/fb2+zip"},
-				opds.Link{Rel: opds.RelAcquisitionOpen, Href: fmt.Sprintf("%s/api/books/%d/download?format=epub", baseURL, result.BookID), Type: "application/epub+zip"},
-			)
+			entry.Links = append(entry.Links, opds.AcquisitionLinks(baseURL, result.BookID, result.Format)...)
 
 			feed.Entries = append(feed.Entries, entry)
 		}
@@ -195,182 +357,639 @@ func opdsSearchHandler(svc *service.Service) http.Handler {
 func opdsNewBooksHandler(svc *service.Service) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		baseURL := getBaseURL(r)
+		root := baseURL + opdsPrefix(r)
+		library := opdsLibrary(r)
 		ctx := r.Context()
+		p := opdsPrinter(w, r, svc)
 
-		// Parse pagination
-		page := 1
-		pageSize := defaultPageSize
-		if p := r.URL.Query().Get("page"); p != "" {
-			if parsed, err := strconv.Atoi(p); err == nil && parsed > 0 {
-				page = parsed
-			}
-		}
-		if ps := r.URL.Query().Get("pageSize"); ps != "" {
-			if parsed, err := strconv.Atoi(ps); err == nil && parsed > 0 && parsed <= maxPageSize {
-				pageSize = parsed
-			}
-		}
+		page, pageSize := opdsPage(r)
 
+		languages := opdsLanguages(r, svc)
 		offset := (page - 1) * pageSize
-		books, total, err := svc.GetRecentBooks(ctx, pageSize, offset)
+		books, total, err := svc.GetRecentBooks(ctx, pageSize, offset, library, languages)
 		if err != nil {
 			logger.Error("OPDS new books failed", "error", err)
-			http.Error(w, "Failed to get new books", http.StatusInternalServerError)
+			respondWithOPDSError(w, "Failed to get new books", err)
 			return
 		}
 
 		feed := opds.NewAcquisitionFeed(
-			"urn:uuid:bopds-new",
-			"New Books",
-			fmt.Sprintf("%s/opds/new", baseURL),
+			"urn:uuid:bopds-new"+libraryURNSuffix(library)+languageURNSuffix(languages),
+			p.Sprintf("New Books"),
+			root+"/new",
 			baseURL+opdsRootURL,
 		)
-		feed.AddUpLink(baseURL+opdsRootURL, true)
+		feed.AddUpLink(root, true)
+		addLanguageFacets(feed, r, svc, p, "/new", languages)
 
 		for _, b := range books {
-			feed.AddBookEntry(&b, baseURL)
+			feed.AddBookEntry(p, &b, baseURL, root)
 		}
 
 		// Add pagination
-		feed.AddPaginationLinks(baseURL+"/opds/new", page, pageSize, total)
+		feed.AddPaginationLinks(root+"/new", page, pageSize, total)
 
 		respondWithOPDS(w, feed, opds.TypeAcquisition)
 	})
 }
 
-// opdsAuthorsHandler returns author navigation feed
+// browseIndex describes a catalog browsed by name prefix
+type browseIndex struct {
+	index repo.PrefixIndex
+	path  string // path under the catalog root
+	title string // feed title, a message of the i18n catalog
+	count string // message counting the names, e.g. "%d authors"
+	// acquisition is set for catalogs whose listings are acquisition feeds
+	acquisition bool
+}
+
+var (
+	authorsIndex = browseIndex{repo.PrefixAuthors, "/authors", "Authors", "%d authors", false}
+	titlesIndex  = browseIndex{repo.PrefixTitles, "/titles", "Titles", "%d books", true}
+	seriesIndex  = browseIndex{repo.PrefixSeries, "/series", "Series", "%d series", false}
+)
+
+// opdsBrowse resolves the name prefix of a catalog browsed by prefix. While
+// too many names start with the prefix it writes the navigation feed of
+// longer prefixes and returns false; otherwise it returns the prefix whose
+// names are to be listed. The "letter" parameter of older links is accepted
+// for "prefix".
+func opdsBrowse(w http.ResponseWriter, r *http.Request, svc *service.Service, p *i18n.Printer, bi browseIndex) (string, bool) {
+	query := r.URL.Query()
+	prefix := cmp.Or(query.Get("prefix"), query.Get("letter"))
+	if prefix != "" && (query.Get("list") != "" || utf8.RuneCountInString(prefix) >= service.MaxPrefixLength) {
+		return prefix, true
+	}
+
+	baseURL := getBaseURL(r)
+	root := baseURL + opdsPrefix(r)
+	library := opdsLibrary(r)
+
+	prefixes, err := svc.GetPrefixes(r.Context(), bi.index, prefix, library)
+	if err != nil {
+		logger.Error("OPDS prefixes failed", "index", bi.index, "prefix", prefix, "error", err)
+		respondWithOPDSError(w, "Failed to get name prefixes", err)
+		return "", false
+	}
+	total := 0
+	for _, pf := range prefixes {
+		total += pf.Count
+	}
+	if prefix != "" && service.PrefixIsLeaf(prefix, total) {
+		return prefix, true
+	}
+
+	feed := opds.NewNavigationFeed(
+		"urn:uuid:bopds"+strings.ReplaceAll(bi.path, "/", "-")+libraryURNSuffix(library),
+		p.Sprintf(bi.title),
+		root+bi.path,
+		baseURL+opdsRootURL,
+	)
+	if prefix == "" {
+		feed.AddUpLink(root, true)
+	} else {
+		feed.Title = fmt.Sprintf("%s: %s", p.Sprintf(bi.title), prefix)
+		feed.ID = fmt.Sprintf("urn:uuid:bopds%s-%s%s", strings.ReplaceAll(bi.path, "/", "-"), prefix, libraryURNSuffix(library))
+		feed.AddUpLink(prefixURL(root, bi, string([]rune(prefix)[:utf8.RuneCountInString(prefix)-1])), true)
+	}
+
+	for _, pf := range prefixes {
+		href := prefixURL(root, bi, pf.Prefix)
+		if strings.EqualFold(pf.Prefix, prefix) {
+			href += "&list=1"
+		}
+		id := fmt.Sprintf("urn:uuid:bopds%s-%s", strings.ReplaceAll(bi.path, "/", "-"), pf.Prefix)
+		content := p.Sprintf(bi.count, pf.Count)
+		if pf.Leaf && bi.acquisition {
+			feed.AddAcquisitionNavigationEntry(id, pf.Prefix, href, opds.RelSubsection, content)
+		} else {
+			feed.AddNavigationEntry(id, pf.Prefix, href, opds.RelSubsection, content)
+		}
+	}
+
+	respondWithOPDS(w, feed, opds.TypeNavigation)
+	return "", false
+}
+
+// opdsListFeed returns the feed listing the names of a catalog browsed by
+// prefix that start with prefix
+func opdsListFeed(r *http.Request, p *i18n.Printer, bi browseIndex, prefix string, acquisition bool) (*opds.Feed, string) {
+	baseURL := getBaseURL(r)
+	root := baseURL + opdsPrefix(r)
+	library := opdsLibrary(r)
+
+	listURL := prefixURL(root, bi, prefix)
+	if r.URL.Query().Get("list") != "" {
+		listURL += "&list=1"
+	}
+	newFeed := opds.NewNavigationFeed
+	if acquisition {
+		newFeed = opds.NewAcquisitionFeed
+	}
+	feed := newFeed(
+		fmt.Sprintf("urn:uuid:bopds%s-%s%s", strings.ReplaceAll(bi.path, "/", "-"), prefix, libraryURNSuffix(library)),
+		fmt.Sprintf("%s: %s", p.Sprintf(bi.title), prefix),
+		listURL,
+		baseURL+opdsRootURL,
+	)
+	feed.AddUpLink(prefixURL(root, bi, string([]rune(prefix)[:utf8.RuneCountInString(prefix)-1])), true)
+	return feed, listURL
+}
+
+// prefixURL returns the URL of the names of a catalog browsed by prefix
+// starting with prefix
+func prefixURL(root string, bi browseIndex, prefix string) string {
+	if prefix == "" {
+		return root + bi.path
+	}
+	return fmt.Sprintf("%s%s?prefix=%s", root, bi.path, url.QueryEscape(prefix))
+}
+
+// pageOptions returns the list options of the page requested, in the
+// list's default order
+func pageOptions(page, pageSize int) repo.ListOptions {
+	return repo.ListOptions{Limit: pageSize, Offset: (page - 1) * pageSize}
+}
+
+// opdsAuthorsHandler returns the author navigation feed, by last name
+// prefix
 func opdsAuthorsHandler(svc *service.Service) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		p := opdsPrinter(w, r, svc)
+		prefix, ok := opdsBrowse(w, r, svc, p, authorsIndex)
+		if !ok {
+			return
+		}
+
+		root := getBaseURL(r) + opdsPrefix(r)
+		page, pageSize := opdsPage(r)
+		authors, total, err := svc.GetAuthorsByLetter(r.Context(), prefix, opdsLibrary(r), pageOptions(page, pageSize))
+		if err != nil {
+			logger.Error("OPDS authors failed", "prefix", prefix, "error", err)
+			respondWithOPDSError(w, "Failed to get authors", err)
+			return
+		}
+
+		feed, listURL := opdsListFeed(r, p, authorsIndex, prefix, false)
+		for _, author := range authors {
+			name := formatAuthorDisplayName(p, author.FirstName, author.MiddleName, author.LastName)
+			feed.AddNavigationEntry(
+				fmt.Sprintf("urn:uuid:bopds-author-%d", author.ID),
+				name,
+				fmt.Sprintf("%s/authors/%d", root, author.ID),
+				opds.RelSubsection,
+				p.Sprintf("%d books", author.BookCount),
+			)
+		}
+		feed.AddPaginationLinks(listURL, page, pageSize, total)
+
+		respondWithOPDS(w, feed, opds.TypeNavigation)
+	})
+}
+
+// opdsTitlesHandler returns books by title prefix (acquisition feed once
+// the prefix is narrow enough)
+func opdsTitlesHandler(svc *service.Service) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		p := opdsPrinter(w, r, svc)
+		prefix, ok := opdsBrowse(w, r, svc, p, titlesIndex)
+		if !ok {
+			return
+		}
+
 		baseURL := getBaseURL(r)
-		ctx := r.Context()
+		root := baseURL + opdsPrefix(r)
+		page, pageSize := opdsPage(r)
+		opts := pageOptions(page, pageSize)
+		opts.Sort = "title"
+		books, total, err := svc.GetBooksByLetter(r.Context(), prefix, opdsLibrary(r), opts)
+		if err != nil {
+			logger.Error("OPDS titles failed", "prefix", prefix, "error", err)
+			respondWithOPDSError(w, "Failed to get books", err)
+			return
+		}
 
-		// Check for letter filter
-		letter := r.URL.Query().Get("letter")
+		feed, listURL := opdsListFeed(r, p, titlesIndex, prefix, true)
+		for _, b := range books {
+			feed.AddBookEntry(p, &b, baseURL, root)
+		}
+		feed.AddPaginationLinks(listURL, page, pageSize, total)
+
+		respondWithOPDS(w, feed, opds.TypeAcquisition)
+	})
+}
+
+// opdsSeriesHandler returns the series navigation feed, by name prefix
+func opdsSeriesHandler(svc *service.Service) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		p := opdsPrinter(w, r, svc)
+		prefix, ok := opdsBrowse(w, r, svc, p, seriesIndex)
+		if !ok {
+			return
+		}
+
+		root := getBaseURL(r) + opdsPrefix(r)
+		page, pageSize := opdsPage(r)
+		series, total, err := svc.GetSeriesByLetter(r.Context(), prefix, opdsLibrary(r), pageOptions(page, pageSize))
+		if err != nil {
+			logger.Error("OPDS series failed", "prefix", prefix, "error", err)
+			respondWithOPDSError(w, "Failed to get series", err)
+			return
+		}
+
+		feed, listURL := opdsListFeed(r, p, seriesIndex, prefix, false)
+		for _, s := range series {
+			feed.AddAcquisitionNavigationEntry(
+				fmt.Sprintf("urn:uuid:bopds-series-%d", s.ID),
+				s.Name,
+				fmt.Sprintf("%s/series/%d", root, s.ID),
+				opds.RelSubsection,
+				p.Sprintf("%d books", s.BookCount),
+			)
+		}
+		feed.AddPaginationLinks(listURL, page, pageSize, total)
+
+		respondWithOPDS(w, feed, opds.TypeNavigation)
+	})
+}
+
+// authorView is an acquisition sub-feed of an author's page; title and
+// content are messages of the i18n catalog
+type authorView struct {
+	path, title, content string
+	view                 service.AuthorBooksView
+}
+
+// authorViews are the acquisition sub-feeds of an author's page, in the
+// order offered
+var authorViews = []authorView{
+	{"books", "All books", "Every book, by title", service.AuthorBooksAll},
+	{"noseries", "Without series", "Books outside any series, by title", service.AuthorBooksNoSeries},
+	{"new", "Recently added", "Most recently added first", service.AuthorBooksRecent},
+}
+
+// opdsAuthor resolves the author of the request, writing an error response
+// and returning false when there is none
+func opdsAuthor(w http.ResponseWriter, r *http.Request, svc *service.Service, p *i18n.Printer) (int64, string, bool) {
+	id, err := strconv.ParseInt(r.PathValue("id"), 10, 64)
+	if err != nil {
+		http.Error(w, "Invalid author ID", http.StatusBadRequest)
+		return 0, "", false
+	}
+	author, err := svc.GetAuthorByID(r.Context(), id)
+	if err != nil {
+		logger.Error("OPDS author not found", "id", id, "error", err)
+		http.Error(w, "Author not found", http.StatusNotFound)
+		return 0, "", false
+	}
+	return id, formatAuthorDisplayName(p, author.FirstName, author.MiddleName, author.LastName), true
+}
+
+// opdsAuthorHandler returns the navigation feed of an author: all books, by
+// series, without series and recently added
+func opdsAuthorHandler(svc *service.Service) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		p := opdsPrinter(w, r, svc)
+		id, authorName, ok := opdsAuthor(w, r, svc, p)
+		if !ok {
+			return
+		}
+
+		baseURL := getBaseURL(r)
+		root := baseURL + opdsPrefix(r)
+		library := opdsLibrary(r)
+		authorURL := fmt.Sprintf("%s/authors/%d", root, id)
 
 		feed := opds.NewNavigationFeed(
-			"urn:uuid:bopds-authors",
-			"Authors",
-			baseURL+"/opds/authors",
+			fmt.Sprintf("urn:uuid:bopds-author-%d%s", id, libraryURNSuffix(library)),
+			authorName,
+			authorURL,
 			baseURL+opdsRootURL,
 		)
-		feed.AddUpLink(baseURL+opdsRootURL, true)
+		feed.AddUpLink(root+"/authors", true)
 
-		if letter == "" {
-			// Show alphabet navigation
-			alphabet := "АБВГДЕЖЗИЙКЛМНОПРСТУФХЦЧШЩЪЫЬЭЮЯABCDEFGHIJKLMNOPQRSTUVWXYZ"
-			for _, char := range alphabet {
-				letterStr := string(char)
-				feed.AddNavigationEntry(
-					fmt.Sprintf("urn:uuid:bopds-authors-%s", letterStr),
-					letterStr,
-					fmt.Sprintf("%s/opds/authors?letter=%s", baseURL, letterStr),
-					opds.RelSubsection,
-					fmt.Sprintf("Authors starting with %s", letterStr),
-				)
-			}
-		} else {
-			// Show authors for the selected letter
-			authors, err := svc.GetAuthorsByLetter(ctx, letter)
-			if err != nil {
-				logger.Error("OPDS authors failed", "letter", letter, "error", err)
-				http.Error(w, "Failed to get authors", http.StatusInternalServerError)
-				return
-			}
+		for _, v := range authorViews[:1] {
+			feed.AddAcquisitionNavigationEntry(
+				fmt.Sprintf("urn:uuid:bopds-author-%d-%s", id, v.path), p.Sprintf(v.title), authorURL+"/"+v.path, opds.RelSubsection, p.Sprintf(v.content))
+		}
+		feed.AddNavigationEntry(
+			fmt.Sprintf("urn:uuid:bopds-author-%d-series", id), p.Sprintf("By series"), authorURL+"/series", opds.RelSubsection, p.Sprintf("Series, by name"))
+		for _, v := range authorViews[1:] {
+			feed.AddAcquisitionNavigationEntry(
+				fmt.Sprintf("urn:uuid:bopds-author-%d-%s", id, v.path), p.Sprintf(v.title), authorURL+"/"+v.path, opds.RelSubsection, p.Sprintf(v.content))
+		}
 
-			feed.Title = fmt.Sprintf("Authors: %s", letter)
-			feed.ID = fmt.Sprintf("urn:uuid:bopds-authors-%s", letter)
+		respondWithOPDS(w, feed, opds.TypeNavigation)
+	})
+}
 
-			for _, author := range authors {
-				name := formatAuthorDisplayName(author.FirstName, author.MiddleName, author.LastName)
-				feed.AddAcquisitionNavigationEntry(
-					fmt.Sprintf("urn:uuid:bopds-author-%d", author.ID),
-					name,
-					fmt.Sprintf("%s/opds/authors/%d", baseURL, author.ID),
-					opds.RelSubsection,
-					fmt.Sprintf("%d books", author.BookCount),
-				)
-			}
+// opdsAuthorBooksHandler returns a page of an author's books in the view
+// at path under the author's page (acquisition feed)
+func opdsAuthorBooksHandler(svc *service.Service, path string) http.Handler {
+	v := authorViews[slices.IndexFunc(authorViews, func(v authorView) bool { return v.path == path })]
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		p := opdsPrinter(w, r, svc)
+		id, authorName, ok := opdsAuthor(w, r, svc, p)
+		if !ok {
+			return
+		}
+
+		baseURL := getBaseURL(r)
+		root := baseURL + opdsPrefix(r)
+		library := opdsLibrary(r)
+		page, pageSize := opdsPage(r)
+
+		languages := opdsLanguages(r, svc)
+		books, total, err := svc.GetAuthorBooks(r.Context(), id, library, languages, v.view, pageSize, (page-1)*pageSize)
+		if err != nil {
+			logger.Error("OPDS author books failed", "id", id, "view", v.view, "error", err)
+			respondWithOPDSError(w, "Failed to get author books", err)
+			return
+		}
+
+		authorURL := fmt.Sprintf("%s/authors/%d", root, id)
+		feed := opds.NewAcquisitionFeed(
+			fmt.Sprintf("urn:uuid:bopds-author-%d-%s%s%s", id, v.path, libraryURNSuffix(library), languageURNSuffix(languages)),
+			authorName+": "+p.Sprintf(v.title),
+			authorURL+"/"+v.path,
+			baseURL+opdsRootURL,
+		)
+		feed.AddUpLink(authorURL, true)
+		addLanguageFacets(feed, r, svc, p, fmt.Sprintf("/authors/%d/%s", id, v.path), languages)
+
+		for _, b := range books {
+			feed.AddBookEntry(p, &b, baseURL, root)
+		}
+		feed.AddPaginationLinks(authorURL+"/"+v.path, page, pageSize, total)
+
+		respondWithOPDS(w, feed, opds.TypeAcquisition)
+	})
+}
+
+// opdsAuthorSeriesHandler returns the navigation feed of an author's series
+func opdsAuthorSeriesHandler(svc *service.Service) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		p := opdsPrinter(w, r, svc)
+		id, authorName, ok := opdsAuthor(w, r, svc, p)
+		if !ok {
+			return
+		}
+
+		baseURL := getBaseURL(r)
+		root := baseURL + opdsPrefix(r)
+		library := opdsLibrary(r)
+
+		languages := opdsLanguages(r, svc)
+		series, err := svc.GetAuthorSeries(r.Context(), id, library, languages)
+		if err != nil {
+			logger.Error("OPDS author series failed", "id", id, "error", err)
+			respondWithOPDSError(w, "Failed to get author series", err)
+			return
+		}
+
+		authorURL := fmt.Sprintf("%s/authors/%d", root, id)
+		feed := opds.NewNavigationFeed(
+			fmt.Sprintf("urn:uuid:bopds-author-%d-series%s%s", id, libraryURNSuffix(library), languageURNSuffix(languages)),
+			authorName+": "+p.Sprintf("By series"),
+			authorURL+"/series",
+			baseURL+opdsRootURL,
+		)
+		feed.AddUpLink(authorURL, true)
+
+		for _, s := range series {
+			feed.AddAcquisitionNavigationEntry(
+				fmt.Sprintf("urn:uuid:bopds-author-%d-series-%d", id, s.ID),
+				s.Name,
+				fmt.Sprintf("%s/series/%d", authorURL, s.ID),
+				opds.RelSubsection,
+				p.Sprintf("%d books", s.BookCount),
+			)
 		}
 
 		respondWithOPDS(w, feed, opds.TypeNavigation)
 	})
 }
 
-// opdsAuthorBooksHandler returns books by author (acquisition feed)
-func opdsAuthorBooksHandler(svc *service.Service) http.Handler {
+// opdsAuthorSeriesBooksHandler returns a page of an author's books in a
+// series, in series order (acquisition feed)
+func opdsAuthorSeriesBooksHandler(svc *service.Service) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		idStr := r.PathValue("id")
-		id, err := strconv.ParseInt(idStr, 10, 64)
+		p := opdsPrinter(w, r, svc)
+		id, authorName, ok := opdsAuthor(w, r, svc, p)
+		if !ok {
+			return
+		}
+		seriesID, err := strconv.ParseInt(r.PathValue("series"), 10, 64)
 		if err != nil {
-			http.Error(w, "Invalid author ID", http.StatusBadRequest)
+			http.Error(w, "Invalid series ID", http.StatusBadRequest)
 			return
 		}
 
 		baseURL := getBaseURL(r)
+		root := baseURL + opdsPrefix(r)
+		library := opdsLibrary(r)
 		ctx := r.Context()
+		page, pageSize := opdsPage(r)
 
-		// Get author info
-		author, err := svc.GetAuthorByID(ctx, id)
+		series, err := svc.GetSeriesByID(ctx, seriesID)
 		if err != nil {
-			logger.Error("OPDS author not found", "id", id, "error", err)
-			http.Error(w, "Author not found", http.StatusNotFound)
+			logger.Error("OPDS series not found", "id", seriesID, "error", err)
+			http.Error(w, "Series not found", http.StatusNotFound)
 			return
 		}
 
-		// Get author's books
-		books, err := svc.GetBooksByAuthorID(ctx, id)
+		languages := opdsLanguages(r, svc)
+		books, total, err := svc.GetAuthorSeriesBooks(ctx, id, seriesID, library, languages, pageSize, (page-1)*pageSize)
 		if err != nil {
-			logger.Error("OPDS author books failed", "id", id, "error", err)
-			http.Error(w, "Failed to get author books", http.StatusInternalServerError)
+			logger.Error("OPDS author series books failed", "id", id, "series", seriesID, "error", err)
+			respondWithOPDSError(w, "Failed to get author books", err)
 			return
 		}
 
-		authorName := formatAuthorDisplayName(author.FirstName, author.MiddleName, author.LastName)
+		authorURL := fmt.Sprintf("%s/authors/%d", root, id)
+		seriesURL := fmt.Sprintf("%s/series/%d", authorURL, seriesID)
+		feed := opds.NewAcquisitionFeed(
+			fmt.Sprintf("urn:uuid:bopds-author-%d-series-%d%s%s", id, seriesID, libraryURNSuffix(library), languageURNSuffix(languages)),
+			authorName+": "+series.Name,
+			seriesURL,
+			baseURL+opdsRootURL,
+		)
+		feed.AddUpLink(authorURL+"/series", true)
+		addLanguageFacets(feed, r, svc, p, fmt.Sprintf("/authors/%d/series/%d", id, seriesID), languages)
+
+		for _, b := range books {
+			feed.AddBookEntry(p, &b, baseURL, root)
+		}
+		feed.AddPaginationLinks(seriesURL, page, pageSize, total)
+
+		respondWithOPDS(w, feed, opds.TypeAcquisition)
+	})
+}
+
+// opdsBookHandler returns the complete entry of a book: its annotation,
+// series, keywords, size and dates, with links to its authors, series and
+// more books in its genres
+func opdsBookHandler(svc *service.Service) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id, err := strconv.ParseInt(r.PathValue("id"), 10, 64)
+		if err != nil {
+			http.Error(w, "Invalid book ID", http.StatusBadRequest)
+			return
+		}
+
+		baseURL := getBaseURL(r)
+		root := baseURL + opdsPrefix(r)
+		library := opdsLibrary(r)
+		ctx := r.Context()
+		p := opdsPrinter(w, r, svc)
+
+		b, err := svc.GetBookByID(ctx, id)
+		if err != nil || (library != "" && b.Library != library) {
+			logger.Error("OPDS book not found", "id", id, "library", library, "error", err)
+			http.Error(w, "Book not found", http.StatusNotFound)
+			return
+		}
+
+		// The annotation is read from the book file; the entry is still
+		// served when the file is unreadable
+		annotation, err := svc.GetBookAnnotation(ctx, b)
+		if err != nil {
+			logger.Warn("OPDS book annotation failed", "id", id, "error", err)
+		}
+
+		genres, err := svc.GetGenres(ctx, library)
+		if err != nil {
+			logger.Error("OPDS book genres failed", "id", id, "error", err)
+			respondWithOPDSError(w, "Failed to get genres", err)
+			return
+		}
+		labels := make(map[string]string, len(genres))
+		for _, genre := range genres {
+			labels[genre.Name] = p.Genre(genre)
+		}
+
+		respondWithOPDS(w, opds.NewBookEntryDocument(p, b, annotation, labels, baseURL, root), opds.TypeEntry)
+	})
+}
+
+// opdsSeriesBooksHandler returns the books of a series in series order
+// (acquisition feed)
+func opdsSeriesBooksHandler(svc *service.Service) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id, err := strconv.ParseInt(r.PathValue("id"), 10, 64)
+		if err != nil {
+			http.Error(w, "Invalid series ID", http.StatusBadRequest)
+			return
+		}
+
+		baseURL := getBaseURL(r)
+		root := baseURL + opdsPrefix(r)
+		library := opdsLibrary(r)
+		ctx := r.Context()
+		p := opdsPrinter(w, r, svc)
+
+		series, err := svc.GetSeriesByID(ctx, id)
+		if err != nil {
+			logger.Error("OPDS series not found", "id", id, "error", err)
+			http.Error(w, "Series not found", http.StatusNotFound)
+			return
+		}
+
+		books, err := svc.GetBooksBySeriesID(ctx, id, library)
+		if err != nil {
+			logger.Error("OPDS series books failed", "id", id, "error", err)
+			respondWithOPDSError(w, "Failed to get series books", err)
+			return
+		}
 
 		feed := opds.NewAcquisitionFeed(
-			fmt.Sprintf("urn:uuid:bopds-author-%d", id),
-			authorName,
-			fmt.Sprintf("%s/opds/authors/%d", baseURL, id),
+			fmt.Sprintf("urn:uuid:bopds-series-%d%s", id, libraryURNSuffix(library)),
+			series.Name,
+			fmt.Sprintf("%s/series/%d", root, id),
 			baseURL+opdsRootURL,
 		)
-		feed.AddUpLink(baseURL+"/opds/authors", true)
+		feed.AddUpLink(root, true)
 
 		for _, b := range books {
-			feed.AddBookEntry(&b, baseURL)
+			feed.AddBookEntry(p, &b, baseURL, root)
 		}
 
 		respondWithOPDS(w, feed, opds.TypeAcquisition)
 	})
 }
 
-// opdsGenresHandler returns genre navigation feed
+// opdsGenresHandler returns the genre navigation feed: the genre categories
+// with their book counts, or the genres of the category named by the
+// "category" parameter
 func opdsGenresHandler(svc *service.Service) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		baseURL := getBaseURL(r)
+		root := baseURL + opdsPrefix(r)
+		library := opdsLibrary(r)
 		ctx := r.Context()
+		p := opdsPrinter(w, r, svc)
 
-		genres, err := svc.GetGenres(ctx)
+		categories, err := svc.GetGenreCategories(ctx, library)
 		if err != nil {
-			logger.Error("OPDS genres failed", "error", err)
-			http.Error(w, "Failed to get genres", http.StatusInternalServerError)
+			logger.Error("OPDS genre categories failed", "error", err)
+			respondWithOPDSError(w, "Failed to get genres", err)
+			return
+		}
+
+		name := r.URL.Query().Get("category")
+		if name == "" {
+			feed := opds.NewNavigationFeed(
+				"urn:uuid:bopds-genres"+libraryURNSuffix(library),
+				p.Sprintf("Genres"),
+				root+"/genres",
+				baseURL+opdsRootURL,
+			)
+			feed.AddUpLink(root, true)
+
+			for _, c := range categories {
+				feed.AddNavigationEntry(
+					fmt.Sprintf("urn:uuid:bopds-genre-category-%s", c.Name),
+					p.GenreCategory(c),
+					genreCategoryURL(root, c.Name),
+					opds.RelSubsection,
+					p.Sprintf("%d books", c.BookCount),
+				)
+			}
+			respondWithOPDS(w, feed, opds.TypeNavigation)
+			return
+		}
+
+		i := slices.IndexFunc(categories, func(c book.GenreCategory) bool { return c.Name == name })
+		if i < 0 {
+			http.Error(w, "Genre category not found", http.StatusNotFound)
+			return
+		}
+		genres, err := svc.GetGenresByCategory(ctx, name, library)
+		if err != nil {
+			logger.Error("OPDS genres failed", "category", name, "error", err)
+			respondWithOPDSError(w, "Failed to get genres", err)
 			return
 		}
 
 		feed := opds.NewNavigationFeed(
-			"urn:uuid:bopds-genres",
-			"Genres",
-			baseURL+"/opds/genres",
+			fmt.Sprintf("urn:uuid:bopds-genre-category-%s%s", name, libraryURNSuffix(library)),
+			fmt.Sprintf("%s: %s", p.Sprintf("Genres"), p.GenreCategory(categories[i])),
+			genreCategoryURL(root, name),
 			baseURL+opdsRootURL,
 		)
-		feed.AddUpLink(baseURL+opdsRootURL, true)
+		feed.AddUpLink(root+"/genres", true)
 
+		// Genres are listed by name in the language of the feed
+		slices.SortStableFunc(genres, func(a, b book.Genre) int {
+			return strings.Compare(strings.ToLower(p.Genre(a)), strings.ToLower(p.Genre(b)))
+		})
 		for _, genre := range genres {
 			feed.AddAcquisitionNavigationEntry(
 				fmt.Sprintf("urn:uuid:bopds-genre-%s", genre.Name),
-				genre.DisplayName,
-				fmt.Sprintf("%s/opds/genres/%s", baseURL, genre.Name),
+				p.Genre(genre),
+				fmt.Sprintf("%s/genres/%s", root, url.PathEscape(genre.Name)),
 				opds.RelSubsection,
-				"",
+				p.Sprintf("%d books", genre.BookCount),
 			)
 		}
 
@@ -378,6 +997,12 @@ func opdsGenresHandler(svc *service.Service) http.Handler {
 	})
 }
 
+// genreCategoryURL returns the URL of the navigation feed of a genre
+// category's genres
+func genreCategoryURL(root, category string) string {
+	return fmt.Sprintf("%s/genres?category=%s", root, url.QueryEscape(category))
+}
+
 // opdsGenreBooksHandler returns books by genre (acquisition feed)
 func opdsGenreBooksHandler(svc *service.Service) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
@@ -388,51 +1013,60 @@ func opdsGenreBooksHandler(svc *service.Service) http.Handler {
 		}
 
 		baseURL := getBaseURL(r)
+		root := baseURL + opdsPrefix(r)
+		library := opdsLibrary(r)
 		ctx := r.Context()
+		p := opdsPrinter(w, r, svc)
 
-		// Parse pagination
-		page := 1
-		pageSize := defaultPageSize
-		if p := r.URL.Query().Get("page"); p != "" {
-			if parsed, err := strconv.Atoi(p); err == nil && parsed > 0 {
-				page = parsed
-			}
-		}
-		if ps := r.URL.Query().Get("pageSize"); ps != "" {
-			if parsed, err := strconv.Atoi(ps); err == nil && parsed > 0 && parsed <= maxPageSize {
-				pageSize = parsed
-			}
-		}
+		page, pageSize := opdsPage(r)
 
+		languages := opdsLanguages(r, svc)
 		offset := (page - 1) * pageSize
-		books, total, err := svc.GetBooksByGenre(ctx, genreName, pageSize, offset)
+		books, total, err := svc.GetBooksByGenre(ctx, genreName, pageSize, offset, library, languages)
 		if err != nil {
 			logger.Error("OPDS genre books failed", "genre", genreName, "error", err)
-			http.Error(w, "Failed to get genre books", http.StatusInternalServerError)
+			respondWithOPDSError(w, "Failed to get genre books", err)
 			return
 		}
 
+		// Title the feed with the localized genre name, falling back to the
+		// name from the URL
+		title, upURL := genreName, root+"/genres"
+		genres, err := svc.GetGenres(ctx, library)
+		if err != nil {
+			logger.Warn("OPDS genre name failed", "genre", genreName, "error", err)
+		}
+		if i := slices.IndexFunc(genres, func(g book.Genre) bool { return g.Name == genreName || g.DisplayName == genreName }); i >= 0 {
+			title = p.Genre(genres[i])
+			if genres[i].Category != "" {
+				upURL = genreCategoryURL(root, genres[i].Category)
+			}
+		}
+
+		genrePath := "/genres/" + url.PathEscape(genreName)
+		genreURL := root + genrePath
 		feed := opds.NewAcquisitionFeed(
-			fmt.Sprintf("urn:uuid:bopds-genre-%s", genreName),
-			genreName,
-			fmt.Sprintf("%s/opds/genres/%s", baseURL, genreName),
+			fmt.Sprintf("urn:uuid:bopds-genre-%s%s%s", genreName, libraryURNSuffix(library), languageURNSuffix(languages)),
+			title,
+			genreURL,
 			baseURL+opdsRootURL,
 		)
-		feed.AddUpLink(baseURL+"/opds/genres", true)
+		feed.AddUpLink(upURL, true)
+		addLanguageFacets(feed, r, svc, p, genrePath, languages)
 
 		for _, b := range books {
-			feed.AddBookEntry(&b, baseURL)
+			feed.AddBookEntry(p, &b, baseURL, root)
 		}
 
 		// Add pagination
-		feed.AddPaginationLinks(fmt.Sprintf("%s/opds/genres/%s", baseURL, genreName), page, pageSize, total)
+		feed.AddPaginationLinks(genreURL, page, pageSize, total)
 
 		respondWithOPDS(w, feed, opds.TypeAcquisition)
 	})
 }
 
 // formatAuthorDisplayName formats author name for display
-func formatAuthorDisplayName(firstName, middleName, lastName string) string {
+func formatAuthorDisplayName(p *i18n.Printer, firstName, middleName, lastName string) string {
 	parts := []string{}
 	if lastName != "" {
 		parts = append(parts, lastName)
@@ -444,7 +1078,7 @@ func formatAuthorDisplayName(firstName, middleName, lastName string) string {
 		parts = append(parts, middleName)
 	}
 	if len(parts) == 0 {
-		return "Unknown Author"
+		return p.Sprintf("Unknown Author")
 	}
 	return strings.Join(parts, " ")
 }
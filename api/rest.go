@@ -1,15 +1,25 @@
 package api
 
 import (
+	"cmp"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"net/http"
 	"net/url"
+	"slices"
 	"strconv"
 	"strings"
+	"time"
+	"unicode/utf8"
 
+	"github.com/htol/bopds/book"
+	"github.com/htol/bopds/converter"
+	"github.com/htol/bopds/i18n"
 	"github.com/htol/bopds/logger"
+	"github.com/htol/bopds/metrics"
+	"github.com/htol/bopds/middleware"
 	"github.com/htol/bopds/repo"
 	"github.com/htol/bopds/service"
 )
@@ -25,16 +35,18 @@ func getAuthorsByLetterHandler(svc *service.Service) http.Handler {
 			respondWithValidationError(w, "missing 'startsWith' query parameter")
 			return
 		}
-		ctx := r.Context()
-		authors, err := svc.GetAuthorsByLetter(ctx, letters)
+		opts, err := parseListOptions(r, defaultPageSize, maxPageSize)
 		if err != nil {
-			respondWithError(w, "Failed to get authors by letter", err, http.StatusInternalServerError)
+			respondWithValidationError(w, err.Error())
 			return
 		}
-		w.Header().Set("Content-Type", "application/json")
-		if err := json.NewEncoder(w).Encode(authors); err != nil {
-			logger.Error("Failed to encode authors response", "error", err)
+		ctx := r.Context()
+		authors, total, err := svc.GetAuthorsByLetter(ctx, letters, r.URL.Query().Get("library"), opts)
+		if err != nil {
+			respondWithServiceError(w, "Failed to get authors by letter", err)
+			return
 		}
+		respondWithList(w, r, authors, total, opts)
 	}
 	return http.HandlerFunc(hf)
 }
@@ -82,17 +94,19 @@ func getBooksByAuthorIDHandler(svc *service.Service) http.Handler {
 			return
 		}
 
-		ctx := r.Context()
-		books, err := svc.GetBooksByAuthorID(ctx, id)
+		opts, err := parseListOptions(r, defaultPageSize, maxPageSize)
 		if err != nil {
-			respondWithError(w, "Failed to get books by author", err, http.StatusInternalServerError)
+			respondWithValidationError(w, err.Error())
 			return
 		}
 
-		w.Header().Set("Content-Type", "application/json")
-		if err := json.NewEncoder(w).Encode(books); err != nil {
-			logger.Error("Failed to encode books response", "error", err)
+		ctx := r.Context()
+		books, total, err := svc.GetBooksByAuthorID(ctx, id, r.URL.Query().Get("library"), nil, opts)
+		if err != nil {
+			respondWithServiceError(w, "Failed to get books by author", err)
+			return
 		}
+		respondWithList(w, r, books, total, opts)
 	}
 	return http.HandlerFunc(hf)
 }
@@ -108,36 +122,11 @@ func searchBooksHandler(svc *service.Service) http.Handler {
 			return
 		}
 
-		// Parse limit with validation
-		limitStr := r.URL.Query().Get("limit")
-		limit := 20 // default
-		if limitStr != "" {
-			l, err := strconv.Atoi(limitStr)
-			if err != nil {
-				respondWithValidationError(w, "invalid 'limit' parameter")
-				return
-			}
-			if l < 1 || l > 100 {
-				respondWithValidationError(w, "'limit' must be between 1 and 100")
-				return
-			}
-			limit = l
-		}
-
-		// Parse offset with validation
-		offsetStr := r.URL.Query().Get("offset")
-		offset := 0 // default
-		if offsetStr != "" {
-			o, err := strconv.Atoi(offsetStr)
-			if err != nil {
-				respondWithValidationError(w, "invalid 'offset' parameter")
-				return
-			}
-			if o < 0 {
-				respondWithValidationError(w, "'offset' must be >= 0")
-				return
-			}
-			offset = o
+		// Parse limit, offset and sort with validation
+		opts, err := parseListOptions(r, 20, 100)
+		if err != nil {
+			respondWithValidationError(w, err.Error())
+			return
 		}
 
 		// Parse fields
@@ -164,18 +153,20 @@ func searchBooksHandler(svc *service.Service) http.Handler {
 			languages = strings.Split(langsStr, ",")
 		}
 
+		// Parse libraries
+		librariesStr := r.URL.Query().Get("library")
+		var libraries []string
+		if librariesStr != "" {
+			libraries = strings.Split(librariesStr, ",")
+		}
+
 		// Perform search with context for cancellation
-		results, err := svc.SearchBooks(ctx, query, limit, offset, fields, languages)
+		results, total, err := svc.SearchBooks(ctx, query, opts, fields, languages, libraries)
 		if err != nil {
-			respondWithError(w, "Failed to search books", err, http.StatusInternalServerError)
+			respondWithServiceError(w, "Failed to search books", err)
 			return
 		}
-
-		// Return JSON response
-		w.Header().Set("Content-Type", "application/json")
-		if err := json.NewEncoder(w).Encode(results); err != nil {
-			logger.Error("Failed to encode search results", "error", err)
-		}
+		respondWithList(w, r, results, total, opts)
 	})
 }
 func authorsAPIHandler(svc *service.Service) http.Handler {
@@ -198,32 +189,115 @@ func getBooksByLetterHandler(svc *service.Service) http.Handler {
 			respondWithValidationError(w, "missing 'startsWith' query parameter")
 			return
 		}
-		ctx := r.Context()
-		books, err := svc.GetBooksByLetter(ctx, letters)
+		opts, err := parseListOptions(r, defaultPageSize, maxPageSize)
 		if err != nil {
-			respondWithError(w, "Failed to get books by letter", err, http.StatusInternalServerError)
+			respondWithValidationError(w, err.Error())
 			return
 		}
-		w.Header().Set("Content-Type", "application/json")
-		if err := json.NewEncoder(w).Encode(books); err != nil {
-			logger.Error("Failed to encode books response", "error", err)
+		ctx := r.Context()
+		books, total, err := svc.GetBooksByLetter(ctx, letters, r.URL.Query().Get("library"), opts)
+		if err != nil {
+			respondWithServiceError(w, "Failed to get books by letter", err)
+			return
 		}
+		respondWithList(w, r, books, total, opts)
 	}
 	return http.HandlerFunc(hf)
 }
 
+// getGenresHandler lists the genres of the library, or of the genre
+// category named by ?category=, with display names in the language asked
+// for by ?lang= or Accept-Language
 func getGenresHandler(svc *service.Service) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		ctx := r.Context()
-		genres, err := svc.GetGenres(ctx)
+		query := r.URL.Query()
+		var genres []book.Genre
+		var err error
+		if category := query.Get("category"); category != "" {
+			genres, err = svc.GetGenresByCategory(ctx, category, query.Get("library"))
+		} else {
+			genres, err = svc.GetGenres(ctx, query.Get("library"))
+		}
 		if err != nil {
-			respondWithError(w, "Failed to get genres", err, http.StatusInternalServerError)
+			respondWithServiceError(w, "Failed to get genres", err)
 			return
 		}
-		w.Header().Set("Content-Type", "application/json")
-		if err := json.NewEncoder(w).Encode(genres); err != nil {
-			logger.Error("Failed to encode genres response", "error", err)
+		p := i18n.FromRequest(r, svc.Config().Catalog.Language)
+		for i := range genres {
+			genres[i].DisplayName = p.Genre(genres[i])
+		}
+		w.Header().Set("Content-Language", p.Lang)
+		w.Header().Add("Vary", "Accept-Language")
+		respondWithAll(w, r, genres)
+	})
+}
+
+// getGenreCategoriesHandler lists the top-level genre categories of the
+// library with their genre and book counts, localized like the genres
+func getGenreCategoriesHandler(svc *service.Service) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		categories, err := svc.GetGenreCategories(r.Context(), r.URL.Query().Get("library"))
+		if err != nil {
+			respondWithServiceError(w, "Failed to get genre categories", err)
+			return
+		}
+		p := i18n.FromRequest(r, svc.Config().Catalog.Language)
+		for i := range categories {
+			categories[i].DisplayName = p.GenreCategory(categories[i])
+		}
+		w.Header().Set("Content-Language", p.Lang)
+		w.Header().Add("Vary", "Accept-Language")
+		respondWithAll(w, r, categories)
+	})
+}
+
+// getPrefixesHandler handles the prefix navigation endpoint: the prefixes
+// one character longer than ?prefix= of the authors, titles or series
+// (?index=) with their counts
+func getPrefixesHandler(svc *service.Service) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		query := r.URL.Query()
+		index := repo.PrefixIndex(query.Get("index"))
+		switch index {
+		case repo.PrefixAuthors, repo.PrefixTitles, repo.PrefixSeries:
+		default:
+			respondWithValidationError(w, "'index' must be one of authors, titles or series")
+			return
+		}
+		prefix := query.Get("prefix")
+		if utf8.RuneCountInString(prefix) >= service.MaxPrefixLength {
+			respondWithValidationError(w, fmt.Sprintf("'prefix' must be shorter than %d characters", service.MaxPrefixLength))
+			return
+		}
+		prefixes, err := svc.GetPrefixes(r.Context(), index, prefix, query.Get("library"))
+		if err != nil {
+			respondWithServiceError(w, "Failed to get prefixes", err)
+			return
+		}
+		respondWithAll(w, r, prefixes)
+	})
+}
+
+// getSeriesByLetterHandler handles the series list endpoint
+func getSeriesByLetterHandler(svc *service.Service) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		letters := r.URL.Query().Get("startsWith")
+		if letters == "" {
+			respondWithValidationError(w, "missing 'startsWith' query parameter")
+			return
 		}
+		opts, err := parseListOptions(r, defaultPageSize, maxPageSize)
+		if err != nil {
+			respondWithValidationError(w, err.Error())
+			return
+		}
+		series, total, err := svc.GetSeriesByLetter(r.Context(), letters, r.URL.Query().Get("library"), opts)
+		if err != nil {
+			respondWithServiceError(w, "Failed to get series by letter", err)
+			return
+		}
+		respondWithList(w, r, series, total, opts)
 	})
 }
 
@@ -236,14 +310,106 @@ func getLanguagesHandler(svc *service.Service) http.Handler {
 			respondWithError(w, "Failed to fetch languages", err, http.StatusInternalServerError)
 			return
 		}
+		respondWithAll(w, r, languages)
+	})
+}
 
-		w.Header().Set("Content-Type", "application/json")
-		if err := json.NewEncoder(w).Encode(languages); err != nil {
-			logger.Error("Failed to encode response", "error", err)
-		}
+// getLibrariesHandler lists the configured library names
+func getLibrariesHandler(svc *service.Service) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		respondWithAll(w, r, svc.GetLibraries(r.Context()))
 	})
 }
 
+// listResponse is a page of a list endpoint: the items of the page, the
+// number of items in the list and the URL of the next page, null on the last
+type listResponse[T any] struct {
+	Items []T     `json:"items"`
+	Total int     `json:"total"`
+	Next  *string `json:"next"`
+}
+
+// parseListOptions reads the limit, offset and sort query parameters of a
+// list endpoint. A sort key prefixed with '-' sorts in descending order.
+func parseListOptions(r *http.Request, defaultLimit, maxLimit int) (repo.ListOptions, error) {
+	query := r.URL.Query()
+	opts := repo.ListOptions{Limit: defaultLimit}
+	if limitStr := query.Get("limit"); limitStr != "" {
+		l, err := strconv.Atoi(limitStr)
+		if err != nil {
+			return opts, errors.New("invalid 'limit' parameter")
+		}
+		if l < 1 || l > maxLimit {
+			return opts, fmt.Errorf("'limit' must be between 1 and %d", maxLimit)
+		}
+		opts.Limit = l
+	}
+	if offsetStr := query.Get("offset"); offsetStr != "" {
+		o, err := strconv.Atoi(offsetStr)
+		if err != nil {
+			return opts, errors.New("invalid 'offset' parameter")
+		}
+		if o < 0 {
+			return opts, errors.New("'offset' must be >= 0")
+		}
+		opts.Offset = o
+	}
+	opts.Sort, opts.Desc = strings.CutPrefix(query.Get("sort"), "-")
+	return opts, nil
+}
+
+// respondWithList sends the page opts asked for of a list of total items,
+// linking the next page when there is one
+func respondWithList[T any](w http.ResponseWriter, r *http.Request, items []T, total int, opts repo.ListOptions) {
+	resp := listResponse[T]{Items: items, Total: total}
+	if resp.Items == nil {
+		resp.Items = []T{}
+	}
+	if next := opts.Offset + len(items); len(items) > 0 && next < total {
+		query := r.URL.Query()
+		query.Set("offset", strconv.Itoa(next))
+		query.Set("limit", strconv.Itoa(opts.Limit))
+		link := r.URL.Path + "?" + query.Encode()
+		resp.Next = &link
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(resp); err != nil {
+		logger.Error("Failed to encode list response", "error", err)
+	}
+}
+
+// respondWithAll sends a list held in memory, such as the genres or the
+// formats, in the envelope of the list endpoints. The whole list is a single
+// page unless limit and offset ask for less; it has no sort keys.
+func respondWithAll[T any](w http.ResponseWriter, r *http.Request, items []T) {
+	opts, err := parseListOptions(r, max(len(items), 1), max(len(items), maxPageSize))
+	if err != nil {
+		respondWithValidationError(w, err.Error())
+		return
+	}
+	if opts.Sort != "" {
+		respondWithValidationError(w, "invalid 'sort' parameter")
+		return
+	}
+	page := items[min(opts.Offset, len(items)):]
+	page = page[:min(opts.Limit, len(page))]
+	respondWithList(w, r, page, len(items), opts)
+}
+
+// respondWithServiceError reports an unknown library filter or sort key as
+// a client error and anything else as an internal error
+func respondWithServiceError(w http.ResponseWriter, message string, err error) {
+	if errors.Is(err, service.ErrUnknownLibrary) {
+		respondWithValidationError(w, err.Error())
+		return
+	}
+	if errors.Is(err, repo.ErrUnknownSort) {
+		respondWithValidationError(w, "invalid 'sort' parameter")
+		return
+	}
+	respondWithError(w, message, err, http.StatusInternalServerError)
+}
+
 func healthCheckHandler(svc *service.Service) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		ctx := r.Context()
@@ -264,7 +430,7 @@ func healthCheckHandler(svc *service.Service) http.HandlerFunc {
 	}
 }
 
-func downloadBookHandler(svc *service.Service) http.Handler {
+func downloadBookHandler(svc *service.Service, limiter *middleware.RateLimiter) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		ctx := r.Context()
 
@@ -279,14 +445,22 @@ func downloadBookHandler(svc *service.Service) http.Handler {
 			return
 		}
 
-		// Get format parameter
-		format := r.URL.Query().Get("format")
-		if format == "" {
-			format = "fb2" // default
+		b, err := svc.GetBookByID(ctx, id)
+		if err != nil {
+			if errors.Is(err, repo.ErrNotFound) {
+				respondWithError(w, "book not found", err, http.StatusNotFound)
+			} else {
+				respondWithError(w, "failed to get book", err, http.StatusInternalServerError)
+			}
+			return
 		}
 
-		if format != "fb2" && format != "fb2.zip" && format != "epub" && format != "mobi" {
-			respondWithValidationError(w, "format must be 'fb2', 'fb2.zip', 'epub' or 'mobi'")
+		// Get format parameter; books are served as stored by default
+		format := r.URL.Query().Get("format")
+		if format == "" {
+			format = cmp.Or(b.Format, "fb2")
+		} else if _, stored := converter.LookupBookFormat(format); !stored && !slices.Contains(downloadFormats(), format) {
+			respondWithValidationError(w, "format must be one of: "+strings.Join(downloadFormats(), ", "))
 			return
 		}
 
@@ -294,46 +468,64 @@ func downloadBookHandler(svc *service.Service) http.Handler {
 		var filename string
 		var size int64
 
+		cfg := svc.Config()
 		switch format {
 		case "fb2":
 			reader, filename, size, err = svc.DownloadBookFB2(ctx, id)
 		case "fb2.zip":
 			reader, filename, size, err = svc.DownloadBookFB2Zip(ctx, id)
-		case "epub":
-			reader, filename, size, err = svc.DownloadBookEPUB(ctx, id)
-		case "mobi":
-			reader, filename, size, err = svc.DownloadBookMOBI(ctx, id)
+		default:
+			var profile string
+			if profile, err = requestProfile(svc, r); err != nil {
+				break
+			}
+			if needsConversion(b, format) {
+				release, ok := limiter.AcquireConversion(w, r)
+				if !ok {
+					return
+				}
+				defer release()
+
+				// Conversions get their own time budget on top of the
+				// server's WriteTimeout, which would otherwise cut off the
+				// finished file
+				if cfg.Server.WriteTimeout > 0 {
+					budget := time.Duration(cfg.Conversion.Timeout+cfg.Server.WriteTimeout) * time.Second
+					if err := http.NewResponseController(w).SetWriteDeadline(time.Now().Add(budget)); err != nil {
+						logger.Debug("cannot extend write deadline", "error", err)
+					}
+				}
+			}
+			reader, filename, size, err = svc.DownloadBookConverted(ctx, id, format, profile)
 		}
 
 		if err != nil {
 			if err == repo.ErrNotFound {
 				respondWithError(w, "book not found", err, http.StatusNotFound)
+			} else if errors.Is(err, service.ErrUnknownProfile) || errors.Is(err, service.ErrFormatUnavailable) {
+				respondWithValidationError(w, err.Error())
+			} else if errors.Is(err, converter.ErrBusy) {
+				w.Header().Set("Retry-After", strconv.Itoa(max(cfg.Conversion.Timeout, 1)))
+				respondWithError(w, "all conversion workers are busy", err, http.StatusServiceUnavailable)
+			} else if errors.Is(err, converter.ErrConversionTimeout) {
+				respondWithError(w, fmt.Sprintf("conversion to %s timed out after %ds", format, cfg.Conversion.Timeout), err, http.StatusGatewayTimeout)
+			} else if ctx.Err() != nil {
+				// The client went away; there is nobody to answer
+				logger.Info("download cancelled by client", "book_id", id, "format", format)
 			} else {
 				respondWithError(w, "failed to prepare download", err, http.StatusInternalServerError)
 			}
 			return
 		}
 		defer reader.Close()
+		metrics.Downloads.WithLabelValues(format).Inc()
 
 		if size > 0 {
 			w.Header().Set("Content-Length", strconv.FormatInt(size, 10))
 		}
 
 		// Set headers for file download
-		switch format {
-		case "fb2":
-			w.Header().Set("Content-Type", "application/fb2+xml")
-		case "fb2.zip":
-			w.Header().Set("Content-Type", "application/zip")
-		case "epub":
-			w.Header().Set("Content-Type", "application/epub+zip")
-		case "mobi":
-			w.Header().Set("Content-Type", "application/x-mobipocket-ebook")
-		}
-
-		// Set filename with proper UTF-8 encoding (RFC 5987)
-		encodedFilename := url.PathEscape(filename)
-		w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename*=UTF-8''%s", encodedFilename))
+		setDownloadHeaders(w, format, filename)
 
 		// Stream file to response
 		_, err = io.Copy(w, reader)
@@ -342,3 +534,61 @@ func downloadBookHandler(svc *service.Service) http.Handler {
 		}
 	})
 }
+
+// needsConversion reports whether serving b in format converts it: only
+// FB2 books are converted, to anything but FB2 and FB2 in a ZIP
+func needsConversion(b *book.Book, format string) bool {
+	return cmp.Or(b.Format, "fb2") == "fb2" && format != "fb2" && format != "fb2.zip"
+}
+
+// formatInfo describes a download format in GET /api/formats
+type formatInfo struct {
+	Name        string `json:"name"`
+	Title       string `json:"title"`
+	ContentType string `json:"content_type"`
+}
+
+// sourceFormats are served from the archive without conversion
+var sourceFormats = []formatInfo{
+	{Name: "fb2", Title: "FB2", ContentType: "application/fb2+xml"},
+	{Name: "fb2.zip", Title: "FB2 (ZIP)", ContentType: "application/zip"},
+}
+
+// availableFormats lists the source formats followed by every registered
+// conversion format: the formats FB2 books are downloaded in
+func availableFormats() []formatInfo {
+	formats := append([]formatInfo(nil), sourceFormats...)
+	for _, f := range converter.Formats() {
+		formats = append(formats, formatInfo{Name: f.Name, Title: f.Title, ContentType: f.ContentType})
+	}
+	return formats
+}
+
+func downloadFormats() []string {
+	var names []string
+	for _, f := range availableFormats() {
+		names = append(names, f.Name)
+	}
+	return names
+}
+
+func getFormatsHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		respondWithAll(w, r, availableFormats())
+	})
+}
+
+// setDownloadHeaders sets the content type for format and an attachment
+// filename with proper UTF-8 encoding (RFC 5987)
+func setDownloadHeaders(w http.ResponseWriter, format, filename string) {
+	if f, ok := converter.LookupBookFormat(format); ok {
+		w.Header().Set("Content-Type", f.ContentType)
+	}
+	for _, f := range availableFormats() {
+		if f.Name == format {
+			w.Header().Set("Content-Type", f.ContentType)
+		}
+	}
+	encodedFilename := url.PathEscape(filename)
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename*=UTF-8''%s", encodedFilename))
+}
@@ -4,18 +4,25 @@ import (
 	"context"
 	"flag"
 	"fmt"
+	"io/fs"
+	"mime"
 	"net/http"
 	"os"
 	"os/signal"
+	"path/filepath"
+	"strings"
 	"syscall"
 	"time"
 
 	"github.com/htol/bopds/api"
 	"github.com/htol/bopds/config"
+	"github.com/htol/bopds/converter"
 	"github.com/htol/bopds/logger"
+	"github.com/htol/bopds/metrics"
 	"github.com/htol/bopds/repo"
 	"github.com/htol/bopds/scanner"
 	"github.com/htol/bopds/service"
+	"github.com/htol/bopds/tracing"
 )
 
 func CLI(args []string) int {
@@ -35,8 +42,8 @@ func CLI(args []string) int {
 type appEnv struct {
 	server      *http.Server
 	config      *config.Config
-	libraryPath string
 	cmd         string
+	args        []string
 	storage     *repo.Repo
 	service     *service.Service
 	shutdownCtx context.Context
@@ -45,15 +52,21 @@ type appEnv struct {
 func (app *appEnv) fromArgs(args []string) error {
 	fl := flag.NewFlagSet("bopds", flag.ContinueOnError)
 
-	// Load default config
-	cfg := config.Load()
-
-	// CLI flags override environment variables
-	port := cfg.Server.Port
-	libPath := cfg.Library.Path
-
-	fl.IntVar(&port, "p", cfg.Server.Port, "Port number")
-	fl.StringVar(&libPath, "l", cfg.Library.Path, "Path to library")
+	// Flags are registered with the built-in defaults for the usage text only;
+	// they override the config file and environment only when set explicitly
+	defaults := config.Default()
+	var (
+		configPath string
+		port       int
+		libPath    string
+		dbPath     string
+		logLevel   string
+	)
+	fl.StringVar(&configPath, "c", "", "Path to a YAML or TOML config file")
+	fl.IntVar(&port, "p", defaults.Server.Port, "Port number")
+	fl.StringVar(&libPath, "l", defaults.DefaultLibrary().Path, "Path to library (replaces configured libraries with the default one)")
+	fl.StringVar(&dbPath, "db", defaults.Database.Path, "Path to the database file")
+	fl.StringVar(&logLevel, "log-level", defaults.LogLevel, "Log level (debug, info, warn, error)")
 
 	if err := fl.Parse(args); err != nil {
 		fl.Usage()
@@ -64,10 +77,31 @@ func (app *appEnv) fromArgs(args []string) error {
 		return fmt.Errorf("please provide a command to run")
 	}
 
+	cfg, err := config.Load(configPath)
+	if err != nil {
+		return err
+	}
+
+	fl.Visit(func(f *flag.Flag) {
+		switch f.Name {
+		case "p":
+			cfg.Server.Port = port
+		case "l":
+			// An explicit -l serves a single library under the default library's name
+			cfg.Libraries = []config.LibraryConfig{{Name: cfg.DefaultLibrary().Name, Path: libPath}}
+		case "db":
+			cfg.Database.Path = dbPath
+		case "log-level":
+			cfg.LogLevel = logLevel
+		}
+	})
+	if err := cfg.Validate(); err != nil {
+		return err
+	}
+
 	app.cmd = fl.Arg(0)
-	app.libraryPath = libPath
+	app.args = fl.Args()[1:]
 	app.config = cfg
-	app.config.Server.Port = port
 
 	return nil
 }
@@ -76,7 +110,15 @@ func (app *appEnv) run() error {
 	// Initialize logger
 	logger.Init(app.config.LogLevel)
 
-	storage := repo.GetStorage(app.config.Database.Path)
+	// Commands that do not touch the database
+	switch app.cmd {
+	case "config":
+		return app.configCmd()
+	case "verify":
+		return app.verify()
+	}
+
+	storage := repo.GetStorageWithConfig(app.config.Database.Path, app.config)
 
 	switch app.cmd {
 	case "scan":
@@ -85,6 +127,33 @@ func (app *appEnv) run() error {
 				logger.Error("Error closing storage", "error", err)
 			}
 		}()
+		fl := flag.NewFlagSet("scan", flag.ContinueOnError)
+		metricsAddr := fl.String("metrics-addr", "", "Serve /metrics on this address while scanning, e.g. :9101")
+		if err := fl.Parse(app.args); err != nil {
+			return err
+		}
+		libraries, err := app.scanTargets(fl.Args())
+		if err != nil {
+			return err
+		}
+		if *metricsAddr != "" {
+			metrics.RegisterDBStats(storage.Stats)
+			serveScanMetrics(*metricsAddr)
+		}
+
+		// Rescanning replaces the libraries' books; other libraries are
+		// untouched. The deletes need the indexes and must precede the
+		// cache, which would otherwise keep the IDs of deleted authors.
+		for _, lib := range libraries {
+			n, err := storage.DeleteLibraryBooks(lib.Name)
+			if err != nil {
+				return fmt.Errorf("clear library %s: %w", lib.Name, err)
+			}
+			if n > 0 {
+				logger.Info("Removed previously scanned books", "library", lib.Name, "books", n)
+			}
+		}
+
 		// Prepare for fast scan
 		if err := storage.InitCache(); err != nil {
 			logger.Warn("Failed to initialize cache", "error", err)
@@ -105,8 +174,11 @@ func (app *appEnv) run() error {
 			logger.Info("Indexes dropped for performance")
 		}
 
-		if err := scanner.ScanLibrary(app.libraryPath, storage, app.config.Database.BatchSize); err != nil {
-			return err
+		for _, lib := range libraries {
+			logger.Info("Scanning library", "library", lib.Name, "path", lib.Path)
+			if err := scanner.ScanLibrary(lib.Name, lib.Path, storage, app.config.Database.BatchSize); err != nil {
+				return fmt.Errorf("scan library %s: %w", lib.Name, err)
+			}
 		}
 
 		logger.Info("Recreating indexes...")
@@ -139,8 +211,10 @@ func (app *appEnv) run() error {
 			logger.Warn("Failed to checkpoint WAL", "error", err)
 		}
 	case "serve":
+		metrics.RegisterDBStats(storage.Stats)
 		app.storage = storage
-		app.service = service.New(storage)
+		registerFormats(app.config.Conversion.Backends)
+		app.service = service.NewWithConfig(storage, app.config)
 		app.serve()
 	case "init":
 		defer func() {
@@ -157,18 +231,175 @@ func (app *appEnv) run() error {
 		if err := storage.RebuildFTSIndex(); err != nil {
 			return err
 		}
+	case "relocate":
+		defer func() {
+			if err := storage.Close(); err != nil {
+				logger.Error("Error closing storage", "error", err)
+			}
+		}()
+		return app.relocate(storage)
 	default:
 		return fmt.Errorf("unknown command %s", app.cmd)
 	}
 	return nil
 }
 
+// registerFormats registers the formats that only configured backends
+// convert to, so that they are offered for download. It runs once, before
+// any service is created.
+func registerFormats(backends []config.BackendConfig) {
+	for _, bc := range backends {
+		if _, ok := converter.LookupFormat(bc.Format); ok {
+			continue
+		}
+		title, contentType := bc.Title, bc.ContentType
+		if title == "" {
+			title = strings.ToUpper(bc.Format)
+		}
+		if contentType == "" {
+			contentType = mime.TypeByExtension("." + bc.Format)
+		}
+		if contentType == "" {
+			contentType = "application/octet-stream"
+		}
+		converter.RegisterFormat(converter.Format{Name: bc.Format, Title: title, ContentType: contentType})
+	}
+}
+
+// configCmd handles "bopds config print", which writes the effective
+// configuration after the config file, environment and flags are applied
+func (app *appEnv) configCmd() error {
+	if len(app.args) != 1 || app.args[0] != "print" {
+		return fmt.Errorf("usage: bopds config print")
+	}
+	out, err := app.config.Marshal()
+	if err != nil {
+		return fmt.Errorf("marshal config: %w", err)
+	}
+	_, err = os.Stdout.Write(out)
+	return err
+}
+
+// verify handles "bopds verify [library...]", which lists the library
+// archives whose books cannot be extracted natively, e.g. 7z archives using a
+// compression method without a Go decoder, and fails if there are any
+func (app *appEnv) verify() error {
+	libraries, err := app.scanTargets(app.args)
+	if err != nil {
+		return err
+	}
+	var checked, failed int
+	for _, lib := range libraries {
+		err := filepath.WalkDir(lib.Path, func(path string, d fs.DirEntry, err error) error {
+			if err != nil {
+				return err
+			}
+			if d.IsDir() || !converter.IsArchive(path) {
+				return nil
+			}
+			checked++
+			if err := converter.CheckArchive(path); err != nil {
+				failed++
+				rel, _ := filepath.Rel(lib.Path, path)
+				fmt.Printf("%s: %s: %v\n", lib.Name, rel, err)
+			}
+			return nil
+		})
+		if err != nil {
+			return fmt.Errorf("verify library %s: %w", lib.Name, err)
+		}
+	}
+	logger.Info("Archives verified", "archives", checked, "unreadable", failed)
+	if failed > 0 {
+		return fmt.Errorf("%d of %d archives cannot be read natively", failed, checked)
+	}
+	return nil
+}
+
+// scanTargets returns the libraries named on the scan command line, or every
+// configured library when none are given
+func (app *appEnv) scanTargets(names []string) ([]config.LibraryConfig, error) {
+	if len(names) == 0 {
+		return app.config.Libraries, nil
+	}
+	libraries := make([]config.LibraryConfig, 0, len(names))
+	for _, name := range names {
+		lib, ok := app.config.FindLibrary(name)
+		if !ok {
+			return nil, fmt.Errorf("unknown library %q (configured: %s)", name, strings.Join(app.config.LibraryNames(), ", "))
+		}
+		libraries = append(libraries, lib)
+	}
+	return libraries, nil
+}
+
+// serveScanMetrics exposes scanner progress for the lifetime of a scan run,
+// which happens outside the HTTP server
+func serveScanMetrics(addr string) {
+	mux := http.NewServeMux()
+	mux.Handle("GET /metrics", metrics.Handler())
+	go func() {
+		logger.Info("Serving scan metrics", "addr", addr)
+		if err := http.ListenAndServe(addr, mux); err != nil {
+			logger.Error("Scan metrics server error", "error", err)
+		}
+	}()
+}
+
+// relocate rewrites archive paths recorded under an old library root so they
+// resolve against the configured library, e.g. after scanning on the host and
+// serving from a container mount
+func (app *appEnv) relocate(storage *repo.Repo) error {
+	fl := flag.NewFlagSet("relocate", flag.ContinueOnError)
+	from := fl.String("from", "", "Library root the archives were scanned under")
+	library := fl.String("library", app.config.DefaultLibrary().Name, "Library the archives belong to")
+	if err := fl.Parse(app.args); err != nil {
+		return err
+	}
+	if *from == "" {
+		return fmt.Errorf("relocate: -from is required")
+	}
+	if _, ok := app.config.FindLibrary(*library); !ok {
+		return fmt.Errorf("relocate: unknown library %q", *library)
+	}
+
+	n, err := storage.RelocateArchives(*from, *library)
+	if err != nil {
+		return err
+	}
+	logger.Info("Archive paths relocated", "from", *from, "library", *library, "rows", n)
+	return nil
+}
+
 func (app *appEnv) serve() {
 	// Create shutdown context with timeout
 	shutdownCtx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
 	defer cancel()
 	app.shutdownCtx = shutdownCtx
 
+	shutdownTracing, err := tracing.Init(context.Background(), app.config.Tracing)
+	if err != nil {
+		logger.Error("Failed to initialize tracing", "error", err)
+		return
+	}
+	defer func() {
+		// Flush spans still buffered by the exporter
+		if err := shutdownTracing(shutdownCtx); err != nil {
+			logger.Error("Tracing shutdown error", "error", err)
+		}
+	}()
+	if app.config.Tracing.Enabled {
+		logger.Info("Tracing enabled", "endpoint", app.config.Tracing.Endpoint, "sample_ratio", app.config.Tracing.SampleRatio)
+	}
+
+	// Conversion jobs run until shutdown; unfinished ones resume on next start
+	jobsCtx, stopJobs := context.WithCancel(context.Background())
+	defer stopJobs()
+	if err := app.service.StartJobs(jobsCtx); err != nil {
+		logger.Error("Failed to start conversion jobs", "error", err)
+		return
+	}
+
 	// Create server
 	srv := &http.Server{
 		Addr:    fmt.Sprintf(":%d", app.config.Server.Port),
@@ -208,6 +439,8 @@ func (app *appEnv) serve() {
 		if err := srv.Shutdown(shutdownCtx); err != nil {
 			logger.Error("Server shutdown error", "error", err)
 		}
+		stopJobs()
+		app.service.WaitJobs()
 
 		// Close database connection
 		logger.Info("Closing database connection...")
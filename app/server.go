@@ -16,7 +16,7 @@ type Server struct {
 func NewServer(libraryPath string, storage *repo.Repo, cfg *config.Config) *Server {
 	return &Server{
 		storage:     storage,
-		service:     service.New(storage),
+		service:     service.NewWithConfig(storage, cfg),
 		config:      cfg,
 		libraryPath: libraryPath,
 	}
@@ -32,8 +32,10 @@ type Book struct {
 	Title    string   `xml:"http://www.gribuser.ru/xml/fictionbook/2.0 book-title"`
 	Lang     string   `xml:"lang"`
 	Genres   []string `xml:""`
-	Archive  string
+	Archive  string   // path relative to the library root
 	FileName string
+	Library  string `json:"library,omitempty"` // name of the library root holding Archive
+	Format   string `json:"format,omitempty"`  // format the book is stored in, e.g. "fb2" or "pdf"
 
 	// ===== NEW FIELDS FROM INPX =====
 	FileSize  int64       `json:"file_size,omitempty"`  // flSize
@@ -52,11 +54,42 @@ type SeriesInfo struct {
 	SeriesNo int    `json:"series_no,omitempty"`
 }
 
+// SeriesWithBookCount represents a series with the number of books in it
+type SeriesWithBookCount struct {
+	ID        int64  `json:"series_id"`
+	Name      string `json:"name"`
+	BookCount int    `json:"book_count"`
+}
+
+// Prefix is a name prefix with the number of authors, titles or series
+// starting with it
+type Prefix struct {
+	Prefix string `json:"prefix"`
+	Count  int    `json:"count"`
+	// Leaf is set when the entries starting with the prefix are listed
+	// rather than drilled into by longer prefixes
+	Leaf bool `json:"leaf"`
+}
+
 // Genre represents a genre (for queries)
 type Genre struct {
-	ID          int64  `json:"genre_id"`
-	Name        string `json:"name"`
-	DisplayName string `json:"display_name,omitempty"`
+	ID           int64  `json:"genre_id"`
+	Name         string `json:"name"`
+	DisplayName  string `json:"display_name,omitempty"`
+	TranslitName string `json:"translit_name,omitempty"`
+	Category     string `json:"category,omitempty"` // name of the genre's category
+	BookCount    int    `json:"book_count"`
+}
+
+// GenreCategory is a top-level group of genres, e.g. all of science
+// fiction and fantasy
+type GenreCategory struct {
+	ID           int64  `json:"category_id"`
+	Name         string `json:"name"`
+	DisplayName  string `json:"display_name,omitempty"`
+	TranslitName string `json:"translit_name,omitempty"`
+	GenreCount   int    `json:"genre_count"`
+	BookCount    int    `json:"book_count"`
 }
 
 // Keyword represents a keyword (for queries)
@@ -79,7 +112,9 @@ type BookSearchResult struct {
 	Author     string   `json:"author"`
 	Lang       string   `json:"lang,omitempty"`
 	Archive    string   `json:"archive,omitempty"`
+	Library    string   `json:"library,omitempty"`
 	FileName   string   `json:"filename,omitempty"`
+	Format     string   `json:"format,omitempty"`
 	Rank       float64  `json:"rank"` // FTS5 relevance score (higher = more relevant)
 	SeriesName string   `json:"series_name,omitempty"`
 	SeriesNo   int      `json:"series_no,omitempty"`
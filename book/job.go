@@ -0,0 +1,40 @@
+package book
+
+import "time"
+
+// Job statuses
+const (
+	JobQueued  = "queued"
+	JobRunning = "running"
+	JobDone    = "done"
+	JobFailed  = "failed"
+)
+
+// Job kinds
+const (
+	JobConvert = "convert" // convert a book to another format
+	JobSend    = "send"    // convert a book and e-mail it to a user
+)
+
+// Job is a background task that survives server restarts
+type Job struct {
+	ID         int64     `json:"id"`
+	Kind       string    `json:"kind"`
+	BookID     int64     `json:"book_id"`
+	Format     string    `json:"format"`
+	Profile    string    `json:"profile,omitempty"` // conversion profile; empty for the defaults
+	Status     string    `json:"status"`
+	Progress   int       `json:"progress"` // percent
+	Error      string    `json:"error,omitempty"`
+	ResultPath string    `json:"-"`                  // file holding the result of a finished job
+	FileName   string    `json:"filename,omitempty"` // download name of the result
+	Recipient  string    `json:"-"`                  // e-mail address of a send job
+	Attempts   int       `json:"attempts,omitempty"` // failed deliveries of a send job
+	CreatedAt  time.Time `json:"created_at"`
+	UpdatedAt  time.Time `json:"updated_at"`
+}
+
+// Finished reports whether the job will not change any more
+func (j *Job) Finished() bool {
+	return j.Status == JobDone || j.Status == JobFailed
+}
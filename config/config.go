@@ -1,71 +1,673 @@
 package config
 
 import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"net/mail"
 	"os"
+	"path/filepath"
+	"slices"
 	"strconv"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v3"
 )
 
+// Config is the effective server configuration. It is built in layers:
+// built-in defaults, then the optional config file, then environment
+// variables; command line flags are applied on top by the caller.
 type Config struct {
-	Server   ServerConfig
-	Database DatabaseConfig
-	Library  LibraryConfig
-	LogLevel string
+	Server       ServerConfig       `yaml:"server" toml:"server"`
+	Database     DatabaseConfig     `yaml:"database" toml:"database"`
+	Libraries    []LibraryConfig    `yaml:"libraries" toml:"libraries"`
+	Archives     ArchivesConfig     `yaml:"archives" toml:"archives"`
+	Tracing      TracingConfig      `yaml:"tracing" toml:"tracing"`
+	RateLimit    RateLimitConfig    `yaml:"rate_limit" toml:"rate_limit"`
+	Conversion   ConversionConfig   `yaml:"conversion" toml:"conversion"`
+	BulkDownload BulkDownloadConfig `yaml:"bulk_download" toml:"bulk_download"`
+	Mail         MailConfig         `yaml:"mail" toml:"mail"`
+	Catalog      CatalogConfig      `yaml:"catalog" toml:"catalog"`
+	Genres       GenresConfig       `yaml:"genres" toml:"genres"`
+	LogLevel     string             `yaml:"log_level" toml:"log_level"`
 }
 
 type ServerConfig struct {
-	Port         int
-	ReadTimeout  int // seconds
-	WriteTimeout int // seconds
-	IdleTimeout  int // seconds
+	Port         int `yaml:"port" toml:"port"`
+	ReadTimeout  int `yaml:"read_timeout" toml:"read_timeout"`   // seconds
+	WriteTimeout int `yaml:"write_timeout" toml:"write_timeout"` // seconds
+	IdleTimeout  int `yaml:"idle_timeout" toml:"idle_timeout"`   // seconds
 }
 
 type DatabaseConfig struct {
-	Path            string
-	MaxOpenConns    int
-	MaxIdleConns    int
-	ConnMaxLifetime int // seconds
-	BatchSize       int
+	Path            string `yaml:"path" toml:"path"`
+	MaxOpenConns    int    `yaml:"max_open_conns" toml:"max_open_conns"`
+	MaxIdleConns    int    `yaml:"max_idle_conns" toml:"max_idle_conns"`
+	ConnMaxLifetime int    `yaml:"conn_max_lifetime" toml:"conn_max_lifetime"` // seconds
+	BatchSize       int    `yaml:"batch_size" toml:"batch_size"`
+}
+
+// ArchivesConfig sizes the pool of library archives kept open for
+// extraction and the cache of decompressed 7z files
+type ArchivesConfig struct {
+	MaxOpen        int `yaml:"max_open" toml:"max_open"`                 // 0 closes archives after every extraction
+	IdleTimeout    int `yaml:"idle_timeout" toml:"idle_timeout"`         // seconds an unused archive stays open
+	BlockCacheSize int `yaml:"block_cache_size" toml:"block_cache_size"` // MiB of decompressed 7z files; 0 disables the cache
+}
+
+// TracingConfig controls OpenTelemetry trace export over OTLP/HTTP.
+// When Endpoint is empty the standard OTEL_EXPORTER_OTLP_* variables apply.
+type TracingConfig struct {
+	Enabled     bool    `yaml:"enabled" toml:"enabled"`
+	Endpoint    string  `yaml:"endpoint" toml:"endpoint"` // host:port of the collector
+	Insecure    bool    `yaml:"insecure" toml:"insecure"` // plain HTTP instead of HTTPS
+	SampleRatio float64 `yaml:"sample_ratio" toml:"sample_ratio"`
+}
+
+// RateLimitConfig controls request rate limits, download quotas and the cap
+// on concurrent conversions. Clients are identified by IP address and, when a
+// reverse proxy authenticates them, by user name.
+type RateLimitConfig struct {
+	Enabled bool `yaml:"enabled" toml:"enabled"` // token buckets and quotas; the conversion cap always applies
+	// UserHeader names the request header carrying the user authenticated
+	// by a reverse proxy; set it only behind a proxy that strips or
+	// overwrites the header, as clients could claim any name otherwise.
+	// Without it clients are identified by IP only.
+	UserHeader string `yaml:"user_header" toml:"user_header"`
+	// TrustForwardedFor takes the client IP from X-Forwarded-For; enable only
+	// behind a reverse proxy that sets it
+	TrustForwardedFor bool `yaml:"trust_forwarded_for" toml:"trust_forwarded_for"`
+
+	OPDS     RouteLimitConfig `yaml:"opds" toml:"opds"`
+	API      RouteLimitConfig `yaml:"api" toml:"api"`
+	Download RouteLimitConfig `yaml:"download" toml:"download"`
+
+	// DailyDownloadQuota caps downloads per user (or IP for anonymous
+	// clients) per UTC day, counting each book of a bulk download; 0
+	// disables the quota
+	DailyDownloadQuota int `yaml:"daily_download_quota" toml:"daily_download_quota"`
+
+	MaxConcurrentConversions int `yaml:"max_concurrent_conversions" toml:"max_concurrent_conversions"` // 0 means one per CPU
+	ConversionQueueSize      int `yaml:"conversion_queue_size" toml:"conversion_queue_size"`           // requests allowed to wait for a slot
+	ConversionQueueTimeout   int `yaml:"conversion_queue_timeout" toml:"conversion_queue_timeout"`     // seconds a request may wait
+}
+
+// RouteLimitConfig holds token bucket parameters for one route group.
+// A rate of 0 disables that limit.
+type RouteLimitConfig struct {
+	IPRate    float64 `yaml:"ip_rate" toml:"ip_rate"` // requests per second
+	IPBurst   int     `yaml:"ip_burst" toml:"ip_burst"`
+	UserRate  float64 `yaml:"user_rate" toml:"user_rate"` // requests per second
+	UserBurst int     `yaml:"user_burst" toml:"user_burst"`
+}
+
+// ConversionConfig sizes the worker pool that runs FB2 conversions and
+// controls where asynchronous conversion jobs keep their results
+type ConversionConfig struct {
+	Workers int    `yaml:"workers" toml:"workers"`   // 0 means one per CPU
+	Timeout int    `yaml:"timeout" toml:"timeout"`   // seconds a single conversion may run
+	JobsDir string `yaml:"jobs_dir" toml:"jobs_dir"` // directory holding finished job results
+	JobTTL  int    `yaml:"job_ttl" toml:"job_ttl"`   // seconds a finished job and its result are kept
+
+	// Backends are external commands converting to a format. The commands
+	// configured for a format are tried in order, followed by the built-in
+	// converter when there is one.
+	Backends []BackendConfig `yaml:"backends" toml:"backends"`
+
+	// Profiles are named sets of conversion options, chosen with the
+	// profile query parameter. DefaultProfile applies when none is given and
+	// UserProfiles sets per-user defaults, keyed by user name.
+	Profiles       []ProfileConfig   `yaml:"profiles" toml:"profiles"`
+	DefaultProfile string            `yaml:"default_profile" toml:"default_profile"`
+	UserProfiles   map[string]string `yaml:"user_profiles" toml:"user_profiles"`
+}
+
+// ProfileConfig is a named set of conversion options
+type ProfileConfig struct {
+	Name        string   `yaml:"name" toml:"name"`
+	NoCover     bool     `yaml:"no_cover" toml:"no_cover"`         // drop the cover image
+	InlineNotes bool     `yaml:"inline_notes" toml:"inline_notes"` // notes in the text instead of at the end
+	Hyphenation bool     `yaml:"hyphenation" toml:"hyphenation"`   // EPUB and HTML only
+	Fonts       []string `yaml:"fonts" toml:"fonts"`               // .ttf, .otf, .woff or .woff2 files to embed; EPUB and HTML only
+}
+
+// BackendConfig is an external conversion command for one output format.
+// The arguments {input} and {output} are replaced with the FB2 source and
+// the file the command must write.
+type BackendConfig struct {
+	Format  string   `yaml:"format" toml:"format"`
+	Command []string `yaml:"command" toml:"command"`
+	// Title and ContentType describe formats without a built-in converter;
+	// they default to the upper-cased name and the type of the extension
+	Title       string `yaml:"title" toml:"title"`
+	ContentType string `yaml:"content_type" toml:"content_type"`
+}
+
+// BulkDownloadConfig limits the ZIP archives of an author's or a series'
+// books. MaxSize caps the bytes written per archive; requests whose books'
+// source files already exceed it are refused up front.
+type BulkDownloadConfig struct {
+	MaxSize int `yaml:"max_size" toml:"max_size"` // MiB; 0 is unlimited
+}
+
+// MailConfig configures delivering books by e-mail, e.g. to a Kindle's
+// Send to Kindle address. Sending is disabled while Host is empty.
+type MailConfig struct {
+	Host     string `yaml:"host" toml:"host"`
+	Port     int    `yaml:"port" toml:"port"`
+	Username string `yaml:"username" toml:"username"` // SMTP AUTH PLAIN; empty skips authentication
+	Password string `yaml:"password" toml:"password"`
+	From     string `yaml:"from" toml:"from"`
+	TLS      string `yaml:"tls" toml:"tls"` // starttls, tls (implicit) or none
+
+	MaxAttempts int `yaml:"max_attempts" toml:"max_attempts"` // deliveries tried before a job fails
+	RetryDelay  int `yaml:"retry_delay" toml:"retry_delay"`   // seconds before the first retry, doubled after each attempt
+
+	// Recipients maps user names, as identified by rate_limit.user_header,
+	// to where their books are sent
+	Recipients map[string]RecipientConfig `yaml:"recipients" toml:"recipients"`
 }
 
+// RecipientConfig is a user's delivery address and the format they receive
+type RecipientConfig struct {
+	Address string `yaml:"address" toml:"address"`
+	Format  string `yaml:"format" toml:"format"` // defaults to epub
+}
+
+// CatalogConfig controls how the catalog presents itself. Language is used
+// when a client asks for none with the lang parameter or Accept-Language.
+// BookLanguages limits OPDS feeds to books in those languages unless the URL
+// names others under /opds/lang/{lang}; UserBookLanguages sets per-user
+// limits, keyed by user name. No languages list books in every language.
+type CatalogConfig struct {
+	Title             string              `yaml:"title" toml:"title"`       // empty uses the localized default title
+	Language          string              `yaml:"language" toml:"language"` // en or ru
+	BookLanguages     []string            `yaml:"book_languages" toml:"book_languages"`
+	UserBookLanguages map[string][]string `yaml:"user_book_languages" toml:"user_book_languages"`
+}
+
+// CatalogLanguages are the languages the catalog can be presented in. They
+// must match the translations of the i18n package, which tests check.
+var CatalogLanguages = []string{"en", "ru"}
+
+// GenresConfig lists files placing genre codes under top-level genre
+// categories, adding to or overriding the built-in placement. Files are
+// YAML, or TOML when named *.toml; later files override earlier ones.
+type GenresConfig struct {
+	MappingFiles []string `yaml:"mapping_files" toml:"mapping_files"`
+}
+
+// DefaultLibraryName is the name given to the library root when none is configured
+const DefaultLibraryName = "default"
+
+// LibraryConfig describes a named library root. Archive paths are stored in
+// the database relative to the root, so the same database can be served from
+// a different mount point by changing Path.
 type LibraryConfig struct {
-	Path string
+	Name string `yaml:"name" toml:"name"`
+	Path string `yaml:"path" toml:"path"`
 }
 
-// Load creates a new Config from environment variables with defaults
-func Load() *Config {
+// Default returns the built-in configuration used when neither a config file
+// nor environment variables override a setting
+func Default() *Config {
 	return &Config{
 		Server: ServerConfig{
-			Port:         getEnvInt("PORT", 3001),
-			ReadTimeout:  getEnvInt("READ_TIMEOUT", 15),
-			WriteTimeout: getEnvInt("WRITE_TIMEOUT", 15),
-			IdleTimeout:  getEnvInt("IDLE_TIMEOUT", 60),
+			Port:         3001,
+			ReadTimeout:  15,
+			WriteTimeout: 15,
+			IdleTimeout:  60,
 		},
 		Database: DatabaseConfig{
-			Path:            getEnv("DB_PATH", "books.db"),
-			MaxOpenConns:    getEnvInt("DB_MAX_OPEN_CONNS", 25),
-			MaxIdleConns:    getEnvInt("DB_MAX_IDLE_CONNS", 25),
-			ConnMaxLifetime: getEnvInt("DB_CONN_MAX_LIFETIME", 300),
-			BatchSize:       getEnvInt("DB_BATCH_SIZE", 1000),
+			Path:            "books.db",
+			MaxOpenConns:    25,
+			MaxIdleConns:    25,
+			ConnMaxLifetime: 300,
+			BatchSize:       1000,
+		},
+		Libraries: []LibraryConfig{{Name: DefaultLibraryName, Path: "./lib"}},
+		Archives: ArchivesConfig{
+			MaxOpen:     32,
+			IdleTimeout: 300,
+		},
+		Tracing: TracingConfig{
+			SampleRatio: 1,
+		},
+		RateLimit: RateLimitConfig{
+			OPDS:                   RouteLimitConfig{IPRate: 10, IPBurst: 30, UserRate: 10, UserBurst: 30},
+			API:                    RouteLimitConfig{IPRate: 20, IPBurst: 50, UserRate: 20, UserBurst: 50},
+			Download:               RouteLimitConfig{IPRate: 1, IPBurst: 5, UserRate: 1, UserBurst: 5},
+			ConversionQueueSize:    16,
+			ConversionQueueTimeout: 30,
+		},
+		Conversion: ConversionConfig{
+			Timeout: 120,
+			JobsDir: "jobs",
+			JobTTL:  86400,
 		},
-		Library: LibraryConfig{
-			Path: getEnv("LIBRARY_PATH", "./lib"),
+		BulkDownload: BulkDownloadConfig{
+			MaxSize: 512,
 		},
-		LogLevel: getEnv("LOG_LEVEL", "info"),
+		Mail: MailConfig{
+			Port:        587,
+			TLS:         "starttls",
+			MaxAttempts: 5,
+			RetryDelay:  60,
+		},
+		Catalog: CatalogConfig{
+			Language: "en",
+		},
+		LogLevel: "info",
 	}
 }
 
-func getEnv(key, defaultVal string) string {
-	if val := os.Getenv(key); val != "" {
-		return val
+// Load builds the configuration from the defaults, the config file at path
+// (skipped when path is empty) and the environment, and validates the result
+func Load(path string) (*Config, error) {
+	cfg := Default()
+	if path != "" {
+		if err := cfg.loadFile(path); err != nil {
+			return nil, err
+		}
+	}
+	if err := cfg.loadEnv(); err != nil {
+		return nil, fmt.Errorf("invalid environment:\n%w", err)
 	}
-	return defaultVal
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+	return cfg, nil
 }
 
-func getEnvInt(key string, defaultVal int) int {
-	if val := os.Getenv(key); val != "" {
-		if intVal, err := strconv.Atoi(val); err == nil {
-			return intVal
+// loadFile overlays settings from a YAML or TOML file, chosen by extension.
+// Unknown keys are rejected so that typos do not silently fall back to defaults.
+func (c *Config) loadFile(path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("read config file: %w", err)
+	}
+
+	switch ext := strings.ToLower(filepath.Ext(path)); ext {
+	case ".yaml", ".yml":
+		dec := yaml.NewDecoder(bytes.NewReader(data))
+		dec.KnownFields(true)
+		if err := dec.Decode(c); err != nil && !errors.Is(err, io.EOF) {
+			return fmt.Errorf("parse config file %s: %w", path, err)
+		}
+	case ".toml":
+		md, err := toml.Decode(string(data), c)
+		if err != nil {
+			return fmt.Errorf("parse config file %s: %w", path, err)
+		}
+		if undecoded := md.Undecoded(); len(undecoded) > 0 {
+			keys := make([]string, len(undecoded))
+			for i, key := range undecoded {
+				keys[i] = key.String()
+			}
+			return fmt.Errorf("parse config file %s: unknown keys: %s", path, strings.Join(keys, ", "))
+		}
+	default:
+		return fmt.Errorf("config file %s: unsupported format %q (use .yaml, .yml or .toml)", path, ext)
+	}
+	return nil
+}
+
+// loadEnv overlays settings from environment variables. Malformed values are
+// reported rather than ignored.
+func (c *Config) loadEnv() error {
+	var errs []error
+	envInt := func(key string, dst *int) {
+		if err := getEnvInt(key, dst); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	envBool := func(key string, dst *bool) {
+		if err := getEnvBool(key, dst); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	envFloat := func(key string, dst *float64) {
+		if err := getEnvFloat(key, dst); err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	envInt("PORT", &c.Server.Port)
+	envInt("READ_TIMEOUT", &c.Server.ReadTimeout)
+	envInt("WRITE_TIMEOUT", &c.Server.WriteTimeout)
+	envInt("IDLE_TIMEOUT", &c.Server.IdleTimeout)
+
+	getEnv("DB_PATH", &c.Database.Path)
+	envInt("DB_MAX_OPEN_CONNS", &c.Database.MaxOpenConns)
+	envInt("DB_MAX_IDLE_CONNS", &c.Database.MaxIdleConns)
+	envInt("DB_CONN_MAX_LIFETIME", &c.Database.ConnMaxLifetime)
+	envInt("DB_BATCH_SIZE", &c.Database.BatchSize)
+
+	if err := c.loadEnvLibraries(); err != nil {
+		errs = append(errs, err)
+	}
+	envInt("ARCHIVE_MAX_OPEN", &c.Archives.MaxOpen)
+	envInt("ARCHIVE_IDLE_TIMEOUT", &c.Archives.IdleTimeout)
+	envInt("ARCHIVE_BLOCK_CACHE_SIZE", &c.Archives.BlockCacheSize)
+
+	envBool("TRACING_ENABLED", &c.Tracing.Enabled)
+	getEnv("TRACING_ENDPOINT", &c.Tracing.Endpoint)
+	envBool("TRACING_INSECURE", &c.Tracing.Insecure)
+	envFloat("TRACING_SAMPLE_RATIO", &c.Tracing.SampleRatio)
+
+	envBool("RATE_LIMIT_ENABLED", &c.RateLimit.Enabled)
+	envBool("RATE_LIMIT_TRUST_FORWARDED_FOR", &c.RateLimit.TrustForwardedFor)
+	getEnv("RATE_LIMIT_USER_HEADER", &c.RateLimit.UserHeader)
+	envInt("DAILY_DOWNLOAD_QUOTA", &c.RateLimit.DailyDownloadQuota)
+	envInt("MAX_CONCURRENT_CONVERSIONS", &c.RateLimit.MaxConcurrentConversions)
+
+	envInt("CONVERSION_WORKERS", &c.Conversion.Workers)
+	envInt("CONVERSION_TIMEOUT", &c.Conversion.Timeout)
+	getEnv("CONVERSION_JOBS_DIR", &c.Conversion.JobsDir)
+	envInt("CONVERSION_JOB_TTL", &c.Conversion.JobTTL)
+
+	envInt("BULK_DOWNLOAD_MAX_SIZE", &c.BulkDownload.MaxSize)
+
+	getEnv("SMTP_HOST", &c.Mail.Host)
+	envInt("SMTP_PORT", &c.Mail.Port)
+	getEnv("SMTP_USERNAME", &c.Mail.Username)
+	getEnv("SMTP_PASSWORD", &c.Mail.Password)
+	getEnv("SMTP_FROM", &c.Mail.From)
+	getEnv("SMTP_TLS", &c.Mail.TLS)
+
+	getEnv("CATALOG_TITLE", &c.Catalog.Title)
+	getEnv("CATALOG_LANGUAGE", &c.Catalog.Language)
+	if val := os.Getenv("CATALOG_BOOK_LANGUAGES"); val != "" {
+		c.Catalog.BookLanguages = strings.Split(val, ",")
+	}
+
+	if val := os.Getenv("GENRE_MAPPING_FILES"); val != "" {
+		c.Genres.MappingFiles = strings.Split(val, ",")
+	}
+
+	getEnv("LOG_LEVEL", &c.LogLevel)
+
+	return errors.Join(errs...)
+}
+
+// loadEnvLibraries reads LIBRARIES as a comma-separated list of name=path
+// pairs, replacing the configured libraries. Otherwise LIBRARY_NAME and
+// LIBRARY_PATH override the default library.
+func (c *Config) loadEnvLibraries() error {
+	if val := os.Getenv("LIBRARIES"); val != "" {
+		var libs []LibraryConfig
+		for _, item := range strings.Split(val, ",") {
+			name, path, ok := strings.Cut(strings.TrimSpace(item), "=")
+			if !ok || name == "" || path == "" {
+				return fmt.Errorf("LIBRARIES: entry %q is not in name=path form", item)
+			}
+			libs = append(libs, LibraryConfig{Name: name, Path: path})
 		}
+		c.Libraries = libs
+		return nil
+	}
+
+	if len(c.Libraries) == 0 {
+		c.Libraries = []LibraryConfig{{Name: DefaultLibraryName}}
+	}
+	getEnv("LIBRARY_NAME", &c.Libraries[0].Name)
+	getEnv("LIBRARY_PATH", &c.Libraries[0].Path)
+	return nil
+}
+
+// Validate checks that every setting is usable and reports all problems at once
+func (c *Config) Validate() error {
+	var errs []error
+	check := func(ok bool, format string, args ...any) {
+		if !ok {
+			errs = append(errs, fmt.Errorf(format, args...))
+		}
+	}
+
+	check(c.Server.Port > 0 && c.Server.Port <= 65535, "server.port: must be between 1 and 65535, got %d", c.Server.Port)
+	check(c.Server.ReadTimeout >= 0, "server.read_timeout: must not be negative, got %d", c.Server.ReadTimeout)
+	check(c.Server.WriteTimeout >= 0, "server.write_timeout: must not be negative, got %d", c.Server.WriteTimeout)
+	check(c.Server.IdleTimeout >= 0, "server.idle_timeout: must not be negative, got %d", c.Server.IdleTimeout)
+
+	check(c.Database.Path != "", "database.path: must not be empty")
+	check(c.Database.MaxOpenConns > 0, "database.max_open_conns: must be positive, got %d", c.Database.MaxOpenConns)
+	check(c.Database.MaxIdleConns >= 0, "database.max_idle_conns: must not be negative, got %d", c.Database.MaxIdleConns)
+	check(c.Database.ConnMaxLifetime >= 0, "database.conn_max_lifetime: must not be negative, got %d", c.Database.ConnMaxLifetime)
+	check(c.Database.BatchSize > 0, "database.batch_size: must be positive, got %d", c.Database.BatchSize)
+
+	check(len(c.Libraries) > 0, "libraries: at least one library is required")
+	seen := make(map[string]bool, len(c.Libraries))
+	for i, lib := range c.Libraries {
+		check(lib.Name != "", "libraries[%d].name: must not be empty", i)
+		check(!strings.ContainsAny(lib.Name, "/?#,="), "libraries[%d].name: %q must not contain '/', '?', '#', ',' or '='", i, lib.Name)
+		check(!seen[lib.Name], "libraries[%d].name: duplicate library %q", i, lib.Name)
+		check(lib.Path != "", "libraries[%d].path: must not be empty", i)
+		seen[lib.Name] = true
+	}
+
+	check(c.Archives.MaxOpen >= 0, "archives.max_open: must not be negative, got %d", c.Archives.MaxOpen)
+	check(c.Archives.IdleTimeout > 0, "archives.idle_timeout: must be positive, got %d", c.Archives.IdleTimeout)
+	check(c.Archives.BlockCacheSize >= 0, "archives.block_cache_size: must not be negative, got %d", c.Archives.BlockCacheSize)
+
+	check(c.Tracing.SampleRatio >= 0 && c.Tracing.SampleRatio <= 1, "tracing.sample_ratio: must be between 0 and 1, got %g", c.Tracing.SampleRatio)
+
+	for _, g := range []struct {
+		group string
+		limit RouteLimitConfig
+	}{
+		{"opds", c.RateLimit.OPDS},
+		{"api", c.RateLimit.API},
+		{"download", c.RateLimit.Download},
+	} {
+		group, limit := g.group, g.limit
+		check(limit.IPRate >= 0, "rate_limit.%s.ip_rate: must not be negative, got %g", group, limit.IPRate)
+		check(limit.IPRate == 0 || limit.IPBurst > 0, "rate_limit.%s.ip_burst: must be positive when ip_rate is set, got %d", group, limit.IPBurst)
+		check(limit.UserRate >= 0, "rate_limit.%s.user_rate: must not be negative, got %g", group, limit.UserRate)
+		check(limit.UserRate == 0 || limit.UserBurst > 0, "rate_limit.%s.user_burst: must be positive when user_rate is set, got %d", group, limit.UserBurst)
+	}
+	check(c.RateLimit.DailyDownloadQuota >= 0, "rate_limit.daily_download_quota: must not be negative, got %d", c.RateLimit.DailyDownloadQuota)
+	check(c.RateLimit.MaxConcurrentConversions >= 0, "rate_limit.max_concurrent_conversions: must not be negative, got %d", c.RateLimit.MaxConcurrentConversions)
+	check(c.RateLimit.ConversionQueueSize >= 0, "rate_limit.conversion_queue_size: must not be negative, got %d", c.RateLimit.ConversionQueueSize)
+	check(c.RateLimit.ConversionQueueTimeout >= 0, "rate_limit.conversion_queue_timeout: must not be negative, got %d", c.RateLimit.ConversionQueueTimeout)
+
+	check(c.Conversion.Workers >= 0, "conversion.workers: must not be negative, got %d", c.Conversion.Workers)
+	check(c.Conversion.Timeout > 0, "conversion.timeout: must be positive, got %d", c.Conversion.Timeout)
+	check(c.Conversion.JobsDir != "", "conversion.jobs_dir: must not be empty")
+	check(c.Conversion.JobTTL > 0, "conversion.job_ttl: must be positive, got %d", c.Conversion.JobTTL)
+	for i, b := range c.Conversion.Backends {
+		check(b.Format != "" && strings.Trim(b.Format, "abcdefghijklmnopqrstuvwxyz0123456789") == "",
+			"conversion.backends[%d].format: must be a lower-case file extension, got %q", i, b.Format)
+		check(b.Format != "fb2", "conversion.backends[%d].format: fb2 is the source format", i)
+		check(len(b.Command) > 0, "conversion.backends[%d].command: must not be empty", i)
+		check(slices.ContainsFunc(b.Command, func(arg string) bool { return strings.Contains(arg, "{output}") }),
+			"conversion.backends[%d].command: must contain {output}", i)
+	}
+	profiles := make(map[string]bool, len(c.Conversion.Profiles))
+	for i, p := range c.Conversion.Profiles {
+		check(p.Name != "" && !strings.ContainsAny(p.Name, "/?#&= "), "conversion.profiles[%d].name: must be non-empty without '/', '?', '#', '&', '=' or spaces, got %q", i, p.Name)
+		check(!profiles[p.Name], "conversion.profiles[%d].name: duplicate profile %q", i, p.Name)
+		profiles[p.Name] = true
+		for _, font := range p.Fonts {
+			switch strings.ToLower(filepath.Ext(font)) {
+			case ".ttf", ".otf", ".woff", ".woff2":
+			default:
+				errs = append(errs, fmt.Errorf("conversion.profiles[%d].fonts: %q must be a .ttf, .otf, .woff or .woff2 file", i, font))
+			}
+		}
+	}
+	check(c.Conversion.DefaultProfile == "" || profiles[c.Conversion.DefaultProfile], "conversion.default_profile: unknown profile %q", c.Conversion.DefaultProfile)
+	for _, user := range slices.Sorted(maps.Keys(c.Conversion.UserProfiles)) {
+		profile := c.Conversion.UserProfiles[user]
+		check(profiles[profile], "conversion.user_profiles.%s: unknown profile %q", user, profile)
+	}
+
+	check(c.BulkDownload.MaxSize >= 0, "bulk_download.max_size: must not be negative, got %d", c.BulkDownload.MaxSize)
+
+	if c.Mail.Host != "" {
+		check(c.Mail.Port > 0 && c.Mail.Port <= 65535, "mail.port: must be between 1 and 65535, got %d", c.Mail.Port)
+		_, err := mail.ParseAddress(c.Mail.From)
+		check(err == nil, "mail.from: must be an e-mail address, got %q", c.Mail.From)
+		check(c.Mail.TLS == "starttls" || c.Mail.TLS == "tls" || c.Mail.TLS == "none", "mail.tls: must be one of starttls, tls, none, got %q", c.Mail.TLS)
+		check(c.Mail.MaxAttempts > 0, "mail.max_attempts: must be positive, got %d", c.Mail.MaxAttempts)
+		check(c.Mail.RetryDelay >= 0, "mail.retry_delay: must not be negative, got %d", c.Mail.RetryDelay)
+	}
+	for _, user := range slices.Sorted(maps.Keys(c.Mail.Recipients)) {
+		rcpt := c.Mail.Recipients[user]
+		_, err := mail.ParseAddress(rcpt.Address)
+		check(err == nil, "mail.recipients.%s.address: must be an e-mail address, got %q", user, rcpt.Address)
+		check(strings.Trim(rcpt.Format, "abcdefghijklmnopqrstuvwxyz0123456789") == "", "mail.recipients.%s.format: must be a lower-case file extension, got %q", user, rcpt.Format)
+	}
+
+	check(slices.Contains(CatalogLanguages, c.Catalog.Language), "catalog.language: must be one of %s, got %q", strings.Join(CatalogLanguages, ", "), c.Catalog.Language)
+
+	for i, lang := range c.Catalog.BookLanguages {
+		check(validBookLanguage(lang), "catalog.book_languages[%d]: must be a language code, got %q", i, lang)
+	}
+	for _, user := range slices.Sorted(maps.Keys(c.Catalog.UserBookLanguages)) {
+		for i, lang := range c.Catalog.UserBookLanguages[user] {
+			check(validBookLanguage(lang), "catalog.user_book_languages.%s[%d]: must be a language code, got %q", user, i, lang)
+		}
+	}
+
+	for i, path := range c.Genres.MappingFiles {
+		check(strings.TrimSpace(path) != "", "genres.mapping_files[%d]: must not be empty", i)
+	}
+
+	switch c.LogLevel {
+	case "debug", "info", "warn", "error":
+	default:
+		errs = append(errs, fmt.Errorf("log_level: must be one of debug, info, warn, error, got %q", c.LogLevel))
+	}
+
+	if len(errs) > 0 {
+		return fmt.Errorf("invalid configuration:\n%w", errors.Join(errs...))
+	}
+	return nil
+}
+
+// validBookLanguage reports whether lang looks like a book language code as
+// FB2 files give it, e.g. "ru" or "pt-br". "all" is reserved for URLs asking
+// for every language.
+func validBookLanguage(lang string) bool {
+	return lang != "" && lang != "all" && strings.Trim(lang, "abcdefghijklmnopqrstuvwxyz-") == ""
+}
+
+// redacted replaces secrets in printed configurations
+const redacted = "<redacted>"
+
+// Marshal renders the configuration as YAML in the config file format,
+// with secrets that are set replaced by "<redacted>"
+func (c *Config) Marshal() ([]byte, error) {
+	printed := *c
+	if printed.Mail.Password != "" {
+		printed.Mail.Password = redacted
+	}
+
+	var buf bytes.Buffer
+	enc := yaml.NewEncoder(&buf)
+	enc.SetIndent(2)
+	if err := enc.Encode(&printed); err != nil {
+		return nil, err
+	}
+	if err := enc.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// DefaultLibrary returns the first configured library, which owns books
+// recorded without a library name
+func (c *Config) DefaultLibrary() LibraryConfig {
+	if len(c.Libraries) == 0 {
+		return LibraryConfig{Name: DefaultLibraryName}
+	}
+	return c.Libraries[0]
+}
+
+// FindLibrary returns the library with the given name.
+// An empty name refers to the default library.
+func (c *Config) FindLibrary(name string) (LibraryConfig, bool) {
+	if name == "" {
+		return c.DefaultLibrary(), len(c.Libraries) > 0
+	}
+	for _, lib := range c.Libraries {
+		if lib.Name == name {
+			return lib, true
+		}
+	}
+	return LibraryConfig{}, false
+}
+
+// LibraryRoot returns the configured root directory for the named library.
+// An empty name refers to the default library.
+func (c *Config) LibraryRoot(name string) (string, bool) {
+	lib, ok := c.FindLibrary(name)
+	return lib.Path, ok
+}
+
+// Profile returns the conversion profile with the given name
+func (c *Config) Profile(name string) (ProfileConfig, bool) {
+	for _, p := range c.Conversion.Profiles {
+		if p.Name == name {
+			return p, true
+		}
+	}
+	return ProfileConfig{}, false
+}
+
+// LibraryNames returns the names of all configured libraries in order
+func (c *Config) LibraryNames() []string {
+	names := make([]string, 0, len(c.Libraries))
+	for _, lib := range c.Libraries {
+		names = append(names, lib.Name)
+	}
+	return names
+}
+
+func getEnv(key string, dst *string) {
+	if val := os.Getenv(key); val != "" {
+		*dst = val
+	}
+}
+
+func getEnvInt(key string, dst *int) error {
+	val := os.Getenv(key)
+	if val == "" {
+		return nil
+	}
+	intVal, err := strconv.Atoi(strings.TrimSpace(val))
+	if err != nil {
+		return fmt.Errorf("%s: invalid integer %q", key, val)
+	}
+	*dst = intVal
+	return nil
+}
+
+func getEnvBool(key string, dst *bool) error {
+	val := os.Getenv(key)
+	if val == "" {
+		return nil
+	}
+	boolVal, err := strconv.ParseBool(strings.TrimSpace(val))
+	if err != nil {
+		return fmt.Errorf("%s: invalid boolean %q", key, val)
+	}
+	*dst = boolVal
+	return nil
+}
+
+func getEnvFloat(key string, dst *float64) error {
+	val := os.Getenv(key)
+	if val == "" {
+		return nil
+	}
+	floatVal, err := strconv.ParseFloat(strings.TrimSpace(val), 64)
+	if err != nil {
+		return fmt.Errorf("%s: invalid number %q", key, val)
 	}
-	return defaultVal
+	*dst = floatVal
+	return nil
 }
@@ -0,0 +1,235 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func writeConfigFile(t *testing.T, name, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+		t.Fatalf("write config file: %v", err)
+	}
+	return path
+}
+
+func TestLoad_Precedence(t *testing.T) {
+	path := writeConfigFile(t, "bopds.yaml", `
+server:
+  port: 4000
+  read_timeout: 30
+database:
+  path: /data/books.db
+libraries:
+  - name: flibusta
+    path: /library/flibusta
+`)
+	t.Setenv("PORT", "5000")
+	t.Setenv("LIBRARY_PATH", "/mnt/flibusta")
+
+	cfg, err := Load(path)
+	if err != nil {
+		t.Fatalf("Load failed: %v", err)
+	}
+
+	if cfg.Server.Port != 5000 {
+		t.Errorf("expected env to override file port, got %d", cfg.Server.Port)
+	}
+	if cfg.Server.ReadTimeout != 30 {
+		t.Errorf("expected read_timeout from file, got %d", cfg.Server.ReadTimeout)
+	}
+	if cfg.Server.WriteTimeout != 15 {
+		t.Errorf("expected default write_timeout, got %d", cfg.Server.WriteTimeout)
+	}
+	if cfg.Database.Path != "/data/books.db" {
+		t.Errorf("expected database path from file, got %q", cfg.Database.Path)
+	}
+	lib := cfg.DefaultLibrary()
+	if lib.Name != "flibusta" || lib.Path != "/mnt/flibusta" {
+		t.Errorf("expected flibusta at /mnt/flibusta, got %+v", lib)
+	}
+}
+
+func TestLoad_TOML(t *testing.T) {
+	path := writeConfigFile(t, "bopds.toml", `
+log_level = "debug"
+
+[server]
+port = 4000
+
+[[libraries]]
+name = "flibusta"
+path = "/library/flibusta"
+
+[[libraries]]
+name = "personal"
+path = "/library/personal"
+`)
+
+	cfg, err := Load(path)
+	if err != nil {
+		t.Fatalf("Load failed: %v", err)
+	}
+	if cfg.Server.Port != 4000 || cfg.LogLevel != "debug" {
+		t.Errorf("unexpected config: %+v", cfg)
+	}
+	if got := strings.Join(cfg.LibraryNames(), ","); got != "flibusta,personal" {
+		t.Errorf("expected libraries flibusta,personal, got %s", got)
+	}
+}
+
+func TestLoad_Errors(t *testing.T) {
+	tests := []struct {
+		name      string
+		file      string
+		content   string
+		env       map[string]string
+		expectErr string
+	}{
+		{
+			name:      "unknown yaml key",
+			file:      "bopds.yaml",
+			content:   "server:\n  prot: 4000\n",
+			expectErr: "field prot not found",
+		},
+		{
+			name:      "unknown toml key",
+			file:      "bopds.toml",
+			content:   "[server]\nprot = 4000\n",
+			expectErr: "unknown keys: server.prot",
+		},
+		{
+			name:      "unsupported extension",
+			file:      "bopds.json",
+			content:   "{}",
+			expectErr: "unsupported format",
+		},
+		{
+			name:      "malformed env integer",
+			env:       map[string]string{"DB_BATCH_SIZE": "lots"},
+			expectErr: `DB_BATCH_SIZE: invalid integer "lots"`,
+		},
+		{
+			name:      "malformed LIBRARIES entry",
+			env:       map[string]string{"LIBRARIES": "flibusta=/a,personal"},
+			expectErr: "not in name=path form",
+		},
+		{
+			name:      "out of range port",
+			env:       map[string]string{"PORT": "70000"},
+			expectErr: "server.port: must be between 1 and 65535",
+		},
+		{
+			name:      "duplicate library",
+			env:       map[string]string{"LIBRARIES": "a=/a,a=/b"},
+			expectErr: `duplicate library "a"`,
+		},
+		{
+			name:      "zero conversion timeout",
+			env:       map[string]string{"CONVERSION_TIMEOUT": "0"},
+			expectErr: "conversion.timeout: must be positive",
+		},
+		{
+			name:      "backend command without output",
+			file:      "bopds.yaml",
+			content:   "conversion:\n  backends:\n    - format: pdf\n      command: [ebook-convert, \"{input}\"]\n",
+			expectErr: "conversion.backends[0].command: must contain {output}",
+		},
+		{
+			name:      "unknown user profile",
+			file:      "bopds.yaml",
+			content:   "conversion:\n  profiles:\n    - name: plain\n      no_cover: true\n  user_profiles:\n    alice: large\n",
+			expectErr: `conversion.user_profiles.alice: unknown profile "large"`,
+		},
+		{
+			name:      "negative archive pool size",
+			env:       map[string]string{"ARCHIVE_MAX_OPEN": "-1"},
+			expectErr: "archives.max_open: must not be negative, got -1",
+		},
+		{
+			name:      "negative bulk download cap",
+			env:       map[string]string{"BULK_DOWNLOAD_MAX_SIZE": "-1"},
+			expectErr: "bulk_download.max_size: must not be negative, got -1",
+		},
+		{
+			name:      "mail without sender",
+			env:       map[string]string{"SMTP_HOST": "smtp.example.com"},
+			expectErr: `mail.from: must be an e-mail address, got ""`,
+		},
+		{
+			name:      "unsupported catalog language",
+			env:       map[string]string{"CATALOG_LANGUAGE": "de"},
+			expectErr: `catalog.language: must be one of en, ru, got "de"`,
+		},
+		{
+			name:      "bad book language",
+			env:       map[string]string{"CATALOG_BOOK_LANGUAGES": "ru,all"},
+			expectErr: `catalog.book_languages[1]: must be a language code, got "all"`,
+		},
+		{
+			name:      "bad user book language",
+			file:      "bopds.yaml",
+			content:   "catalog:\n  user_book_languages:\n    alice: [RU]\n",
+			expectErr: `catalog.user_book_languages.alice[0]: must be a language code, got "RU"`,
+		},
+		{
+			name:      "bad log level",
+			env:       map[string]string{"LOG_LEVEL": "verbose"},
+			expectErr: "log_level: must be one of",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for k, v := range tt.env {
+				t.Setenv(k, v)
+			}
+			path := ""
+			if tt.file != "" {
+				path = writeConfigFile(t, tt.file, tt.content)
+			}
+
+			_, err := Load(path)
+			if err == nil {
+				t.Fatalf("expected error containing %q, got none", tt.expectErr)
+			}
+			if !strings.Contains(err.Error(), tt.expectErr) {
+				t.Errorf("expected error containing %q, got %v", tt.expectErr, err)
+			}
+		})
+	}
+}
+
+func TestMarshal_RoundTrip(t *testing.T) {
+	out, err := Default().Marshal()
+	if err != nil {
+		t.Fatalf("Marshal failed: %v", err)
+	}
+	path := writeConfigFile(t, "bopds.yaml", string(out))
+
+	cfg, err := Load(path)
+	if err != nil {
+		t.Fatalf("Load of printed config failed: %v", err)
+	}
+	if cfg.Server != Default().Server || cfg.Database != Default().Database {
+		t.Errorf("round trip changed config: %+v", cfg)
+	}
+}
+
+func TestMarshal_RedactsSecrets(t *testing.T) {
+	cfg := Default()
+	cfg.Mail.Password = "hunter2"
+	out, err := cfg.Marshal()
+	if err != nil {
+		t.Fatalf("Marshal failed: %v", err)
+	}
+	if strings.Contains(string(out), "hunter2") || !strings.Contains(string(out), "password: <redacted>") {
+		t.Errorf("expected the SMTP password redacted, got\n%s", out)
+	}
+	if cfg.Mail.Password != "hunter2" {
+		t.Errorf("Marshal changed the configuration's password to %q", cfg.Mail.Password)
+	}
+}
@@ -0,0 +1,167 @@
+package converter
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"strings"
+
+	"golang.org/x/net/html"
+	"golang.org/x/net/html/charset"
+)
+
+// maxAnnotationEPUBSize caps EPUB books read into memory for their
+// annotation; larger ones are described without it
+const maxAnnotationEPUBSize = 16 << 20
+
+// ReadAnnotation returns the annotation of a book stored in format as plain
+// text, one paragraph per line: the title-info annotation of an FB2 book or
+// the description of an EPUB. Other formats have no annotation read.
+func ReadAnnotation(r io.Reader, format string) (string, error) {
+	switch format {
+	case "fb2":
+		return readFB2Annotation(r)
+	case "epub":
+		data, err := io.ReadAll(io.LimitReader(r, maxAnnotationEPUBSize+1))
+		if err != nil {
+			return "", fmt.Errorf("read EPUB: %w", err)
+		}
+		if len(data) > maxAnnotationEPUBSize {
+			return "", nil
+		}
+		return readEPUBDescription(data)
+	}
+	return "", nil
+}
+
+// readFB2Annotation reads the FB2 document up to the end of its description
+func readFB2Annotation(r io.Reader) (string, error) {
+	dec := xml.NewDecoder(r)
+	dec.CharsetReader = charset.NewReaderLabel
+	dec.Strict = false
+	dec.Entity = xml.HTMLEntity
+
+	var (
+		stack      []string
+		paragraphs []string
+		text       strings.Builder
+		inside     bool // within description/title-info/annotation
+	)
+	for {
+		tok, err := dec.Token()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return "", fmt.Errorf("parse FB2: %w", err)
+		}
+		switch t := tok.(type) {
+		case xml.StartElement:
+			stack = append(stack, t.Name.Local)
+			if len(stack) == 4 && t.Name.Local == "annotation" && stack[1] == "description" && stack[2] == "title-info" {
+				inside = true
+			}
+		case xml.CharData:
+			if inside {
+				text.Write(t)
+			}
+		case xml.EndElement:
+			if len(stack) == 0 {
+				continue
+			}
+			name := stack[len(stack)-1]
+			stack = stack[:len(stack)-1]
+			if inside && (name == "p" || name == "v" || name == "subtitle" || len(stack) == 3) {
+				if p := strings.Join(strings.Fields(text.String()), " "); p != "" {
+					paragraphs = append(paragraphs, p)
+				}
+				text.Reset()
+			}
+			if inside && len(stack) == 3 {
+				inside = false
+			}
+			if name == "description" {
+				return strings.Join(paragraphs, "\n"), nil
+			}
+		}
+	}
+	return strings.Join(paragraphs, "\n"), nil
+}
+
+// readEPUBDescription returns the dc:description of the package document,
+// which is often HTML, as text
+func readEPUBDescription(data []byte) (string, error) {
+	zr, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		return "", fmt.Errorf("open EPUB: %w", err)
+	}
+	var container struct {
+		Rootfiles []struct {
+			FullPath string `xml:"full-path,attr"`
+		} `xml:"rootfiles>rootfile"`
+	}
+	if err := decodeXMLFile(zr, "META-INF/container.xml", &container); err != nil {
+		return "", err
+	}
+	if len(container.Rootfiles) == 0 {
+		return "", fmt.Errorf("parse EPUB: no package document")
+	}
+	var opf struct {
+		Descriptions []string `xml:"metadata>description"`
+	}
+	if err := decodeXMLFile(zr, container.Rootfiles[0].FullPath, &opf); err != nil {
+		return "", err
+	}
+	if len(opf.Descriptions) == 0 {
+		return "", nil
+	}
+	return htmlText(opf.Descriptions[0]), nil
+}
+
+func decodeXMLFile(zr *zip.Reader, name string, v any) error {
+	f, err := zr.Open(name)
+	if err != nil {
+		return fmt.Errorf("parse EPUB: %w", err)
+	}
+	defer f.Close()
+	dec := xml.NewDecoder(f)
+	dec.CharsetReader = charset.NewReaderLabel
+	dec.Strict = false
+	dec.Entity = xml.HTMLEntity
+	if err := dec.Decode(v); err != nil {
+		return fmt.Errorf("parse EPUB %s: %w", name, err)
+	}
+	return nil
+}
+
+// htmlText returns the text of an HTML fragment, a line per block element
+func htmlText(s string) string {
+	var (
+		lines []string
+		line  strings.Builder
+	)
+	flush := func() {
+		if l := strings.Join(strings.Fields(line.String()), " "); l != "" {
+			lines = append(lines, l)
+		}
+		line.Reset()
+	}
+	z := html.NewTokenizer(strings.NewReader(s))
+	for {
+		switch z.Next() {
+		case html.ErrorToken:
+			flush()
+			return strings.Join(lines, "\n")
+		case html.TextToken:
+			line.Write(z.Text())
+		case html.StartTagToken, html.EndTagToken, html.SelfClosingTagToken:
+			name, _ := z.TagName()
+			switch string(name) {
+			case "p", "div", "br", "li", "h1", "h2", "h3", "h4", "h5", "h6":
+				flush()
+			}
+		}
+	}
+}
@@ -0,0 +1,49 @@
+package converter
+
+import (
+	"archive/zip"
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestReadAnnotation(t *testing.T) {
+	fb2 := strings.Replace(sampleFB2, "<lang>ru</lang>",
+		"<lang>ru</lang><annotation><p>Роман  о войне</p><empty-line/><p>и &amp; мире.</p></annotation>", 1)
+
+	var epub bytes.Buffer
+	zw := zip.NewWriter(&epub)
+	for name, content := range map[string]string{
+		"META-INF/container.xml": `<container><rootfiles><rootfile full-path="content.opf"/></rootfiles></container>`,
+		"content.opf": `<package xmlns="http://www.idpf.org/2007/opf"><metadata xmlns:dc="http://purl.org/dc/elements/1.1/">
+			<dc:description>&lt;p&gt;First &lt;b&gt;part&lt;/b&gt;&lt;/p&gt;&lt;p&gt;Second&lt;/p&gt;</dc:description></metadata></package>`,
+	} {
+		w, _ := zw.Create(name)
+		w.Write([]byte(content))
+	}
+	zw.Close()
+
+	tests := []struct {
+		name, format, data, expect string
+	}{
+		{"fb2", "fb2", fb2, "Роман о войне\nи & мире."},
+		{"fb2 without annotation", "fb2", sampleFB2, ""},
+		{"epub", "epub", epub.String(), "First part\nSecond"},
+		{"pdf", "pdf", "%PDF-1.4", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ReadAnnotation(strings.NewReader(tt.data), tt.format)
+			if err != nil {
+				t.Fatalf("read annotation: %v", err)
+			}
+			if got != tt.expect {
+				t.Errorf("expected %q, got %q", tt.expect, got)
+			}
+		})
+	}
+
+	if _, err := ReadAnnotation(strings.NewReader("not a zip"), "epub"); err == nil {
+		t.Error("expected an error for a broken EPUB")
+	}
+}
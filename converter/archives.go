@@ -0,0 +1,503 @@
+package converter
+
+import (
+	"archive/zip"
+	"bytes"
+	"container/list"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bodgit/sevenzip"
+	"github.com/htol/bopds/logger"
+	"github.com/htol/bopds/metrics"
+	"github.com/nwaples/rardecode/v2"
+)
+
+// Archives keeps recently used library archives open. Opening an archive
+// parses its whole central directory, which is slow for archives holding
+// thousands of books, so readers are pooled with an index from file name to
+// entry. Besides the archives being read, at most maxOpen unused readers are
+// kept, the least recently used closed first, and readers unused for the
+// idle timeout are closed too. An archive modified on disk is reopened.
+//
+// Solid 7z archives compress many files as one block, so extracting a file
+// decompresses every file before it in the block. With a block cache, those
+// files are kept for the requests that follow.
+type Archives struct {
+	maxOpen int
+	idle    time.Duration
+	blocks  *blockCache // nil when disabled
+
+	mu    sync.Mutex
+	open  map[string]*archive
+	lru   *list.List // of *archive, most recently used at the front
+	sweep *time.Timer
+}
+
+// archive is an open ZIP or 7z reader with its entry index
+type archive struct {
+	path    string
+	modTime time.Time
+	size    int64
+
+	ready chan struct{} // closed once opened; err is set on failure
+	err   error
+
+	zip      *zip.ReadCloser
+	zipFiles map[string]*zip.File
+	sz       *sevenzip.ReadCloser
+	szFiles  map[string]int // index into sz.File
+
+	refs     int
+	lastUsed time.Time
+	elem     *list.Element // nil once retired
+}
+
+// NewArchives creates a pool keeping up to maxOpen unused archives open,
+// closing those idle for longer than idle. blockCacheSize bytes of decompressed 7z
+// files are cached; 0 disables the cache. With maxOpen 0 every archive is
+// closed as soon as it is no longer read.
+func NewArchives(maxOpen int, idle time.Duration, blockCacheSize int64) *Archives {
+	a := &Archives{
+		maxOpen: maxOpen,
+		idle:    idle,
+		open:    make(map[string]*archive),
+		lru:     list.New(),
+	}
+	if blockCacheSize > 0 {
+		a.blocks = newBlockCache(blockCacheSize)
+	}
+	return a
+}
+
+// Close closes every archive not being read; archives being read are closed
+// when their last reader is
+func (a *Archives) Close() {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.sweep != nil {
+		a.sweep.Stop()
+		a.sweep = nil
+	}
+	for _, ar := range a.open {
+		a.retire(ar)
+	}
+}
+
+// acquire returns the open archive at path, opening it when needed. The
+// caller must release it.
+func (a *Archives) acquire(path string) (*archive, error) {
+	fi, err := os.Stat(path)
+	if err != nil {
+		return nil, fmt.Errorf("open archive: %w", err)
+	}
+
+	a.mu.Lock()
+	ar, ok := a.open[path]
+	if ok && (!ar.modTime.Equal(fi.ModTime()) || ar.size != fi.Size()) {
+		// Rewritten since it was opened, e.g. by a library update
+		a.retire(ar)
+		ok = false
+	}
+	if ok {
+		metrics.ArchiveLookups.WithLabelValues("hit").Inc()
+		ar.refs++
+		a.lru.MoveToFront(ar.elem)
+		a.mu.Unlock()
+
+		<-ar.ready
+		if ar.err != nil {
+			a.release(ar)
+			return nil, ar.err
+		}
+		return ar, nil
+	}
+
+	metrics.ArchiveLookups.WithLabelValues("miss").Inc()
+	ar = &archive{path: path, modTime: fi.ModTime(), size: fi.Size(), ready: make(chan struct{}), refs: 1}
+	ar.elem = a.lru.PushFront(ar)
+	a.open[path] = ar
+	a.mu.Unlock()
+
+	// Opening can take a while; other archives stay available meanwhile and
+	// requests for this one wait on ready
+	ar.err = ar.load()
+	close(ar.ready)
+	if ar.err != nil {
+		a.mu.Lock()
+		a.retire(ar)
+		a.mu.Unlock()
+		a.release(ar)
+		return nil, ar.err
+	}
+	metrics.ArchivesOpen.Inc()
+	return ar, nil
+}
+
+// release returns an archive obtained from acquire
+func (a *Archives) release(ar *archive) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	ar.refs--
+	ar.lastUsed = time.Now()
+	if ar.elem == nil {
+		if ar.refs == 0 {
+			ar.close()
+		}
+	} else {
+		a.lru.MoveToFront(ar.elem)
+	}
+	a.trim()
+}
+
+// trim closes the least recently used unused archives beyond maxOpen and
+// schedules closing the ones that stay idle
+func (a *Archives) trim() {
+	unused := 0
+	for e := a.lru.Front(); e != nil; {
+		next := e.Next()
+		if ar := e.Value.(*archive); ar.refs == 0 {
+			if unused++; unused > a.maxOpen {
+				a.retire(ar)
+			}
+		}
+		e = next
+	}
+	if a.idle > 0 && a.lru.Len() > 0 && a.sweep == nil {
+		a.sweep = time.AfterFunc(a.idle, a.closeIdle)
+	}
+}
+
+// closeIdle closes archives unused for the idle timeout and reschedules
+// itself while archives remain open
+func (a *Archives) closeIdle() {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.sweep = nil
+	cutoff := time.Now().Add(-a.idle)
+	for e := a.lru.Back(); e != nil; {
+		prev := e.Prev()
+		if ar := e.Value.(*archive); ar.refs == 0 && ar.lastUsed.Before(cutoff) {
+			logger.Debug("Closing idle archive", "archive", ar.path)
+			a.retire(ar)
+		}
+		e = prev
+	}
+	if a.lru.Len() > 0 {
+		a.sweep = time.AfterFunc(a.idle, a.closeIdle)
+	}
+}
+
+// retire removes ar from the pool, closing it unless it is being read.
+// a.mu must be held.
+func (a *Archives) retire(ar *archive) {
+	if ar.elem == nil {
+		return
+	}
+	a.lru.Remove(ar.elem)
+	ar.elem = nil
+	if a.open[ar.path] == ar {
+		delete(a.open, ar.path)
+	}
+	if ar.refs == 0 {
+		ar.close()
+	}
+}
+
+// load opens the archive and indexes its entries
+func (ar *archive) load() error {
+	switch archiveExt(ar.path) {
+	case ".zip":
+		r, err := zip.OpenReader(ar.path)
+		if err != nil {
+			return fmt.Errorf("open zip archive: %w", err)
+		}
+		ar.zip = r
+		ar.zipFiles = make(map[string]*zip.File, len(r.File))
+		for _, f := range r.File {
+			ar.zipFiles[f.Name] = f
+		}
+	case ".7z":
+		r, err := sevenzip.OpenReader(ar.path)
+		if err != nil {
+			return fmt.Errorf("open 7z archive: %w", err)
+		}
+		ar.sz = r
+		ar.szFiles = make(map[string]int, len(r.File))
+		for i, f := range r.File {
+			ar.szFiles[f.Name] = i
+		}
+	default:
+		return fmt.Errorf("unsupported archive format: %s", archiveExt(ar.path))
+	}
+	return nil
+}
+
+func (ar *archive) close() {
+	var err error
+	switch {
+	case ar.zip != nil:
+		err = ar.zip.Close()
+		metrics.ArchivesOpen.Dec()
+	case ar.sz != nil:
+		err = ar.sz.Close()
+		metrics.ArchivesOpen.Dec()
+	}
+	if err != nil {
+		logger.Warn("Failed to close archive", "archive", ar.path, "error", err)
+	}
+}
+
+// ErrUnsupportedCompression is returned by CheckArchive for archives using a
+// compression method, or encryption, that cannot be decoded natively
+var ErrUnsupportedCompression = errors.New("unsupported compression method")
+
+// CheckArchive reports whether every file in the archive at path can be
+// decompressed natively, without the 7z command line tool. Each compression
+// method of a ZIP archive, and each solid block of a 7z archive, is opened
+// once; opening sets up the decoders without decompressing. RAR archives are
+// checked for encryption; gzipped tar archives and books stored directly
+// need no check.
+func CheckArchive(path string) error {
+	switch archiveExt(path) {
+	case ".zip":
+		r, err := zip.OpenReader(path)
+		if err != nil {
+			return fmt.Errorf("open zip archive: %w", err)
+		}
+		defer r.Close()
+		checked := make(map[uint16]bool)
+		for _, f := range r.File {
+			if checked[f.Method] {
+				continue
+			}
+			checked[f.Method] = true
+			rc, err := f.Open()
+			if errors.Is(err, zip.ErrAlgorithm) {
+				return fmt.Errorf("%w %d: %s", ErrUnsupportedCompression, f.Method, f.Name)
+			}
+			if err != nil {
+				return fmt.Errorf("open %s: %w", f.Name, err)
+			}
+			rc.Close()
+		}
+	case ".7z":
+		r, err := sevenzip.OpenReader(path)
+		if err != nil {
+			return fmt.Errorf("open 7z archive: %w", err)
+		}
+		defer r.Close()
+		checked := make(map[int]bool)
+		for _, f := range r.File {
+			if f.UncompressedSize == 0 || checked[f.Stream] {
+				continue
+			}
+			checked[f.Stream] = true
+			rc, err := f.Open()
+			if err != nil {
+				var re *sevenzip.ReadError
+				switch {
+				case errors.As(err, &re) && re.Encrypted:
+					return fmt.Errorf("%w: %s is encrypted", ErrUnsupportedCompression, f.Name)
+				case strings.Contains(err.Error(), "unsupported compression algorithm"):
+					return fmt.Errorf("%w: %s", ErrUnsupportedCompression, f.Name)
+				}
+				return fmt.Errorf("open %s: %w", f.Name, err)
+			}
+			rc.Close()
+		}
+	case ".rar":
+		files, err := rardecode.List(path)
+		if err != nil {
+			return fmt.Errorf("open rar archive: %w", err)
+		}
+		for _, f := range files {
+			if f.Encrypted {
+				return fmt.Errorf("%w: %s is encrypted", ErrUnsupportedCompression, f.Name)
+			}
+		}
+	case ".tar.gz", ".fb2", ".epub":
+	default:
+		return fmt.Errorf("unsupported archive format: %s", archiveExt(path))
+	}
+	return nil
+}
+
+// openZIP opens filename in the ZIP archive at path
+func (a *Archives) openZIP(path, filename string) (io.ReadCloser, int64, error) {
+	ar, err := a.acquire(path)
+	if err != nil {
+		return nil, 0, err
+	}
+	f, ok := ar.zipFiles[filename]
+	if !ok {
+		a.release(ar)
+		return nil, 0, fmt.Errorf("file %s not found in archive", filename)
+	}
+	rc, err := f.Open()
+	if err != nil {
+		a.release(ar)
+		return nil, 0, fmt.Errorf("open file in archive: %w", err)
+	}
+	return a.entryReader(ar, rc), int64(f.UncompressedSize64), nil
+}
+
+// open7z opens filename in the 7z archive at path, through the block cache
+// when it is enabled
+func (a *Archives) open7z(path, filename string) (io.ReadCloser, int64, error) {
+	ar, err := a.acquire(path)
+	if err != nil {
+		return nil, 0, err
+	}
+	i, ok := ar.szFiles[filename]
+	if !ok {
+		a.release(ar)
+		return nil, 0, fmt.Errorf("file %s not found in archive", filename)
+	}
+	f := ar.sz.File[i]
+	size := int64(f.UncompressedSize)
+
+	if a.blocks != nil && a.blocks.fits(size) {
+		data, err := a.readThroughBlock(ar, i)
+		a.release(ar)
+		if err != nil {
+			return nil, 0, err
+		}
+		return io.NopCloser(bytes.NewReader(data)), size, nil
+	}
+
+	rc, err := f.Open()
+	if err != nil {
+		a.release(ar)
+		return nil, 0, fmt.Errorf("open file in archive: %w", err)
+	}
+	return a.entryReader(ar, rc), size, nil
+}
+
+// readThroughBlock returns the content of the archive's i-th file from the
+// block cache. On a miss, the uncached files before it in its block are
+// decompressed and cached along with it: reaching the file decompresses
+// them anyway.
+func (a *Archives) readThroughBlock(ar *archive, i int) ([]byte, error) {
+	files := ar.sz.File
+	key := func(f *sevenzip.File) blockKey {
+		return blockKey{archive: ar.path, modTime: ar.modTime.UnixNano(), name: f.Name}
+	}
+	if data, ok := a.blocks.get(key(files[i])); ok {
+		metrics.SevenZipBlockCache.WithLabelValues("hit").Inc()
+		return data, nil
+	}
+	metrics.SevenZipBlockCache.WithLabelValues("miss").Inc()
+
+	start := i
+	for start > 0 && files[start-1].Stream == files[i].Stream && !a.blocks.has(key(files[start-1])) {
+		start--
+	}
+	for j := start; j <= i; j++ {
+		f := files[j]
+		rc, err := f.Open()
+		if err != nil {
+			return nil, fmt.Errorf("open file in archive: %w", err)
+		}
+		if j < i && !a.blocks.fits(int64(f.UncompressedSize)) {
+			_, err = io.Copy(io.Discard, rc)
+			rc.Close()
+			if err != nil {
+				return nil, fmt.Errorf("read %s in archive: %w", f.Name, err)
+			}
+			continue
+		}
+		data, err := io.ReadAll(rc)
+		rc.Close()
+		if err != nil {
+			return nil, fmt.Errorf("read %s in archive: %w", f.Name, err)
+		}
+		a.blocks.put(key(f), data)
+		if j == i {
+			return data, nil
+		}
+	}
+	return nil, fmt.Errorf("file %s not found in archive", files[i].Name)
+}
+
+// entryReader releases ar once rc is closed
+func (a *Archives) entryReader(ar *archive, rc io.ReadCloser) io.ReadCloser {
+	var once sync.Once
+	return &readCloser{
+		ReadCloser: rc,
+		onClose:    func() { once.Do(func() { a.release(ar) }) },
+	}
+}
+
+// blockKey identifies a file in a version of an archive
+type blockKey struct {
+	archive string
+	modTime int64
+	name    string
+}
+
+// blockCache is an LRU cache of decompressed files bounded in bytes
+type blockCache struct {
+	max int64
+
+	mu    sync.Mutex
+	size  int64
+	lru   *list.List // of *blockEntry, most recently used at the front
+	items map[blockKey]*list.Element
+}
+
+type blockEntry struct {
+	key  blockKey
+	data []byte
+}
+
+func newBlockCache(max int64) *blockCache {
+	return &blockCache{max: max, lru: list.New(), items: make(map[blockKey]*list.Element)}
+}
+
+// fits reports whether a file of size is small enough to cache; a single
+// file may take at most a quarter of the cache
+func (c *blockCache) fits(size int64) bool {
+	return size <= c.max/4
+}
+
+func (c *blockCache) get(key blockKey) ([]byte, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e, ok := c.items[key]
+	if !ok {
+		return nil, false
+	}
+	c.lru.MoveToFront(e)
+	return e.Value.(*blockEntry).data, true
+}
+
+func (c *blockCache) has(key blockKey) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	_, ok := c.items[key]
+	return ok
+}
+
+func (c *blockCache) put(key blockKey, data []byte) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if e, ok := c.items[key]; ok {
+		c.lru.MoveToFront(e)
+		return
+	}
+	c.items[key] = c.lru.PushFront(&blockEntry{key: key, data: data})
+	c.size += int64(len(data))
+	for c.size > c.max {
+		e := c.lru.Back()
+		entry := e.Value.(*blockEntry)
+		c.lru.Remove(e)
+		delete(c.items, entry.key)
+		c.size -= int64(len(entry.data))
+	}
+}
@@ -0,0 +1,361 @@
+package converter
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+	"unicode/utf16"
+)
+
+// archiveEntry is a file written to a test archive
+type archiveEntry struct {
+	name, content string
+}
+
+func writeZip(t *testing.T, path string, entries ...archiveEntry) {
+	t.Helper()
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	for _, e := range entries {
+		w, err := zw.Create(e.name)
+		if err != nil {
+			t.Fatalf("create entry: %v", err)
+		}
+		io.WriteString(w, e.content)
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatalf("close archive: %v", err)
+	}
+	if err := os.WriteFile(path, buf.Bytes(), 0o644); err != nil {
+		t.Fatalf("write archive: %v", err)
+	}
+}
+
+// sevenZipBlock is the compressed block of a test 7z archive
+type sevenZipBlock struct {
+	method, props []byte
+	packed        []byte // the entries compressed with method
+}
+
+// write7z writes a solid 7z archive: every entry is in a single block, stored
+// with the Copy method when block is nil
+func write7z(t *testing.T, path string, block *sevenZipBlock, entries ...archiveEntry) {
+	t.Helper()
+	if block == nil {
+		block = &sevenZipBlock{method: []byte{0x00}}
+		for _, e := range entries {
+			block.packed = append(block.packed, e.content...)
+		}
+	}
+	packed := block.packed
+	unpacked := 0
+	for _, e := range entries {
+		unpacked += len(e.content)
+	}
+
+	number := func(v int) []byte {
+		if v < 0x80 {
+			return []byte{byte(v)}
+		}
+		if v >= 0x4000 {
+			t.Fatalf("write7z: %d is too large for the test writer", v)
+		}
+		return []byte{0x80 | byte(v>>8), byte(v)}
+	}
+	var h bytes.Buffer
+	h.Write([]byte{0x01, 0x04}) // Header, MainStreamsInfo
+	h.Write([]byte{0x06, 0x00, 0x01, 0x09})
+	h.Write(number(len(packed)))
+	h.Write([]byte{0x00})       // end of PackInfo
+	h.Write([]byte{0x07, 0x0b}) // UnPackInfo, Folder
+	if len(block.props) > 0 {
+		h.Write([]byte{0x01, 0x00, 0x01, 0x20 | byte(len(block.method))})
+		h.Write(block.method)
+		h.Write(number(len(block.props)))
+		h.Write(block.props)
+	} else {
+		h.Write([]byte{0x01, 0x00, 0x01, byte(len(block.method))})
+		h.Write(block.method)
+	}
+	h.Write([]byte{0x0c})
+	h.Write(number(unpacked))
+	h.Write([]byte{0x00})       // end of UnPackInfo
+	h.Write([]byte{0x08, 0x0d}) // SubStreamsInfo, NumUnPackStream
+	h.Write(number(len(entries)))
+	h.Write([]byte{0x09})
+	for _, e := range entries[:len(entries)-1] {
+		h.Write(number(len(e.content)))
+	}
+	h.Write([]byte{0x0a, 0x01})
+	for _, e := range entries {
+		binary.Write(&h, binary.LittleEndian, crc32.ChecksumIEEE([]byte(e.content)))
+	}
+	h.Write([]byte{0x00, 0x00}) // end of SubStreamsInfo and MainStreamsInfo
+
+	var names bytes.Buffer
+	names.WriteByte(0x00) // not external
+	for _, e := range entries {
+		for _, u := range utf16.Encode([]rune(e.name + "\x00")) {
+			binary.Write(&names, binary.LittleEndian, u)
+		}
+	}
+	h.Write([]byte{0x05})
+	h.Write(number(len(entries)))
+	h.Write([]byte{0x11})
+	h.Write(number(names.Len()))
+	h.Write(names.Bytes())
+	h.Write([]byte{0x00, 0x00}) // end of FilesInfo and Header
+
+	start := make([]byte, 20)
+	binary.LittleEndian.PutUint64(start[0:], uint64(len(packed)))
+	binary.LittleEndian.PutUint64(start[8:], uint64(h.Len()))
+	binary.LittleEndian.PutUint32(start[16:], crc32.ChecksumIEEE(h.Bytes()))
+
+	var out bytes.Buffer
+	out.Write([]byte{'7', 'z', 0xbc, 0xaf, 0x27, 0x1c, 0x00, 0x04})
+	binary.Write(&out, binary.LittleEndian, crc32.ChecksumIEEE(start))
+	out.Write(start)
+	out.Write(packed)
+	out.Write(h.Bytes())
+	if err := os.WriteFile(path, out.Bytes(), 0o644); err != nil {
+		t.Fatalf("write archive: %v", err)
+	}
+}
+
+func readEntry(t *testing.T, rc io.ReadCloser, err error) string {
+	t.Helper()
+	if err != nil {
+		t.Fatalf("open entry: %v", err)
+	}
+	defer rc.Close()
+	data, err := io.ReadAll(rc)
+	if err != nil {
+		t.Fatalf("read entry: %v", err)
+	}
+	return string(data)
+}
+
+func TestArchives_ReusesOpenArchives(t *testing.T) {
+	dir := t.TempDir()
+	first, second := filepath.Join(dir, "first.zip"), filepath.Join(dir, "second.zip")
+	writeZip(t, first, archiveEntry{"1.fb2", "one"}, archiveEntry{"2.fb2", "two"})
+	writeZip(t, second, archiveEntry{"3.fb2", "three"})
+
+	a := NewArchives(1, time.Hour, 0)
+	defer a.Close()
+
+	rc, _, err := a.openZIP(first, "1.fb2")
+	if got := readEntry(t, rc, err); got != "one" {
+		t.Errorf("expected %q, got %q", "one", got)
+	}
+	opened := a.open[first]
+	rc, size, err := a.openZIP(first, "2.fb2")
+	if got := readEntry(t, rc, err); got != "two" || size != 3 {
+		t.Errorf("expected %q of 3 bytes, got %q of %d", "two", got, size)
+	}
+	if a.open[first] != opened {
+		t.Error("the open archive was not reused")
+	}
+	if _, _, err := a.openZIP(first, "missing.fb2"); err == nil || !strings.Contains(err.Error(), "not found") {
+		t.Errorf("expected a not found error, got %v", err)
+	}
+
+	// A reader in use keeps its archive open beyond the pool size
+	held, _, err := a.openZIP(first, "1.fb2")
+	if err != nil {
+		t.Fatalf("open entry: %v", err)
+	}
+	rc, _, err = a.openZIP(second, "3.fb2")
+	readEntry(t, rc, err)
+	if a.open[first] == nil {
+		t.Fatal("an archive being read was closed")
+	}
+	if got, _ := io.ReadAll(held); string(got) != "one" {
+		t.Errorf("expected %q from the held reader, got %q", "one", got)
+	}
+	if len(a.open) != 2 {
+		t.Errorf("expected the archive being read and the last used one open, got %v", a.open)
+	}
+	held.Close()
+	held.Close() // closing twice must not release the archive twice
+	if len(a.open) != 1 || a.open[first] == nil || a.open[first].refs != 0 {
+		t.Errorf("expected only the most recently used archive to stay open, got %v", a.open)
+	}
+
+	// A rewritten archive is reopened
+	writeZip(t, first, archiveEntry{"1.fb2", "one, revised"})
+	rc, _, err = a.openZIP(first, "1.fb2")
+	if got := readEntry(t, rc, err); got != "one, revised" {
+		t.Errorf("expected the rewritten content, got %q", got)
+	}
+}
+
+func TestArchives_ClosesIdleArchives(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "books.zip")
+	writeZip(t, path, archiveEntry{"1.fb2", "one"})
+
+	a := NewArchives(10, 20*time.Millisecond, 0)
+	defer a.Close()
+	rc, _, err := a.openZIP(path, "1.fb2")
+	readEntry(t, rc, err)
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		a.mu.Lock()
+		n := len(a.open)
+		a.mu.Unlock()
+		if n == 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("idle archive was not closed")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestArchives_SevenZipBlockCache(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "books.7z")
+	entries := []archiveEntry{{"1.fb2", "first book"}, {"2.fb2", "second book"}, {"3.fb2", "third book"}}
+	write7z(t, path, nil, entries...)
+
+	for _, tt := range []struct {
+		name      string
+		cacheSize int64
+	}{
+		{"without cache", 0},
+		{"with cache", 1 << 20},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			a := NewArchives(4, time.Hour, tt.cacheSize)
+			defer a.Close()
+
+			for _, i := range []int{2, 0, 1, 2} {
+				rc, size, err := a.open7z(path, entries[i].name)
+				if got := readEntry(t, rc, err); got != entries[i].content || size != int64(len(got)) {
+					t.Errorf("%s: expected %q, got %q of %d bytes", entries[i].name, entries[i].content, got, size)
+				}
+				if i == 2 && a.blocks != nil {
+					// Reaching the last file decompressed the whole block
+					for _, e := range entries {
+						key := blockKey{archive: path, modTime: a.open[path].modTime.UnixNano(), name: e.name}
+						if !a.blocks.has(key) {
+							t.Errorf("%s was not cached", e.name)
+						}
+					}
+				}
+			}
+			if _, _, err := a.open7z(path, "missing.fb2"); err == nil {
+				t.Error("expected an error for a missing file")
+			}
+		})
+	}
+}
+
+func TestBlockCache_Evicts(t *testing.T) {
+	c := newBlockCache(8)
+	for _, name := range []string{"a", "b", "c", "d", "e"} {
+		c.put(blockKey{name: name}, []byte("xx"))
+	}
+	if c.size != 8 || c.has(blockKey{name: "a"}) || !c.has(blockKey{name: "e"}) {
+		t.Errorf("expected the oldest entry evicted, size %d", c.size)
+	}
+	if !c.fits(2) || c.fits(3) {
+		t.Error("entries are limited to a quarter of the cache")
+	}
+}
+
+// ppmdReadme is a PPMd variant H stream (order 7, 64 KiB of model memory)
+// of ppmdReadmeText, as 7-Zip stores it
+const ppmdReadme = "005001e2de412208822be4cd546b1b6367a4c13d31a177577b91d54d75d2" +
+	"48d4b9c0e7857d4fe73bab4c55863c511f860c5fb67ba0227c0ad31f1b0e" +
+	"852a78d607de7b3337db8324fcc708d05db711294a130cb7bf7784959d7c" +
+	"bdb42ad03a8abaadc54da83ea5eed5c6ea1b8f683cd0015eabbbe2524800"
+
+const ppmdReadmeText = "PPMD variant H with 7-zip extensions decompressor for go.\n" +
+	"PPMD7 in 7-zip source code.\n" +
+	"Ported to go from C# SharpCompress https://github.com/adamhathcock/sharpcompress\n"
+
+func ppmdBlock(t *testing.T) *sevenZipBlock {
+	t.Helper()
+	packed, err := hex.DecodeString(ppmdReadme)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &sevenZipBlock{
+		method: []byte{0x03, 0x04, 0x01},
+		props:  []byte{7, 0x00, 0x00, 0x01, 0x00}, // order, memory size
+		packed: packed,
+	}
+}
+
+func TestArchives_SevenZipPPMd(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "books.7z")
+	entries := []archiveEntry{{"1.fb2", ppmdReadmeText[:58]}, {"2.fb2", ppmdReadmeText[58:]}}
+	write7z(t, path, ppmdBlock(t), entries...)
+
+	a := NewArchives(4, time.Hour, 0)
+	defer a.Close()
+	for _, e := range entries {
+		rc, size, err := a.open7z(path, e.name)
+		if got := readEntry(t, rc, err); got != e.content || size != int64(len(e.content)) {
+			t.Errorf("%s: expected %q, got %q of %d bytes", e.name, e.content, got, size)
+		}
+	}
+}
+
+func TestCheckArchive(t *testing.T) {
+	dir := t.TempDir()
+	book := archiveEntry{"1.fb2", "book"}
+
+	tests := []struct {
+		name        string
+		write       func(path string)
+		unsupported bool
+	}{
+		{"zip.zip", func(path string) { writeZip(t, path, book) }, false},
+		{"deflate64.zip", func(path string) {
+			var buf bytes.Buffer
+			zw := zip.NewWriter(&buf)
+			w, err := zw.CreateRaw(&zip.FileHeader{Name: book.name, Method: 9, CompressedSize64: 4, UncompressedSize64: 4})
+			if err != nil {
+				t.Fatal(err)
+			}
+			io.WriteString(w, book.content)
+			zw.Close()
+			if err := os.WriteFile(path, buf.Bytes(), 0o644); err != nil {
+				t.Fatal(err)
+			}
+		}, true},
+		{"copy.7z", func(path string) { write7z(t, path, nil, book) }, false},
+		{"ppmd.7z", func(path string) {
+			write7z(t, path, ppmdBlock(t), archiveEntry{book.name, ppmdReadmeText})
+		}, false},
+		{"deflate64.7z", func(path string) {
+			write7z(t, path, &sevenZipBlock{method: []byte{0x04, 0x01, 0x09}, packed: []byte(book.content)}, book)
+		}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(dir, tt.name)
+			tt.write(path)
+			err := CheckArchive(path)
+			if tt.unsupported != errors.Is(err, ErrUnsupportedCompression) || (!tt.unsupported && err != nil) {
+				t.Errorf("unexpected result: %v", err)
+			}
+		})
+	}
+
+	if err := CheckArchive(filepath.Join(dir, "missing.7z")); err == nil || errors.Is(err, ErrUnsupportedCompression) {
+		t.Errorf("expected an open error for a missing archive, got %v", err)
+	}
+}
@@ -0,0 +1,132 @@
+package converter
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/htol/bopds/logger"
+	"github.com/htol/bopds/metrics"
+)
+
+// Backend converts FB2 files into one output format
+type Backend interface {
+	// Name identifies the backend in logs and metrics
+	Name() string
+	// Convert converts the FB2 file at src into the file at dst
+	Convert(ctx context.Context, src, dst string) error
+}
+
+// ConvertFunc converts the FB2 file at src into the file at dst
+type ConvertFunc func(ctx context.Context, src, dst string) error
+
+type funcBackend struct {
+	name    string
+	convert ConvertFunc
+}
+
+// NewBackend returns a Backend named name that converts with convert
+func NewBackend(name string, convert ConvertFunc) Backend {
+	return &funcBackend{name: name, convert: convert}
+}
+
+func (b *funcBackend) Name() string { return b.name }
+
+func (b *funcBackend) Convert(ctx context.Context, src, dst string) error {
+	return b.convert(ctx, src, dst)
+}
+
+// commandWaitDelay bounds how long a killed command's output pipes are
+// waited for, in case it left children holding them open
+const commandWaitDelay = 5 * time.Second
+
+// maxCommandOutput is how much of a failed command's output is kept in the error
+const maxCommandOutput = 512
+
+type commandBackend struct {
+	args []string
+}
+
+// NewCommandBackend returns a Backend running an external command such as
+// ebook-convert. The arguments {input} and {output} are replaced with the
+// source and destination paths. The command is killed when the conversion
+// is cancelled or times out.
+func NewCommandBackend(args []string) Backend {
+	return &commandBackend{args: args}
+}
+
+func (b *commandBackend) Name() string { return filepath.Base(b.args[0]) }
+
+func (b *commandBackend) Convert(ctx context.Context, src, dst string) error {
+	r := strings.NewReplacer("{input}", src, "{output}", dst)
+	args := make([]string, len(b.args))
+	for i, arg := range b.args {
+		args[i] = r.Replace(arg)
+	}
+
+	cmd := exec.CommandContext(ctx, args[0], args[1:]...)
+	cmd.WaitDelay = commandWaitDelay
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		output := strings.TrimSpace(string(out))
+		if len(output) > maxCommandOutput {
+			output = "..." + output[len(output)-maxCommandOutput:]
+		}
+		if output == "" {
+			return fmt.Errorf("%s: %w", b.Name(), err)
+		}
+		return fmt.Errorf("%s: %w: %s", b.Name(), err, output)
+	}
+	if _, err := os.Stat(dst); err != nil {
+		return fmt.Errorf("%s: no output written: %w", b.Name(), err)
+	}
+	return nil
+}
+
+type chainBackend []Backend
+
+// Chain returns a Backend trying each of backends in turn until one
+// succeeds. A cancelled or timed out conversion is not retried.
+func Chain(backends ...Backend) Backend {
+	if len(backends) == 1 {
+		return backends[0]
+	}
+	return chainBackend(backends)
+}
+
+func (c chainBackend) Name() string {
+	names := make([]string, len(c))
+	for i, b := range c {
+		names[i] = b.Name()
+	}
+	return strings.Join(names, ",")
+}
+
+func (c chainBackend) Convert(ctx context.Context, src, dst string) error {
+	var errs []error
+	for i, b := range c {
+		err := b.Convert(ctx, src, dst)
+		if err == nil {
+			return nil
+		}
+		if ctx.Err() != nil {
+			return err
+		}
+		metrics.ConversionBackendFailures.WithLabelValues(b.Name()).Inc()
+		errs = append(errs, err)
+		// Do not let the next backend see a partial output
+		os.Remove(dst)
+		if i < len(c)-1 {
+			logger.Warn("Conversion backend failed, trying next", "backend", b.Name(), "next", c[i+1].Name(), "error", err)
+		}
+	}
+	return fmt.Errorf("all conversion backends failed: %w", errors.Join(errs...))
+}
@@ -0,0 +1,224 @@
+package converter
+
+import (
+	"context"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// stubBackend writes a fixed output, or fails with err, and counts its calls
+type stubBackend struct {
+	name   string
+	output string
+	err    error
+	calls  int
+}
+
+func (b *stubBackend) Name() string { return b.name }
+
+func (b *stubBackend) Convert(ctx context.Context, src, dst string) error {
+	b.calls++
+	if b.err != nil {
+		// Leave a partial file behind like a crashing converter would
+		os.WriteFile(dst, []byte("partial"), 0o644)
+		return b.err
+	}
+	return os.WriteFile(dst, []byte(b.output), 0o644)
+}
+
+func TestChain(t *testing.T) {
+	errBroken := errors.New("broken")
+
+	tests := []struct {
+		name        string
+		backends    []*stubBackend
+		cancel      bool
+		expectOut   string
+		expectErr   error
+		expectCalls []int
+	}{
+		{
+			name:        "first backend succeeds",
+			backends:    []*stubBackend{{name: "a", output: "A"}, {name: "b", output: "B"}},
+			expectOut:   "A",
+			expectCalls: []int{1, 0},
+		},
+		{
+			name:        "falls back after a failure",
+			backends:    []*stubBackend{{name: "a", err: errBroken}, {name: "b", output: "B"}},
+			expectOut:   "B",
+			expectCalls: []int{1, 1},
+		},
+		{
+			name:        "all backends fail",
+			backends:    []*stubBackend{{name: "a", err: errBroken}, {name: "b", err: errTest}},
+			expectErr:   errTest,
+			expectCalls: []int{1, 1},
+		},
+		{
+			name:        "cancelled conversion is not retried",
+			backends:    []*stubBackend{{name: "a", err: context.Canceled}, {name: "b", output: "B"}},
+			cancel:      true,
+			expectErr:   context.Canceled,
+			expectCalls: []int{1, 0},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			if tt.cancel {
+				cancel()
+			}
+
+			var backends []Backend
+			for _, b := range tt.backends {
+				backends = append(backends, b)
+			}
+			dst := filepath.Join(t.TempDir(), "out")
+			err := Chain(backends...).Convert(ctx, "in.fb2", dst)
+
+			if tt.expectErr != nil {
+				if !errors.Is(err, tt.expectErr) {
+					t.Errorf("expected %v, got %v", tt.expectErr, err)
+				}
+			} else if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			} else if out, _ := os.ReadFile(dst); string(out) != tt.expectOut {
+				t.Errorf("expected output %q, got %q", tt.expectOut, out)
+			}
+			for i, b := range tt.backends {
+				if b.calls != tt.expectCalls[i] {
+					t.Errorf("backend %s called %d times, expected %d", b.name, b.calls, tt.expectCalls[i])
+				}
+			}
+		})
+	}
+}
+
+func TestChain_Name(t *testing.T) {
+	a, b := &stubBackend{name: "ebook-convert"}, &stubBackend{name: "fb2c"}
+	if got := Chain(a).Name(); got != "ebook-convert" {
+		t.Errorf("single backend chain should be the backend itself, got %q", got)
+	}
+	if got := Chain(a, b).Name(); got != "ebook-convert,fb2c" {
+		t.Errorf("unexpected chain name %q", got)
+	}
+}
+
+func TestCommandBackend(t *testing.T) {
+	src := writeSample(t, []byte(sampleFB2))
+
+	tests := []struct {
+		name      string
+		args      []string
+		expectErr string
+	}{
+		{name: "copies input", args: []string{"cp", "{input}", "{output}"}},
+		{name: "failing command", args: []string{"sh", "-c", "echo bad input >&2; exit 3"}, expectErr: "sh: exit status 3: bad input"},
+		{name: "no output written", args: []string{"true", "{output}"}, expectErr: "true: no output written"},
+		{name: "missing binary", args: []string{"no-such-converter", "{input}", "{output}"}, expectErr: "no-such-converter"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dst := filepath.Join(t.TempDir(), "out.pdf")
+			err := NewCommandBackend(tt.args).Convert(context.Background(), src, dst)
+			if tt.expectErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.expectErr) {
+					t.Errorf("expected error containing %q, got %v", tt.expectErr, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if out, _ := os.ReadFile(dst); string(out) != sampleFB2 {
+				t.Errorf("unexpected output %q", out)
+			}
+		})
+	}
+}
+
+func TestCommandBackend_KilledOnTimeout(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	start := time.Now()
+	err := NewCommandBackend([]string{"sleep", "10"}).Convert(ctx, "in.fb2", filepath.Join(t.TempDir(), "out"))
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("expected deadline exceeded, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("command was not killed, took %s", elapsed)
+	}
+}
+
+func TestConverter_ConvertFB2(t *testing.T) {
+	src := writeSample(t, []byte(sampleFB2))
+
+	tests := []struct {
+		name      string
+		format    string
+		backends  map[string]Backend
+		expectOut string
+		expectErr string
+	}{
+		{
+			name:      "configured backend replaces built-in",
+			format:    "epub",
+			backends:  map[string]Backend{"epub": &stubBackend{name: "stub", output: "stub epub"}},
+			expectOut: "stub epub",
+		},
+		{
+			name:      "format without built-in backend",
+			format:    "pdf",
+			backends:  map[string]Backend{"pdf": &stubBackend{name: "stub", output: "stub pdf"}},
+			expectOut: "stub pdf",
+		},
+		{
+			name:      "failing backend",
+			format:    "epub",
+			backends:  map[string]Backend{"epub": &stubBackend{name: "stub", err: errTest}},
+			expectErr: "convert FB2 to epub: broken FB2",
+		},
+		{
+			name:      "unknown format",
+			format:    "doc",
+			expectErr: "invalid format",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := New(NewPool(1, time.Second), nil, tt.backends)
+			rc, path, err := c.ConvertFB2(context.Background(), src, tt.format, Profile{})
+			if tt.expectErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.expectErr) {
+					t.Errorf("expected error containing %q, got %v", tt.expectErr, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			out, _ := io.ReadAll(rc)
+			if string(out) != tt.expectOut {
+				t.Errorf("expected output %q, got %q", tt.expectOut, out)
+			}
+			if filepath.Ext(path) != "."+tt.format {
+				t.Errorf("unexpected output path %q", path)
+			}
+			rc.Close()
+			if _, err := os.Stat(filepath.Dir(path)); !os.IsNotExist(err) {
+				t.Errorf("temp dir %s was not removed on close", filepath.Dir(path))
+			}
+		})
+	}
+}
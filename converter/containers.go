@@ -0,0 +1,217 @@
+package converter
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/bodgit/sevenzip"
+	"github.com/nwaples/rardecode/v2"
+)
+
+// Besides ZIP and 7z archives, books are stored in RAR and gzipped tar
+// archives, and directly as .fb2, .epub, .pdf and .djvu files. A book stored
+// directly is its own archive: its archive path is the file and its file
+// name the file's base name.
+
+// IsArchive reports whether path is an archive of books that
+// ExtractFromArchive reads, by its extension
+func IsArchive(path string) bool {
+	switch archiveExt(path) {
+	case ".zip", ".7z", ".rar", ".tar.gz":
+		return true
+	}
+	return false
+}
+
+// IsBookFile reports whether path is a book stored directly, by its extension
+func IsBookFile(path string) bool {
+	switch archiveExt(path) {
+	case ".fb2", ".epub", ".pdf", ".djvu":
+		return true
+	}
+	return false
+}
+
+// WalkArchive calls fn for every file in the archive at path, in archive
+// order. r is valid only during the call; files fn does not read are
+// skipped without decompressing where the archive allows it. An error from
+// fn stops the walk and is returned.
+func WalkArchive(path string, fn func(name string, size int64, r io.Reader) error) error {
+	switch archiveExt(path) {
+	case ".zip":
+		r, err := zip.OpenReader(path)
+		if err != nil {
+			return fmt.Errorf("open zip archive: %w", err)
+		}
+		defer r.Close()
+		for _, f := range r.File {
+			if f.FileInfo().IsDir() {
+				continue
+			}
+			if err := walkEntry(f.Name, int64(f.UncompressedSize64), f.Open, fn); err != nil {
+				return err
+			}
+		}
+	case ".7z":
+		r, err := sevenzip.OpenReader(path)
+		if err != nil {
+			return fmt.Errorf("open 7z archive: %w", err)
+		}
+		defer r.Close()
+		for _, f := range r.File {
+			if f.FileInfo().IsDir() {
+				continue
+			}
+			if err := walkEntry(f.Name, int64(f.UncompressedSize), f.Open, fn); err != nil {
+				return err
+			}
+		}
+	case ".rar", ".tar.gz":
+		sa, err := openStreamArchive(path)
+		if err != nil {
+			return err
+		}
+		defer sa.close()
+		for {
+			name, size, err := sa.next()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				return fmt.Errorf("read %s: %w", path, err)
+			}
+			if err := fn(name, size, sa.r); err != nil {
+				return err
+			}
+		}
+	default:
+		return fmt.Errorf("unsupported archive format: %s", archiveExt(path))
+	}
+	return nil
+}
+
+func walkEntry(name string, size int64, open func() (io.ReadCloser, error), fn func(string, int64, io.Reader) error) error {
+	rc, err := open()
+	if err != nil {
+		return fmt.Errorf("open %s: %w", name, err)
+	}
+	defer rc.Close()
+	return fn(name, size, rc)
+}
+
+// streamArchive is an archive read from the start, one file after another
+type streamArchive struct {
+	// next advances to the next regular file, returning io.EOF at the end
+	next  func() (name string, size int64, err error)
+	r     io.Reader // contents of the current file
+	close func() error
+}
+
+func openStreamArchive(path string) (*streamArchive, error) {
+	switch archiveExt(path) {
+	case ".rar":
+		rr, err := rardecode.OpenReader(path)
+		if err != nil {
+			return nil, fmt.Errorf("open rar archive: %w", err)
+		}
+		return &streamArchive{
+			next: func() (string, int64, error) {
+				for {
+					h, err := rr.Next()
+					if err != nil {
+						return "", 0, err
+					}
+					if !h.IsDir {
+						return h.Name, h.UnPackedSize, nil
+					}
+				}
+			},
+			r:     rr,
+			close: rr.Close,
+		}, nil
+	case ".tar.gz":
+		f, err := os.Open(path)
+		if err != nil {
+			return nil, fmt.Errorf("open tar archive: %w", err)
+		}
+		gz, err := gzip.NewReader(f)
+		if err != nil {
+			f.Close()
+			return nil, fmt.Errorf("open tar archive: %w", err)
+		}
+		tr := tar.NewReader(gz)
+		return &streamArchive{
+			next: func() (string, int64, error) {
+				for {
+					h, err := tr.Next()
+					if err != nil {
+						return "", 0, err
+					}
+					if h.Typeflag == tar.TypeReg {
+						return h.Name, h.Size, nil
+					}
+				}
+			},
+			r: tr,
+			close: func() error {
+				return errors.Join(gz.Close(), f.Close())
+			},
+		}, nil
+	}
+	return nil, fmt.Errorf("unsupported archive format: %s", archiveExt(path))
+}
+
+// extractStreamed opens filename in a RAR or gzipped tar archive. These
+// have no index, so the archive is read up to the file.
+func extractStreamed(path, filename string) (io.ReadCloser, int64, error) {
+	sa, err := openStreamArchive(path)
+	if err != nil {
+		return nil, 0, err
+	}
+	for {
+		name, size, err := sa.next()
+		if err == io.EOF {
+			sa.close()
+			return nil, 0, fmt.Errorf("file %s not found in archive", filename)
+		}
+		if err != nil {
+			sa.close()
+			return nil, 0, fmt.Errorf("read %s: %w", path, err)
+		}
+		if name == filename {
+			return &streamReadCloser{Reader: sa.r, close: sa.close}, size, nil
+		}
+	}
+}
+
+type streamReadCloser struct {
+	io.Reader
+	close func() error
+}
+
+func (s *streamReadCloser) Close() error {
+	return s.close()
+}
+
+// extractFile opens a book stored directly, whose file name is its own
+func extractFile(path, filename string) (io.ReadCloser, int64, error) {
+	if filepath.Base(path) != filename {
+		return nil, 0, fmt.Errorf("file %s not found in %s", filename, filepath.Base(path))
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, 0, fmt.Errorf("open book: %w", err)
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, 0, fmt.Errorf("open book: %w", err)
+	}
+	return f, fi.Size(), nil
+}
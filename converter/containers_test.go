@@ -0,0 +1,154 @@
+package converter
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/binary"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func writeTarGz(t *testing.T, path string, entries ...archiveEntry) {
+	t.Helper()
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(gz)
+	tw.WriteHeader(&tar.Header{Name: "books/", Typeflag: tar.TypeDir, Mode: 0o755})
+	for _, e := range entries {
+		if err := tw.WriteHeader(&tar.Header{Name: e.name, Mode: 0o644, Size: int64(len(e.content))}); err != nil {
+			t.Fatalf("write tar header: %v", err)
+		}
+		io.WriteString(tw, e.content)
+	}
+	tw.Close()
+	gz.Close()
+	if err := os.WriteFile(path, buf.Bytes(), 0o644); err != nil {
+		t.Fatalf("write archive: %v", err)
+	}
+}
+
+// writeRar writes a RAR 5 archive with the entries stored uncompressed
+func writeRar(t *testing.T, path string, entries ...archiveEntry) {
+	t.Helper()
+	vint := func(v int) []byte {
+		var b []byte
+		for v >= 0x80 {
+			b = append(b, byte(v)|0x80)
+			v >>= 7
+		}
+		return append(b, byte(v))
+	}
+	var out bytes.Buffer
+	block := func(header ...[]byte) {
+		h := bytes.Join(header, nil)
+		sized := append(vint(len(h)), h...)
+		binary.Write(&out, binary.LittleEndian, crc32.ChecksumIEEE(sized))
+		out.Write(sized)
+	}
+
+	out.WriteString("Rar!\x1a\x07\x01\x00")
+	block(vint(1), vint(0), vint(0)) // main archive header
+	for _, e := range entries {
+		crc := binary.LittleEndian.AppendUint32(nil, crc32.ChecksumIEEE([]byte(e.content)))
+		block(
+			vint(2), vint(0x02), vint(len(e.content)), // file header with data
+			vint(0x04), vint(len(e.content)), vint(0x20), crc, // CRC32 present, size, attributes
+			vint(0), vint(1), // stored, Unix
+			vint(len(e.name)), []byte(e.name),
+		)
+		out.WriteString(e.content)
+	}
+	block(vint(5), vint(0), vint(0)) // end of archive
+
+	if err := os.WriteFile(path, out.Bytes(), 0o644); err != nil {
+		t.Fatalf("write archive: %v", err)
+	}
+}
+
+func TestExtractFromArchive_Containers(t *testing.T) {
+	dir := t.TempDir()
+	books := []archiveEntry{{"books/1.fb2", "first book"}, {"books/2.epub", "second book"}}
+
+	writeTarGz(t, filepath.Join(dir, "books.tar.gz"), books...)
+	writeRar(t, filepath.Join(dir, "books.rar"), books...)
+	writeZip(t, filepath.Join(dir, "single.fb2.zip"), archiveEntry{"single.fb2", "single book"})
+	os.WriteFile(filepath.Join(dir, "loose.fb2"), []byte("loose book"), 0o644)
+	os.WriteFile(filepath.Join(dir, "loose.epub"), []byte("loose epub"), 0o644)
+	os.WriteFile(filepath.Join(dir, "loose.pdf"), []byte("loose pdf"), 0o644)
+
+	tests := []struct {
+		archive, file string
+		expect        string // empty when extraction fails
+	}{
+		{"books.tar.gz", "books/2.epub", "second book"},
+		{"books.tar.gz", "books/1.fb2", "first book"},
+		{"books.tar.gz", "missing.fb2", ""},
+		{"books.rar", "books/2.epub", "second book"},
+		{"books.rar", "missing.fb2", ""},
+		{"single.fb2.zip", "single.fb2", "single book"},
+		{"loose.fb2", "loose.fb2", "loose book"},
+		{"loose.epub", "loose.epub", "loose epub"},
+		{"loose.pdf", "loose.pdf", "loose pdf"},
+		{"loose.fb2", "other.fb2", ""},
+		{"books.rar", "/etc/passwd", ""},
+	}
+	c := New(NewPool(1, 0), nil, nil)
+	for _, tt := range tests {
+		t.Run(tt.archive+"/"+tt.file, func(t *testing.T) {
+			rc, size, err := c.ExtractFromArchive(context.Background(), filepath.Join(dir, tt.archive), tt.file)
+			if tt.expect == "" {
+				if err == nil {
+					rc.Close()
+					t.Fatal("expected an error")
+				}
+				return
+			}
+			if got := readEntry(t, rc, err); got != tt.expect || size != int64(len(got)) {
+				t.Errorf("expected %q, got %q of %d bytes", tt.expect, got, size)
+			}
+		})
+	}
+}
+
+func TestWalkArchive(t *testing.T) {
+	dir := t.TempDir()
+	books := []archiveEntry{{"books/1.fb2", "first book"}, {"books/2.epub", "second book"}, {"3.fb2", "third"}}
+	writeZip(t, filepath.Join(dir, "books.zip"), books...)
+	write7z(t, filepath.Join(dir, "books.7z"), nil, books...)
+	writeTarGz(t, filepath.Join(dir, "books.tgz"), books...)
+	writeRar(t, filepath.Join(dir, "books.rar"), books...)
+
+	for _, name := range []string{"books.zip", "books.7z", "books.tgz", "books.rar"} {
+		t.Run(name, func(t *testing.T) {
+			var got []string
+			err := WalkArchive(filepath.Join(dir, name), func(name string, size int64, r io.Reader) error {
+				if name == "3.fb2" {
+					return nil // left unread
+				}
+				data, err := io.ReadAll(r)
+				if err != nil || size != int64(len(data)) {
+					t.Errorf("%s: read %d of %d bytes: %v", name, len(data), size, err)
+				}
+				got = append(got, name+"="+string(data))
+				return nil
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if want := []string{"books/1.fb2=first book", "books/2.epub=second book"}; !slices.Equal(got, want) {
+				t.Errorf("expected %v, got %v", want, got)
+			}
+		})
+	}
+
+	if err := WalkArchive(filepath.Join(dir, "books.txt"), nil); err == nil || !strings.Contains(err.Error(), "unsupported") {
+		t.Errorf("expected an unsupported format error, got %v", err)
+	}
+}
@@ -1,8 +1,8 @@
 package converter
 
 import (
-	"archive/zip"
 	"context"
+	"errors"
 	"fmt"
 	"io"
 	"os"
@@ -12,22 +12,49 @@ import (
 
 	"os/exec"
 
-	"github.com/bodgit/sevenzip"
 	"github.com/htol/bopds/book"
 	"github.com/htol/bopds/logger"
-	"github.com/htol/fb2c"
+	"github.com/htol/bopds/metrics"
+	"github.com/htol/bopds/tracing"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 )
 
-// Converter handles FB2 extraction and EPUB conversions
-type Converter struct{}
+// Converter handles FB2 extraction and conversions to the registered formats
+type Converter struct {
+	pool     *Pool
+	archives *Archives
+	backends map[string]Backend
+}
 
-// New creates a new Converter
-func New() *Converter {
-	return &Converter{}
+// New creates a new Converter running conversions on pool and extracting
+// books through archives; a nil archives opens every archive afresh.
+// backends replace the built-in backend of the formats they are keyed by;
+// formats without a built-in backend must have one here to be converted.
+func New(pool *Pool, archives *Archives, backends map[string]Backend) *Converter {
+	if archives == nil {
+		archives = NewArchives(0, 0, 0)
+	}
+	return &Converter{pool: pool, archives: archives, backends: backends}
+}
+
+// backend returns the backend converting to format
+func (c *Converter) backend(format string) (Backend, error) {
+	if b, ok := c.backends[format]; ok {
+		return b, nil
+	}
+	target, ok := LookupFormat(format)
+	if !ok {
+		return nil, fmt.Errorf("invalid format: must be one of %s", strings.Join(FormatNames(), ", "))
+	}
+	if target.Backend == nil {
+		return nil, fmt.Errorf("no conversion backend configured for %s", format)
+	}
+	return target.Backend, nil
 }
 
 // ExtractFromZIP extracts an FB2 file from a ZIP archive
-func (c *Converter) ExtractFromZIP(archivePath, filename string) (io.ReadCloser, int64, error) {
+func (c *Converter) ExtractFromZIP(ctx context.Context, archivePath, filename string) (io.ReadCloser, int64, error) {
 	if err := validateFilename(filename); err != nil {
 		return nil, 0, fmt.Errorf("invalid filename: %w", err)
 	}
@@ -36,90 +63,61 @@ func (c *Converter) ExtractFromZIP(archivePath, filename string) (io.ReadCloser,
 		return nil, 0, fmt.Errorf("invalid archive path: contains directory traversal")
 	}
 
-	// The database stores relative paths like "lib/fb2-xxx.zip" from the working directory
-	r, err := zip.OpenReader(archivePath)
-	if err != nil {
-		return nil, 0, fmt.Errorf("open zip archive: %w", err)
-	}
-
-	for _, f := range r.File {
-		if f.Name == filename {
-			file, err := f.Open()
-			if err != nil {
-				r.Close()
-				return nil, 0, fmt.Errorf("open file in archive: %w", err)
-			}
-
-			return &readCloser{
-				ReadCloser: file,
-				onClose: func() {
-					r.Close()
-				},
-			}, int64(f.UncompressedSize64), nil
-		}
-	}
-
-	r.Close()
-	return nil, 0, fmt.Errorf("file %s not found in archive", filename)
+	return c.archives.openZIP(archivePath, filename)
 }
 
 // ExtractFrom7Z extracts an FB2 file from a 7z archive
-func (c *Converter) ExtractFrom7Z(archivePath, filename string) (io.ReadCloser, int64, error) {
+func (c *Converter) ExtractFrom7Z(ctx context.Context, archivePath, filename string) (io.ReadCloser, int64, error) {
 	if err := validateFilename(filename); err != nil {
 		return nil, 0, fmt.Errorf("invalid filename: %w", err)
 	}
 
 	start := time.Now()
 
-	// Try native Go extraction first (supports LZMA, LZMA2, Deflate, etc.)
+	// Try native Go extraction first (supports LZMA, LZMA2, PPMd, BCJ, etc.)
 	rc, size, err := c.extractFrom7zNative(archivePath, filename)
 	if err == nil {
 		logger.Info("7z extraction completed (native)", "archive", archivePath, "file", filename, "duration", time.Since(start).Milliseconds())
 		return rc, size, nil
 	}
 
-	// Fallback for algorithms unsupported by pure Go lib (e.g. PPMd, BCJ)
+	// Fallback for algorithms unsupported by pure Go lib (e.g. Deflate64),
+	// when a 7z binary is installed
 	if strings.Contains(err.Error(), "unsupported compression algorithm") {
+		trace.SpanFromContext(ctx).AddEvent("7z CLI fallback", trace.WithAttributes(attribute.String("reason", err.Error())))
 		startCLI := time.Now()
 		rc, size, err := c.extractWith7zCLI(archivePath, filename)
 		if err == nil {
+			metrics.SevenZipCLIFallbacks.WithLabelValues("success").Inc()
 			logger.Info("7z extraction completed (CLI fallback)", "archive", archivePath, "file", filename, "duration", time.Since(startCLI).Milliseconds())
 			return rc, size, nil
 		}
+		metrics.SevenZipCLIFallbacks.WithLabelValues("failure").Inc()
 	}
 
 	return nil, 0, err
 }
 
-func (c *Converter) extractFrom7zNative(archivePath, filename string) (io.ReadCloser, int64, error) {
+// extractOther opens a book in an archive without an index, or stored directly
+func extractOther(archivePath, filename string) (io.ReadCloser, int64, error) {
+	if err := validateFilename(filename); err != nil {
+		return nil, 0, fmt.Errorf("invalid filename: %w", err)
+	}
 	if strings.Contains(archivePath, "..") {
 		return nil, 0, fmt.Errorf("invalid archive path: contains directory traversal")
 	}
-
-	r, err := sevenzip.OpenReader(archivePath)
-	if err != nil {
-		return nil, 0, fmt.Errorf("open 7z archive: %w", err)
+	if IsBookFile(archivePath) {
+		return extractFile(archivePath, filename)
 	}
+	return extractStreamed(archivePath, filename)
+}
 
-	for _, f := range r.File {
-		if f.Name == filename {
-			file, err := f.Open()
-			if err != nil {
-				r.Close()
-				return nil, 0, fmt.Errorf("open file in archive: %w", err)
-			}
-
-			return &readCloser{
-				ReadCloser: file,
-				onClose: func() {
-					r.Close()
-				},
-			}, int64(f.UncompressedSize), nil
-		}
+func (c *Converter) extractFrom7zNative(archivePath, filename string) (io.ReadCloser, int64, error) {
+	if strings.Contains(archivePath, "..") {
+		return nil, 0, fmt.Errorf("invalid archive path: contains directory traversal")
 	}
 
-	r.Close()
-	return nil, 0, fmt.Errorf("file %s not found in archive", filename)
+	return c.archives.open7z(archivePath, filename)
 }
 
 func (c *Converter) extractWith7zCLI(archivePath, filename string) (io.ReadCloser, int64, error) {
@@ -153,31 +151,66 @@ func (c *cmdReadCloser) Close() error {
 	return readErr
 }
 
-// ExtractFromArchive extracts an FB2 file from a ZIP or 7z archive
-// It auto-detects the archive type based on file extension
-func (c *Converter) ExtractFromArchive(archivePath, filename string) (io.ReadCloser, int64, error) {
-	ext := strings.ToLower(filepath.Ext(archivePath))
-
+// ExtractFromArchive extracts a book from a ZIP, 7z, RAR or gzipped tar
+// archive, or opens a book stored directly (see IsBookFile). It auto-detects
+// the archive type based on file extension.
+// The extraction span stays open until the returned reader is closed, since
+// decompression happens while the stream is read.
+func (c *Converter) ExtractFromArchive(ctx context.Context, archivePath, filename string) (io.ReadCloser, int64, error) {
+	ext := archiveExt(archivePath)
+
+	ctx, span := tracing.Start(ctx, "converter.ExtractFromArchive",
+		attribute.String("archive", archivePath),
+		attribute.String("file", filename),
+	)
+
+	var (
+		rc   io.ReadCloser
+		size int64
+		err  error
+	)
 	switch ext {
 	case ".zip":
-		return c.ExtractFromZIP(archivePath, filename)
+		rc, size, err = c.ExtractFromZIP(ctx, archivePath, filename)
 	case ".7z":
-		return c.ExtractFrom7Z(archivePath, filename)
+		rc, size, err = c.ExtractFrom7Z(ctx, archivePath, filename)
+	case ".rar", ".tar.gz", ".fb2", ".epub", ".pdf", ".djvu":
+		rc, size, err = extractOther(archivePath, filename)
 	default:
-		return nil, 0, fmt.Errorf("unsupported archive format: %s", ext)
+		err = fmt.Errorf("unsupported archive format: %s", ext)
+	}
+	if err != nil {
+		tracing.End(span, err)
+		return nil, 0, err
 	}
+
+	return &readCloser{
+		ReadCloser: rc,
+		onClose: func() {
+			span.End()
+		},
+	}, size, nil
 }
 
-// ConvertFB2 converts an FB2 file to EPUB or MOBI format
-func (c *Converter) ConvertFB2(ctx context.Context, fb2Path string, format string) (io.ReadCloser, string, error) {
+// ConvertFB2 converts an FB2 file to one of the registered output formats,
+// applying profile to the source before and to the result after conversion
+func (c *Converter) ConvertFB2(ctx context.Context, fb2Path string, format string, profile Profile) (_ io.ReadCloser, _ string, err error) {
 	if strings.Contains(fb2Path, "..") {
 		return nil, "", fmt.Errorf("invalid FB2 path: contains directory traversal")
 	}
 
-	if format != "epub" && format != "mobi" {
-		return nil, "", fmt.Errorf("invalid format: must be 'epub' or 'mobi'")
+	backend, err := c.backend(format)
+	if err != nil {
+		return nil, "", err
 	}
 
+	_, span := tracing.Start(ctx, "converter.ConvertFB2",
+		attribute.String("format", format),
+		attribute.String("backend", backend.Name()),
+		attribute.String("profile", profile.Name),
+	)
+	defer func() { tracing.End(span, err) }()
+
 	tempDir, err := os.MkdirTemp("", "fb2convert-*")
 	if err != nil {
 		return nil, "", fmt.Errorf("create temp dir: %w", err)
@@ -186,16 +219,34 @@ func (c *Converter) ConvertFB2(ctx context.Context, fb2Path string, format strin
 	outputPath := filepath.Join(tempDir, "converted."+format)
 
 	start := time.Now()
-	fb2Converter := fb2c.NewConverter()
-	fb2Converter.SetOptions(fb2c.DefaultConvertOptions())
-
-	if err := fb2Converter.Convert(fb2Path, outputPath); err != nil {
+	err = c.pool.Run(ctx, func(ctx context.Context) error {
+		src := fb2Path
+		if profile.rewritesSource() {
+			src = filepath.Join(tempDir, "source.fb2")
+			if err := profile.prepareSource(fb2Path, src); err != nil {
+				return err
+			}
+		}
+		if err := backend.Convert(ctx, src, outputPath); err != nil {
+			return err
+		}
+		return profile.finishOutput(format, outputPath)
+	})
+	if err != nil {
+		// An abandoned job may still be writing; removing the directory now
+		// leaves it an unlinked file that disappears once the job is done
 		os.RemoveAll(tempDir)
+		if errors.Is(err, context.Canceled) {
+			logger.Info("FB2 conversion cancelled", "format", format, "backend", backend.Name(), "profile", profile.Name, "path", fb2Path, "duration", time.Since(start).Milliseconds())
+		} else {
+			metrics.ConversionFailures.WithLabelValues(format).Inc()
+		}
 		return nil, "", fmt.Errorf("convert FB2 to %s: %w", format, err)
 	}
 
-	convertDuration := time.Since(start).Milliseconds()
-	logger.Info("FB2 conversion completed", "format", format, "path", fb2Path, "duration", convertDuration)
+	elapsed := time.Since(start)
+	metrics.ConversionDuration.WithLabelValues(format).Observe(elapsed.Seconds())
+	logger.Info("FB2 conversion completed", "format", format, "backend", backend.Name(), "profile", profile.Name, "path", fb2Path, "duration", elapsed.Milliseconds())
 
 	convertedFile, err := os.Open(outputPath)
 	if err != nil {
@@ -214,12 +265,12 @@ func (c *Converter) ConvertFB2(ctx context.Context, fb2Path string, format strin
 // ConvertFB2ToEPUB converts an FB2 file to EPUB format
 // Maintained for backward compatibility
 func (c *Converter) ConvertFB2ToEPUB(ctx context.Context, fb2Path string) (io.ReadCloser, string, error) {
-	return c.ConvertFB2(ctx, fb2Path, "epub")
+	return c.ConvertFB2(ctx, fb2Path, "epub", Profile{})
 }
 
 // ConvertFB2ToMOBI converts an FB2 file to MOBI format
 func (c *Converter) ConvertFB2ToMOBI(ctx context.Context, fb2Path string) (io.ReadCloser, string, error) {
-	return c.ConvertFB2(ctx, fb2Path, "mobi")
+	return c.ConvertFB2(ctx, fb2Path, "mobi", Profile{})
 }
 
 // SanitizeFilename creates a safe filename from a book title
@@ -307,13 +358,24 @@ func FormatBookFilename(b *book.Book, format string) string {
 	return filename + "." + format
 }
 
+// archiveExt returns the archive's lower-cased extension, .tar.gz for
+// gzipped tar archives
+func archiveExt(path string) string {
+	lower := strings.ToLower(path)
+	if strings.HasSuffix(lower, ".tar.gz") || strings.HasSuffix(lower, ".tgz") {
+		return ".tar.gz"
+	}
+	return filepath.Ext(lower)
+}
+
 // validateFilename checks that a filename is safe
 func validateFilename(filename string) error {
 	if strings.Contains(filename, "..") {
 		return fmt.Errorf("filename contains directory traversal")
 	}
-	if strings.Contains(filename, "/") || strings.Contains(filename, "\\") {
-		return fmt.Errorf("filename contains path separators")
+	// Books in folders of an archive are named with forward slashes
+	if strings.HasPrefix(filename, "/") || strings.Contains(filename, "\\") {
+		return fmt.Errorf("filename is absolute or contains backslashes")
 	}
 	return nil
 }
@@ -0,0 +1,447 @@
+package converter
+
+import (
+	"bufio"
+	"context"
+	"encoding/base64"
+	"encoding/xml"
+	"fmt"
+	"html"
+	"io"
+	"net/url"
+	"os"
+	"strings"
+
+	"golang.org/x/net/html/charset"
+)
+
+// fb2Node is an element or text node of a parsed FB2 document
+type fb2Node struct {
+	name     string // element local name; empty for text
+	attrs    map[string]string
+	text     string
+	children []*fb2Node
+}
+
+func (n *fb2Node) child(name string) *fb2Node {
+	for _, c := range n.children {
+		if c.name == name {
+			return c
+		}
+	}
+	return nil
+}
+
+// textContent returns the node's text with whitespace collapsed
+func (n *fb2Node) textContent() string {
+	var sb strings.Builder
+	var walk func(*fb2Node)
+	walk = func(n *fb2Node) {
+		if n.name == "" {
+			sb.WriteString(n.text)
+		}
+		for _, c := range n.children {
+			walk(c)
+		}
+	}
+	walk(n)
+	return strings.Join(strings.Fields(sb.String()), " ")
+}
+
+type fb2Binary struct {
+	contentType string
+	data        string // base64, re-encoded so that it holds nothing else
+}
+
+// fb2Doc holds the parts of an FB2 document the text and HTML renderers use
+type fb2Doc struct {
+	title    string
+	authors  []string
+	lang     string
+	cover    string // binary ID of the cover image
+	bodies   []*fb2Node
+	binaries map[string]fb2Binary
+}
+
+// parseFB2Tree reads an FB2 document in any encoding it declares into a
+// node tree. Namespace declarations are dropped; attributes are keyed by
+// their local name.
+func parseFB2Tree(r io.Reader) (*fb2Node, error) {
+	dec := xml.NewDecoder(r)
+	dec.CharsetReader = charset.NewReaderLabel
+	dec.Strict = false
+	dec.Entity = xml.HTMLEntity
+
+	root := &fb2Node{}
+	stack := []*fb2Node{root}
+	for {
+		tok, err := dec.Token()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("parse FB2: %w", err)
+		}
+		parent := stack[len(stack)-1]
+		switch t := tok.(type) {
+		case xml.StartElement:
+			n := &fb2Node{name: t.Name.Local, attrs: make(map[string]string, len(t.Attr))}
+			for _, a := range t.Attr {
+				if a.Name.Space == "xmlns" || a.Name.Local == "xmlns" {
+					continue
+				}
+				n.attrs[a.Name.Local] = a.Value
+			}
+			parent.children = append(parent.children, n)
+			stack = append(stack, n)
+		case xml.EndElement:
+			if len(stack) > 1 {
+				stack = stack[:len(stack)-1]
+			}
+		case xml.CharData:
+			parent.children = append(parent.children, &fb2Node{text: string(t)})
+		}
+	}
+	if root.child("FictionBook") == nil {
+		return nil, fmt.Errorf("parse FB2: missing FictionBook element")
+	}
+	return root, nil
+}
+
+// parseFB2 reads an FB2 document in any encoding it declares
+func parseFB2(r io.Reader) (*fb2Doc, error) {
+	root, err := parseFB2Tree(r)
+	if err != nil {
+		return nil, err
+	}
+
+	fb := root.child("FictionBook")
+	doc := &fb2Doc{binaries: make(map[string]fb2Binary)}
+	if info := fb.child("description"); info != nil {
+		if info = info.child("title-info"); info != nil {
+			if t := info.child("book-title"); t != nil {
+				doc.title = t.textContent()
+			}
+			if l := info.child("lang"); l != nil {
+				doc.lang = l.textContent()
+			}
+			for _, c := range info.children {
+				if c.name != "author" {
+					continue
+				}
+				var parts []string
+				for _, part := range []string{"first-name", "middle-name", "last-name"} {
+					if p := c.child(part); p != nil && p.textContent() != "" {
+						parts = append(parts, p.textContent())
+					}
+				}
+				if len(parts) == 0 {
+					if nick := c.child("nickname"); nick != nil {
+						parts = append(parts, nick.textContent())
+					}
+				}
+				if len(parts) > 0 {
+					doc.authors = append(doc.authors, strings.Join(parts, " "))
+				}
+			}
+			if cp := info.child("coverpage"); cp != nil {
+				if img := cp.child("image"); img != nil {
+					doc.cover = strings.TrimPrefix(img.attrs["href"], "#")
+				}
+			}
+		}
+	}
+	for _, c := range fb.children {
+		switch c.name {
+		case "body":
+			doc.bodies = append(doc.bodies, c)
+		case "binary":
+			// Binaries that are not base64 are dropped
+			data, err := base64.StdEncoding.DecodeString(strings.Join(strings.Fields(c.textContent()), ""))
+			if err != nil {
+				continue
+			}
+			doc.binaries[c.attrs["id"]] = fb2Binary{
+				contentType: c.attrs["content-type"],
+				data:        base64.StdEncoding.EncodeToString(data),
+			}
+		}
+	}
+	return doc, nil
+}
+
+// renderFB2 returns a ConvertFunc that parses the FB2 source and writes it
+// with render
+func renderFB2(render func(*bufio.Writer, *fb2Doc)) ConvertFunc {
+	return func(ctx context.Context, src, dst string) error {
+		in, err := os.Open(src)
+		if err != nil {
+			return fmt.Errorf("open FB2: %w", err)
+		}
+		doc, err := parseFB2(in)
+		in.Close()
+		if err != nil {
+			return err
+		}
+
+		out, err := os.Create(dst)
+		if err != nil {
+			return fmt.Errorf("create output: %w", err)
+		}
+		w := bufio.NewWriter(out)
+		render(w, doc)
+		if err := w.Flush(); err != nil {
+			out.Close()
+			return fmt.Errorf("write output: %w", err)
+		}
+		return out.Close()
+	}
+}
+
+// writeText renders the book as plain UTF-8 text, one paragraph per line
+func writeText(w *bufio.Writer, doc *fb2Doc) {
+	w.WriteString(doc.title + "\n")
+	if len(doc.authors) > 0 {
+		w.WriteString(strings.Join(doc.authors, ", ") + "\n")
+	}
+	w.WriteString("\n")
+
+	var block func(n *fb2Node)
+	block = func(n *fb2Node) {
+		switch n.name {
+		case "":
+			if text := strings.Join(strings.Fields(n.text), " "); text != "" {
+				w.WriteString(text + "\n")
+			}
+		case "title":
+			w.WriteString("\n")
+			for _, c := range n.children {
+				if text := c.textContent(); text != "" {
+					w.WriteString(text + "\n")
+				}
+			}
+			w.WriteString("\n")
+		case "p", "v", "subtitle", "text-author":
+			w.WriteString(n.textContent() + "\n")
+		case "empty-line":
+			w.WriteString("\n")
+		case "image", "binary":
+		case "tr":
+			var cells []string
+			for _, c := range n.children {
+				if c.name != "" {
+					cells = append(cells, c.textContent())
+				}
+			}
+			w.WriteString(strings.Join(cells, "\t") + "\n")
+		case "stanza", "poem", "epigraph", "cite", "annotation":
+			for _, c := range n.children {
+				block(c)
+			}
+			w.WriteString("\n")
+		default:
+			for _, c := range n.children {
+				block(c)
+			}
+		}
+	}
+	for _, body := range doc.bodies {
+		block(body)
+	}
+}
+
+const htmlStyle = `body{max-width:40em;margin:0 auto;padding:1em;font-family:serif;line-height:1.5}
+p{margin:0;text-indent:1.5em}
+h1,h2,h3,h4,h5,h6{text-align:center}
+.author,.subtitle,.text-author{text-align:right;text-indent:0}
+.subtitle{text-align:center;font-weight:bold}
+blockquote{margin:1em 0 1em 3em;font-style:italic}
+.stanza{margin:1em 0 1em 2em}.stanza p{text-indent:0}
+.notes{margin-top:3em;border-top:1px solid #ccc;font-size:90%}
+img{display:block;max-width:100%;margin:1em auto}`
+
+// writeHTML renders the book as a single self-contained HTML page with
+// images embedded as data URIs
+func writeHTML(w *bufio.Writer, doc *fb2Doc) {
+	r := htmlRenderer{w: w, doc: doc}
+
+	w.WriteString("<!DOCTYPE html>\n<html")
+	if doc.lang != "" {
+		fmt.Fprintf(w, ` lang="%s"`, html.EscapeString(doc.lang))
+	}
+	w.WriteString(">\n<head>\n<meta charset=\"utf-8\">\n")
+	w.WriteString(`<meta name="viewport" content="width=device-width, initial-scale=1">` + "\n")
+	fmt.Fprintf(w, "<title>%s</title>\n<style>\n%s\n</style>\n</head>\n<body>\n", html.EscapeString(doc.title), htmlStyle)
+
+	if doc.cover != "" {
+		r.image(doc.cover)
+	}
+	fmt.Fprintf(w, "<h1>%s</h1>\n", html.EscapeString(doc.title))
+	if len(doc.authors) > 0 {
+		fmt.Fprintf(w, "<p class=\"author\">%s</p>\n", html.EscapeString(strings.Join(doc.authors, ", ")))
+	}
+
+	for _, body := range doc.bodies {
+		class := "body"
+		if body.attrs["name"] == "notes" {
+			class = "notes"
+		}
+		fmt.Fprintf(w, "<div class=\"%s\">\n", class)
+		for _, c := range body.children {
+			r.block(c, 2)
+		}
+		w.WriteString("</div>\n")
+	}
+	w.WriteString("</body>\n</html>\n")
+}
+
+type htmlRenderer struct {
+	w   *bufio.Writer
+	doc *fb2Doc
+}
+
+// open writes a start tag with the node's FB2 id, so note links keep working
+func (r *htmlRenderer) open(tag, class string, n *fb2Node) {
+	r.w.WriteString("<" + tag)
+	if id := n.attrs["id"]; id != "" {
+		fmt.Fprintf(r.w, ` id="%s"`, html.EscapeString(id))
+	}
+	if class != "" {
+		fmt.Fprintf(r.w, ` class="%s"`, class)
+	}
+	r.w.WriteString(">")
+}
+
+func (r *htmlRenderer) block(n *fb2Node, depth int) {
+	switch n.name {
+	case "":
+		if strings.TrimSpace(n.text) != "" {
+			r.w.WriteString(html.EscapeString(n.text))
+		}
+	case "section":
+		r.open("section", "", n)
+		r.w.WriteString("\n")
+		for _, c := range n.children {
+			r.block(c, depth+1)
+		}
+		r.w.WriteString("</section>\n")
+	case "title":
+		tag := fmt.Sprintf("h%d", min(depth, 6))
+		r.open(tag, "", n)
+		first := true
+		for _, c := range n.children {
+			if c.name == "" {
+				continue
+			}
+			if !first {
+				r.w.WriteString("<br>")
+			}
+			r.inlineChildren(c)
+			first = false
+		}
+		r.w.WriteString("</" + tag + ">\n")
+	case "p", "subtitle", "text-author", "v":
+		class := n.name
+		if class == "p" {
+			class = ""
+		}
+		r.open("p", class, n)
+		r.inlineChildren(n)
+		r.w.WriteString("</p>\n")
+	case "empty-line":
+		r.w.WriteString("<br>\n")
+	case "image":
+		r.image(strings.TrimPrefix(n.attrs["href"], "#"))
+	case "epigraph", "cite", "annotation":
+		r.open("blockquote", n.name, n)
+		r.w.WriteString("\n")
+		for _, c := range n.children {
+			r.block(c, depth)
+		}
+		r.w.WriteString("</blockquote>\n")
+	case "poem", "stanza":
+		r.open("div", n.name, n)
+		r.w.WriteString("\n")
+		for _, c := range n.children {
+			r.block(c, depth)
+		}
+		r.w.WriteString("</div>\n")
+	case "table":
+		r.open("table", "", n)
+		r.w.WriteString("\n")
+		for _, row := range n.children {
+			if row.name != "tr" {
+				continue
+			}
+			r.w.WriteString("<tr>")
+			for _, cell := range row.children {
+				if cell.name == "th" || cell.name == "td" {
+					r.w.WriteString("<" + cell.name + ">")
+					r.inlineChildren(cell)
+					r.w.WriteString("</" + cell.name + ">")
+				}
+			}
+			r.w.WriteString("</tr>\n")
+		}
+		r.w.WriteString("</table>\n")
+	default:
+		for _, c := range n.children {
+			r.block(c, depth)
+		}
+	}
+}
+
+// inlineTags maps FB2 inline elements to HTML
+var inlineTags = map[string]string{
+	"emphasis":      "em",
+	"strong":        "strong",
+	"strikethrough": "s",
+	"sub":           "sub",
+	"sup":           "sup",
+	"code":          "code",
+}
+
+func (r *htmlRenderer) inlineChildren(n *fb2Node) {
+	for _, c := range n.children {
+		r.inline(c)
+	}
+}
+
+func (r *htmlRenderer) inline(n *fb2Node) {
+	switch {
+	case n.name == "":
+		r.w.WriteString(html.EscapeString(n.text))
+	case n.name == "a" && safeHref(n.attrs["href"]):
+		fmt.Fprintf(r.w, `<a href="%s">`, html.EscapeString(n.attrs["href"]))
+		r.inlineChildren(n)
+		r.w.WriteString("</a>")
+	case n.name == "image":
+		r.image(strings.TrimPrefix(n.attrs["href"], "#"))
+	case inlineTags[n.name] != "":
+		tag := inlineTags[n.name]
+		r.w.WriteString("<" + tag + ">")
+		r.inlineChildren(n)
+		r.w.WriteString("</" + tag + ">")
+	default:
+		r.inlineChildren(n)
+	}
+}
+
+// safeHref reports whether a link may be kept in HTML: links within the book
+// and to web pages are, javascript: and other schemes are not
+func safeHref(href string) bool {
+	if strings.HasPrefix(href, "#") {
+		return true
+	}
+	u, err := url.Parse(href)
+	return err == nil && (strings.EqualFold(u.Scheme, "http") || strings.EqualFold(u.Scheme, "https"))
+}
+
+// image embeds the binary with the given ID; unknown IDs are skipped
+func (r *htmlRenderer) image(id string) {
+	bin, ok := r.doc.binaries[id]
+	if !ok || bin.data == "" {
+		return
+	}
+	fmt.Fprintf(r.w, "<img src=\"data:%s;base64,%s\" alt=\"\">\n", html.EscapeString(bin.contentType), html.EscapeString(bin.data))
+}
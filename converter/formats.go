@@ -0,0 +1,110 @@
+package converter
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	"github.com/htol/fb2c"
+)
+
+// Format is an output format books can be converted to from FB2. Registered
+// formats are accepted by the download and conversion endpoints and
+// advertised in OPDS acquisition links.
+type Format struct {
+	Name        string // format query parameter and file extension, e.g. "epub"
+	Title       string // human-readable name, e.g. "EPUB"
+	ContentType string
+	Backend     Backend // built-in converter; nil when only configured backends produce the format
+}
+
+var (
+	formatsMu sync.RWMutex
+	formats   []Format
+)
+
+// RegisterFormat makes an output format available. It panics if a format with
+// the same name is already registered.
+func RegisterFormat(f Format) {
+	formatsMu.Lock()
+	defer formatsMu.Unlock()
+	for _, existing := range formats {
+		if existing.Name == f.Name {
+			panic(fmt.Sprintf("converter: format %q registered twice", f.Name))
+		}
+	}
+	formats = append(formats, f)
+}
+
+// Formats returns the registered output formats in registration order
+func Formats() []Format {
+	formatsMu.RLock()
+	defer formatsMu.RUnlock()
+	return append([]Format(nil), formats...)
+}
+
+// FormatNames returns the names of the registered output formats
+func FormatNames() []string {
+	var names []string
+	for _, f := range Formats() {
+		names = append(names, f.Name)
+	}
+	return names
+}
+
+// LookupFormat returns the registered output format with the given name
+func LookupFormat(name string) (Format, bool) {
+	formatsMu.RLock()
+	defer formatsMu.RUnlock()
+	for _, f := range formats {
+		if f.Name == name {
+			return f, true
+		}
+	}
+	return Format{}, false
+}
+
+// bookFormats are the formats books are stored in. FB2 books are served as
+// they are or converted to the registered formats; books in other formats are
+// served only as they are.
+var bookFormats = []Format{
+	{Name: "fb2", Title: "FB2", ContentType: "application/fb2+xml"},
+	{Name: "epub", Title: "EPUB", ContentType: "application/epub+zip"},
+	{Name: "pdf", Title: "PDF", ContentType: "application/pdf"},
+	{Name: "djvu", Title: "DjVu", ContentType: "image/vnd.djvu"},
+}
+
+// BookFormats returns the formats books are stored in
+func BookFormats() []Format {
+	return append([]Format(nil), bookFormats...)
+}
+
+// LookupBookFormat returns the format books stored as name are served in
+func LookupBookFormat(name string) (Format, bool) {
+	for _, f := range bookFormats {
+		if f.Name == name {
+			return f, true
+		}
+	}
+	return Format{}, false
+}
+
+func init() {
+	RegisterFormat(Format{Name: "epub", Title: "EPUB", ContentType: "application/epub+zip", Backend: fb2cBackend(fb2c.MobiTypeOld)})
+	RegisterFormat(Format{Name: "mobi", Title: "MOBI", ContentType: "application/x-mobipocket-ebook", Backend: fb2cBackend(fb2c.MobiTypeOld)})
+	RegisterFormat(Format{Name: "azw3", Title: "AZW3 (Kindle)", ContentType: "application/vnd.amazon.ebook", Backend: fb2cBackend(fb2c.MobiTypeNew)})
+	RegisterFormat(Format{Name: "txt", Title: "Plain text", ContentType: "text/plain; charset=utf-8", Backend: NewBackend("builtin", renderFB2(writeText))})
+	RegisterFormat(Format{Name: "html", Title: "HTML", ContentType: "text/html; charset=utf-8", Backend: NewBackend("builtin", renderFB2(writeHTML))})
+}
+
+// fb2cBackend converts with fb2c, which picks EPUB or a Kindle format from
+// the extension of dst; mobiType selects MOBI 6 or KF8 (AZW3) for the latter
+func fb2cBackend(mobiType string) Backend {
+	return NewBackend("fb2c", func(ctx context.Context, src, dst string) error {
+		opts := fb2c.DefaultConvertOptions()
+		opts.MobiType = mobiType
+		c := fb2c.NewConverter()
+		c.SetOptions(opts)
+		return c.Convert(src, dst)
+	})
+}
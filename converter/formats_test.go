@@ -0,0 +1,168 @@
+package converter
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"golang.org/x/text/encoding/charmap"
+)
+
+const sampleFB2 = `<?xml version="1.0" encoding="utf-8"?>
+<FictionBook xmlns="http://www.gribuser.ru/xml/fictionbook/2.0" xmlns:l="http://www.w3.org/1999/xlink">
+  <description>
+    <title-info>
+      <genre>prose</genre>
+      <author><first-name>Лев</first-name><last-name>Толстой</last-name></author>
+      <book-title>Война &amp; мир</book-title>
+      <coverpage><image l:href="#cover.png"/></coverpage>
+      <lang>ru</lang>
+    </title-info>
+  </description>
+  <body>
+    <section id="ch1">
+      <title><p>Глава 1</p></title>
+      <epigraph><p>Эпиграф</p><text-author>Автор</text-author></epigraph>
+      <p>Первый <emphasis>абзац</emphasis> со сноской<a l:href="#n1" type="note">[1]</a>.</p>
+      <empty-line/>
+      <poem><stanza><v>Строка один</v><v>Строка два</v></stanza></poem>
+    </section>
+  </body>
+  <body name="notes">
+    <section id="n1"><title><p>1</p></title><p>Текст сноски</p></section>
+  </body>
+  <binary id="cover.png" content-type="image/png">iVBORw0KGgo=</binary>
+</FictionBook>`
+
+func writeSample(t *testing.T, content []byte) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "book.fb2")
+	if err := os.WriteFile(path, content, 0o644); err != nil {
+		t.Fatalf("write FB2: %v", err)
+	}
+	return path
+}
+
+func TestFormats_Registered(t *testing.T) {
+	for _, name := range []string{"epub", "mobi", "azw3", "txt", "html"} {
+		f, ok := LookupFormat(name)
+		if !ok {
+			t.Errorf("format %s is not registered", name)
+			continue
+		}
+		if f.ContentType == "" || f.Title == "" || f.Backend == nil {
+			t.Errorf("format %s is incomplete: %+v", name, f)
+		}
+	}
+	if _, ok := LookupFormat("fb2"); ok {
+		t.Error("fb2 is a source format and must not be registered for conversion")
+	}
+}
+
+func TestFormats_Convert(t *testing.T) {
+	src := writeSample(t, []byte(sampleFB2))
+
+	tests := []struct {
+		format   string
+		contains [][]byte
+	}{
+		{format: "epub", contains: [][]byte{[]byte("PK"), []byte("application/epub+zip")}},
+		{format: "mobi", contains: [][]byte{[]byte("BOOKMOBI")}},
+		{format: "azw3", contains: [][]byte{[]byte("BOOKMOBI")}},
+		{format: "txt", contains: [][]byte{
+			[]byte("Война & мир\nЛев Толстой\n"),
+			[]byte("\nГлава 1\n\n"),
+			[]byte("Первый абзац со сноской[1].\n"),
+			[]byte("Строка один\nСтрока два\n"),
+			[]byte("Текст сноски\n"),
+		}},
+		{format: "html", contains: [][]byte{
+			[]byte(`<html lang="ru">`),
+			[]byte("<title>Война &amp; мир</title>"),
+			[]byte(`<img src="data:image/png;base64,iVBORw0KGgo="`),
+			[]byte(`<section id="ch1">`),
+			[]byte("<h3>Глава 1</h3>"),
+			[]byte(`<blockquote class="epigraph">`),
+			[]byte("<em>абзац</em>"),
+			[]byte(`<a href="#n1">[1]</a>`),
+			[]byte(`<p class="v">Строка один</p>`),
+			[]byte(`<div class="notes">`),
+			[]byte(`<section id="n1">`),
+		}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.format, func(t *testing.T) {
+			f, _ := LookupFormat(tt.format)
+			dst := filepath.Join(t.TempDir(), "out."+tt.format)
+			if err := f.Backend.Convert(context.Background(), src, dst); err != nil {
+				t.Fatalf("Convert failed: %v", err)
+			}
+			out, err := os.ReadFile(dst)
+			if err != nil {
+				t.Fatalf("read output: %v", err)
+			}
+			for _, want := range tt.contains {
+				if !bytes.Contains(out, want) {
+					t.Errorf("output does not contain %q", want)
+				}
+			}
+		})
+	}
+}
+
+func TestFormats_HTMLEscapesBinariesAndLinks(t *testing.T) {
+	src := writeSample(t, []byte(strings.NewReplacer(
+		`<binary id="cover.png" content-type="image/png">iVBORw0KGgo=</binary>`,
+		`<binary id="cover.png" content-type="image/png">iVBORw0KGgo=&quot;&gt;&lt;script&gt;alert(1)&lt;/script&gt;</binary>
+  <binary id="pic.png" content-type="image/png">iVBO
+    Rw0KGgo=</binary>`,
+		`<empty-line/>`,
+		`<p><a l:href="javascript:alert(1)">bad</a> <a l:href="https://example.com/?a=1&amp;b=2">good</a><image l:href="#pic.png"/></p>`,
+	).Replace(sampleFB2)))
+
+	f, _ := LookupFormat("html")
+	dst := filepath.Join(t.TempDir(), "out.html")
+	if err := f.Backend.Convert(context.Background(), src, dst); err != nil {
+		t.Fatalf("Convert failed: %v", err)
+	}
+	out, err := os.ReadFile(dst)
+	if err != nil {
+		t.Fatalf("read output: %v", err)
+	}
+	for _, unwanted := range []string{"<script>", "javascript:"} {
+		if bytes.Contains(out, []byte(unwanted)) {
+			t.Errorf("output contains %q", unwanted)
+		}
+	}
+	for _, want := range []string{
+		`<p>bad <a href="https://example.com/?a=1&amp;b=2">good</a>`,
+		`<img src="data:image/png;base64,iVBORw0KGgo="`,
+	} {
+		if !bytes.Contains(out, []byte(want)) {
+			t.Errorf("output does not contain %q", want)
+		}
+	}
+}
+
+func TestFormats_TextFromWindows1251(t *testing.T) {
+	encoded, err := charmap.Windows1251.NewEncoder().String(
+		strings.Replace(sampleFB2, `encoding="utf-8"`, `encoding="windows-1251"`, 1))
+	if err != nil {
+		t.Fatalf("encode sample: %v", err)
+	}
+	src := writeSample(t, []byte(encoded))
+
+	f, _ := LookupFormat("txt")
+	dst := filepath.Join(t.TempDir(), "out.txt")
+	if err := f.Backend.Convert(context.Background(), src, dst); err != nil {
+		t.Fatalf("Convert failed: %v", err)
+	}
+	out, _ := os.ReadFile(dst)
+	if !strings.HasPrefix(string(out), "Война & мир\n") {
+		t.Errorf("expected UTF-8 output, got %q", out[:min(len(out), 40)])
+	}
+}
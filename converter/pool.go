@@ -0,0 +1,91 @@
+package converter
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"runtime"
+	"time"
+
+	"github.com/htol/bopds/logger"
+)
+
+var (
+	// ErrConversionTimeout is returned when a conversion runs longer than the
+	// pool's per-job timeout
+	ErrConversionTimeout = errors.New("conversion timed out")
+	// ErrBusy is returned when no worker frees up within the pool's per-job
+	// timeout
+	ErrBusy = errors.New("all conversion workers are busy")
+)
+
+// Pool runs conversion jobs on a bounded number of workers, each job under
+// its own timeout. fb2c cannot be interrupted, so a timed-out conversion
+// keeps its worker until fb2c returns; when every worker is held that way,
+// new jobs give up waiting with ErrBusy.
+type Pool struct {
+	workers chan struct{}
+	timeout time.Duration
+}
+
+// NewPool creates a pool running at most workers jobs at once (one per CPU
+// when workers is 0), each limited to timeout
+func NewPool(workers int, timeout time.Duration) *Pool {
+	if workers <= 0 {
+		workers = runtime.NumCPU()
+	}
+	return &Pool{
+		workers: make(chan struct{}, workers),
+		timeout: timeout,
+	}
+}
+
+// Timeout returns the per-job timeout
+func (p *Pool) Timeout() time.Duration {
+	return p.timeout
+}
+
+// Run waits up to the per-job timeout for a free worker (ErrBusy) and runs
+// job on it. It returns as soon as the job finishes, its timeout expires
+// (ErrConversionTimeout) or ctx is cancelled. Jobs should honour their
+// context; one that does not keeps its worker busy until it returns, so a
+// stuck conversion never lets more than the configured number of jobs run.
+func (p *Pool) Run(ctx context.Context, job func(ctx context.Context) error) error {
+	var wait <-chan time.Time
+	if p.timeout > 0 {
+		timer := time.NewTimer(p.timeout)
+		defer timer.Stop()
+		wait = timer.C
+	}
+	select {
+	case p.workers <- struct{}{}:
+	case <-wait:
+		return fmt.Errorf("%w after waiting %s", ErrBusy, p.timeout)
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+
+	jobCtx, cancel := context.WithTimeout(ctx, p.timeout)
+	defer cancel()
+
+	done := make(chan error, 1)
+	start := time.Now()
+	go func() {
+		defer func() { <-p.workers }()
+		err := job(jobCtx)
+		if jobCtx.Err() != nil {
+			logger.Warn("Abandoned conversion finished", "duration", time.Since(start).Milliseconds(), "error", err)
+		}
+		done <- err
+	}()
+
+	select {
+	case err := <-done:
+		return err
+	case <-jobCtx.Done():
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		return fmt.Errorf("%w after %s", ErrConversionTimeout, p.timeout)
+	}
+}
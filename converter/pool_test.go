@@ -0,0 +1,126 @@
+package converter
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/htol/bopds/logger"
+)
+
+func init() {
+	// Initialize logger for tests
+	logger.Init("info")
+}
+
+func TestPool_Run(t *testing.T) {
+	release := make(chan struct{})
+	defer close(release)
+
+	tests := []struct {
+		name      string
+		timeout   time.Duration
+		cancel    bool
+		job       func(ctx context.Context) error
+		expectErr error
+	}{
+		{
+			name:    "job succeeds",
+			timeout: time.Second,
+			job:     func(context.Context) error { return nil },
+		},
+		{
+			name:      "job error is returned",
+			timeout:   time.Second,
+			job:       func(context.Context) error { return errTest },
+			expectErr: errTest,
+		},
+		{
+			name:      "stuck job times out",
+			timeout:   10 * time.Millisecond,
+			job:       func(context.Context) error { <-release; return nil },
+			expectErr: ErrConversionTimeout,
+		},
+		{
+			name:      "cancelled caller",
+			timeout:   time.Second,
+			cancel:    true,
+			job:       func(ctx context.Context) error { <-ctx.Done(); return ctx.Err() },
+			expectErr: context.Canceled,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			if tt.cancel {
+				time.AfterFunc(10*time.Millisecond, cancel)
+			}
+
+			err := NewPool(1, tt.timeout).Run(ctx, tt.job)
+			if tt.expectErr == nil && err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if tt.expectErr != nil && !errors.Is(err, tt.expectErr) {
+				t.Fatalf("expected %v, got %v", tt.expectErr, err)
+			}
+		})
+	}
+}
+
+var errTest = errors.New("broken FB2")
+
+func TestPool_BoundsWorkers(t *testing.T) {
+	pool := NewPool(2, time.Second)
+
+	var running, peak atomic.Int32
+	done := make(chan error)
+	for range 6 {
+		go func() {
+			done <- pool.Run(context.Background(), func(context.Context) error {
+				n := running.Add(1)
+				for {
+					p := peak.Load()
+					if n <= p || peak.CompareAndSwap(p, n) {
+						break
+					}
+				}
+				time.Sleep(5 * time.Millisecond)
+				running.Add(-1)
+				return nil
+			})
+		}()
+	}
+	for range 6 {
+		if err := <-done; err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+	if peak.Load() > 2 {
+		t.Errorf("expected at most 2 concurrent jobs, saw %d", peak.Load())
+	}
+}
+
+func TestPool_TimedOutJobKeepsWorker(t *testing.T) {
+	pool := NewPool(1, 10*time.Millisecond)
+	release := make(chan struct{})
+
+	err := pool.Run(context.Background(), func(context.Context) error { <-release; return nil })
+	if !errors.Is(err, ErrConversionTimeout) {
+		t.Fatalf("expected timeout, got %v", err)
+	}
+
+	// The abandoned job still occupies the only worker, and waiting for it
+	// is bounded by the timeout even without a caller deadline
+	if err := pool.Run(context.Background(), func(context.Context) error { return nil }); !errors.Is(err, ErrBusy) {
+		t.Fatalf("expected the busy worker to be given up on, got %v", err)
+	}
+
+	close(release)
+	if err := pool.Run(context.Background(), func(context.Context) error { return nil }); err != nil {
+		t.Fatalf("expected worker to be released, got %v", err)
+	}
+}
@@ -0,0 +1,376 @@
+package converter
+
+import (
+	"archive/zip"
+	"bufio"
+	"encoding/base64"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strings"
+)
+
+// Profile adjusts how a book is converted. The zero Profile leaves the
+// source and the backend's output untouched.
+type Profile struct {
+	Name        string   // identifies the profile in logs and job results
+	NoCover     bool     // drop the cover image
+	InlineNotes bool     // put notes in brackets where they are referenced instead of at the end
+	Hyphenation bool     // let reading systems hyphenate paragraphs (EPUB and HTML)
+	Fonts       []string // font files embedded as the body font (EPUB and HTML)
+}
+
+// FontMediaTypes maps the font file extensions a profile may embed to their
+// media types
+var FontMediaTypes = map[string]string{
+	".ttf":   "font/ttf",
+	".otf":   "font/otf",
+	".woff":  "font/woff",
+	".woff2": "font/woff2",
+}
+
+func (p Profile) rewritesSource() bool { return p.NoCover || p.InlineNotes }
+
+func (p Profile) stylesOutput() bool { return p.Hyphenation || len(p.Fonts) > 0 }
+
+// prepareSource writes the FB2 file at src with the profile's changes to dst
+func (p Profile) prepareSource(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return fmt.Errorf("open FB2: %w", err)
+	}
+	root, err := parseFB2Tree(in)
+	in.Close()
+	if err != nil {
+		return err
+	}
+
+	fb := root.child("FictionBook")
+	if p.NoCover {
+		if desc := fb.child("description"); desc != nil {
+			for _, info := range desc.children {
+				if info.name == "title-info" || info.name == "src-title-info" {
+					info.children = slices.DeleteFunc(info.children, func(c *fb2Node) bool { return c.name == "coverpage" })
+				}
+			}
+		}
+	}
+	if p.InlineNotes {
+		inlineNotes(fb)
+	}
+
+	out, err := os.Create(dst)
+	if err != nil {
+		return fmt.Errorf("create FB2: %w", err)
+	}
+	w := bufio.NewWriter(out)
+	w.WriteString(xml.Header)
+	writeFB2Node(w, fb)
+	if err := w.Flush(); err != nil {
+		out.Close()
+		return fmt.Errorf("write FB2: %w", err)
+	}
+	return out.Close()
+}
+
+// inlineNotes replaces links to notes with the note text in brackets and
+// drops the notes bodies
+func inlineNotes(fb *fb2Node) {
+	notes := make(map[string]string)
+	var kept []*fb2Node
+	for _, c := range fb.children {
+		if c.name == "body" && (c.attrs["name"] == "notes" || c.attrs["name"] == "comments") {
+			for _, section := range c.children {
+				if section.name == "section" && section.attrs["id"] != "" {
+					var parts []string
+					for _, part := range section.children {
+						if part.name != "" && part.name != "title" {
+							parts = append(parts, part.textContent())
+						}
+					}
+					notes[section.attrs["id"]] = strings.Join(parts, " ")
+				}
+			}
+			continue
+		}
+		kept = append(kept, c)
+	}
+	fb.children = kept
+
+	var walk func(n *fb2Node)
+	walk = func(n *fb2Node) {
+		for i, c := range n.children {
+			if c.name == "a" {
+				if note, ok := notes[strings.TrimPrefix(c.attrs["href"], "#")]; ok {
+					n.children[i] = &fb2Node{text: " [" + note + "]"}
+					continue
+				}
+			}
+			walk(c)
+		}
+	}
+	walk(fb)
+}
+
+// writeFB2Node serializes a parsed FB2 tree. Links are written in the xlink
+// namespace declared on the root element, as FB2 readers expect.
+func writeFB2Node(w *bufio.Writer, n *fb2Node) {
+	if n.name == "" {
+		xml.EscapeText(w, []byte(n.text))
+		return
+	}
+
+	w.WriteString("<" + n.name)
+	if n.name == "FictionBook" {
+		w.WriteString(` xmlns="http://www.gribuser.ru/xml/fictionbook/2.0" xmlns:l="http://www.w3.org/1999/xlink"`)
+	}
+	keys := make([]string, 0, len(n.attrs))
+	for k := range n.attrs {
+		keys = append(keys, k)
+	}
+	slices.Sort(keys)
+	for _, k := range keys {
+		name := k
+		if k == "href" {
+			name = "l:href"
+		}
+		w.WriteString(" " + name + `="`)
+		xml.EscapeText(w, []byte(n.attrs[k]))
+		w.WriteString(`"`)
+	}
+	if len(n.children) == 0 {
+		w.WriteString("/>")
+		return
+	}
+	w.WriteString(">")
+	for _, c := range n.children {
+		writeFB2Node(w, c)
+	}
+	w.WriteString("</" + n.name + ">")
+}
+
+// finishOutput applies the profile's styles to the converted file at path.
+// Only EPUB and HTML carry stylesheets; other formats are left as they are.
+func (p Profile) finishOutput(format, path string) error {
+	if !p.stylesOutput() {
+		return nil
+	}
+	switch format {
+	case "epub":
+		return p.styleEPUB(path)
+	case "html":
+		return p.styleHTML(path)
+	}
+	return nil
+}
+
+// embeddedFont is a font file of a profile
+type embeddedFont struct {
+	file      string // base name
+	mediaType string
+	data      []byte
+}
+
+func (p Profile) loadFonts() ([]embeddedFont, error) {
+	fonts := make([]embeddedFont, 0, len(p.Fonts))
+	for _, name := range p.Fonts {
+		mediaType, ok := FontMediaTypes[strings.ToLower(filepath.Ext(name))]
+		if !ok {
+			return nil, fmt.Errorf("unsupported font file %s", name)
+		}
+		data, err := os.ReadFile(name)
+		if err != nil {
+			return nil, fmt.Errorf("read font: %w", err)
+		}
+		fonts = append(fonts, embeddedFont{file: filepath.Base(name), mediaType: mediaType, data: data})
+	}
+	return fonts, nil
+}
+
+// stylesheet returns the profile's CSS, referring to each font by url(font)
+func (p Profile) stylesheet(fonts []embeddedFont, url func(embeddedFont) string) string {
+	var sb strings.Builder
+	for _, f := range fonts {
+		// Faces share one family; weight and style are guessed from the
+		// file name, e.g. PTSerif-BoldItalic.ttf
+		lower := strings.ToLower(f.file)
+		weight, style := "normal", "normal"
+		if strings.Contains(lower, "bold") {
+			weight = "bold"
+		}
+		if strings.Contains(lower, "italic") || strings.Contains(lower, "oblique") {
+			style = "italic"
+		}
+		fmt.Fprintf(&sb, "@font-face{font-family:\"bopds-embedded\";src:url(\"%s\");font-weight:%s;font-style:%s}\n", url(f), weight, style)
+	}
+	if len(fonts) > 0 {
+		sb.WriteString("body{font-family:\"bopds-embedded\",serif}\n")
+	}
+	if p.Hyphenation {
+		sb.WriteString("p{hyphens:auto;-webkit-hyphens:auto;-epub-hyphens:auto;adobe-hyphenate:auto}\n")
+	}
+	return sb.String()
+}
+
+// styleHTML adds the profile's stylesheet to a single-page HTML book, with
+// fonts embedded as data URIs
+func (p Profile) styleHTML(path string) error {
+	fonts, err := p.loadFonts()
+	if err != nil {
+		return err
+	}
+	page, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("read HTML: %w", err)
+	}
+	css := p.stylesheet(fonts, func(f embeddedFont) string {
+		return "data:" + f.mediaType + ";base64," + base64.StdEncoding.EncodeToString(f.data)
+	})
+	page = insertBeforeHeadEnd(page, "<style>\n"+css+"</style>\n")
+	if err := os.WriteFile(path, page, 0o644); err != nil {
+		return fmt.Errorf("write HTML: %w", err)
+	}
+	return nil
+}
+
+var (
+	headEndPattern     = regexp.MustCompile(`(?i)</head>`)
+	manifestEndPattern = regexp.MustCompile(`</(?:[A-Za-z]+:)?manifest>`)
+	rootfilePattern    = regexp.MustCompile(`full-path="([^"]+)"`)
+)
+
+func insertBeforeHeadEnd(page []byte, s string) []byte {
+	loc := headEndPattern.FindIndex(page)
+	if loc == nil {
+		return page
+	}
+	return slices.Concat(page[:loc[0]], []byte(s), page[loc[0]:])
+}
+
+// styleEPUB rewrites an EPUB with the profile's stylesheet and fonts added
+// to its package and linked from every content document
+func (p Profile) styleEPUB(epubPath string) error {
+	fonts, err := p.loadFonts()
+	if err != nil {
+		return err
+	}
+	r, err := zip.OpenReader(epubPath)
+	if err != nil {
+		return fmt.Errorf("open EPUB: %w", err)
+	}
+	defer r.Close()
+
+	opfPath, err := epubRootfile(&r.Reader)
+	if err != nil {
+		return err
+	}
+	opfDir := path.Dir(opfPath)
+	cssPath := path.Join(opfDir, "bopds.css")
+
+	tmp := epubPath + ".tmp"
+	out, err := os.Create(tmp)
+	if err != nil {
+		return fmt.Errorf("create EPUB: %w", err)
+	}
+	defer os.Remove(tmp)
+	w := zip.NewWriter(out)
+
+	for _, f := range r.File {
+		ext := strings.ToLower(path.Ext(f.Name))
+		switch {
+		case f.Name == opfPath:
+			items := `<item id="bopds-css" href="bopds.css" media-type="text/css"/>`
+			for i, font := range fonts {
+				items += fmt.Sprintf(`<item id="bopds-font-%d" href="fonts/%s" media-type="%s"/>`, i, font.file, font.mediaType)
+			}
+			err = rewriteEntry(w, f, func(b []byte) []byte {
+				loc := manifestEndPattern.FindIndex(b)
+				if loc == nil {
+					return b
+				}
+				return slices.Concat(b[:loc[0]], []byte(items+"\n"), b[loc[0]:])
+			})
+		case ext == ".xhtml" || ext == ".html" || ext == ".htm":
+			href, relErr := filepath.Rel(filepath.FromSlash(path.Dir(f.Name)), filepath.FromSlash(cssPath))
+			if relErr != nil {
+				href = cssPath
+			}
+			link := fmt.Sprintf(`<link rel="stylesheet" type="text/css" href="%s"/>`, filepath.ToSlash(href))
+			err = rewriteEntry(w, f, func(b []byte) []byte { return insertBeforeHeadEnd(b, link) })
+		default:
+			err = w.Copy(f)
+		}
+		if err != nil {
+			out.Close()
+			return fmt.Errorf("rewrite EPUB entry %s: %w", f.Name, err)
+		}
+	}
+
+	css := p.stylesheet(fonts, func(f embeddedFont) string { return "fonts/" + f.file })
+	if err := writeEntry(w, cssPath, []byte(css)); err != nil {
+		out.Close()
+		return err
+	}
+	for _, f := range fonts {
+		if err := writeEntry(w, path.Join(opfDir, "fonts", f.file), f.data); err != nil {
+			out.Close()
+			return err
+		}
+	}
+	if err := w.Close(); err != nil {
+		out.Close()
+		return fmt.Errorf("write EPUB: %w", err)
+	}
+	if err := out.Close(); err != nil {
+		return fmt.Errorf("write EPUB: %w", err)
+	}
+	return os.Rename(tmp, epubPath)
+}
+
+// epubRootfile returns the path of the package document named in
+// META-INF/container.xml
+func epubRootfile(r *zip.Reader) (string, error) {
+	f, err := r.Open("META-INF/container.xml")
+	if err != nil {
+		return "", fmt.Errorf("open EPUB container: %w", err)
+	}
+	defer f.Close()
+	b, err := io.ReadAll(f)
+	if err != nil {
+		return "", fmt.Errorf("read EPUB container: %w", err)
+	}
+	m := rootfilePattern.FindSubmatch(b)
+	if m == nil {
+		return "", fmt.Errorf("EPUB container has no rootfile")
+	}
+	return string(m[1]), nil
+}
+
+func rewriteEntry(w *zip.Writer, f *zip.File, rewrite func([]byte) []byte) error {
+	rc, err := f.Open()
+	if err != nil {
+		return err
+	}
+	b, err := io.ReadAll(rc)
+	rc.Close()
+	if err != nil {
+		return err
+	}
+	return writeEntry(w, f.Name, rewrite(b))
+}
+
+func writeEntry(w *zip.Writer, name string, data []byte) error {
+	entry, err := w.CreateHeader(&zip.FileHeader{Name: name, Method: zip.Deflate})
+	if err != nil {
+		return fmt.Errorf("add EPUB entry %s: %w", name, err)
+	}
+	if _, err := entry.Write(data); err != nil {
+		return fmt.Errorf("write EPUB entry %s: %w", name, err)
+	}
+	return nil
+}
@@ -0,0 +1,143 @@
+package converter
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestProfile_PrepareSource(t *testing.T) {
+	src := writeSample(t, []byte(sampleFB2))
+
+	tests := []struct {
+		name           string
+		profile        Profile
+		contains       []string
+		doesNotContain []string
+	}{
+		{
+			name:           "no cover",
+			profile:        Profile{NoCover: true},
+			contains:       []string{`<a l:href="#n1" type="note">[1]</a>`, `<body name="notes">`},
+			doesNotContain: []string{"<coverpage>"},
+		},
+		{
+			name:           "inline notes",
+			profile:        Profile{InlineNotes: true},
+			contains:       []string{"со сноской [Текст сноски].", `<image l:href="#cover.png"/>`},
+			doesNotContain: []string{`<body name="notes">`, `type="note"`},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dst := filepath.Join(t.TempDir(), "source.fb2")
+			if err := tt.profile.prepareSource(src, dst); err != nil {
+				t.Fatalf("prepareSource failed: %v", err)
+			}
+			out, _ := os.ReadFile(dst)
+			for _, want := range tt.contains {
+				if !strings.Contains(string(out), want) {
+					t.Errorf("output does not contain %q", want)
+				}
+			}
+			for _, unwanted := range tt.doesNotContain {
+				if strings.Contains(string(out), unwanted) {
+					t.Errorf("output contains %q", unwanted)
+				}
+			}
+			// The rewritten source must still be a readable FB2 document
+			f, _ := os.Open(dst)
+			defer f.Close()
+			if doc, err := parseFB2(f); err != nil || doc.title != "Война & мир" {
+				t.Errorf("rewritten source does not parse: %v", err)
+			}
+		})
+	}
+}
+
+func TestProfile_Convert(t *testing.T) {
+	src := writeSample(t, []byte(sampleFB2))
+	font := filepath.Join(t.TempDir(), "Serif-Bold.ttf")
+	if err := os.WriteFile(font, []byte("font data"), 0o644); err != nil {
+		t.Fatalf("write font: %v", err)
+	}
+	profile := Profile{Name: "reader", NoCover: true, InlineNotes: true, Hyphenation: true, Fonts: []string{font}}
+	c := New(NewPool(1, 30*time.Second), nil, nil)
+
+	t.Run("epub", func(t *testing.T) {
+		rc, _, err := c.ConvertFB2(context.Background(), src, "epub", profile)
+		if err != nil {
+			t.Fatalf("ConvertFB2 failed: %v", err)
+		}
+		defer rc.Close()
+		data, _ := io.ReadAll(rc)
+		zr, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+		if err != nil {
+			t.Fatalf("result is not a ZIP: %v", err)
+		}
+		if zr.File[0].Name != "mimetype" || zr.File[0].Method != zip.Store {
+			t.Errorf("mimetype must stay the first, stored entry")
+		}
+
+		entries := make(map[string]string)
+		for _, f := range zr.File {
+			r, _ := f.Open()
+			b, _ := io.ReadAll(r)
+			r.Close()
+			entries[f.Name] = string(b)
+		}
+		var css, opf, xhtml string
+		for name, content := range entries {
+			switch {
+			case strings.HasSuffix(name, "bopds.css"):
+				css = content
+			case strings.HasSuffix(name, ".opf"):
+				opf = content
+			case strings.HasSuffix(name, ".xhtml"):
+				xhtml += content
+			case strings.HasSuffix(name, "fonts/Serif-Bold.ttf"):
+				if content != "font data" {
+					t.Errorf("unexpected font content %q", content)
+				}
+			}
+		}
+		for _, want := range []string{"hyphens:auto", `src:url("fonts/Serif-Bold.ttf");font-weight:bold`} {
+			if !strings.Contains(css, want) {
+				t.Errorf("stylesheet does not contain %q: %s", want, css)
+			}
+		}
+		if !strings.Contains(opf, `href="fonts/Serif-Bold.ttf" media-type="font/ttf"`) || !strings.Contains(opf, `href="bopds.css"`) {
+			t.Errorf("manifest does not list the stylesheet and font: %s", opf)
+		}
+		if !strings.Contains(xhtml, `bopds.css"/>`) {
+			t.Error("content documents do not link the stylesheet")
+		}
+		if !strings.Contains(xhtml, "[Текст сноски]") {
+			t.Error("notes were not inlined")
+		}
+	})
+
+	t.Run("html", func(t *testing.T) {
+		rc, _, err := c.ConvertFB2(context.Background(), src, "html", profile)
+		if err != nil {
+			t.Fatalf("ConvertFB2 failed: %v", err)
+		}
+		defer rc.Close()
+		out, _ := io.ReadAll(rc)
+		for _, want := range []string{"hyphens:auto", "data:font/ttf;base64,", "[Текст сноски]"} {
+			if !strings.Contains(string(out), want) {
+				t.Errorf("output does not contain %q", want)
+			}
+		}
+		if strings.Contains(string(out), "data:image/png") {
+			t.Error("cover was not dropped")
+		}
+	})
+}
@@ -6,13 +6,23 @@ export const fetchAPI = async (endpoint, options = {}) => {
   return res.json()
 }
 
-// Download a book file (FB2 or EPUB)
-export const downloadBook = async (bookId, format = 'fb2') => {
-  const res = await fetch(`${BASE_URL}/api/books/${bookId}/download?format=${format}`)
+// Formats served straight from the archive; every other format is produced
+// by a background conversion job instead of a direct download
+const SOURCE_FORMATS = ['fb2', 'fb2.zip']
+const JOB_POLL_INTERVAL = 1000
+
+const sleep = (ms) => new Promise((resolve) => setTimeout(resolve, ms))
+
+// Save a download response as a file, named after its Content-Disposition header
+const saveResponse = async (res, fallbackName) => {
+  if (!res.ok) {
+    const errorText = await res.text()
+    throw new Error(errorText || res.statusText)
+  }
 
   // Extract filename from Content-Disposition header
   const contentDisposition = res.headers.get('Content-Disposition')
-  let filename = `book.${format}`
+  let filename = fallbackName
   if (contentDisposition) {
     // Try RFC 5987 encoding first (filename*=UTF-8''...)
     const utf8Match = contentDisposition.match(/filename\*=UTF-8''([^;]+)/i)
@@ -27,11 +37,6 @@ export const downloadBook = async (bookId, format = 'fb2') => {
     }
   }
 
-  if (!res.ok) {
-    const errorText = await res.text()
-    throw new Error(errorText || res.statusText)
-  }
-
   const blob = await res.blob()
   const url = window.URL.createObjectURL(blob)
   const a = document.createElement('a')
@@ -43,11 +48,50 @@ export const downloadBook = async (bookId, format = 'fb2') => {
   document.body.removeChild(a)
 }
 
+// Queue a conversion and poll the job until its result is ready.
+// onProgress receives the job (status and progress percent) after each poll.
+const convertBook = async (bookId, format, onProgress) => {
+  const res = await fetch(`${BASE_URL}/api/books/${bookId}/convert?format=${format}`, { method: 'POST' })
+  if (!res.ok) {
+    const errorText = await res.text()
+    throw new Error(errorText || res.statusText)
+  }
+  let job = await res.json()
+
+  while (job.status !== 'done') {
+    if (job.status === 'failed') throw new Error(job.error || 'Conversion failed')
+    if (onProgress) onProgress(job)
+    await sleep(JOB_POLL_INTERVAL)
+    job = await fetchAPI(`/api/jobs/${job.id}`)
+  }
+  if (onProgress) onProgress(job)
+  return job
+}
+
+// Download a book file. Converted formats are produced by a background job
+// that is polled until ready, so big books do not hit HTTP timeouts. Books
+// stored in another format than FB2 (bookFormat) are served as they are.
+export const downloadBook = async (bookId, format = 'fb2', onProgress, bookFormat = 'fb2') => {
+  if (!SOURCE_FORMATS.includes(format) && format !== bookFormat) {
+    const job = await convertBook(bookId, format, onProgress)
+    const res = await fetch(`${BASE_URL}${job.download_url}`)
+    return saveResponse(res, job.filename || `book.${format}`)
+  }
+
+  const res = await fetch(`${BASE_URL}/api/books/${bookId}/download?format=${format}`)
+  return saveResponse(res, `book.${format}`)
+}
+
 export const api = {
+  // List endpoints return a page: { items, total, next }
   getGenres: () => fetchAPI('/api/genres'),
-  getAuthors: (letter) => fetchAPI(`/api/authors?startsWith=${letter}`),
-  getBooks: (letter) => fetchAPI(`/api/books?startsWith=${letter}`),
-  getBooksByAuthor: (authorId) => fetchAPI(`/api/authors/${authorId}/books`),
+  getFormats: () => fetchAPI('/api/formats'),
+  getAuthors: (letter, limit = 50, offset = 0) =>
+    fetchAPI(`/api/authors?startsWith=${encodeURIComponent(letter)}&limit=${limit}&offset=${offset}`),
+  getBooks: (letter, limit = 50, offset = 0) =>
+    fetchAPI(`/api/books?startsWith=${encodeURIComponent(letter)}&limit=${limit}&offset=${offset}`),
+  getBooksByAuthor: (authorId, limit = 50, offset = 0) =>
+    fetchAPI(`/api/authors/${authorId}/books?limit=${limit}&offset=${offset}`),
   getAuthorById: (authorId) => fetchAPI(`/api/authors/${authorId}`),
   getLanguages: () => fetchAPI('/api/languages'),
   searchBooks: (query, limit = 20, offset = 0, fields = [], languages = []) => {
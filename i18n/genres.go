@@ -0,0 +1,353 @@
+package i18n
+
+// englishGenreCategories names the built-in genre categories in English
+var englishGenreCategories = map[string]string{
+	"sf":         "Science Fiction and Fantasy",
+	"detective":  "Mysteries and Thrillers",
+	"prose":      "Fiction",
+	"love":       "Romance",
+	"adventure":  "Adventure",
+	"children":   "Children's",
+	"poetry":     "Poetry",
+	"dramaturgy": "Drama",
+	"antique":    "Early Literature",
+	"science":    "Science and Education",
+	"computers":  "Computers and Internet",
+	"technics":   "Technology",
+	"reference":  "Reference",
+	"nonfiction": "Nonfiction",
+	"religion":   "Religion and Spirituality",
+	"humor":      "Humor",
+	"home":       "Home and Family",
+	"business":   "Business",
+	"military":   "Military",
+	"art":        "Arts",
+	"folklore":   "Folklore",
+	"other":      "Other",
+}
+
+// englishGenres names the genres of the catalog in English. Genres missing
+// here are shown by their transliterated Russian names.
+var englishGenres = map[string]string{
+	"about_musicians":                 "Biographies and Memoirs: Musicians, Composers, Artists",
+	"adv_all":                         "Adventure",
+	"adv_animal":                      "Nature and Animals",
+	"adv_detective":                   "Adventure Mystery",
+	"adv_geo":                         "Travel and Geography",
+	"adv_history":                     "Historical Adventure",
+	"adv_indian":                      "Westerns, Native Americans",
+	"adv_maritime":                    "Sea Adventure",
+	"adv_modern":                      "Modern Adventure",
+	"adv_story":                       "Picaresque Novel",
+	"adv_western":                     "Western",
+	"adventure":                       "Adventure",
+	"adventure_fantasy":               "Adventure Fantasy",
+	"antique":                         "Classical Antiquity",
+	"antique_ant":                     "Classical Antiquity",
+	"antique_east":                    "Ancient Eastern Literature",
+	"antique_european":                "Early European Literature",
+	"antique_myths":                   "Myths, Legends, Epics",
+	"antique_russian":                 "Old Russian Literature",
+	"aphorisms":                       "Aphorisms and Quotations",
+	"architecture_book":               "Sculpture and Architecture",
+	"art_criticism":                   "Art Criticism",
+	"art_world_culture":               "World Art and Culture",
+	"asian_fantasy":                   "Asian Fantasy",
+	"astrology":                       "Astrology and Palmistry",
+	"auto_business":                   "Motoring",
+	"auto_regulations":                "Cars and Traffic Rules",
+	"banking":                         "Finance",
+	"child_adv":                       "Children's Adventure",
+	"child_adv_animal":                "Children's Books about Animals and Nature",
+	"child_classical":                 "Children's Classics",
+	"child_det":                       "Children's Thrillers",
+	"child_det_animal_detectives":     "Children's Mysteries: Animal Detectives",
+	"child_det_children_detectives":   "Children's Mysteries: Kid Detectives",
+	"child_det_other":                 "Children's Mysteries",
+	"child_dramaturgy":                "Plays for Children and Teenagers",
+	"child_education":                 "Children's Educational Books",
+	"child_folklore":                  "Children's Folklore",
+	"child_prose":                     "Children's Fiction",
+	"child_prose_history":             "Children's War and Historical Fiction",
+	"child_prose_humor":               "Children's Humor and School Stories",
+	"child_prose_romantic":            "Children's Romance",
+	"child_sf":                        "Children's Science Fiction",
+	"child_sf_fantasy":                "Children's Fantasy",
+	"child_sf_horror":                 "Children's Horror and Mystery",
+	"child_sf_hronoopera":             "Children's Time Travel",
+	"child_sf_space":                  "Children's Space Adventure and Aliens",
+	"child_tale":                      "Fairy Tales",
+	"child_tale_foreign_writers":      "Fairy Tales by Foreign Writers",
+	"child_tale_rus":                  "Russian Fairy Tales",
+	"child_tale_russian_writers":      "Fairy Tales by Russian Writers",
+	"child_verse":                     "Poetry for Children and Teenagers",
+	"children":                        "Children's Books",
+	"boyar_anime":                     "Boyar Anime",
+	"cine":                            "Cinema",
+	"comedy":                          "Comedy",
+	"comics":                          "Comics",
+	"comp_db":                         "Programming and Databases",
+	"comp_hard":                       "Computer Hardware and Signal Processing",
+	"comp_os":                         "Operating Systems",
+	"comp_programming":                "Programming",
+	"comp_soft":                       "Software",
+	"comp_www":                        "Networking and the Internet",
+	"computer_translation":            "Machine Translation",
+	"computers":                       "Computers",
+	"dark_fantasy":                    "Dark Fantasy",
+	"design":                          "Art and Design",
+	"det_action":                      "Action",
+	"det_artifact":                    "Artifact Mysteries",
+	"det_classic":                     "Classic Mystery",
+	"det_cozy":                        "Cozy Mystery",
+	"det_crime":                       "Crime",
+	"det_espionage":                   "Espionage",
+	"det_hard":                        "Hardboiled",
+	"det_history":                     "Historical Mystery",
+	"det_ironic":                      "Comic Mystery",
+	"det_irony":                       "Comic Mystery",
+	"det_lady":                        "Women's Mystery",
+	"det_legal":                       "Legal Thriller",
+	"det_maniac":                      "Serial Killers",
+	"det_other":                       "Mysteries and Thrillers",
+	"det_police":                      "Police Procedural",
+	"det_political":                   "Political Thriller",
+	"det_soft":                        "Soft-Boiled Mystery",
+	"det_su":                          "Soviet Mystery",
+	"det_thriller":                    "Thriller",
+	"detective":                       "Mystery",
+	"dorama":                          "Dorama",
+	"drama":                           "Drama",
+	"drama_antique":                   "Classical Drama",
+	"dramaturgy":                      "Plays",
+	"dystopian":                       "Dystopia",
+	"economics":                       "Economics",
+	"economics_ref":                   "Business",
+	"epic":                            "Byliny and Epics",
+	"epic_poetry":                     "Epic Poetry",
+	"epistolary_fiction":              "Epistolary Fiction",
+	"equ_history":                     "History of Technology",
+	"essay":                           "Essays",
+	"everyday_fantasy":                "Slice of Life Fantasy",
+	"experimental_poetry":             "Experimental Poetry",
+	"fable":                           "Fables",
+	"fairy_fantasy":                   "Mythic Fantasy",
+	"family":                          "Family Relationships",
+	"fan_translation":                 "Fan Translations",
+	"fanfiction":                      "Fan Fiction",
+	"fantasy_det":                     "Fantasy Mystery",
+	"folk_songs":                      "Folk Songs",
+	"folk_tale":                       "Folk Tales",
+	"folklore":                        "Folklore and Riddles",
+	"foreign_antique":                 "Medieval Classics",
+	"foreign_children":                "Foreign Children's Books",
+	"foreign_language":                "Foreign Languages",
+	"foreign_prose":                   "Foreign Classics",
+	"foreign_sf":                      "Foreign Science Fiction and Fantasy",
+	"geo_guides":                      "Guidebooks, Maps and Atlases",
+	"gothic_novel":                    "Gothic Novel",
+	"great_story":                     "Novels and Novellas",
+	"historical_fantasy":              "Historical Fantasy",
+	"home":                            "Home and Family",
+	"home_collecting":                 "Collecting",
+	"home_cooking":                    "Cooking",
+	"home_crafts":                     "Hobbies and Crafts",
+	"home_diy":                        "Do It Yourself",
+	"home_entertain":                  "Entertainment",
+	"home_garden":                     "Gardening",
+	"home_health":                     "Health",
+	"home_pets":                       "Pets",
+	"home_sex":                        "Relationships and Sex",
+	"home_sport":                      "Sports and Martial Arts",
+	"hronoopera":                      "Time Travel",
+	"humor":                           "Humor",
+	"humor_anecdote":                  "Jokes",
+	"humor_fantasy":                   "Humorous Science Fiction",
+	"humor_prose":                     "Humorous Fiction",
+	"humor_satire":                    "Satire",
+	"humor_verse":                     "Humorous Verse and Fables",
+	"in_verse":                        "In Verse",
+	"limerick":                        "Chastushki and Nursery Rhymes",
+	"literature_18":                   "17th and 18th Century Classics",
+	"literature_19":                   "19th Century Classics",
+	"literature_20":                   "20th Century Classics",
+	"love":                            "Romance",
+	"love_contemporary":               "Contemporary Romance",
+	"love_detective":                  "Romantic Suspense",
+	"love_erotica":                    "Erotica",
+	"love_hard":                       "Adult",
+	"love_historical":                 "Historical Romance",
+	"love_history":                    "Historical Romance",
+	"love_sf":                         "Romantic Fantasy",
+	"love_short":                      "Short Romance",
+	"lyrics":                          "Lyric Poetry",
+	"magic_school":                    "Magic Academy",
+	"management":                      "Management",
+	"marketing":                       "Marketing",
+	"military_all":                    "Military Science",
+	"military_arts":                   "Martial Arts",
+	"military_history":                "Military History",
+	"military_special":                "Military Science",
+	"military_weapon":                 "Military Equipment and Weapons",
+	"modern_tale":                     "Modern Fairy Tales",
+	"music":                           "Music",
+	"network_literature":              "Self-Published and Web Fiction",
+	"nonf_biography":                  "Biographies and Memoirs",
+	"nonf_biography_celebrities":      "Biographies and Memoirs: Film, Theatre and Show Business",
+	"nonf_biography_historical":       "Biographies and Memoirs: Historical Figures",
+	"nonf_biography_military_figures": "Military Memoirs",
+	"nonf_biography_writers":          "Biographies and Memoirs: Writers and Poets",
+	"nonf_criticism":                  "Criticism",
+	"nonf_military":                   "Military Nonfiction",
+	"nonf_publicism":                  "Journalism",
+	"nonfiction":                      "Nonfiction",
+	"notes":                           "Sheet Music",
+	"nsf":                             "Non-Science Fiction",
+	"org_behavior":                    "Marketing and PR",
+	"other":                           "Uncategorized",
+	"painting":                        "Painting and Art Albums",
+	"palindromes":                     "Visual Poetry, Free Verse and Palindromes",
+	"periodic":                        "Magazines and Newspapers",
+	"personal_finance":                "Personal Finance",
+	"poem":                            "Narrative Poems",
+	"poetry":                          "Poetry",
+	"poetry_classical":                "Classic Poetry",
+	"poetry_east":                     "Eastern Poetry",
+	"poetry_for_classical":            "Classic Foreign Poetry",
+	"poetry_for_modern":               "Modern Foreign Poetry",
+	"poetry_modern":                   "Modern Poetry",
+	"poetry_rus_classical":            "Classic Russian Poetry",
+	"poetry_rus_modern":               "Modern Russian Poetry",
+	"popadancy":                       "Isekai",
+	"popadanec":                       "Isekai",
+	"popular_business":                "Careers",
+	"prose":                           "Fiction",
+	"prose_abs":                       "Absurdist Fiction",
+	"prose_classic":                   "Classics",
+	"prose_contemporary":              "Contemporary Fiction",
+	"prose_counter":                   "Counterculture",
+	"prose_game":                      "Children's Activities",
+	"prose_history":                   "Historical Fiction",
+	"prose_magic":                     "Magical Realism",
+	"prose_military":                  "War Fiction",
+	"prose_neformatny":                "Experimental Fiction",
+	"prose_rus_classic":               "Russian Classics",
+	"prose_sentimental":               "Sentimental Fiction",
+	"prose_su_classics":               "Soviet Classics",
+	"proverbs":                        "Proverbs and Sayings",
+	"psy_sex_and_family":              "Sex and Family Psychology",
+	"psy_theraphy":                    "Psychotherapy",
+	"ref_dict":                        "Dictionaries",
+	"ref_encyc":                       "Encyclopedias",
+	"ref_guide":                       "Guides",
+	"ref_ref":                         "Reference Books",
+	"reference":                       "Reference",
+	"religion":                        "Religion",
+	"religion_budda":                  "Buddhism",
+	"religion_catholicism":            "Catholicism",
+	"religion_christianity":           "Christianity",
+	"religion_esoterics":              "Esotericism",
+	"religion_hinduism":               "Hinduism",
+	"religion_islam":                  "Islam",
+	"religion_judaism":                "Judaism",
+	"religion_orthodoxy":              "Orthodox Christianity",
+	"religion_paganism":               "Paganism",
+	"religion_protestantism":          "Protestantism",
+	"religion_rel":                    "Religion",
+	"religion_self":                   "Self-Improvement",
+	"roman":                           "Novels",
+	"russian_fantasy":                 "Russian Fantasy",
+	"sagas":                           "Sagas",
+	"scenarios":                       "Scripts",
+	"sci_biology":                     "Biology, Biophysics, Biochemistry",
+	"sci_botany":                      "Botany",
+	"sci_build":                       "Construction and Strength of Materials",
+	"sci_business":                    "Business",
+	"sci_chem":                        "Chemistry",
+	"sci_cosmos":                      "Astronomy and Space",
+	"sci_culture":                     "Cultural Studies",
+	"sci_ecology":                     "Ecology",
+	"sci_economy":                     "Economics",
+	"sci_geo":                         "Geology and Geography",
+	"sci_history":                     "History",
+	"sci_juris":                       "Law",
+	"sci_linguistic":                  "Linguistics",
+	"sci_math":                        "Mathematics",
+	"sci_medicine":                    "Medicine",
+	"sci_medicine_alternative":        "Alternative Medicine",
+	"sci_metal":                       "Metallurgy",
+	"sci_oriental":                    "Oriental Studies",
+	"sci_pedagogy":                    "Education and Parenting",
+	"sci_philology":                   "Literary Studies",
+	"sci_philosophy":                  "Philosophy",
+	"sci_phys":                        "Physics",
+	"sci_politics":                    "Politics",
+	"sci_popular":                     "Popular Science",
+	"sci_psychology":                  "Psychology and Psychotherapy",
+	"sci_psychology_popular":          "Popular Psychology",
+	"sci_radio":                       "Electronics",
+	"sci_religion":                    "Religious Studies",
+	"sci_social_studies":              "Social Sciences",
+	"sci_state":                       "State and Law",
+	"sci_tech":                        "Engineering",
+	"sci_textbook":                    "Textbooks",
+	"sci_theories":                    "Alternative Science",
+	"sci_transport":                   "Transport and Aviation",
+	"sci_veterinary":                  "Veterinary Medicine",
+	"sci_zoo":                         "Zoology",
+	"science":                         "Science",
+	"screenplays":                     "Screenplays",
+	"sf":                              "Science Fiction",
+	"sf_action":                       "Action Science Fiction and Fantasy",
+	"sf_cyberpunk":                    "Cyberpunk",
+	"sf_cyberpunk_f":                  "Cyberpunk Fantasy",
+	"sf_detective":                    "Science Fiction Mystery",
+	"sf_detective_f":                  "Fantasy Mystery",
+	"sf_epic":                         "Epic Science Fiction and Fantasy",
+	"sf_etc":                          "Speculative Fiction",
+	"sf_fantasy":                      "Fantasy",
+	"sf_fantasy_city":                 "Urban Fantasy",
+	"sf_fantasy_f":                    "Fantasy",
+	"sf_fantasy_irony":                "Comic Fantasy",
+	"sf_heroic":                       "Heroic Fantasy",
+	"sf_history":                      "Alternate History",
+	"sf_horror":                       "Horror",
+	"sf_horror_f":                     "Horror and Mystic Fantasy",
+	"sf_humor":                        "Humorous Science Fiction and Fantasy",
+	"sf_humor_f":                      "Humorous Fantasy",
+	"sf_industrial_magic":             "Industrial Magic",
+	"sf_irony":                        "Comic Science Fiction",
+	"sf_litrpg":                       "LitRPG",
+	"sf_mystic":                       "Mysticism",
+	"sf_postapocalyptic":              "Post-Apocalyptic",
+	"sf_realrpg":                      "RealRPG",
+	"sf_social":                       "Social Science Fiction",
+	"sf_social_f":                     "Social Fantasy",
+	"sf_space":                        "Space Fiction",
+	"sf_space_f":                      "Space Fantasy",
+	"sf_space_opera":                  "Space Opera",
+	"sf_stimpank":                     "Steampunk",
+	"sf_su":                           "Soviet Science Fiction",
+	"sf_technofantasy":                "Technofantasy",
+	"short_story":                     "Short Stories",
+	"slavic_fantasy":                  "Slavic Fantasy",
+	"song_poetry":                     "Song Lyrics",
+	"stock":                           "Securities",
+	"story":                           "Short Fiction",
+	"tale_chivalry":                   "Chivalric Romance",
+	"tbg_computers":                   "Computer Tutorials",
+	"tbg_higher":                      "University Textbooks",
+	"tbg_school":                      "School Textbooks",
+	"tbg_secondary":                   "Secondary and Vocational Textbooks",
+	"theatre":                         "Theatre",
+	"thriller":                        "Thriller",
+	"thriller_medical":                "Medical Thriller",
+	"thriller_techno":                 "Techno-Thriller",
+	"tragedy":                         "Tragedy",
+	"travel_notes":                    "Travel Writing",
+	"unfinished":                      "Unfinished",
+	"utopia":                          "Utopia",
+	"vaudeville":                      "Mystery Plays, Farce, Vaudeville",
+	"visual_arts":                     "Visual Arts",
+	"ya":                              "Young Adult",
+}
@@ -0,0 +1,139 @@
+// Package i18n localizes the text of OPDS feeds and API responses. Messages
+// are keyed by their English text and formatted with fmt verbs; Russian
+// translations live in the message catalog.
+package i18n
+
+import (
+	"cmp"
+	"net/http"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/htol/bopds/book"
+	"golang.org/x/text/language"
+	"golang.org/x/text/language/display"
+	"golang.org/x/text/message"
+	"golang.org/x/text/message/catalog"
+)
+
+// Supported languages; the first one is the default
+var supported = []language.Tag{language.English, language.Russian}
+
+var matcher = language.NewMatcher(supported)
+
+var messages = newCatalog()
+
+// Languages returns the codes of the supported languages, e.g. "en"
+func Languages() []string {
+	codes := make([]string, len(supported))
+	for i, tag := range supported {
+		codes[i] = tag.String()
+	}
+	return codes
+}
+
+// Printer formats messages in one language
+type Printer struct {
+	*message.Printer
+	Lang string // language code, e.g. "ru"
+}
+
+// New returns the printer of the supported language closest to lang,
+// falling back to English
+func New(lang string) *Printer {
+	tag, _ := language.Parse(lang)
+	_, i, _ := matcher.Match(tag)
+	return newPrinter(supported[i])
+}
+
+func newPrinter(tag language.Tag) *Printer {
+	return &Printer{
+		Printer: message.NewPrinter(tag, message.Catalog(messages)),
+		Lang:    tag.String(),
+	}
+}
+
+// FromRequest returns the printer for the language a request asks for: the
+// lang query parameter, then the Accept-Language header, then fallback
+func FromRequest(r *http.Request, fallback string) *Printer {
+	if lang := r.URL.Query().Get("lang"); lang != "" {
+		return New(lang)
+	}
+	if accept := r.Header.Get("Accept-Language"); accept != "" {
+		tags, _, err := language.ParseAcceptLanguage(accept)
+		if err == nil && len(tags) > 0 {
+			if _, i, confidence := matcher.Match(tags...); confidence != language.No {
+				return newPrinter(supported[i])
+			}
+		}
+	}
+	return New(fallback)
+}
+
+// Genre returns the name of a genre: the catalog's Russian display name in
+// Russian; in English the translated name, or the transliterated display
+// name for genres without one
+func (p *Printer) Genre(g book.Genre) string {
+	return p.localizedName(englishGenres, g.Name, g.DisplayName, g.TranslitName)
+}
+
+// GenreCategory returns the name of a genre category, like Genre does for
+// genres
+func (p *Printer) GenreCategory(c book.GenreCategory) string {
+	return p.localizedName(englishGenreCategories, c.Name, c.DisplayName, c.TranslitName)
+}
+
+func (p *Printer) localizedName(english map[string]string, name, displayName, translitName string) string {
+	if p.Lang == language.Russian.String() {
+		return cmp.Or(displayName, name)
+	}
+	if translated, ok := english[name]; ok {
+		return translated
+	}
+	return cmp.Or(translitName, displayName, name)
+}
+
+// LanguageName returns the name of a book language by its code, e.g.
+// "Ukrainian" for "uk", or the code itself when it is unknown
+func (p *Printer) LanguageName(code string) string {
+	tag, err := language.Parse(code)
+	if _, confidence := tag.Base(); err != nil || confidence == language.No {
+		return code
+	}
+	name := display.Tags(language.Make(p.Lang)).Name(tag)
+	if name == "" {
+		return code
+	}
+	r, size := utf8.DecodeRuneInString(name)
+	return string(unicode.ToUpper(r)) + name[size:]
+}
+
+// Size formats a file size in bytes, e.g. "1.2 MB"
+func (p *Printer) Size(size int64) string {
+	switch {
+	case size >= 1<<20:
+		return p.Sprintf("%.1f MB", float64(size)/(1<<20))
+	case size >= 1<<10:
+		return p.Sprintf("%d KB", size>>10)
+	}
+	return p.Sprintf("%d bytes", size)
+}
+
+// newCatalog builds the message catalog. English messages are their own
+// keys except for plurals, which need forms in every language.
+func newCatalog() catalog.Catalog {
+	b := catalog.NewBuilder(catalog.Fallback(language.English))
+	for key, msg := range russian {
+		if err := b.SetString(language.Russian, key, msg); err != nil {
+			panic(err)
+		}
+	}
+	for key, forms := range plurals {
+		for tag, msg := range forms {
+			if err := b.Set(tag, key, msg); err != nil {
+				panic(err)
+			}
+		}
+	}
+	return b
+}
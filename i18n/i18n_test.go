@@ -0,0 +1,145 @@
+package i18n
+
+import (
+	"net/http/httptest"
+	"slices"
+	"testing"
+
+	"github.com/htol/bopds/book"
+	"github.com/htol/bopds/config"
+)
+
+func TestLanguagesMatchConfig(t *testing.T) {
+	if got := Languages(); !slices.Equal(got, config.CatalogLanguages) {
+		t.Errorf("expected the catalog languages %v of the configuration, got %v", config.CatalogLanguages, got)
+	}
+}
+
+func TestFromRequest(t *testing.T) {
+	tests := []struct {
+		name     string
+		url      string
+		accept   string
+		fallback string
+		expected string
+	}{
+		{"fallback", "/opds", "", "en", "en"},
+		{"configured fallback", "/opds", "", "ru", "ru"},
+		{"accept language", "/opds", "ru-RU,ru;q=0.9,en;q=0.8", "en", "ru"},
+		{"accept language preference", "/opds", "de,en;q=0.5,ru;q=0.3", "ru", "en"},
+		{"unsupported accept language", "/opds", "de", "ru", "ru"},
+		{"lang parameter wins", "/opds?lang=en", "ru", "ru", "en"},
+		{"lang parameter with region", "/opds?lang=ru-UA", "", "en", "ru"},
+		{"unsupported lang parameter", "/opds?lang=xx", "ru", "ru", "en"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest("GET", tt.url, nil)
+			if tt.accept != "" {
+				req.Header.Set("Accept-Language", tt.accept)
+			}
+			if got := FromRequest(req, tt.fallback).Lang; got != tt.expected {
+				t.Errorf("expected %q, got %q", tt.expected, got)
+			}
+		})
+	}
+}
+
+func TestPrinter_Sprintf(t *testing.T) {
+	en, ru := New("en"), New("ru")
+
+	tests := []struct {
+		name     string
+		p        *Printer
+		key      string
+		args     []any
+		expected string
+	}{
+		{"english message", en, "New Books", nil, "New Books"},
+		{"russian message", ru, "New Books", nil, "Новые книги"},
+		{"russian arguments", ru, "Series: %s #%d", []any{"Полдень", 2}, "Серия: Полдень №2"},
+		{"untranslated message", ru, "%s: %s", []any{"a", "b"}, "a: b"},
+		{"english singular", en, "%d books", []any{1}, "1 book"},
+		{"english plural", en, "%d books", []any{5}, "5 books"},
+		{"russian one", ru, "%d books", []any{21}, "21 книга"},
+		{"russian few", ru, "%d books", []any{3}, "3 книги"},
+		{"russian many", ru, "%d books", []any{11}, "11 книг"},
+		{"russian series", ru, "%d series", []any{2}, "2 серии"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.p.Sprintf(tt.key, tt.args...); got != tt.expected {
+				t.Errorf("expected %q, got %q", tt.expected, got)
+			}
+		})
+	}
+}
+
+func TestPrinter_Genre(t *testing.T) {
+	tests := []struct {
+		name     string
+		lang     string
+		genre    book.Genre
+		expected string
+	}{
+		{"russian", "ru", book.Genre{Name: "sf", DisplayName: "Научная фантастика"}, "Научная фантастика"},
+		{"russian without display name", "ru", book.Genre{Name: "custom"}, "custom"},
+		{"english", "en", book.Genre{Name: "sf", DisplayName: "Научная фантастика", TranslitName: "Nauchnaya fantastika"}, "Science Fiction"},
+		{"english transliterated", "en", book.Genre{Name: "custom", DisplayName: "Своё", TranslitName: "Svoyo"}, "Svoyo"},
+		{"english without transliteration", "en", book.Genre{Name: "custom", DisplayName: "Своё"}, "Своё"},
+		{"english name only", "en", book.Genre{Name: "custom"}, "custom"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := New(tt.lang).Genre(tt.genre); got != tt.expected {
+				t.Errorf("expected %q, got %q", tt.expected, got)
+			}
+		})
+	}
+}
+
+func TestPrinter_GenreCategory(t *testing.T) {
+	tests := []struct {
+		name     string
+		lang     string
+		category book.GenreCategory
+		expected string
+	}{
+		{"russian", "ru", book.GenreCategory{Name: "sf", DisplayName: "Фантастика"}, "Фантастика"},
+		{"english", "en", book.GenreCategory{Name: "sf", DisplayName: "Фантастика", TranslitName: "Fantastika"}, "Science Fiction and Fantasy"},
+		{"english transliterated", "en", book.GenreCategory{Name: "manga", DisplayName: "Манга", TranslitName: "Manga"}, "Manga"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := New(tt.lang).GenreCategory(tt.category); got != tt.expected {
+				t.Errorf("expected %q, got %q", tt.expected, got)
+			}
+		})
+	}
+}
+
+func TestPrinter_LanguageName(t *testing.T) {
+	tests := []struct {
+		name     string
+		lang     string
+		code     string
+		expected string
+	}{
+		{"english", "en", "uk", "Ukrainian"},
+		{"russian", "ru", "uk", "Украинский"},
+		{"russian own name", "ru", "ru", "Русский"},
+		{"unknown code", "en", "x-fb2", "x-fb2"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := New(tt.lang).LanguageName(tt.code); got != tt.expected {
+				t.Errorf("expected %q, got %q", tt.expected, got)
+			}
+		})
+	}
+}
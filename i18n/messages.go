@@ -0,0 +1,71 @@
+package i18n
+
+import (
+	"golang.org/x/text/feature/plural"
+	"golang.org/x/text/language"
+	"golang.org/x/text/message/catalog"
+)
+
+// russian translates the messages of OPDS feeds, keyed by their English text
+var russian = map[string]string{
+	// Catalog root
+	"bopds Library":                        "Библиотека bopds",
+	"OPDS Catalog for bopds eBook Library": "OPDS-каталог библиотеки bopds",
+	"New Books":                            "Новые книги",
+	"Recently added publications":          "Недавно добавленные книги",
+	"Authors":                              "Авторы",
+	"Browse by author":                     "Книги по авторам",
+	"Titles":                               "Названия",
+	"Browse by title":                      "Книги по названиям",
+	"Series":                               "Серии",
+	"Browse by series":                     "Книги по сериям",
+	"Genres":                               "Жанры",
+	"Browse by genre":                      "Книги по жанрам",
+	"Browse the %s library":                "Библиотека %s",
+	"Search: %s":                           "Поиск: %s",
+
+	// Author pages
+	"All books":                          "Все книги",
+	"Every book, by title":               "Все книги по названию",
+	"By series":                          "По сериям",
+	"Series, by name":                    "Серии по названию",
+	"Without series":                     "Вне серий",
+	"Books outside any series, by title": "Книги вне серий по названию",
+	"Recently added":                     "Недавно добавленные",
+	"Most recently added first":          "Сначала недавно добавленные",
+	"Unknown Author":                     "Неизвестный автор",
+
+	// Book entries
+	"Full entry":                 "Подробнее",
+	"All books by %s":            "Все книги автора %s",
+	"All books in the series %s": "Все книги серии %s",
+	"More in %s":                 "Ещё в жанре %s",
+	"Series: %s":                 "Серия: %s",
+	"Series: %s #%d":             "Серия: %s №%d",
+	"Keywords: %s":               "Ключевые слова: %s",
+	"Size: %s":                   "Размер: %s",
+	"Added: %s":                  "Добавлена: %s",
+	"%.1f MB":                    "%.1f МБ",
+	"%d KB":                      "%d КБ",
+	"%d bytes":                   "%d байт",
+
+	// Language facets
+	"Language":      "Язык",
+	"All languages": "Все языки",
+}
+
+// plurals are messages with a count, in the plural forms of each language
+var plurals = map[string]map[language.Tag]catalog.Message{
+	"%d books": {
+		language.English: plural.Selectf(1, "%d", "one", "%d book", "other", "%d books"),
+		language.Russian: plural.Selectf(1, "%d", "one", "%d книга", "few", "%d книги", "other", "%d книг"),
+	},
+	"%d authors": {
+		language.English: plural.Selectf(1, "%d", "one", "%d author", "other", "%d authors"),
+		language.Russian: plural.Selectf(1, "%d", "one", "%d автор", "few", "%d автора", "other", "%d авторов"),
+	},
+	"%d series": {
+		language.English: plural.Selectf(1, "%d", "other", "%d series"),
+		language.Russian: plural.Selectf(1, "%d", "one", "%d серия", "few", "%d серии", "other", "%d серий"),
+	},
+}
@@ -0,0 +1,227 @@
+// Package mailer delivers books as e-mail attachments over SMTP
+package mailer
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net"
+	"net/smtp"
+	"net/textproto"
+	"strconv"
+	"time"
+
+	"github.com/htol/bopds/config"
+)
+
+const (
+	dialTimeout = 30 * time.Second
+	// sendTimeout bounds a delivery whose context has no deadline
+	sendTimeout = 10 * time.Minute
+)
+
+// Message is an e-mail with a single attachment
+type Message struct {
+	To          string
+	Subject     string
+	Body        string
+	FileName    string
+	ContentType string
+	Attachment  io.Reader
+}
+
+// Mailer sends messages through the configured SMTP server
+type Mailer struct {
+	cfg config.MailConfig
+}
+
+// New creates a mailer for cfg
+func New(cfg config.MailConfig) *Mailer {
+	return &Mailer{cfg: cfg}
+}
+
+// Enabled reports whether an SMTP server is configured
+func (m *Mailer) Enabled() bool {
+	return m.cfg.Host != ""
+}
+
+// IsPermanent reports whether err is a permanent rejection by the SMTP
+// server (a 5xx reply), which retrying will not fix
+func IsPermanent(err error) bool {
+	var tpErr *textproto.Error
+	return errors.As(err, &tpErr) && tpErr.Code >= 500
+}
+
+// Send delivers msg. The attachment is streamed to the server as it is read.
+func (m *Mailer) Send(ctx context.Context, msg Message) error {
+	if !m.Enabled() {
+		return fmt.Errorf("mail is not configured")
+	}
+	addr := net.JoinHostPort(m.cfg.Host, strconv.Itoa(m.cfg.Port))
+	tlsConfig := &tls.Config{ServerName: m.cfg.Host}
+
+	dialer := &net.Dialer{Timeout: dialTimeout}
+	var conn net.Conn
+	var err error
+	if m.cfg.TLS == "tls" {
+		conn, err = (&tls.Dialer{NetDialer: dialer, Config: tlsConfig}).DialContext(ctx, "tcp", addr)
+	} else {
+		conn, err = dialer.DialContext(ctx, "tcp", addr)
+	}
+	if err != nil {
+		return fmt.Errorf("connect to %s: %w", addr, err)
+	}
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		deadline = time.Now().Add(sendTimeout)
+	}
+	conn.SetDeadline(deadline)
+	// net/smtp has no context support; closing the connection aborts it
+	stop := context.AfterFunc(ctx, func() { conn.Close() })
+	defer stop()
+
+	c, err := smtp.NewClient(conn, m.cfg.Host)
+	if err != nil {
+		conn.Close()
+		return m.wrap(ctx, "greeting", err)
+	}
+	defer c.Close()
+
+	if m.cfg.TLS == "starttls" {
+		if ok, _ := c.Extension("STARTTLS"); !ok {
+			return fmt.Errorf("smtp server %s does not support STARTTLS", addr)
+		}
+		if err := c.StartTLS(tlsConfig); err != nil {
+			return m.wrap(ctx, "starttls", err)
+		}
+	}
+	if m.cfg.Username != "" {
+		if err := c.Auth(smtp.PlainAuth("", m.cfg.Username, m.cfg.Password, m.cfg.Host)); err != nil {
+			return m.wrap(ctx, "auth", err)
+		}
+	}
+	if err := c.Mail(m.cfg.From); err != nil {
+		return m.wrap(ctx, "mail from", err)
+	}
+	if err := c.Rcpt(msg.To); err != nil {
+		return m.wrap(ctx, "rcpt to", err)
+	}
+	w, err := c.Data()
+	if err != nil {
+		return m.wrap(ctx, "data", err)
+	}
+	if err := m.writeMessage(w, msg); err != nil {
+		w.Close()
+		return m.wrap(ctx, "write message", err)
+	}
+	if err := w.Close(); err != nil {
+		return m.wrap(ctx, "data", err)
+	}
+	return m.wrap(ctx, "quit", c.Quit())
+}
+
+// wrap reports ctx's error for a connection closed by cancellation
+func (m *Mailer) wrap(ctx context.Context, stage string, err error) error {
+	if err == nil {
+		return nil
+	}
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	return fmt.Errorf("smtp %s: %w", stage, err)
+}
+
+// writeMessage writes msg as a multipart/mixed MIME message with a text
+// part and the base64-encoded attachment
+func (m *Mailer) writeMessage(w io.Writer, msg Message) error {
+	bw := bufio.NewWriter(w)
+	mw := multipart.NewWriter(bw)
+
+	header := []struct{ key, value string }{
+		{"From", m.cfg.From},
+		{"To", msg.To},
+		{"Subject", mime.QEncoding.Encode("utf-8", msg.Subject)},
+		{"Date", time.Now().Format(time.RFC1123Z)},
+		{"MIME-Version", "1.0"},
+		{"Content-Type", mime.FormatMediaType("multipart/mixed", map[string]string{"boundary": mw.Boundary()})},
+	}
+	for _, h := range header {
+		fmt.Fprintf(bw, "%s: %s\r\n", h.key, h.value)
+	}
+	bw.WriteString("\r\n")
+
+	text, err := mw.CreatePart(textproto.MIMEHeader{
+		"Content-Type":              {"text/plain; charset=utf-8"},
+		"Content-Transfer-Encoding": {"quoted-printable"},
+	})
+	if err != nil {
+		return err
+	}
+	qp := quotedprintable.NewWriter(text)
+	if _, err := qp.Write([]byte(msg.Body)); err != nil {
+		return err
+	}
+	if err := qp.Close(); err != nil {
+		return err
+	}
+
+	contentType := msg.ContentType
+	if contentType == "" {
+		contentType = "application/octet-stream"
+	}
+	attachment, err := mw.CreatePart(textproto.MIMEHeader{
+		"Content-Type":              {contentType},
+		"Content-Disposition":       {mime.FormatMediaType("attachment", map[string]string{"filename": msg.FileName})},
+		"Content-Transfer-Encoding": {"base64"},
+	})
+	if err != nil {
+		return err
+	}
+	enc := base64.NewEncoder(base64.StdEncoding, &lineWriter{w: attachment})
+	if _, err := io.Copy(enc, msg.Attachment); err != nil {
+		return fmt.Errorf("read attachment: %w", err)
+	}
+	if err := enc.Close(); err != nil {
+		return err
+	}
+	if err := mw.Close(); err != nil {
+		return err
+	}
+	return bw.Flush()
+}
+
+// maxLineLength is the base64 line length of RFC 2045
+const maxLineLength = 76
+
+// lineWriter breaks the base64 stream into CRLF-terminated lines
+type lineWriter struct {
+	w   io.Writer
+	col int
+}
+
+func (l *lineWriter) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		n := min(len(p), maxLineLength-l.col)
+		if _, err := l.w.Write(p[:n]); err != nil {
+			return written, err
+		}
+		written += n
+		l.col += n
+		p = p[n:]
+		if l.col == maxLineLength {
+			if _, err := io.WriteString(l.w, "\r\n"); err != nil {
+				return written, err
+			}
+			l.col = 0
+		}
+	}
+	return written, nil
+}
@@ -0,0 +1,143 @@
+package mailer
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"errors"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/mail"
+	"strings"
+	"testing"
+
+	"github.com/htol/bopds/config"
+	"github.com/htol/bopds/mailer/mailtest"
+)
+
+func testConfig(srv *mailtest.Server) config.MailConfig {
+	return config.MailConfig{
+		Host:        srv.Host(),
+		Port:        srv.Port(),
+		From:        "library@example.com",
+		TLS:         "none",
+		MaxAttempts: 1,
+	}
+}
+
+func TestSend(t *testing.T) {
+	srv := mailtest.NewServer(t)
+	m := New(testConfig(srv))
+
+	book := bytes.Repeat([]byte("EPUB binary \x00\xff "), 100)
+	err := m.Send(context.Background(), Message{
+		To:          "reader@kindle.com",
+		Subject:     "Толстой - Война и мир",
+		Body:        "Your book is attached.",
+		FileName:    "Толстой - Война и мир.epub",
+		ContentType: "application/epub+zip",
+		Attachment:  bytes.NewReader(book),
+	})
+	if err != nil {
+		t.Fatalf("Send failed: %v", err)
+	}
+
+	msgs := srv.Messages()
+	if len(msgs) != 1 {
+		t.Fatalf("expected 1 message, got %d", len(msgs))
+	}
+	if msgs[0].From != "library@example.com" || len(msgs[0].To) != 1 || msgs[0].To[0] != "reader@kindle.com" {
+		t.Errorf("unexpected envelope %s -> %v", msgs[0].From, msgs[0].To)
+	}
+
+	parsed, err := mail.ReadMessage(bytes.NewReader(msgs[0].Data))
+	if err != nil {
+		t.Fatalf("parse message: %v", err)
+	}
+	subject, _ := new(mime.WordDecoder).DecodeHeader(parsed.Header.Get("Subject"))
+	if subject != "Толстой - Война и мир" {
+		t.Errorf("unexpected subject %q", subject)
+	}
+	_, params, err := mime.ParseMediaType(parsed.Header.Get("Content-Type"))
+	if err != nil {
+		t.Fatalf("parse content type: %v", err)
+	}
+
+	mr := multipart.NewReader(parsed.Body, params["boundary"])
+	text, err := mr.NextPart()
+	if err != nil {
+		t.Fatalf("read text part: %v", err)
+	}
+	if body, _ := io.ReadAll(text); string(body) != "Your book is attached." {
+		t.Errorf("unexpected body %q", body)
+	}
+	attachment, err := mr.NextPart()
+	if err != nil {
+		t.Fatalf("read attachment: %v", err)
+	}
+	if attachment.FileName() != "Толстой - Война и мир.epub" {
+		t.Errorf("unexpected attachment name %q", attachment.FileName())
+	}
+	// multipart.Part decodes quoted-printable only; base64 is left to us.
+	// The stand-in stores DATA with plain newlines, as textproto reads it.
+	raw, _ := io.ReadAll(attachment)
+	for _, line := range strings.Split(strings.TrimSpace(string(raw)), "\n") {
+		if len(line) > maxLineLength {
+			t.Fatalf("base64 line of %d bytes exceeds %d", len(line), maxLineLength)
+		}
+	}
+	decoded, err := io.ReadAll(base64.NewDecoder(base64.StdEncoding, bytes.NewReader(raw)))
+	if err != nil || !bytes.Equal(decoded, book) {
+		t.Errorf("attachment does not round-trip: %v", err)
+	}
+}
+
+func TestSend_Errors(t *testing.T) {
+	tests := []struct {
+		name            string
+		reject          string
+		tls             string
+		expectErr       string
+		expectPermanent bool
+	}{
+		{name: "temporary rejection", reject: "451 4.3.0 try again later", expectErr: "451"},
+		{name: "permanent rejection", reject: "550 5.1.1 no such user", expectErr: "550", expectPermanent: true},
+		{name: "starttls required", tls: "starttls", expectErr: "does not support STARTTLS"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv := mailtest.NewServer(t)
+			cfg := testConfig(srv)
+			if tt.tls != "" {
+				cfg.TLS = tt.tls
+			}
+			if tt.reject != "" {
+				srv.Reject(tt.reject)
+			}
+
+			err := New(cfg).Send(context.Background(), Message{To: "reader@kindle.com", Attachment: strings.NewReader("x")})
+			if err == nil || !strings.Contains(err.Error(), tt.expectErr) {
+				t.Fatalf("expected error containing %q, got %v", tt.expectErr, err)
+			}
+			if IsPermanent(err) != tt.expectPermanent {
+				t.Errorf("IsPermanent = %v, expected %v", IsPermanent(err), tt.expectPermanent)
+			}
+			if len(srv.Messages()) != 0 {
+				t.Error("no message should have been accepted")
+			}
+		})
+	}
+}
+
+func TestSend_Cancelled(t *testing.T) {
+	srv := mailtest.NewServer(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	err := New(testConfig(srv)).Send(ctx, Message{To: "reader@kindle.com", Attachment: strings.NewReader("x")})
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("expected context.Canceled, got %v", err)
+	}
+}
@@ -0,0 +1,186 @@
+// Package metrics defines the Prometheus collectors exported on /metrics.
+// Collectors live in a dedicated registry so tests and embedders are not
+// affected by the global default registry.
+package metrics
+
+import (
+	"database/sql"
+	"net/http"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const namespace = "bopds"
+
+// Registry holds every bopds collector plus the Go runtime and process collectors
+var Registry = prometheus.NewRegistry()
+
+var factory = promauto.With(Registry)
+
+func init() {
+	Registry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+	)
+}
+
+// HTTP
+var (
+	HTTPRequests = factory.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "http_requests_total",
+		Help:      "HTTP requests by method, route pattern and status code.",
+	}, []string{"method", "route", "status"})
+
+	HTTPRequestDuration = factory.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "http_request_duration_seconds",
+		Help:      "HTTP request latency by method and route pattern.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"method", "route"})
+
+	RateLimited = factory.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "rate_limited_total",
+		Help:      "Requests rejected by rate limits, quotas or the conversion cap, by route group and reason.",
+	}, []string{"group", "reason"})
+
+	ConversionsWaiting = factory.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "conversions_waiting",
+		Help:      "Conversion requests queued for a free conversion slot.",
+	})
+)
+
+// Downloads and conversion
+var (
+	Downloads = factory.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "downloads_total",
+		Help:      "Book downloads served, by format.",
+	}, []string{"format"})
+
+	ConversionDuration = factory.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "conversion_duration_seconds",
+		Help:      "Time spent converting FB2 books, by target format.",
+		Buckets:   []float64{0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60},
+	}, []string{"format"})
+
+	ConversionFailures = factory.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "conversion_failures_total",
+		Help:      "Failed FB2 conversions, by target format.",
+	}, []string{"format"})
+
+	ConversionBackendFailures = factory.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "conversion_backend_failures_total",
+		Help:      "Conversion backend failures that fell back to the next backend in the chain, by backend.",
+	}, []string{"backend"})
+
+	ArchiveLookups = factory.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "archive_lookups_total",
+		Help:      "Archive reader lookups for extraction, by whether an open reader was reused (hit) or the archive was opened (miss).",
+	}, []string{"result"})
+
+	ArchivesOpen = factory.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "archives_open",
+		Help:      "Library archives currently held open for extraction.",
+	})
+
+	SevenZipBlockCache = factory.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "sevenzip_block_cache_lookups_total",
+		Help:      "7z extractions served from the block cache (hit) or decompressed (miss).",
+	}, []string{"result"})
+
+	SevenZipCLIFallbacks = factory.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "sevenzip_cli_fallbacks_total",
+		Help:      "7z extractions that fell back to the 7z command line tool, by result.",
+	}, []string{"result"})
+)
+
+// Scanner progress
+var (
+	ScanRunning = factory.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "scan_running",
+		Help:      "Whether a library scan is in progress (1) or not (0).",
+	}, []string{"library"})
+
+	ScanArchivesTotal = factory.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "scan_archives_total",
+		Help:      "Archives listed in the INPX indexes of the current scan.",
+	}, []string{"library"})
+
+	ScanArchivesDone = factory.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "scan_archives_done",
+		Help:      "Archives processed so far in the current scan.",
+	}, []string{"library"})
+
+	ScanBooksStored = factory.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "scan_books_stored",
+		Help:      "Books written to the database so far in the current scan.",
+	}, []string{"library"})
+
+	ScanUnreadableArchives = factory.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "scan_unreadable_archives",
+		Help:      "Archives of the current scan using compression methods that cannot be decoded natively.",
+	}, []string{"library"})
+)
+
+// Handler serves the registry in the Prometheus exposition format
+func Handler() http.Handler {
+	return promhttp.HandlerFor(Registry, promhttp.HandlerOpts{Registry: Registry})
+}
+
+// RegisterDBStats exports connection pool statistics read from stats on every
+// scrape. It must be called at most once per process.
+func RegisterDBStats(stats func() sql.DBStats) {
+	gauge := func(name, help string, value func(sql.DBStats) float64) {
+		factory.NewGaugeFunc(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Subsystem: "db",
+			Name:      name,
+			Help:      help,
+		}, func() float64 { return value(stats()) })
+	}
+	counter := func(name, help string, value func(sql.DBStats) float64) {
+		factory.NewCounterFunc(prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: "db",
+			Name:      name,
+			Help:      help,
+		}, func() float64 { return value(stats()) })
+	}
+
+	gauge("max_open_connections", "Maximum number of open connections to the database.",
+		func(s sql.DBStats) float64 { return float64(s.MaxOpenConnections) })
+	gauge("open_connections", "Established connections, both in use and idle.",
+		func(s sql.DBStats) float64 { return float64(s.OpenConnections) })
+	gauge("in_use_connections", "Connections currently in use.",
+		func(s sql.DBStats) float64 { return float64(s.InUse) })
+	gauge("idle_connections", "Idle connections.",
+		func(s sql.DBStats) float64 { return float64(s.Idle) })
+	counter("wait_count_total", "Connections waited for.",
+		func(s sql.DBStats) float64 { return float64(s.WaitCount) })
+	counter("wait_duration_seconds_total", "Time blocked waiting for a new connection.",
+		func(s sql.DBStats) float64 { return s.WaitDuration.Seconds() })
+	counter("max_idle_closed_total", "Connections closed due to the idle connection limit.",
+		func(s sql.DBStats) float64 { return float64(s.MaxIdleClosed) })
+	counter("max_idle_time_closed_total", "Connections closed due to the idle time limit.",
+		func(s sql.DBStats) float64 { return float64(s.MaxIdleTimeClosed) })
+	counter("max_lifetime_closed_total", "Connections closed due to the connection lifetime limit.",
+		func(s sql.DBStats) float64 { return float64(s.MaxLifetimeClosed) })
+}
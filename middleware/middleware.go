@@ -3,15 +3,31 @@ package middleware
 import (
 	"context"
 	"net/http"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/google/uuid"
 	"github.com/htol/bopds/logger"
+	"github.com/htol/bopds/metrics"
+	"github.com/htol/bopds/tracing"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
 )
 
 type contextKey string
 
-const RequestIDKey contextKey = "requestID"
+const (
+	RequestIDKey contextKey = "requestID"
+	routeKey     contextKey = "route"
+)
+
+// unmatchedRoute labels requests that no route pattern matched, keeping
+// arbitrary paths out of metric labels
+const unmatchedRoute = "unmatched"
 
 // responseWriter wraps http.ResponseWriter to capture status code
 type responseWriter struct {
@@ -28,6 +44,11 @@ func (rw *responseWriter) WriteHeader(code int) {
 	}
 }
 
+// Unwrap exposes the underlying writer to http.ResponseController
+func (rw *responseWriter) Unwrap() http.ResponseWriter {
+	return rw.ResponseWriter
+}
+
 // RequestID adds a unique request ID to each request
 func RequestID(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
@@ -42,21 +63,28 @@ func RequestID(next http.Handler) http.Handler {
 	})
 }
 
-// Logger logs HTTP requests with structured logging
+// Logger logs HTTP requests with structured logging and records request
+// metrics labelled by the route pattern captured by RoutePattern
 func Logger(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		start := time.Now()
 
 		ww := &responseWriter{ResponseWriter: w, status: http.StatusOK}
+		route := unmatchedRoute
+		r = r.WithContext(context.WithValue(r.Context(), routeKey, &route))
 
 		next.ServeHTTP(ww, r)
 
 		duration := time.Since(start)
 		requestID := r.Context().Value(RequestIDKey)
 
+		metrics.HTTPRequests.WithLabelValues(r.Method, route, strconv.Itoa(ww.status)).Inc()
+		metrics.HTTPRequestDuration.WithLabelValues(r.Method, route).Observe(duration.Seconds())
+
 		logger.Info("HTTP request",
 			"method", r.Method,
 			"path", r.URL.Path,
+			"route", route,
 			"query", r.URL.RawQuery,
 			"status", ww.status,
 			"duration", duration,
@@ -67,6 +95,57 @@ func Logger(next http.Handler) http.Handler {
 	})
 }
 
+// Tracing starts a server span for each request, continuing a trace
+// propagated by the client, and tags it with the request ID so traces can be
+// found from log lines. It must run inside RequestID and outside RoutePattern.
+func Tracing(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := otel.GetTextMapPropagator().Extract(r.Context(), propagation.HeaderCarrier(r.Header))
+		requestID, _ := ctx.Value(RequestIDKey).(string)
+		ctx, span := tracing.Tracer().Start(ctx, r.Method,
+			trace.WithSpanKind(trace.SpanKindServer),
+			trace.WithAttributes(
+				attribute.String("http.request.method", r.Method),
+				attribute.String("url.path", r.URL.Path),
+				attribute.String("request.id", requestID),
+			),
+		)
+		defer span.End()
+
+		ww := &responseWriter{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(ww, r.WithContext(ctx))
+
+		if route, ok := ctx.Value(routeKey).(*string); ok && *route != unmatchedRoute {
+			span.SetName(r.Method + " " + *route)
+			span.SetAttributes(attribute.String("http.route", *route))
+		}
+		span.SetAttributes(attribute.Int("http.response.status_code", ww.status))
+		if ww.status >= http.StatusInternalServerError {
+			span.SetStatus(codes.Error, http.StatusText(ww.status))
+		}
+	})
+}
+
+// RoutePattern reports the ServeMux pattern that matched the request back to
+// Logger. It must wrap the mux directly: the mux records the pattern on the
+// request it is handed, which outer middleware never see.
+func RoutePattern(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		next.ServeHTTP(w, r)
+
+		route, ok := r.Context().Value(routeKey).(*string)
+		if !ok || r.Pattern == "" {
+			return
+		}
+		// The method is a separate label; keep only the path part of "GET /path"
+		pattern := r.Pattern
+		if _, path, found := strings.Cut(pattern, " "); found {
+			pattern = path
+		}
+		*route = pattern
+	})
+}
+
 // Recovery recovers from panics and logs them
 func Recovery(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
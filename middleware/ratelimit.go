@@ -0,0 +1,323 @@
+package middleware
+
+import (
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/htol/bopds/config"
+	"github.com/htol/bopds/logger"
+	"github.com/htol/bopds/metrics"
+	"golang.org/x/time/rate"
+)
+
+// Route groups with independent rate limits
+const (
+	GroupOPDS     = "opds"
+	GroupAPI      = "api"
+	GroupDownload = "download"
+)
+
+const (
+	// bucketIdleTTL is how long an unused token bucket is kept; by then it has
+	// refilled completely, so dropping it loses no state
+	bucketIdleTTL = 10 * time.Minute
+	sweepInterval = time.Minute
+)
+
+// RateLimiter applies per-IP and per-user token buckets for each route group,
+// daily download quotas, and a global cap on concurrent conversions
+type RateLimiter struct {
+	cfg config.RateLimitConfig
+	now func() time.Time
+
+	mu        sync.Mutex
+	buckets   map[string]*bucket
+	lastSweep time.Time
+	quotaDay  string
+	downloads map[string]int
+
+	conversions chan struct{}
+	waitMu      sync.Mutex
+	waiting     int
+}
+
+type bucket struct {
+	limiter  *rate.Limiter
+	lastSeen time.Time
+}
+
+// NewRateLimiter creates a rate limiter from configuration
+func NewRateLimiter(cfg config.RateLimitConfig) *RateLimiter {
+	slots := cfg.MaxConcurrentConversions
+	if slots == 0 {
+		slots = runtime.NumCPU()
+	}
+	return &RateLimiter{
+		cfg:         cfg,
+		now:         time.Now,
+		buckets:     make(map[string]*bucket),
+		downloads:   make(map[string]int),
+		conversions: make(chan struct{}, slots),
+	}
+}
+
+// Limit returns middleware enforcing the token buckets configured for group
+func (l *RateLimiter) Limit(group string) func(http.Handler) http.Handler {
+	var limits config.RouteLimitConfig
+	switch group {
+	case GroupOPDS:
+		limits = l.cfg.OPDS
+	case GroupAPI:
+		limits = l.cfg.API
+	case GroupDownload:
+		limits = l.cfg.Download
+	}
+
+	return func(next http.Handler) http.Handler {
+		if !l.cfg.Enabled {
+			return next
+		}
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if limits.IPRate > 0 {
+				ip := l.clientIP(r)
+				if wait, ok := l.allow(group+"|ip:"+ip, limits.IPRate, limits.IPBurst); !ok {
+					l.reject(w, r, group, "ip", http.StatusTooManyRequests, wait, "Too many requests")
+					return
+				}
+			}
+			if user := l.user(r); user != "" && limits.UserRate > 0 {
+				if wait, ok := l.allow(group+"|user:"+user, limits.UserRate, limits.UserBurst); !ok {
+					l.reject(w, r, group, "user", http.StatusTooManyRequests, wait, "Too many requests")
+					return
+				}
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// Quota enforces the daily download quota per user, or per IP for anonymous
+// clients. A download is counted when it starts, so concurrent requests
+// cannot overrun the quota, and refunded if the response is an error.
+func (l *RateLimiter) Quota(next http.Handler) http.Handler {
+	if !l.cfg.Enabled || l.cfg.DailyDownloadQuota == 0 {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		client := l.quotaClient(r)
+		day, ok := l.reserveDownloads(client, 1)
+		if !ok {
+			l.rejectQuota(w, r)
+			return
+		}
+
+		ww := &responseWriter{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(ww, r)
+		if ww.status >= http.StatusBadRequest {
+			l.refundDownloads(client, day, 1)
+		}
+	})
+}
+
+// ReserveDownloads counts n downloads against the daily quota for a request
+// serving several books, such as a bulk download, which is not wrapped in
+// Quota. When fewer than n downloads are left the request is answered with
+// 429 and ok is false. The returned refund gives back the downloads that
+// were not served, e.g. books left out of the archive.
+func (l *RateLimiter) ReserveDownloads(w http.ResponseWriter, r *http.Request, n int) (refund func(unused int), ok bool) {
+	if !l.cfg.Enabled || l.cfg.DailyDownloadQuota == 0 {
+		return func(int) {}, true
+	}
+	client := l.quotaClient(r)
+	day, ok := l.reserveDownloads(client, n)
+	if !ok {
+		l.rejectQuota(w, r)
+		return nil, false
+	}
+	return func(unused int) { l.refundDownloads(client, day, unused) }, true
+}
+
+// AcquireConversion takes one of the slots capping the number of requests
+// converting books at once, returning the function that gives it back. When
+// no slot is free the request waits in a bounded queue; if the queue is full
+// or the wait times out it is answered with 503 and Retry-After, and ok is
+// false. Handlers call it only once they know the book must be converted.
+func (l *RateLimiter) AcquireConversion(w http.ResponseWriter, r *http.Request) (release func(), ok bool) {
+	timeout := time.Duration(l.cfg.ConversionQueueTimeout) * time.Second
+	retryAfter := max(timeout, time.Second)
+	release = func() { <-l.conversions }
+
+	select {
+	case l.conversions <- struct{}{}:
+		return release, true
+	default:
+	}
+	if !l.enqueue() {
+		l.reject(w, r, GroupDownload, "conversions", http.StatusServiceUnavailable, retryAfter, "Conversion queue is full")
+		return nil, false
+	}
+	defer l.dequeue()
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case l.conversions <- struct{}{}:
+		return release, true
+	case <-timer.C:
+		l.reject(w, r, GroupDownload, "conversions", http.StatusServiceUnavailable, retryAfter, "Timed out waiting for a conversion slot")
+		return nil, false
+	case <-r.Context().Done():
+		// The client went away; there is nobody to answer
+		return nil, false
+	}
+}
+
+// allow takes a token from the bucket for key, returning how long the client
+// should wait when the bucket is empty
+func (l *RateLimiter) allow(key string, r float64, burst int) (time.Duration, bool) {
+	now := l.now()
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if now.Sub(l.lastSweep) > sweepInterval {
+		for k, b := range l.buckets {
+			if now.Sub(b.lastSeen) > bucketIdleTTL {
+				delete(l.buckets, k)
+			}
+		}
+		l.lastSweep = now
+	}
+
+	b, ok := l.buckets[key]
+	if !ok {
+		b = &bucket{limiter: rate.NewLimiter(rate.Limit(r), burst)}
+		l.buckets[key] = b
+	}
+	b.lastSeen = now
+
+	res := b.limiter.ReserveN(now, 1)
+	if delay := res.DelayFrom(now); delay > 0 {
+		res.CancelAt(now)
+		return delay, false
+	}
+	return 0, true
+}
+
+// quotaClient returns the key the request's downloads are counted under:
+// the user, or the IP for anonymous clients
+func (l *RateLimiter) quotaClient(r *http.Request) string {
+	if user := l.user(r); user != "" {
+		return user
+	}
+	return "ip:" + l.clientIP(r)
+}
+
+// reserveDownloads counts n downloads for client unless that would exceed
+// its quota, returning the quota day the downloads were counted on
+func (l *RateLimiter) reserveDownloads(client string, n int) (string, bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.rollQuotaDay()
+	if l.downloads[client]+n > l.cfg.DailyDownloadQuota {
+		return "", false
+	}
+	l.downloads[client] += n
+	return l.quotaDay, true
+}
+
+// refundDownloads returns n downloads reserved on day to client's quota.
+// Counts from a previous day are already gone.
+func (l *RateLimiter) refundDownloads(client, day string, n int) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.rollQuotaDay()
+	if day == l.quotaDay {
+		l.downloads[client] = max(l.downloads[client]-n, 0)
+	}
+}
+
+// rollQuotaDay resets download counters at UTC midnight. Callers hold l.mu.
+func (l *RateLimiter) rollQuotaDay() {
+	day := l.now().UTC().Format(time.DateOnly)
+	if day != l.quotaDay {
+		l.quotaDay = day
+		clear(l.downloads)
+	}
+}
+
+func (l *RateLimiter) enqueue() bool {
+	l.waitMu.Lock()
+	defer l.waitMu.Unlock()
+	if l.waiting >= l.cfg.ConversionQueueSize {
+		return false
+	}
+	l.waiting++
+	metrics.ConversionsWaiting.Inc()
+	return true
+}
+
+func (l *RateLimiter) dequeue() {
+	l.waitMu.Lock()
+	defer l.waitMu.Unlock()
+	l.waiting--
+	metrics.ConversionsWaiting.Dec()
+}
+
+// clientIP returns the request's client address, taken from X-Forwarded-For
+// only when the deployment trusts its proxy
+func (l *RateLimiter) clientIP(r *http.Request) string {
+	if l.cfg.TrustForwardedFor {
+		if fwd := r.Header.Get("X-Forwarded-For"); fwd != "" {
+			first, _, _ := strings.Cut(fwd, ",")
+			return strings.TrimSpace(first)
+		}
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// user returns the authenticated user name set by a reverse proxy, or ""
+func (l *RateLimiter) user(r *http.Request) string {
+	return UserName(r, l.cfg.UserHeader)
+}
+
+// UserName returns the user name a reverse proxy authenticated the request
+// as, taken from header, or "". HTTP Basic credentials are not trusted: the
+// server never checks their password, so any client could claim any name.
+func UserName(r *http.Request, header string) string {
+	if header == "" {
+		return ""
+	}
+	return r.Header.Get(header)
+}
+
+// rejectQuota answers a request over the daily quota, retrying at midnight
+func (l *RateLimiter) rejectQuota(w http.ResponseWriter, r *http.Request) {
+	now := l.now().UTC()
+	midnight := time.Date(now.Year(), now.Month(), now.Day()+1, 0, 0, 0, 0, time.UTC)
+	l.reject(w, r, GroupDownload, "quota", http.StatusTooManyRequests, midnight.Sub(now),
+		fmt.Sprintf("Daily download quota of %d exceeded", l.cfg.DailyDownloadQuota))
+}
+
+func (l *RateLimiter) reject(w http.ResponseWriter, r *http.Request, group, reason string, status int, retryAfter time.Duration, message string) {
+	metrics.RateLimited.WithLabelValues(group, reason).Inc()
+	logger.Warn("Request rejected by rate limiter",
+		"group", group,
+		"reason", reason,
+		"path", r.URL.Path,
+		"request_id", r.Context().Value(RequestIDKey),
+	)
+	w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(retryAfter.Seconds()))))
+	http.Error(w, message, status)
+}
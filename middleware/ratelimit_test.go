@@ -0,0 +1,335 @@
+package middleware
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/htol/bopds/config"
+	"github.com/htol/bopds/logger"
+)
+
+func init() {
+	// Initialize logger for tests
+	logger.Init("info")
+}
+
+var okHandler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+	w.WriteHeader(http.StatusOK)
+})
+
+func newRequest(remoteAddr, user string) *http.Request {
+	req := httptest.NewRequest("GET", "/api/books/1/download", nil)
+	req.RemoteAddr = remoteAddr
+	if user != "" {
+		req.Header.Set("X-Remote-User", user)
+	}
+	return req
+}
+
+func TestRateLimiter_Limit(t *testing.T) {
+	cfg := config.RateLimitConfig{
+		Enabled:    true,
+		UserHeader: "X-Remote-User",
+		Download:   config.RouteLimitConfig{IPRate: 0.001, IPBurst: 2, UserRate: 0.001, UserBurst: 3},
+	}
+
+	tests := []struct {
+		name     string
+		requests []*http.Request
+		expected []int
+	}{
+		{
+			name:     "per-IP burst then rejected",
+			requests: []*http.Request{newRequest("10.0.0.1:1000", ""), newRequest("10.0.0.1:1001", ""), newRequest("10.0.0.1:1002", "")},
+			expected: []int{http.StatusOK, http.StatusOK, http.StatusTooManyRequests},
+		},
+		{
+			name:     "IPs are limited independently",
+			requests: []*http.Request{newRequest("10.0.0.1:1000", ""), newRequest("10.0.0.1:1000", ""), newRequest("10.0.0.2:1000", "")},
+			expected: []int{http.StatusOK, http.StatusOK, http.StatusOK},
+		},
+		{
+			name: "per-user limit spans IPs",
+			requests: []*http.Request{
+				newRequest("10.0.0.1:1000", "alice"), newRequest("10.0.0.2:1000", "alice"),
+				newRequest("10.0.0.3:1000", "alice"), newRequest("10.0.0.4:1000", "alice"),
+			},
+			expected: []int{http.StatusOK, http.StatusOK, http.StatusOK, http.StatusTooManyRequests},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			handler := NewRateLimiter(cfg).Limit(GroupDownload)(okHandler)
+			for i, req := range tt.requests {
+				w := httptest.NewRecorder()
+				handler.ServeHTTP(w, req)
+				if w.Code != tt.expected[i] {
+					t.Fatalf("request %d: expected status %d, got %d", i, tt.expected[i], w.Code)
+				}
+				if w.Code == http.StatusTooManyRequests && w.Header().Get("Retry-After") == "" {
+					t.Errorf("request %d: expected Retry-After header", i)
+				}
+			}
+		})
+	}
+}
+
+func TestRateLimiter_Disabled(t *testing.T) {
+	cfg := config.RateLimitConfig{
+		Download:           config.RouteLimitConfig{IPRate: 0.001, IPBurst: 1},
+		DailyDownloadQuota: 1,
+	}
+	limiter := NewRateLimiter(cfg)
+	handler := limiter.Limit(GroupDownload)(limiter.Quota(okHandler))
+
+	for i := 0; i < 5; i++ {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, newRequest("10.0.0.1:1000", ""))
+		if w.Code != http.StatusOK {
+			t.Fatalf("request %d: expected status 200 with limits disabled, got %d", i, w.Code)
+		}
+	}
+}
+
+func TestRateLimiter_Quota(t *testing.T) {
+	limiter := NewRateLimiter(config.RateLimitConfig{
+		Enabled:            true,
+		UserHeader:         "X-Remote-User",
+		DailyDownloadQuota: 2,
+	})
+	now := time.Date(2026, 3, 1, 22, 0, 0, 0, time.UTC)
+	limiter.now = func() time.Time { return now }
+
+	status := http.StatusOK
+	handler := limiter.Quota(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(status)
+	}))
+	serve := func(user string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, newRequest("10.0.0.1:1000", user))
+		return w
+	}
+
+	// Failed downloads do not use up the quota
+	status = http.StatusNotFound
+	serve("alice")
+	status = http.StatusOK
+
+	for i := 0; i < 2; i++ {
+		if w := serve("alice"); w.Code != http.StatusOK {
+			t.Fatalf("download %d: expected status 200, got %d", i, w.Code)
+		}
+	}
+	w := serve("alice")
+	if w.Code != http.StatusTooManyRequests {
+		t.Fatalf("expected quota to be exhausted, got %d", w.Code)
+	}
+	if got := w.Header().Get("Retry-After"); got != "7200" {
+		t.Errorf("expected Retry-After until midnight (7200), got %q", got)
+	}
+
+	if w := serve("bob"); w.Code != http.StatusOK {
+		t.Errorf("expected other users to be unaffected, got %d", w.Code)
+	}
+
+	now = now.Add(3 * time.Hour)
+	if w := serve("alice"); w.Code != http.StatusOK {
+		t.Errorf("expected quota to reset the next day, got %d", w.Code)
+	}
+}
+
+func TestRateLimiter_QuotaConcurrent(t *testing.T) {
+	limiter := NewRateLimiter(config.RateLimitConfig{
+		Enabled:            true,
+		UserHeader:         "X-Remote-User",
+		DailyDownloadQuota: 2,
+	})
+	release := make(chan struct{})
+	handler := limiter.Quota(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+		w.WriteHeader(http.StatusOK)
+	}))
+
+	// Downloads in flight hold their place in the quota, so a burst of
+	// parallel requests cannot all pass the check before any is counted
+	const requests = 5
+	codes := make(chan int, requests)
+	var wg sync.WaitGroup
+	for range requests {
+		wg.Go(func() {
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, newRequest("10.0.0.1:1000", "alice"))
+			codes <- w.Code
+		})
+	}
+	for range requests - 2 {
+		if code := <-codes; code != http.StatusTooManyRequests {
+			t.Errorf("expected excess downloads to be rejected, got %d", code)
+		}
+	}
+	close(release)
+	wg.Wait()
+	close(codes)
+	for code := range codes {
+		if code != http.StatusOK {
+			t.Errorf("expected the reserved downloads to succeed, got %d", code)
+		}
+	}
+}
+
+func TestRateLimiter_QuotaIgnoresBasicAuth(t *testing.T) {
+	limiter := NewRateLimiter(config.RateLimitConfig{
+		Enabled:            true,
+		UserHeader:         "X-Remote-User",
+		DailyDownloadQuota: 2,
+	})
+	handler := limiter.Quota(okHandler)
+
+	// Unverified Basic user names are keyed by IP, so rotating them does not
+	// earn a fresh quota
+	for i, user := range []string{"alice", "bob", "carol"} {
+		req := newRequest("10.0.0.1:1000", "")
+		req.SetBasicAuth(user, "")
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		expected := http.StatusOK
+		if i == 2 {
+			expected = http.StatusTooManyRequests
+		}
+		if w.Code != expected {
+			t.Fatalf("download %d as %s: expected status %d, got %d", i, user, expected, w.Code)
+		}
+	}
+}
+
+func TestUserName(t *testing.T) {
+	tests := []struct {
+		name   string
+		header string
+		set    func(*http.Request)
+		expect string
+	}{
+		{"proxy header", "X-Remote-User", func(r *http.Request) { r.Header.Set("X-Remote-User", "alice") }, "alice"},
+		{"header not configured", "", func(r *http.Request) { r.Header.Set("X-Remote-User", "alice") }, ""},
+		{"basic auth", "X-Remote-User", func(r *http.Request) { r.SetBasicAuth("alice", "secret") }, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest("GET", "/", nil)
+			tt.set(req)
+			if got := UserName(req, tt.header); got != tt.expect {
+				t.Errorf("expected %q, got %q", tt.expect, got)
+			}
+		})
+	}
+}
+
+func TestRateLimiter_Conversions(t *testing.T) {
+	limiter := NewRateLimiter(config.RateLimitConfig{
+		MaxConcurrentConversions: 1,
+		ConversionQueueSize:      0,
+		ConversionQueueTimeout:   5,
+	})
+
+	started := make(chan struct{})
+	release := make(chan struct{})
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("format") == "epub" {
+			done, ok := limiter.AcquireConversion(w, r)
+			if !ok {
+				return
+			}
+			defer done()
+			started <- struct{}{}
+			<-release
+		}
+		w.WriteHeader(http.StatusOK)
+	})
+
+	done := make(chan int)
+	go func() {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest("GET", "/api/books/1/download?format=epub", nil))
+		done <- w.Code
+	}()
+	<-started
+
+	// The only slot is taken and nothing may queue
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("GET", "/api/books/2/download?format=epub", nil))
+	if w.Code != http.StatusServiceUnavailable {
+		t.Errorf("expected 503 while the slot is busy, got %d", w.Code)
+	}
+	if got := w.Header().Get("Retry-After"); got != "5" {
+		t.Errorf("expected Retry-After 5, got %q", got)
+	}
+
+	// Requests that do not ask for a slot bypass the cap
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("GET", "/api/books/2/download?format=fb2", nil))
+	if w.Code != http.StatusOK {
+		t.Errorf("expected fb2 download to bypass the cap, got %d", w.Code)
+	}
+
+	close(release)
+	if code := <-done; code != http.StatusOK {
+		t.Errorf("expected first conversion to succeed, got %d", code)
+	}
+}
+
+func TestRateLimiter_ConversionQueue(t *testing.T) {
+	limiter := NewRateLimiter(config.RateLimitConfig{
+		MaxConcurrentConversions: 1,
+		ConversionQueueSize:      1,
+		ConversionQueueTimeout:   5,
+	})
+
+	started := make(chan struct{}, 2)
+	release := make(chan struct{})
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		done, ok := limiter.AcquireConversion(w, r)
+		if !ok {
+			return
+		}
+		defer done()
+		started <- struct{}{}
+		<-release
+		w.WriteHeader(http.StatusOK)
+	})
+
+	done := make(chan int, 2)
+	for i := 0; i < 2; i++ {
+		go func() {
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, httptest.NewRequest("GET", "/api/books/1/download?format=epub", nil))
+			done <- w.Code
+		}()
+	}
+	<-started
+
+	// Wait until the second request is queued behind the first
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		limiter.waitMu.Lock()
+		waiting := limiter.waiting
+		limiter.waitMu.Unlock()
+		if waiting == 1 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("second request never queued")
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	close(release)
+	for i := 0; i < 2; i++ {
+		if code := <-done; code != http.StatusOK {
+			t.Errorf("expected queued conversions to complete, got %d", code)
+		}
+	}
+}
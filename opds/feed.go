@@ -2,9 +2,14 @@ package opds
 
 import (
 	"fmt"
+	"mime"
+	"net/url"
+	"strings"
 	"time"
 
 	"github.com/htol/bopds/book"
+	"github.com/htol/bopds/converter"
+	"github.com/htol/bopds/i18n"
 )
 
 // NewNavigationFeed creates a new navigation feed
@@ -103,19 +108,48 @@ func (f *Feed) AddAcquisitionNavigationEntry(id, title, href, rel, content strin
 	f.Entries = append(f.Entries, entry)
 }
 
-// AddBookEntry adds a book entry with acquisition links
-func (f *Feed) AddBookEntry(b *book.Book, baseURL string) {
+// AddBookEntry adds a partial book entry: authors, language, genres, links
+// to the book's complete entry, its authors and series under the catalog
+// root, and acquisition links, titled in the language of p
+func (f *Feed) AddBookEntry(p *i18n.Printer, b *book.Book, baseURL, root string) {
+	f.Entries = append(f.Entries, BookEntry(p, b, baseURL, root))
+}
+
+// BookEntry returns the partial entry of a book for feeds under the catalog
+// root
+func BookEntry(p *i18n.Printer, b *book.Book, baseURL, root string) Entry {
 	entry := Entry{
 		ID:      fmt.Sprintf("urn:uuid:bopds-book-%d", b.BookID),
 		Title:   b.Title,
-		Updated: time.Now().UTC(),
-		Links:   []Link{},
+		Updated: bookUpdated(b),
+		Links: []Link{
+			{Rel: RelAlternate, Href: fmt.Sprintf("%s/books/%d", root, b.BookID), Type: TypeEntry, Title: p.Sprintf("Full entry")},
+		},
 	}
 
-	// Add authors
+	// Add authors, linked to their books
 	for _, author := range b.Author {
-		name := formatAuthorName(author)
-		entry.Authors = append(entry.Authors, Author{Name: name})
+		name := formatAuthorName(p, author)
+		a := Author{Name: name}
+		if author.ID > 0 {
+			a.URI = fmt.Sprintf("%s/authors/%d", root, author.ID)
+			entry.Links = append(entry.Links, Link{
+				Rel:   RelRelated,
+				Href:  a.URI + "/books",
+				Type:  TypeAcquisition,
+				Title: p.Sprintf("All books by %s", name),
+			})
+		}
+		entry.Authors = append(entry.Authors, a)
+	}
+
+	if b.Series != nil && b.Series.ID > 0 {
+		entry.Links = append(entry.Links, Link{
+			Rel:   RelRelated,
+			Href:  fmt.Sprintf("%s/series/%d", root, b.Series.ID),
+			Type:  TypeAcquisition,
+			Title: p.Sprintf("All books in the series %s", b.Series.Name),
+		})
 	}
 
 	// Add language
@@ -131,43 +165,132 @@ func (f *Feed) AddBookEntry(b *book.Book, baseURL string) {
 		})
 	}
 
-	// Add acquisition links for different formats
-	// FB2 zipped (primary format)
-	entry.Links = append(entry.Links, Link{
-		Rel:  RelAcquisitionOpen,
-		Href: fmt.Sprintf("%s/api/books/%d/download?format=fb2.zip", baseURL, b.BookID),
-		Type: "application/fb2+zip",
-	})
+	entry.Links = append(entry.Links, AcquisitionLinks(baseURL, b.BookID, b.Format)...)
+	return entry
+}
 
-	// EPUB
-	entry.Links = append(entry.Links, Link{
-		Rel:  RelAcquisitionOpen,
-		Href: fmt.Sprintf("%s/api/books/%d/download?format=epub", baseURL, b.BookID),
-		Type: "application/epub+zip",
-	})
+// NewBookEntryDocument returns the complete entry of a book under the
+// catalog root: the partial entry with the annotation, series, keywords,
+// size and date added, genres labelled with labels (by genre name) and
+// linked to more books in each genre
+func NewBookEntryDocument(p *i18n.Printer, b *book.Book, annotation string, labels map[string]string, baseURL, root string) *EntryDocument {
+	entry := BookEntry(p, b, baseURL, root)
+	selfURL := fmt.Sprintf("%s/books/%d", root, b.BookID)
+	entry.Links[0] = Link{Rel: RelSelf, Href: selfURL, Type: TypeEntry}
 
-	// MOBI
-	entry.Links = append(entry.Links, Link{
-		Rel:  RelAcquisitionOpen,
-		Href: fmt.Sprintf("%s/api/books/%d/download?format=mobi", baseURL, b.BookID),
-		Type: "application/x-mobipocket-ebook",
-	})
+	for i := range entry.Categories {
+		genre := entry.Categories[i].Term
+		label := labels[genre]
+		if label == "" {
+			label = genre
+		}
+		entry.Categories[i].Label = label
+		entry.Links = append(entry.Links, Link{
+			Rel:   RelRelated,
+			Href:  fmt.Sprintf("%s/genres/%s", root, url.PathEscape(genre)),
+			Type:  TypeAcquisition,
+			Title: p.Sprintf("More in %s", label),
+		})
+	}
 
-	f.Entries = append(f.Entries, entry)
+	var details []string
+	if b.Series != nil && b.Series.Name != "" {
+		series := p.Sprintf("Series: %s", b.Series.Name)
+		if b.Series.SeriesNo > 0 {
+			series = p.Sprintf("Series: %s #%d", b.Series.Name, b.Series.SeriesNo)
+		}
+		details = append(details, series)
+	}
+	if len(b.Keywords) > 0 {
+		details = append(details, p.Sprintf("Keywords: %s", strings.Join(b.Keywords, ", ")))
+	}
+	if b.FileSize > 0 {
+		entry.Extent = p.Size(b.FileSize)
+		details = append(details, p.Sprintf("Size: %s", entry.Extent))
+	}
+	if b.DateAdded != "" {
+		details = append(details, p.Sprintf("Added: %s", b.DateAdded))
+	}
+	content := strings.Join(details, "\n")
+	if annotation != "" {
+		entry.Summary = annotation
+		content = strings.TrimSpace(annotation + "\n\n" + content)
+	}
+	if content != "" {
+		entry.Content = &Content{Type: "text", Value: content}
+	}
+
+	return &EntryDocument{
+		Xmlns:     NamespaceAtom,
+		XmlnsDc:   NamespaceDC,
+		XmlnsOpds: NamespaceOpds,
+		Entry:     entry,
+	}
+}
+
+// bookUpdated returns when the book was added, or now for books that do
+// not say
+func bookUpdated(b *book.Book) time.Time {
+	if t, err := time.Parse(time.DateOnly, b.DateAdded); err == nil {
+		return t
+	}
+	return time.Now().UTC()
 }
 
-// AddPaginationLinks adds next/prev links for RFC 5005 pagination
+// AcquisitionLinks returns download links for a book stored in format: for
+// FB2, zipped FB2 (the primary format) followed by every format registered
+// with the converter; for other formats, the book as it is stored
+func AcquisitionLinks(baseURL string, bookID int64, format string) []Link {
+	if format != "" && format != "fb2" {
+		href := fmt.Sprintf("%s/api/books/%d/download", baseURL, bookID)
+		f, ok := converter.LookupBookFormat(format)
+		if ok {
+			href += "?format=" + f.Name
+		} else {
+			// Served as stored, which is the download default
+			f = converter.Format{Name: format, Title: strings.ToUpper(format), ContentType: "application/octet-stream"}
+			if t := mime.TypeByExtension("." + format); t != "" {
+				f.ContentType = t
+			}
+		}
+		return []Link{{Rel: RelAcquisitionOpen, Href: href, Type: f.ContentType, Title: f.Title}}
+	}
+
+	links := []Link{{
+		Rel:   RelAcquisitionOpen,
+		Href:  fmt.Sprintf("%s/api/books/%d/download?format=fb2.zip", baseURL, bookID),
+		Type:  "application/fb2+zip",
+		Title: "FB2",
+	}}
+	for _, f := range converter.Formats() {
+		links = append(links, Link{
+			Rel:   RelAcquisitionOpen,
+			Href:  fmt.Sprintf("%s/api/books/%d/download?format=%s", baseURL, bookID, f.Name),
+			Type:  f.ContentType,
+			Title: f.Title,
+		})
+	}
+	return links
+}
+
+// AddPaginationLinks adds next/prev links for RFC 5005 pagination. baseURL
+// may carry a query of its own.
 func (f *Feed) AddPaginationLinks(baseURL string, page, pageSize, total int) {
 	totalPages := (total + pageSize - 1) / pageSize
 	if totalPages == 0 {
 		totalPages = 1
 	}
+	if strings.Contains(baseURL, "?") {
+		baseURL += "&"
+	} else {
+		baseURL += "?"
+	}
 
 	// First page
 	if page > 1 {
 		f.Links = append(f.Links, Link{
 			Rel:  RelFirst,
-			Href: fmt.Sprintf("%s?page=1&pageSize=%d", baseURL, pageSize),
+			Href: fmt.Sprintf("%spage=1&pageSize=%d", baseURL, pageSize),
 			Type: TypeAcquisition,
 		})
 	}
@@ -176,7 +299,7 @@ func (f *Feed) AddPaginationLinks(baseURL string, page, pageSize, total int) {
 	if page > 1 {
 		f.Links = append(f.Links, Link{
 			Rel:  RelPrevious,
-			Href: fmt.Sprintf("%s?page=%d&pageSize=%d", baseURL, page-1, pageSize),
+			Href: fmt.Sprintf("%spage=%d&pageSize=%d", baseURL, page-1, pageSize),
 			Type: TypeAcquisition,
 		})
 	}
@@ -185,7 +308,7 @@ func (f *Feed) AddPaginationLinks(baseURL string, page, pageSize, total int) {
 	if page < totalPages {
 		f.Links = append(f.Links, Link{
 			Rel:  RelNext,
-			Href: fmt.Sprintf("%s?page=%d&pageSize=%d", baseURL, page+1, pageSize),
+			Href: fmt.Sprintf("%spage=%d&pageSize=%d", baseURL, page+1, pageSize),
 			Type: TypeAcquisition,
 		})
 	}
@@ -194,14 +317,30 @@ func (f *Feed) AddPaginationLinks(baseURL string, page, pageSize, total int) {
 	if page < totalPages {
 		f.Links = append(f.Links, Link{
 			Rel:  RelLast,
-			Href: fmt.Sprintf("%s?page=%d&pageSize=%d", baseURL, totalPages, pageSize),
+			Href: fmt.Sprintf("%spage=%d&pageSize=%d", baseURL, totalPages, pageSize),
 			Type: TypeAcquisition,
 		})
 	}
 }
 
+// AddFacetLink adds a link to the feed filtered by a facet of group, marking
+// the facet the feed is currently filtered by as active
+func (f *Feed) AddFacetLink(href, title, group string, active bool) {
+	link := Link{
+		Rel:        RelFacet,
+		Href:       href,
+		Type:       TypeAcquisition,
+		Title:      title,
+		FacetGroup: group,
+	}
+	if active {
+		link.ActiveFacet = "true"
+	}
+	f.Links = append(f.Links, link)
+}
+
 // formatAuthorName formats an author's full name
-func formatAuthorName(a book.Author) string {
+func formatAuthorName(p *i18n.Printer, a book.Author) string {
 	name := ""
 	if a.FirstName != "" {
 		name = a.FirstName
@@ -219,7 +358,7 @@ func formatAuthorName(a book.Author) string {
 		name += a.LastName
 	}
 	if name == "" {
-		name = "Unknown Author"
+		name = p.Sprintf("Unknown Author")
 	}
 	return name
 }
@@ -20,7 +20,8 @@ type OpenSearchURL struct {
 }
 
 // NewOpenSearchDescription creates an OpenSearch description document
-func NewOpenSearchDescription(baseURL, shortName, description string) *OpenSearchDescription {
+// for the acquisition search endpoint at searchURL
+func NewOpenSearchDescription(searchURL, shortName, description string) *OpenSearchDescription {
 	return &OpenSearchDescription{
 		Xmlns:       NamespaceSearch,
 		ShortName:   shortName,
@@ -29,7 +30,7 @@ func NewOpenSearchDescription(baseURL, shortName, description string) *OpenSearc
 		OutputEnc:   "UTF-8",
 		URL: OpenSearchURL{
 			Type:     TypeAcquisition,
-			Template: baseURL + "/opds/search?q={searchTerms}",
+			Template: searchURL + "?q={searchTerms}",
 		},
 	}
 }
@@ -43,6 +43,11 @@ const (
 	RelSortPopular = "http://opds-spec.org/sort/popular"
 )
 
+// Facet Relations
+const (
+	RelFacet = "http://opds-spec.org/facet"
+)
+
 // Standard Link Relations (RFC 5988)
 const (
 	RelSelf       = "self"
@@ -55,6 +60,7 @@ const (
 	RelSubsection = "subsection"
 	RelSearch     = "search"
 	RelAlternate  = "alternate"
+	RelRelated    = "related"
 )
 
 // Feed represents an OPDS Atom feed (navigation or acquisition)
@@ -84,6 +90,17 @@ type Entry struct {
 	// Dublin Core extensions
 	Language string `xml:"dc:language,omitempty"`
 	Issued   string `xml:"dc:issued,omitempty"`
+	Extent   string `xml:"dc:extent,omitempty"` // file size, e.g. "1.2 MB"
+}
+
+// EntryDocument is a standalone OPDS entry: the complete description of a
+// book that partial entries in feeds link to
+type EntryDocument struct {
+	XMLName   xml.Name `xml:"entry"`
+	Xmlns     string   `xml:"xmlns,attr"`
+	XmlnsDc   string   `xml:"xmlns:dc,attr,omitempty"`
+	XmlnsOpds string   `xml:"xmlns:opds,attr,omitempty"`
+	Entry
 }
 
 // Author represents an Atom author element
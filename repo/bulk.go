@@ -159,7 +159,7 @@ func (r *Repo) AddBatch(records []*book.Book) error {
 }
 
 func (r *Repo) bulkInsertBooks(tx *sql.Tx, records []*book.Book) error {
-	chunkSize := 3000 // Increased from 100. SQLite limit is usually 32766 params. 3000*9 = 27000. Safe.
+	chunkSize := 2800 // Increased from 100. SQLite limit is usually 32766 params. 2800*11 = 30800. Safe.
 	for i := 0; i < len(records); i += chunkSize {
 		end := i + chunkSize
 		if end > len(records) {
@@ -168,19 +168,19 @@ func (r *Repo) bulkInsertBooks(tx *sql.Tx, records []*book.Book) error {
 		chunk := records[i:end]
 
 		valueStrings := make([]string, 0, len(chunk))
-		valueArgs := make([]interface{}, 0, len(chunk)*9)
+		valueArgs := make([]interface{}, 0, len(chunk)*11)
 
 		for _, b := range chunk {
-			valueStrings = append(valueStrings, "(?, ?, ?, ?, ?, ?, ?, ?, ?)")
+			valueStrings = append(valueStrings, "(?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)")
 			del := 0
 			if b.Deleted {
 				del = 1
 			}
-			valueArgs = append(valueArgs, b.Title, b.Lang, b.Archive, b.FileName, b.FileSize, b.DateAdded, b.LibID, del, b.LibRate)
+			valueArgs = append(valueArgs, b.Title, b.Lang, b.Archive, b.Library, b.FileName, bookFormat(b), b.FileSize, b.DateAdded, b.LibID, del, b.LibRate)
 		}
 
 		// Use Exec instead of Query with RETURNING - much faster for bulk inserts
-		stmt := fmt.Sprintf("INSERT INTO books(title, lang, archive, filename, file_size, date_added, lib_id, deleted, lib_rate) VALUES %s",
+		stmt := fmt.Sprintf("INSERT INTO books(title, lang, archive, library, filename, format, file_size, date_added, lib_id, deleted, lib_rate) VALUES %s",
 			strings.Join(valueStrings, ","))
 
 		result, err := tx.Exec(stmt, valueArgs...)
@@ -205,6 +205,15 @@ func (r *Repo) bulkInsertBooks(tx *sql.Tx, records []*book.Book) error {
 	return nil
 }
 
+// bookFormat returns the format stored for the book; books that do not say
+// are FB2
+func bookFormat(b *book.Book) string {
+	if b.Format == "" {
+		return "fb2"
+	}
+	return b.Format
+}
+
 func (r *Repo) bulkInsertLinks(tx *sql.Tx, table string, columns string, links []linkData) error {
 	chunkSize := 10000 // SQLite limit ~32k. 10000 * 2 = 20000 vars. Safe.
 	for i := 0; i < len(links); i += chunkSize {
@@ -308,7 +317,7 @@ func (r *Repo) NewBatchInserter(tx *sql.Tx) (*BatchInserter, error) {
 		return s, nil
 	}
 
-	if bi.stmtInsertBook, err = prepare(`INSERT INTO books(title, lang, archive, filename, file_size, date_added, lib_id, deleted, lib_rate) VALUES(?, ?, ?, ?, ?, ?, ?, ?, ?)`); err != nil {
+	if bi.stmtInsertBook, err = prepare(`INSERT INTO books(title, lang, archive, library, filename, format, file_size, date_added, lib_id, deleted, lib_rate) VALUES(?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`); err != nil {
 		bi.Close()
 		return nil, err
 	}
@@ -328,7 +337,7 @@ func (r *Repo) NewBatchInserter(tx *sql.Tx) (*BatchInserter, error) {
 		bi.Close()
 		return nil, err
 	}
-	if bi.stmtInsertGenre, err = prepare(`INSERT INTO genres(name) VALUES(?)`); err != nil {
+	if bi.stmtInsertGenre, err = prepare(`INSERT INTO genres(name, category_id) VALUES(?, (SELECT category_id FROM genre_categories WHERE name = ?))`); err != nil {
 		bi.Close()
 		return nil, err
 	}
@@ -385,7 +394,9 @@ func (bi *BatchInserter) Add(record *book.Book) error {
 		record.Title,
 		record.Lang,
 		record.Archive,
+		record.Library,
 		record.FileName,
+		bookFormat(record),
 		record.FileSize,
 		record.DateAdded,
 		record.LibID,
@@ -506,7 +517,7 @@ func (bi *BatchInserter) getOrCreateGenre(name string) (int64, error) {
 		return id, nil
 	}
 
-	res, err := bi.stmtInsertGenre.Exec(name)
+	res, err := bi.stmtInsertGenre.Exec(name, bi.repo.genreMapping.category(name))
 	if err != nil {
 		return 0, err
 	}
@@ -0,0 +1,398 @@
+package repo
+
+import (
+	"cmp"
+	"database/sql"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+	"github.com/htol/bopds/book"
+	"github.com/htol/bopds/logger"
+	"gopkg.in/yaml.v3"
+)
+
+// OtherGenreCategory holds the genres no category claims
+const OtherGenreCategory = "other"
+
+// genreCategory is a top-level group of genres
+type genreCategory struct {
+	Name        string `yaml:"name" toml:"name"`
+	DisplayName string `yaml:"display_name" toml:"display_name"`
+}
+
+// genreCategories are the built-in categories, in the order they are listed
+var genreCategories = []genreCategory{
+	{"sf", "Фантастика"},
+	{"detective", "Детективы и триллеры"},
+	{"prose", "Проза"},
+	{"love", "Любовные романы"},
+	{"adventure", "Приключения"},
+	{"children", "Детское"},
+	{"poetry", "Поэзия"},
+	{"dramaturgy", "Драматургия"},
+	{"antique", "Старинное"},
+	{"science", "Наука, образование"},
+	{"computers", "Компьютеры и интернет"},
+	{"technics", "Техника"},
+	{"reference", "Справочная литература"},
+	{"nonfiction", "Документальная литература"},
+	{"religion", "Религия и духовность"},
+	{"humor", "Юмор"},
+	{"home", "Дом и семья"},
+	{"business", "Деловая литература"},
+	{"military", "Военное дело"},
+	{"art", "Искусство"},
+	{"folklore", "Фольклор"},
+	{OtherGenreCategory, "Прочее"},
+}
+
+// genreCategoryPrefixes place genre codes by the part before the first
+// underscore, e.g. sf_space under sf
+var genreCategoryPrefixes = map[string]string{
+	"adv":      "adventure",
+	"antique":  "antique",
+	"child":    "children",
+	"comp":     "computers",
+	"det":      "detective",
+	"home":     "home",
+	"humor":    "humor",
+	"love":     "love",
+	"military": "military",
+	"nonf":     "nonfiction",
+	"poetry":   "poetry",
+	"prose":    "prose",
+	"psy":      "science",
+	"ref":      "reference",
+	"religion": "religion",
+	"sci":      "science",
+	"sf":       "sf",
+	"tbg":      "science",
+	"thriller": "detective",
+}
+
+// genreCategoryMap places the genre codes the prefixes miss or misplace
+var genreCategoryMap = map[string]string{
+	"about_musicians":      "nonfiction",
+	"adventure":            "adventure",
+	"adventure_fantasy":    "sf",
+	"aphorisms":            "reference",
+	"architecture_book":    "art",
+	"art_criticism":        "art",
+	"art_world_culture":    "art",
+	"asian_fantasy":        "sf",
+	"astrology":            "religion",
+	"auto_business":        "technics",
+	"auto_regulations":     "technics",
+	"banking":              "business",
+	"boyar_anime":          "sf",
+	"children":             "children",
+	"cine":                 "art",
+	"comedy":               "dramaturgy",
+	"comics":               "art",
+	"computer_translation": OtherGenreCategory,
+	"computers":            "computers",
+	"dark_fantasy":         "sf",
+	"design":               "art",
+	"detective":            "detective",
+	"dorama":               "dramaturgy",
+	"drama":                "dramaturgy",
+	"drama_antique":        "dramaturgy",
+	"dramaturgy":           "dramaturgy",
+	"dystopian":            "sf",
+	"economics":            "business",
+	"economics_ref":        "business",
+	"epic":                 "folklore",
+	"epic_poetry":          "poetry",
+	"epistolary_fiction":   "prose",
+	"equ_history":          "technics",
+	"essay":                "prose",
+	"everyday_fantasy":     "sf",
+	"experimental_poetry":  "poetry",
+	"fable":                "poetry",
+	"fairy_fantasy":        "sf",
+	"family":               "home",
+	"fan_translation":      OtherGenreCategory,
+	"fanfiction":           "sf",
+	"fantasy_det":          "sf",
+	"folk_songs":           "folklore",
+	"folk_tale":            "folklore",
+	"folklore":             "folklore",
+	"foreign_antique":      "antique",
+	"foreign_children":     "children",
+	"foreign_language":     "science",
+	"foreign_prose":        "prose",
+	"foreign_sf":           "sf",
+	"geo_guides":           "reference",
+	"gothic_novel":         "prose",
+	"great_story":          "prose",
+	"historical_fantasy":   "sf",
+	"hronoopera":           "sf",
+	"in_verse":             "poetry",
+	"limerick":             "folklore",
+	"literature_18":        "prose",
+	"literature_19":        "prose",
+	"literature_20":        "prose",
+	"lyrics":               "poetry",
+	"magic_school":         "sf",
+	"management":           "business",
+	"marketing":            "business",
+	"military_history":     "nonfiction",
+	"modern_tale":          "prose",
+	"music":                "art",
+	"network_literature":   "prose",
+	"nonfiction":           "nonfiction",
+	"notes":                "art",
+	"nsf":                  "sf",
+	"org_behavior":         "business",
+	"other":                OtherGenreCategory,
+	"painting":             "art",
+	"palindromes":          "poetry",
+	"periodic":             OtherGenreCategory,
+	"personal_finance":     "business",
+	"poem":                 "poetry",
+	"popadancy":            "sf",
+	"popadanec":            "sf",
+	"popular_business":     "business",
+	"prose_game":           "children",
+	"proverbs":             "folklore",
+	"reference":            "reference",
+	"roman":                "prose",
+	"russian_fantasy":      "sf",
+	"sagas":                "folklore",
+	"scenarios":            "dramaturgy",
+	"sci_build":            "technics",
+	"sci_business":         "business",
+	"sci_economy":          "business",
+	"sci_metal":            "technics",
+	"sci_radio":            "technics",
+	"sci_religion":         "religion",
+	"sci_tech":             "technics",
+	"sci_transport":        "technics",
+	"science":              "science",
+	"screenplays":          "dramaturgy",
+	"short_story":          "prose",
+	"slavic_fantasy":       "sf",
+	"song_poetry":          "poetry",
+	"stock":                "business",
+	"story":                "prose",
+	"tale_chivalry":        "antique",
+	"theatre":              "art",
+	"tragedy":              "dramaturgy",
+	"travel_notes":         "nonfiction",
+	"unfinished":           OtherGenreCategory,
+	"utopia":               "sf",
+	"vaudeville":           "dramaturgy",
+	"visual_arts":          "art",
+	"ya":                   "children",
+}
+
+// genreMapping adds to or overrides the built-in categories and the
+// placement of genre codes. It is read from genres.mapping_files.
+type genreMapping struct {
+	Categories []genreCategory   `yaml:"categories" toml:"categories"`
+	Genres     map[string]string `yaml:"genres" toml:"genres"` // genre code -> category name
+}
+
+// loadGenreMapping reads and merges the mapping files at paths; later
+// files override earlier ones. TOML files are recognized by their
+// extension, anything else is read as YAML.
+func loadGenreMapping(paths []string) (genreMapping, error) {
+	mapping := genreMapping{Genres: make(map[string]string)}
+	for _, path := range paths {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return genreMapping{}, fmt.Errorf("read genre mapping: %w", err)
+		}
+		var file genreMapping
+		if strings.EqualFold(filepath.Ext(path), ".toml") {
+			err = toml.Unmarshal(data, &file)
+		} else {
+			err = yaml.Unmarshal(data, &file)
+		}
+		if err != nil {
+			return genreMapping{}, fmt.Errorf("parse genre mapping %s: %w", path, err)
+		}
+		for _, c := range file.Categories {
+			if c.Name == "" {
+				return genreMapping{}, fmt.Errorf("genre mapping %s: category without a name", path)
+			}
+			mapping.Categories = append(mapping.Categories, c)
+		}
+		for code, category := range file.Genres {
+			mapping.Genres[code] = category
+		}
+	}
+
+	var errs []error
+	known := make(map[string]bool)
+	for _, c := range mapping.allCategories() {
+		known[c.Name] = true
+	}
+	for code, category := range mapping.Genres {
+		if !known[category] {
+			errs = append(errs, fmt.Errorf("genre mapping: %s is placed under unknown category %q", code, category))
+		}
+	}
+	if err := errors.Join(errs...); err != nil {
+		return genreMapping{}, err
+	}
+	return mapping, nil
+}
+
+// allCategories returns the built-in categories, renamed by the mapping,
+// followed by the categories the mapping adds
+func (m genreMapping) allCategories() []genreCategory {
+	categories := make([]genreCategory, 0, len(genreCategories)+len(m.Categories))
+	index := make(map[string]int)
+	for _, c := range append(genreCategories[:len(genreCategories):len(genreCategories)], m.Categories...) {
+		if i, ok := index[c.Name]; ok {
+			if c.DisplayName != "" {
+				categories[i].DisplayName = c.DisplayName
+			}
+			continue
+		}
+		index[c.Name] = len(categories)
+		categories = append(categories, c)
+	}
+	return categories
+}
+
+// category returns the name of the category a genre code is placed under
+func (m genreMapping) category(code string) string {
+	if category, ok := m.Genres[code]; ok {
+		return category
+	}
+	if category, ok := genreCategoryMap[code]; ok {
+		return category
+	}
+	prefix, _, _ := strings.Cut(code, "_")
+	if category, ok := genreCategoryPrefixes[prefix]; ok {
+		return category
+	}
+	return OtherGenreCategory
+}
+
+// SyncGenreCategories stores the categories and places every genre under
+// its category
+func (r *Repo) SyncGenreCategories() {
+	if err := r.syncGenreCategories(); err != nil {
+		logger.Error("Failed to sync genre categories", "error", err)
+	}
+}
+
+func (r *Repo) syncGenreCategories() error {
+	tx, err := r.db.Begin()
+	if err != nil {
+		return fmt.Errorf("begin transaction: %w", err)
+	}
+	defer func() {
+		if err := tx.Rollback(); err != nil && !errors.Is(err, sql.ErrTxDone) {
+			logger.Error("Failed to rollback transaction", "error", err)
+		}
+	}()
+
+	upsert, err := tx.Prepare(`
+		INSERT INTO genre_categories(name, display_name, translit_name, position) VALUES(?, ?, ?, ?)
+		ON CONFLICT(name) DO UPDATE SET
+			display_name = excluded.display_name,
+			translit_name = excluded.translit_name,
+			position = excluded.position
+	`)
+	if err != nil {
+		return fmt.Errorf("prepare category upsert: %w", err)
+	}
+	defer upsert.Close()
+	for i, c := range r.genreMapping.allCategories() {
+		displayName := cmp.Or(c.DisplayName, c.Name)
+		if _, err := upsert.Exec(c.Name, displayName, Translit(displayName), i); err != nil {
+			return fmt.Errorf("store category %s: %w", c.Name, err)
+		}
+	}
+
+	rows, err := tx.Query(`
+		SELECT g.genre_id, g.name, COALESCE(c.name, '')
+		FROM genres g
+		LEFT JOIN genre_categories c ON c.category_id = g.category_id
+	`)
+	if err != nil {
+		return fmt.Errorf("query genres: %w", err)
+	}
+	type placement struct {
+		genreID  int64
+		category string
+	}
+	var moves []placement
+	for rows.Next() {
+		var id int64
+		var name, current string
+		if err := rows.Scan(&id, &name, &current); err != nil {
+			rows.Close()
+			return fmt.Errorf("scan genre: %w", err)
+		}
+		if category := r.genreMapping.category(name); category != current {
+			moves = append(moves, placement{id, category})
+		}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("iterate genres: %w", err)
+	}
+
+	for _, m := range moves {
+		if _, err := tx.Exec(`UPDATE genres SET category_id = (SELECT category_id FROM genre_categories WHERE name = ?) WHERE genre_id = ?`,
+			m.category, m.genreID); err != nil {
+			return fmt.Errorf("place genre %d: %w", m.genreID, err)
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("commit: %w", err)
+	}
+	if len(moves) > 0 {
+		logger.Info("Updated genre categories", "genres", len(moves))
+	}
+	return nil
+}
+
+// GetGenreCategories returns the categories with books in the library (all
+// libraries when empty), with their genre and book counts, in listing order
+func (r *Repo) GetGenreCategories(library string) ([]book.GenreCategory, error) {
+	QUERY := `
+		SELECT c.category_id, c.name, c.display_name, c.translit_name,
+			COUNT(DISTINCT g.genre_id), COUNT(DISTINCT b.book_id)
+		FROM genre_categories c
+		JOIN genres g ON g.category_id = c.category_id
+		JOIN book_genres bg ON bg.genre_id = g.genre_id
+		JOIN books b ON b.book_id = bg.book_id
+		WHERE b.deleted = 0
+		AND (? = '' OR b.library = ?)
+		GROUP BY c.category_id
+		ORDER BY c.position, c.name
+	`
+
+	rows, err := r.db.Query(QUERY, library, library)
+	if err != nil {
+		return nil, fmt.Errorf("query genre categories: %w", err)
+	}
+	defer rows.Close()
+
+	categories := make([]book.GenreCategory, 0)
+	for rows.Next() {
+		var c book.GenreCategory
+		var displayName, translitName sql.NullString
+		if err := rows.Scan(&c.ID, &c.Name, &displayName, &translitName, &c.GenreCount, &c.BookCount); err != nil {
+			return nil, fmt.Errorf("scan genre category: %w", err)
+		}
+		c.DisplayName = cmp.Or(displayName.String, c.Name)
+		c.TranslitName = translitName.String
+		categories = append(categories, c)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("iterate genre categories: %w", err)
+	}
+	return categories, nil
+}
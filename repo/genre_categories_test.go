@@ -0,0 +1,138 @@
+package repo
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/htol/bopds/book"
+	"github.com/htol/bopds/config"
+)
+
+func TestGenreCategories(t *testing.T) {
+	dir := t.TempDir()
+	mappingFile := filepath.Join(dir, "genres.yaml")
+	mapping := `
+categories:
+  - name: manga
+    display_name: Манга
+  - name: sf
+    display_name: Фантастика и фэнтези
+genres:
+  comics_manga: manga
+  sf_humor: humor
+`
+	if err := os.WriteFile(mappingFile, []byte(mapping), 0o644); err != nil {
+		t.Fatalf("write mapping: %v", err)
+	}
+	cfg := config.Default()
+	cfg.Genres.MappingFiles = []string{mappingFile}
+	db := GetStorageWithConfig(":memory:", cfg)
+	defer db.Close()
+
+	for _, genres := range [][]string{{"sf_space", "sf_fantasy"}, {"sf_humor"}, {"comics_manga"}, {"made_up"}, {"det_police"}} {
+		b := &book.Book{Title: strings.Join(genres, ","), Archive: "books.zip", FileName: genres[0] + ".fb2", Genres: genres}
+		if err := db.Add(b); err != nil {
+			t.Fatalf("add book: %v", err)
+		}
+	}
+
+	categories, err := db.GetGenreCategories("")
+	if err != nil {
+		t.Fatalf("GetGenreCategories: %v", err)
+	}
+	expect := []book.GenreCategory{
+		{Name: "sf", DisplayName: "Фантастика и фэнтези", GenreCount: 2, BookCount: 1},
+		{Name: "detective", DisplayName: "Детективы и триллеры", GenreCount: 1, BookCount: 1},
+		{Name: "humor", DisplayName: "Юмор", GenreCount: 1, BookCount: 1},
+		{Name: "other", DisplayName: "Прочее", GenreCount: 1, BookCount: 1},
+		{Name: "manga", DisplayName: "Манга", GenreCount: 1, BookCount: 1},
+	}
+	if len(categories) != len(expect) {
+		t.Fatalf("expected %d categories, got %+v", len(expect), categories)
+	}
+	for i, c := range categories {
+		e := expect[i]
+		if c.Name != e.Name || c.DisplayName != e.DisplayName || c.GenreCount != e.GenreCount || c.BookCount != e.BookCount {
+			t.Errorf("category %d: expected %+v, got %+v", i, e, c)
+		}
+	}
+	if categories[4].TranslitName != "Manga" {
+		t.Errorf("expected a transliterated category name, got %q", categories[4].TranslitName)
+	}
+
+	// A changed mapping moves genres on the next sync
+	db.genreMapping.Genres["sf_humor"] = "sf"
+	db.SyncGenreCategories()
+	genres, err := db.GetGenres("")
+	if err != nil {
+		t.Fatalf("GetGenres: %v", err)
+	}
+	for _, g := range genres {
+		if g.Name == "sf_humor" && g.Category != "sf" {
+			t.Errorf("expected sf_humor moved to sf, got %q", g.Category)
+		}
+	}
+}
+
+func TestLoadGenreMapping(t *testing.T) {
+	dir := t.TempDir()
+	write := func(name, data string) string {
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, []byte(data), 0o644); err != nil {
+			t.Fatalf("write %s: %v", name, err)
+		}
+		return path
+	}
+	yamlFile := write("a.yaml", "genres:\n  comics_manga: art\n  sf_humor: humor\n")
+	tomlFile := write("b.toml", "[genres]\nsf_humor = \"sf\"\n")
+	unknown := write("c.yaml", "genres:\n  comics_manga: manga\n")
+	unnamed := write("d.yaml", "categories:\n  - display_name: Манга\n")
+
+	mapping, err := loadGenreMapping([]string{yamlFile, tomlFile})
+	if err != nil {
+		t.Fatalf("loadGenreMapping: %v", err)
+	}
+	tests := []struct {
+		code   string
+		expect string
+	}{
+		{"comics_manga", "art"},
+		{"sf_humor", "sf"},
+		{"sf_space", "sf"},
+		{"sci_tech", "technics"},
+		{"sci_math", "science"},
+		{"made_up", OtherGenreCategory},
+	}
+	for _, tt := range tests {
+		if got := mapping.category(tt.code); got != tt.expect {
+			t.Errorf("%s: expected %q, got %q", tt.code, tt.expect, got)
+		}
+	}
+
+	for _, paths := range [][]string{{unknown}, {unnamed}, {filepath.Join(dir, "missing.yaml")}} {
+		if _, err := loadGenreMapping(paths); err == nil {
+			t.Errorf("%v: expected an error", paths)
+		}
+	}
+}
+
+// TestGenreCategoryMapping checks that every built-in genre is placed under a
+// built-in category
+func TestGenreCategoryMapping(t *testing.T) {
+	known := make(map[string]bool)
+	for _, c := range genreCategories {
+		known[c.Name] = true
+	}
+	for code := range genreMap {
+		if category := (genreMapping{}).category(code); !known[category] {
+			t.Errorf("%s: unknown category %q", code, category)
+		}
+	}
+	for code, category := range genreCategoryMap {
+		if !known[category] {
+			t.Errorf("%s: unknown category %q", code, category)
+		}
+	}
+}
@@ -0,0 +1,182 @@
+package repo
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+
+	"github.com/htol/bopds/book"
+	"github.com/htol/bopds/logger"
+)
+
+const jobColumns = `job_id, kind, book_id, format, profile, status, progress, error, result_path, filename, recipient, attempts, created_at, updated_at`
+
+// CreateJob stores a new job and sets its ID and timestamps
+func (r *Repo) CreateJob(job *book.Job) error {
+	now := time.Now().UTC()
+	res, err := r.db.Exec(`
+		INSERT INTO jobs (kind, book_id, format, profile, status, progress, error, result_path, filename, recipient, attempts, created_at, updated_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+	`, job.Kind, job.BookID, job.Format, job.Profile, job.Status, job.Progress, job.Error, job.ResultPath, job.FileName,
+		job.Recipient, job.Attempts, now.Format(time.RFC3339), now.Format(time.RFC3339))
+	if err != nil {
+		return fmt.Errorf("create job: %w", err)
+	}
+	id, err := res.LastInsertId()
+	if err != nil {
+		return fmt.Errorf("create job: %w", err)
+	}
+	job.ID = id
+	job.CreatedAt = now.Truncate(time.Second)
+	job.UpdatedAt = job.CreatedAt
+	return nil
+}
+
+// UpdateJob saves the job's status, progress, delivery attempts and result
+func (r *Repo) UpdateJob(job *book.Job) error {
+	now := time.Now().UTC()
+	res, err := r.db.Exec(`
+		UPDATE jobs
+		SET status = ?, progress = ?, error = ?, result_path = ?, filename = ?, attempts = ?, updated_at = ?
+		WHERE job_id = ?
+	`, job.Status, job.Progress, job.Error, job.ResultPath, job.FileName, job.Attempts, now.Format(time.RFC3339), job.ID)
+	if err != nil {
+		return fmt.Errorf("update job %d: %w", job.ID, err)
+	}
+	if n, err := res.RowsAffected(); err == nil && n == 0 {
+		return ErrNotFound
+	}
+	job.UpdatedAt = now.Truncate(time.Second)
+	return nil
+}
+
+// TouchJob marks the job as just used, so that a result handed out again is
+// not expired right away
+func (r *Repo) TouchJob(id int64) error {
+	res, err := r.db.Exec(`UPDATE jobs SET updated_at = ? WHERE job_id = ?`, time.Now().UTC().Format(time.RFC3339), id)
+	if err != nil {
+		return fmt.Errorf("touch job %d: %w", id, err)
+	}
+	if n, err := res.RowsAffected(); err == nil && n == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+// GetJob returns the job with the given ID
+func (r *Repo) GetJob(id int64) (*book.Job, error) {
+	row := r.db.QueryRow(`SELECT `+jobColumns+` FROM jobs WHERE job_id = ?`, id)
+	job, err := scanJob(row)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, ErrNotFound
+		}
+		return nil, fmt.Errorf("get job %d: %w", id, err)
+	}
+	return job, nil
+}
+
+// FindJob returns the newest job of the given kind for the book, format and
+// profile that has not failed, so that its result can be reused
+func (r *Repo) FindJob(kind string, bookID int64, format, profile string) (*book.Job, error) {
+	row := r.db.QueryRow(`
+		SELECT `+jobColumns+` FROM jobs
+		WHERE kind = ? AND book_id = ? AND format = ? AND profile = ? AND status != ?
+		ORDER BY job_id DESC
+		LIMIT 1
+	`, kind, bookID, format, profile, book.JobFailed)
+	job, err := scanJob(row)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, ErrNotFound
+		}
+		return nil, fmt.Errorf("find job: %w", err)
+	}
+	return job, nil
+}
+
+// GetUnfinishedJobs returns queued and running jobs, oldest first. It is used
+// to resume work interrupted by a restart.
+func (r *Repo) GetUnfinishedJobs() ([]book.Job, error) {
+	rows, err := r.db.Query(`
+		SELECT `+jobColumns+` FROM jobs
+		WHERE status IN (?, ?)
+		ORDER BY job_id
+	`, book.JobQueued, book.JobRunning)
+	if err != nil {
+		return nil, fmt.Errorf("get unfinished jobs: %w", err)
+	}
+	defer rows.Close()
+
+	var jobs []book.Job
+	for rows.Next() {
+		job, err := scanJob(rows)
+		if err != nil {
+			return nil, fmt.Errorf("scan job: %w", err)
+		}
+		jobs = append(jobs, *job)
+	}
+	return jobs, rows.Err()
+}
+
+// ExpireJobs deletes finished jobs last updated before the given time and
+// returns them so their result files can be removed
+func (r *Repo) ExpireJobs(before time.Time) ([]book.Job, error) {
+	tx, err := r.db.Begin()
+	if err != nil {
+		return nil, fmt.Errorf("begin transaction: %w", err)
+	}
+	defer func() {
+		if err := tx.Rollback(); err != nil && err != sql.ErrTxDone {
+			logger.Error("Failed to rollback transaction", "error", err)
+		}
+	}()
+
+	cutoff := before.UTC().Format(time.RFC3339)
+	rows, err := tx.Query(`
+		SELECT `+jobColumns+` FROM jobs
+		WHERE status IN (?, ?) AND updated_at < ?
+	`, book.JobDone, book.JobFailed, cutoff)
+	if err != nil {
+		return nil, fmt.Errorf("get expired jobs: %w", err)
+	}
+	var jobs []book.Job
+	for rows.Next() {
+		job, err := scanJob(rows)
+		if err != nil {
+			rows.Close()
+			return nil, fmt.Errorf("scan job: %w", err)
+		}
+		jobs = append(jobs, *job)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("get expired jobs: %w", err)
+	}
+
+	if _, err := tx.Exec(`DELETE FROM jobs WHERE status IN (?, ?) AND updated_at < ?`,
+		book.JobDone, book.JobFailed, cutoff); err != nil {
+		return nil, fmt.Errorf("delete expired jobs: %w", err)
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, fmt.Errorf("commit transaction: %w", err)
+	}
+	return jobs, nil
+}
+
+func scanJob(row interface{ Scan(...any) error }) (*book.Job, error) {
+	var job book.Job
+	var errMsg, resultPath, filename, recipient sql.NullString
+	var createdAt, updatedAt string
+	if err := row.Scan(&job.ID, &job.Kind, &job.BookID, &job.Format, &job.Profile, &job.Status, &job.Progress,
+		&errMsg, &resultPath, &filename, &recipient, &job.Attempts, &createdAt, &updatedAt); err != nil {
+		return nil, err
+	}
+	job.Error = errMsg.String
+	job.ResultPath = resultPath.String
+	job.FileName = filename.String
+	job.Recipient = recipient.String
+	job.CreatedAt, _ = time.Parse(time.RFC3339, createdAt)
+	job.UpdatedAt, _ = time.Parse(time.RFC3339, updatedAt)
+	return &job, nil
+}
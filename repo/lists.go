@@ -0,0 +1,190 @@
+package repo
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+
+	"github.com/htol/bopds/book"
+)
+
+// ListOptions pages and orders a list. A Limit of zero or less lists every
+// item; an empty Sort orders the list by its default sort key.
+type ListOptions struct {
+	Limit  int
+	Offset int
+	Sort   string // sort key, e.g. "title"
+	Desc   bool   // reverse the order
+}
+
+// ErrUnknownSort is returned for a sort key the list cannot be ordered by
+var ErrUnknownSort = errors.New("unknown sort key")
+
+// sortKey names the SQL expressions a list is ordered by
+type sortKey struct {
+	name  string
+	terms []string
+}
+
+// sortKeys are the sort keys of a list, its default first
+type sortKeys []sortKey
+
+// Sort expressions of the books b by their first author, in name order, and
+// their series
+const (
+	firstAuthorSQL = `(SELECT a.last_name || ' ' || a.first_name FROM book_authors ba
+		JOIN authors a ON ba.author_id = a.author_id
+		WHERE ba.book_id = b.book_id ORDER BY a.last_name, a.first_name LIMIT 1) COLLATE NOCASE`
+	seriesNameSQL = `(SELECT s.name FROM book_series bs
+		JOIN series s ON bs.series_id = s.series_id WHERE bs.book_id = b.book_id) COLLATE NOCASE`
+	seriesNoSQL = `(SELECT bs.series_no FROM book_series bs WHERE bs.book_id = b.book_id)`
+)
+
+var (
+	bookSorts = sortKeys{
+		{"author", []string{firstAuthorSQL, seriesNameSQL, seriesNoSQL, "b.title COLLATE NOCASE"}},
+		{"title", []string{"b.title COLLATE NOCASE"}},
+		{"added", []string{"b.date_added"}},
+	}
+	authorSorts = sortKeys{
+		{"name", []string{"a.last_name COLLATE NOCASE", "a.first_name COLLATE NOCASE", "a.middle_name COLLATE NOCASE"}},
+		{"books", []string{"book_count"}},
+	}
+	seriesSorts = sortKeys{
+		{"name", []string{"s.name COLLATE NOCASE"}},
+		{"books", []string{"book_count"}},
+	}
+	searchSorts = sortKeys{
+		{"author", []string{"author COLLATE NOCASE", "s.name COLLATE NOCASE", "bs.series_no", "b.title COLLATE NOCASE"}},
+		{"title", []string{"b.title COLLATE NOCASE"}},
+		{"added", []string{"b.date_added"}},
+		{"relevance", []string{"fts.rank"}},
+	}
+)
+
+// orderBy returns the ORDER BY clause of the sort key opts asks for,
+// ending with tiebreak to make the order total
+func (keys sortKeys) orderBy(opts ListOptions, tiebreak string) (string, error) {
+	key := keys[0]
+	if opts.Sort != "" {
+		i := slices.IndexFunc(keys, func(k sortKey) bool { return k.name == opts.Sort })
+		if i < 0 {
+			names := make([]string, len(keys))
+			for i, k := range keys {
+				names[i] = k.name
+			}
+			return "", fmt.Errorf("%w %q, must be one of %s", ErrUnknownSort, opts.Sort, strings.Join(names, ", "))
+		}
+		key = keys[i]
+	}
+	terms := append(slices.Clone(key.terms), tiebreak)
+	if opts.Desc {
+		for i := range terms {
+			terms[i] += " DESC"
+		}
+	}
+	return "ORDER BY " + strings.Join(terms, ", "), nil
+}
+
+// limitArgs returns the LIMIT and OFFSET arguments of opts. SQLite reads a
+// negative limit as none.
+func (opts ListOptions) limitArgs() []interface{} {
+	limit := opts.Limit
+	if limit <= 0 {
+		limit = -1
+	}
+	return []interface{}{limit, max(opts.Offset, 0)}
+}
+
+// queryBookPage returns the page of the books b matching where, ordered and
+// paged by opts, with the number of books matching it
+func (r *Repo) queryBookPage(where string, args []interface{}, opts ListOptions) ([]book.Book, int, error) {
+	orderBy, err := bookSorts.orderBy(opts, "b.book_id")
+	if err != nil {
+		return nil, 0, err
+	}
+
+	var total int
+	if err := r.db.QueryRow(`SELECT COUNT(*) FROM books b WHERE `+where, args...).Scan(&total); err != nil {
+		return nil, 0, fmt.Errorf("count books: %w", err)
+	}
+
+	// Page the book IDs first so that books with several authors take a
+	// single place on the page
+	QUERY := `
+		WITH page AS (
+			SELECT b.book_id, ROW_NUMBER() OVER (` + orderBy + `) AS pos
+			FROM books b
+			WHERE ` + where + `
+			ORDER BY pos
+			LIMIT ? OFFSET ?
+		)
+		SELECT b.book_id, b.title, b.lang, b.archive, IFNULL(b.library, ''), b.filename, b.format,
+			   b.file_size, b.date_added, b.lib_id, b.deleted, b.lib_rate,
+			   a.author_id, a.first_name, a.middle_name, a.last_name,
+			   s.series_id, s.name, bs.series_no
+		FROM page p
+		JOIN books b ON p.book_id = b.book_id
+		LEFT JOIN book_authors ba ON b.book_id = ba.book_id
+		LEFT JOIN authors a ON ba.author_id = a.author_id
+		LEFT JOIN book_series bs ON b.book_id = bs.book_id
+		LEFT JOIN series s ON bs.series_id = s.series_id
+		ORDER BY p.pos, a.last_name, a.first_name
+	`
+	rows, err := r.db.Query(QUERY, append(slices.Clone(args), opts.limitArgs()...)...)
+	if err != nil {
+		return nil, 0, fmt.Errorf("query books: %w", err)
+	}
+	defer rows.Close()
+
+	books, err := scanBooks(rows)
+	if err != nil {
+		return nil, 0, err
+	}
+	return books, total, nil
+}
+
+// scanBooks reads books with their authors and series from rows of one
+// book, author and series each, keeping the order the books come in
+func scanBooks(rows *sql.Rows) ([]book.Book, error) {
+	books := make([]book.Book, 0)
+	index := make(map[int64]int)
+	for rows.Next() {
+		var b book.Book
+		var authorID, libRate, seriesID, seriesNo sql.NullInt64
+		var firstName, middleName, lastName, seriesName sql.NullString
+		if err := rows.Scan(
+			&b.BookID, &b.Title, &b.Lang, &b.Archive, &b.Library, &b.FileName, &b.Format,
+			&b.FileSize, &b.DateAdded, &b.LibID, &b.Deleted, &libRate,
+			&authorID, &firstName, &middleName, &lastName,
+			&seriesID, &seriesName, &seriesNo,
+		); err != nil {
+			return nil, fmt.Errorf("scan book: %w", err)
+		}
+
+		i, ok := index[b.BookID]
+		if !ok {
+			b.LibRate = int(libRate.Int64)
+			if seriesName.Valid {
+				b.Series = &book.SeriesInfo{ID: seriesID.Int64, Name: seriesName.String, SeriesNo: int(seriesNo.Int64)}
+			}
+			i = len(books)
+			index[b.BookID] = i
+			books = append(books, b)
+		}
+		if authorID.Valid && !slices.ContainsFunc(books[i].Author, func(a book.Author) bool { return a.ID == authorID.Int64 }) {
+			books[i].Author = append(books[i].Author, book.Author{
+				ID:         authorID.Int64,
+				FirstName:  firstName.String,
+				MiddleName: middleName.String,
+				LastName:   lastName.String,
+			})
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("iterate books: %w", err)
+	}
+	return books, nil
+}
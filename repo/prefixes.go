@@ -0,0 +1,161 @@
+package repo
+
+import (
+	"cmp"
+	"fmt"
+	"slices"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/htol/bopds/book"
+	"golang.org/x/text/cases"
+	"golang.org/x/text/language"
+)
+
+// PrefixIndex names the names GetPrefixes counts
+type PrefixIndex string
+
+const (
+	PrefixAuthors PrefixIndex = "authors" // authors by last name
+	PrefixTitles  PrefixIndex = "titles"  // books by title
+	PrefixSeries  PrefixIndex = "series"  // series by name
+)
+
+// prefixQueries count the entries of each index by the name prefix of the
+// length given by the first argument, among names matching the LIKE pattern
+// of the second in the library of the third and fourth
+var prefixQueries = map[PrefixIndex]string{
+	PrefixAuthors: `
+		SELECT substr(a.last_name, 1, ?) AS prefix, COUNT(DISTINCT a.author_id)
+		FROM authors a
+		JOIN book_authors ba ON a.author_id = ba.author_id
+		JOIN books b ON ba.book_id = b.book_id
+		WHERE a.last_name LIKE ? ESCAPE '\' AND b.deleted = 0
+		AND (? = '' OR b.library = ?)
+		GROUP BY prefix
+	`,
+	PrefixTitles: `
+		SELECT substr(b.title, 1, ?) AS prefix, COUNT(*)
+		FROM books b
+		WHERE b.title LIKE ? ESCAPE '\' AND b.deleted = 0
+		AND (? = '' OR b.library = ?)
+		GROUP BY prefix
+	`,
+	PrefixSeries: `
+		SELECT substr(s.name, 1, ?) AS prefix, COUNT(DISTINCT s.series_id)
+		FROM series s
+		JOIN book_series bs ON s.series_id = bs.series_id
+		JOIN books b ON bs.book_id = b.book_id
+		WHERE s.name LIKE ? ESCAPE '\' AND b.deleted = 0
+		AND (? = '' OR b.library = ?)
+		GROUP BY prefix
+	`,
+}
+
+// GetPrefixes counts the names of the index starting with prefix by their
+// prefixes one character longer, e.g. "Ста" and "Сте" for "Ст". Prefixes
+// differing only in case are counted together. Names no longer than prefix
+// are counted under prefix itself. An empty library matches books from
+// every library.
+func (r *Repo) GetPrefixes(index PrefixIndex, prefix, library string) ([]book.Prefix, error) {
+	query, ok := prefixQueries[index]
+	if !ok {
+		return nil, fmt.Errorf("unknown prefix index %q", index)
+	}
+	pattern := likePrefix(cases.Title(language.Und, cases.NoLower).String(prefix))
+	rows, err := r.db.Query(query, utf8.RuneCountInString(prefix)+1, pattern, library, library)
+	if err != nil {
+		return nil, fmt.Errorf("query %s prefixes: %w", index, err)
+	}
+	defer rows.Close()
+
+	counts := make(map[string]int)
+	for rows.Next() {
+		var p string
+		var count int
+		if err := rows.Scan(&p, &count); err != nil {
+			return nil, fmt.Errorf("scan %s prefix: %w", index, err)
+		}
+		if p = prefixKey(p); p != "" {
+			counts[p] += count
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("iterate %s prefixes: %w", index, err)
+	}
+
+	prefixes := make([]book.Prefix, 0, len(counts))
+	for p, count := range counts {
+		prefixes = append(prefixes, book.Prefix{Prefix: p, Count: count})
+	}
+	slices.SortFunc(prefixes, func(a, b book.Prefix) int { return cmp.Compare(a.Prefix, b.Prefix) })
+	return prefixes, nil
+}
+
+// GetSeriesWithBookCountByLetter returns the page of series whose names
+// start with letters, with their number of books, ordered by opts, and the
+// number of such series. An empty library matches books from every library.
+func (r *Repo) GetSeriesWithBookCountByLetter(letters, library string, opts ListOptions) ([]book.SeriesWithBookCount, int, error) {
+	orderBy, err := seriesSorts.orderBy(opts, "s.series_id")
+	if err != nil {
+		return nil, 0, err
+	}
+	pattern := likePrefix(cases.Title(language.Und, cases.NoLower).String(letters))
+	args := []interface{}{pattern, library, library}
+	FROM := `
+		FROM series s
+		JOIN book_series bs ON s.series_id = bs.series_id
+		JOIN books b ON bs.book_id = b.book_id
+		WHERE s.name LIKE ? ESCAPE '\' AND b.deleted = 0
+		AND (? = '' OR b.library = ?)
+	`
+
+	var total int
+	if err := r.db.QueryRow(`SELECT COUNT(DISTINCT s.series_id) `+FROM, args...).Scan(&total); err != nil {
+		return nil, 0, fmt.Errorf("count series by letter: %w", err)
+	}
+
+	QUERY := `
+		SELECT s.series_id, s.name, COUNT(b.book_id) AS book_count
+		` + FROM + `
+		GROUP BY s.series_id, s.name
+		` + orderBy + `
+		LIMIT ? OFFSET ?
+	`
+
+	rows, err := r.db.Query(QUERY, append(args, opts.limitArgs()...)...)
+	if err != nil {
+		return nil, 0, fmt.Errorf("query series by letter: %w", err)
+	}
+	defer rows.Close()
+
+	series := make([]book.SeriesWithBookCount, 0)
+	for rows.Next() {
+		var s book.SeriesWithBookCount
+		if err := rows.Scan(&s.ID, &s.Name, &s.BookCount); err != nil {
+			return nil, 0, fmt.Errorf("scan series by letter: %w", err)
+		}
+		series = append(series, s)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, 0, fmt.Errorf("iterate series by letter: %w", err)
+	}
+
+	return series, total, nil
+}
+
+// likePrefix returns the LIKE pattern matching strings starting with
+// prefix, escaping its wildcards
+func likePrefix(prefix string) string {
+	return strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`).Replace(prefix) + "%"
+}
+
+// prefixKey folds the case of a name prefix the way names are written:
+// the first letter upper case and the rest lower case
+func prefixKey(p string) string {
+	first, size := utf8.DecodeRuneInString(p)
+	if first == utf8.RuneError {
+		return ""
+	}
+	return strings.ToUpper(string(first)) + strings.ToLower(p[size:])
+}
@@ -161,23 +161,43 @@ func (r *Repo) GetAuthorsWithBookCount() ([]book.AuthorWithBookCount, error) {
 	return authors, nil
 }
 
-func (r *Repo) GetAuthorsWithBookCountByLetter(letters string) ([]book.AuthorWithBookCount, error) {
+// GetAuthorsWithBookCountByLetter returns the page of authors whose last
+// name starts with letters, with their number of books, ordered by opts, and
+// the number of such authors. An empty library matches books from every
+// library.
+func (r *Repo) GetAuthorsWithBookCountByLetter(letters, library string, opts ListOptions) ([]book.AuthorWithBookCount, int, error) {
+	orderBy, err := authorSorts.orderBy(opts, "a.author_id")
+	if err != nil {
+		return nil, 0, err
+	}
 	pattern := cases.Title(language.Und, cases.NoLower).String(letters) + "%"
-	QUERY := `
-		SELECT a.author_id, a.first_name, a.middle_name, a.last_name,
-			   COUNT(b.book_id) as book_count
+	args := []interface{}{pattern, library, library}
+	FROM := `
 		FROM authors a
 		JOIN book_authors ba ON a.author_id = ba.author_id
 		JOIN books b ON ba.book_id = b.book_id
 		WHERE a.last_name LIKE ? COLLATE NOCASE
 		AND b.deleted = 0
+		AND (? = '' OR b.library = ?)
+	`
+
+	var total int
+	if err := r.db.QueryRow(`SELECT COUNT(DISTINCT a.author_id) `+FROM, args...).Scan(&total); err != nil {
+		return nil, 0, fmt.Errorf("count authors by letter: %w", err)
+	}
+
+	QUERY := `
+		SELECT a.author_id, a.first_name, a.middle_name, a.last_name,
+			   COUNT(b.book_id) as book_count
+		` + FROM + `
 		GROUP BY a.author_id, a.first_name, a.middle_name, a.last_name
-		ORDER BY a.last_name
+		` + orderBy + `
+		LIMIT ? OFFSET ?
 	`
 
-	rows, err := r.db.Query(QUERY, pattern)
+	rows, err := r.db.Query(QUERY, append(args, opts.limitArgs()...)...)
 	if err != nil {
-		return nil, fmt.Errorf("query authors with book count by letter: %w", err)
+		return nil, 0, fmt.Errorf("query authors with book count by letter: %w", err)
 	}
 	defer rows.Close()
 
@@ -185,15 +205,15 @@ func (r *Repo) GetAuthorsWithBookCountByLetter(letters string) ([]book.AuthorWit
 	for rows.Next() {
 		var a book.AuthorWithBookCount
 		if err := rows.Scan(&a.ID, &a.FirstName, &a.MiddleName, &a.LastName, &a.BookCount); err != nil {
-			return nil, fmt.Errorf("scan author with count by letter: %w", err)
+			return nil, 0, fmt.Errorf("scan author with count by letter: %w", err)
 		}
 		authors = append(authors, a)
 	}
 	if err := rows.Err(); err != nil {
-		return nil, fmt.Errorf("iterate authors with count by letter: %w", err)
+		return nil, 0, fmt.Errorf("iterate authors with count by letter: %w", err)
 	}
 
-	return authors, nil
+	return authors, total, nil
 }
 
 func (r *Repo) GetAuthorByID(id int64) (*book.Author, error) {
@@ -250,231 +270,51 @@ func (r *Repo) GetBooks() ([]string, error) {
 	return books, nil
 }
 
-func (r *Repo) GetBooksByLetter(letters string) ([]book.Book, error) {
+// GetBooksByLetter returns the page of books whose title starts with
+// letters, ordered by opts, with the number of such books. An empty library
+// matches books from every library.
+func (r *Repo) GetBooksByLetter(letters, library string, opts ListOptions) ([]book.Book, int, error) {
 	pattern := cases.Title(language.Und, cases.NoLower).String(letters) + "%"
-	QUERY := `
-		SELECT b.book_id, b.title, b.lang, b.archive, b.filename,
-			   b.file_size, b.date_added, b.lib_id, b.deleted, b.lib_rate,
-			   a.first_name, a.middle_name, a.last_name,
-			   s.series_id, s.name, bs.series_no
-		FROM books b
-		LEFT JOIN book_authors ba ON b.book_id = ba.book_id
-		LEFT JOIN authors a ON ba.author_id = a.author_id
-		LEFT JOIN book_series bs ON b.book_id = bs.book_id
-		LEFT JOIN series s ON bs.series_id = s.series_id
-		WHERE b.title LIKE ? COLLATE NOCASE AND b.deleted = 0
-		ORDER BY b.title
-	`
+	where := `b.title LIKE ? COLLATE NOCASE AND b.deleted = 0 AND (? = '' OR b.library = ?)`
 
-	rows, err := r.db.Query(QUERY, pattern)
+	books, total, err := r.queryBookPage(where, []interface{}{pattern, library, library}, opts)
 	if err != nil {
-		return nil, fmt.Errorf("query books by letter: %w", err)
+		return nil, 0, fmt.Errorf("get books by letter: %w", err)
 	}
-	defer rows.Close()
-
-	booksMap := make(map[int64]*book.Book)
-	for rows.Next() {
-		var b book.Book
-		var author book.Author
-		var firstName, middleName, lastName sql.NullString
-		var deleted bool
-		var libRate sql.NullInt64
-		var seriesID sql.NullInt64
-		var seriesName sql.NullString
-		var seriesNo sql.NullInt64
-
-		if err := rows.Scan(
-			&b.BookID, &b.Title, &b.Lang, &b.Archive, &b.FileName,
-			&b.FileSize, &b.DateAdded, &b.LibID, &deleted, &libRate,
-			&firstName, &middleName, &lastName,
-			&seriesID, &seriesName, &seriesNo,
-		); err != nil {
-			return nil, fmt.Errorf("scan book by letter: %w", err)
-		}
-
-		b.Deleted = deleted
-		if libRate.Valid {
-			b.LibRate = int(libRate.Int64)
-		}
-
-		// Helper to construct series info
-		var seriesInfo *book.SeriesInfo
-		if seriesName.Valid {
-			seriesInfo = &book.SeriesInfo{
-				ID:       seriesID.Int64,
-				Name:     seriesName.String,
-				SeriesNo: int(seriesNo.Int64),
-			}
-		}
-
-		if existingBook, ok := booksMap[b.BookID]; ok {
-			// Check if author is new
-			isNewAuthor := true
-			for _, a := range existingBook.Author {
-				if a.FirstName == firstName.String && a.LastName == lastName.String {
-					isNewAuthor = false
-					break
-				}
-			}
-
-			if isNewAuthor && (firstName.Valid || middleName.Valid || lastName.Valid) {
-				author.FirstName = firstName.String
-				author.MiddleName = middleName.String
-				author.LastName = lastName.String
-				existingBook.Author = append(existingBook.Author, author)
-			}
-
-			// If series is missing, add it
-			if existingBook.Series == nil && seriesInfo != nil {
-				existingBook.Series = seriesInfo
-			}
-		} else {
-			if firstName.Valid || middleName.Valid || lastName.Valid {
-				author.FirstName = firstName.String
-				author.MiddleName = middleName.String
-				author.LastName = lastName.String
-				b.Author = []book.Author{author}
-			}
-			if seriesInfo != nil {
-				b.Series = seriesInfo
-			}
-			booksMap[b.BookID] = &b
-		}
-	}
-	if err := rows.Err(); err != nil {
-		return nil, fmt.Errorf("iterate books by letter: %w", err)
-	}
-
-	// Re-sort in Go to be fast and correct (since map randomization)
-	books := make([]book.Book, 0, len(booksMap))
-	for _, book := range booksMap {
-		books = append(books, *book)
-	}
-
-	sortBooks(books)
-
-	return books, nil
+	return books, total, nil
 }
 
-func (r *Repo) GetBooksByAuthorID(id int64) ([]book.Book, error) {
-	QUERY := `
-		SELECT b.book_id, b.title, b.lang, b.archive, b.filename,
-			   b.file_size, b.date_added, b.lib_id, b.deleted, b.lib_rate,
-			   a.first_name, a.middle_name, a.last_name,
-			   s.series_id, s.name, bs.series_no
-		FROM books b
-		JOIN book_authors ba ON b.book_id = ba.book_id
-		LEFT JOIN authors a ON ba.author_id = a.author_id
-		LEFT JOIN book_series bs ON b.book_id = bs.book_id
-		LEFT JOIN series s ON bs.series_id = s.series_id
-		WHERE ba.author_id = ? AND b.deleted = 0
-		ORDER BY b.title
-	`
+// GetBooksByAuthorID returns the page of the author's books in any of
+// languages, ordered by opts, with the number of such books. An empty
+// library matches books from every library, no languages books in every
+// language.
+func (r *Repo) GetBooksByAuthorID(id int64, library string, languages []string, opts ListOptions) ([]book.Book, int, error) {
+	langCondition, langArgs := languageFilter(languages)
+	where := `b.book_id IN (SELECT book_id FROM book_authors WHERE author_id = ?) AND b.deleted = 0
+		AND (? = '' OR b.library = ?) ` + langCondition
 
-	rows, err := r.db.Query(QUERY, id)
+	books, total, err := r.queryBookPage(where, append([]interface{}{id, library, library}, langArgs...), opts)
 	if err != nil {
-		return nil, fmt.Errorf("query books by author id: %w", err)
+		return nil, 0, fmt.Errorf("get books by author id: %w", err)
 	}
-	defer rows.Close()
-
-	booksMap := make(map[int64]*book.Book)
-	for rows.Next() {
-		var b book.Book
-		var author book.Author
-		var firstName, middleName, lastName sql.NullString
-		var deleted bool
-		var libRate sql.NullInt64
-		var seriesID sql.NullInt64
-		var seriesName sql.NullString
-		var seriesNo sql.NullInt64
-
-		if err := rows.Scan(
-			&b.BookID, &b.Title, &b.Lang, &b.Archive, &b.FileName,
-			&b.FileSize, &b.DateAdded, &b.LibID, &deleted, &libRate,
-			&firstName, &middleName, &lastName,
-			&seriesID, &seriesName, &seriesNo,
-		); err != nil {
-			return nil, fmt.Errorf("scan book by author id: %w", err)
-		}
-
-		b.Deleted = deleted
-		if libRate.Valid {
-			b.LibRate = int(libRate.Int64)
-		}
-
-		// Helper to construct series info
-		var seriesInfo *book.SeriesInfo
-		if seriesName.Valid {
-			seriesInfo = &book.SeriesInfo{
-				ID:       seriesID.Int64,
-				Name:     seriesName.String,
-				SeriesNo: int(seriesNo.Int64),
-			}
-		}
-
-		if existingBook, ok := booksMap[b.BookID]; ok {
-			// Check if author is new (avoid duplicates if multiple series rows caused duplication)
-			isNewAuthor := true
-			for _, a := range existingBook.Author {
-				if a.FirstName == firstName.String && a.LastName == lastName.String {
-					isNewAuthor = false
-					break
-				}
-			}
-
-			if isNewAuthor && (firstName.Valid || middleName.Valid || lastName.Valid) {
-				author.FirstName = firstName.String
-				author.MiddleName = middleName.String
-				author.LastName = lastName.String
-				existingBook.Author = append(existingBook.Author, author)
-			}
-
-			// If series is missing, add it
-			if existingBook.Series == nil && seriesInfo != nil {
-				existingBook.Series = seriesInfo
-			}
-
-		} else {
-			if firstName.Valid || middleName.Valid || lastName.Valid {
-				author.FirstName = firstName.String
-				author.MiddleName = middleName.String
-				author.LastName = lastName.String
-				b.Author = []book.Author{author}
-			}
-			if seriesInfo != nil {
-				b.Series = seriesInfo
-			}
-			booksMap[b.BookID] = &b
-		}
-	}
-
-	if err := rows.Err(); err != nil {
-		return nil, fmt.Errorf("iterate books by author id: %w", err)
-	}
-
-	// Re-sort using universal logic
-	books := make([]book.Book, 0, len(booksMap))
-	for _, book := range booksMap {
-		books = append(books, *book)
-	}
-
-	sortBooks(books)
-
-	return books, nil
+	return books, total, nil
 }
 
-func (r *Repo) GetGenres() ([]book.Genre, error) {
+func (r *Repo) GetGenres(library string) ([]book.Genre, error) {
 	QUERY := `
-		SELECT g.genre_id, g.name, g.display_name
+		SELECT g.genre_id, g.name, g.display_name, g.translit_name,
+			COALESCE(c.name, ''), COUNT(DISTINCT b.book_id)
 		FROM genres g
 		JOIN book_genres bg ON g.genre_id = bg.genre_id
 		JOIN books b ON bg.book_id = b.book_id
+		LEFT JOIN genre_categories c ON c.category_id = g.category_id
 		WHERE b.deleted = 0
+		AND (? = '' OR b.library = ?)
 		GROUP BY g.genre_id
 		ORDER BY g.display_name
 	`
 
-	rows, err := r.db.Query(QUERY)
+	rows, err := r.db.Query(QUERY, library, library)
 	if err != nil {
 		return nil, fmt.Errorf("query genres: %w", err)
 	}
@@ -483,10 +323,11 @@ func (r *Repo) GetGenres() ([]book.Genre, error) {
 	genres := make([]book.Genre, 0)
 	for rows.Next() {
 		var g book.Genre
-		var displayName sql.NullString
-		if err := rows.Scan(&g.ID, &g.Name, &displayName); err != nil {
+		var displayName, translitName sql.NullString
+		if err := rows.Scan(&g.ID, &g.Name, &displayName, &translitName, &g.Category, &g.BookCount); err != nil {
 			return nil, fmt.Errorf("scan genre: %w", err)
 		}
+		g.TranslitName = translitName.String
 		if displayName.Valid {
 			g.DisplayName = displayName.String
 		} else {
@@ -503,18 +344,19 @@ func (r *Repo) GetGenres() ([]book.Genre, error) {
 
 func (r *Repo) GetBookByID(id int64) (*book.Book, error) {
 	QUERY := `
-		SELECT book_id, title, lang, archive, filename,
+		SELECT book_id, title, lang, archive, library, filename, format,
 			   file_size, date_added, lib_id, deleted, lib_rate
 		FROM books
 		WHERE book_id = ? AND deleted = 0
 	`
 
 	var b book.Book
+	var library sql.NullString
 	var deleted bool
 	var libRate sql.NullInt64
 
 	err := r.db.QueryRow(QUERY, id).Scan(
-		&b.BookID, &b.Title, &b.Lang, &b.Archive, &b.FileName,
+		&b.BookID, &b.Title, &b.Lang, &b.Archive, &library, &b.FileName, &b.Format,
 		&b.FileSize, &b.DateAdded, &b.LibID, &deleted, &libRate,
 	)
 	if err != nil {
@@ -524,6 +366,7 @@ func (r *Repo) GetBookByID(id int64) (*book.Book, error) {
 		return nil, fmt.Errorf("get book by ID %d: %w", id, err)
 	}
 
+	b.Library = library.String
 	b.Deleted = deleted
 	if libRate.Valid {
 		b.LibRate = int(libRate.Int64)
@@ -537,19 +380,24 @@ func (r *Repo) GetBookByID(id int64) (*book.Book, error) {
 	return &b, nil
 }
 
-// GetRecentBooks returns recently added books with pagination
-func (r *Repo) GetRecentBooks(limit, offset int) ([]book.Book, int, error) {
+// GetRecentBooks returns recently added books with pagination.
+// An empty library matches books from every library, no languages books
+// in every language.
+func (r *Repo) GetRecentBooks(limit, offset int, library string, languages []string) ([]book.Book, int, error) {
+	langCondition, langArgs := languageFilter(languages)
+	filterArgs := append([]interface{}{library, library}, langArgs...)
+
 	// Get total count
-	countQuery := `SELECT COUNT(*) FROM books WHERE deleted = 0`
+	countQuery := `SELECT COUNT(*) FROM books b WHERE b.deleted = 0 AND (? = '' OR b.library = ?) ` + langCondition
 	var total int
-	if err := r.db.QueryRow(countQuery).Scan(&total); err != nil {
+	if err := r.db.QueryRow(countQuery, filterArgs...).Scan(&total); err != nil {
 		return nil, 0, fmt.Errorf("count recent books: %w", err)
 	}
 
 	QUERY := `
-		SELECT b.book_id, b.title, b.lang, b.archive, b.filename,
+		SELECT b.book_id, b.title, b.lang, b.archive, IFNULL(b.library, ''), b.filename, b.format,
 			   b.file_size, b.date_added, b.lib_id, b.deleted, b.lib_rate,
-			   a.first_name, a.middle_name, a.last_name,
+			   a.author_id, a.first_name, a.middle_name, a.last_name,
 			   s.series_id, s.name, bs.series_no
 		FROM books b
 		LEFT JOIN book_authors ba ON b.book_id = ba.book_id
@@ -557,11 +405,13 @@ func (r *Repo) GetRecentBooks(limit, offset int) ([]book.Book, int, error) {
 		LEFT JOIN book_series bs ON b.book_id = bs.book_id
 		LEFT JOIN series s ON bs.series_id = s.series_id
 		WHERE b.deleted = 0
+		AND (? = '' OR b.library = ?)
+		` + langCondition + `
 		ORDER BY b.date_added DESC, b.book_id DESC
 		LIMIT ? OFFSET ?
 	`
 
-	rows, err := r.db.Query(QUERY, limit, offset)
+	rows, err := r.db.Query(QUERY, append(filterArgs, limit, offset)...)
 	if err != nil {
 		return nil, 0, fmt.Errorf("query recent books: %w", err)
 	}
@@ -573,6 +423,7 @@ func (r *Repo) GetRecentBooks(limit, offset int) ([]book.Book, int, error) {
 	for rows.Next() {
 		var b book.Book
 		var author book.Author
+		var authorID sql.NullInt64
 		var firstName, middleName, lastName sql.NullString
 		var deleted bool
 		var libRate sql.NullInt64
@@ -581,9 +432,9 @@ func (r *Repo) GetRecentBooks(limit, offset int) ([]book.Book, int, error) {
 		var seriesNo sql.NullInt64
 
 		if err := rows.Scan(
-			&b.BookID, &b.Title, &b.Lang, &b.Archive, &b.FileName,
+			&b.BookID, &b.Title, &b.Lang, &b.Archive, &b.Library, &b.FileName, &b.Format,
 			&b.FileSize, &b.DateAdded, &b.LibID, &deleted, &libRate,
-			&firstName, &middleName, &lastName,
+			&authorID, &firstName, &middleName, &lastName,
 			&seriesID, &seriesName, &seriesNo,
 		); err != nil {
 			return nil, 0, fmt.Errorf("scan recent book: %w", err)
@@ -612,6 +463,7 @@ func (r *Repo) GetRecentBooks(limit, offset int) ([]book.Book, int, error) {
 				}
 			}
 			if isNewAuthor && (firstName.Valid || middleName.Valid || lastName.Valid) {
+				author.ID = authorID.Int64
 				author.FirstName = firstName.String
 				author.MiddleName = middleName.String
 				author.LastName = lastName.String
@@ -622,6 +474,7 @@ func (r *Repo) GetRecentBooks(limit, offset int) ([]book.Book, int, error) {
 			}
 		} else {
 			if firstName.Valid || middleName.Valid || lastName.Valid {
+				author.ID = authorID.Int64
 				author.FirstName = firstName.String
 				author.MiddleName = middleName.String
 				author.LastName = lastName.String
@@ -647,8 +500,13 @@ func (r *Repo) GetRecentBooks(limit, offset int) ([]book.Book, int, error) {
 	return books, total, nil
 }
 
-// GetBooksByGenre returns books by genre with pagination
-func (r *Repo) GetBooksByGenre(genre string, limit, offset int) ([]book.Book, int, error) {
+// GetBooksByGenre returns books by genre with pagination.
+// An empty library matches books from every library, no languages books
+// in every language.
+func (r *Repo) GetBooksByGenre(genre string, limit, offset int, library string, languages []string) ([]book.Book, int, error) {
+	langCondition, langArgs := languageFilter(languages)
+	filterArgs := append([]interface{}{genre, genre, library, library}, langArgs...)
+
 	// Get total count for this genre
 	countQuery := `
 		SELECT COUNT(DISTINCT b.book_id)
@@ -656,16 +514,18 @@ func (r *Repo) GetBooksByGenre(genre string, limit, offset int) ([]book.Book, in
 		JOIN book_genres bg ON b.book_id = bg.book_id
 		JOIN genres g ON bg.genre_id = g.genre_id
 		WHERE (g.display_name = ? OR g.name = ?) AND b.deleted = 0
+		AND (? = '' OR b.library = ?)
+		` + langCondition + `
 	`
 	var total int
-	if err := r.db.QueryRow(countQuery, genre, genre).Scan(&total); err != nil {
+	if err := r.db.QueryRow(countQuery, filterArgs...).Scan(&total); err != nil {
 		return nil, 0, fmt.Errorf("count books by genre: %w", err)
 	}
 
 	QUERY := `
-		SELECT b.book_id, b.title, b.lang, b.archive, b.filename,
+		SELECT b.book_id, b.title, b.lang, b.archive, IFNULL(b.library, ''), b.filename, b.format,
 			   b.file_size, b.date_added, b.lib_id, b.deleted, b.lib_rate,
-			   a.first_name, a.middle_name, a.last_name,
+			   a.author_id, a.first_name, a.middle_name, a.last_name,
 			   s.series_id, s.name, bs.series_no
 		FROM books b
 		JOIN book_genres bg ON b.book_id = bg.book_id
@@ -675,11 +535,13 @@ func (r *Repo) GetBooksByGenre(genre string, limit, offset int) ([]book.Book, in
 		LEFT JOIN book_series bs ON b.book_id = bs.book_id
 		LEFT JOIN series s ON bs.series_id = s.series_id
 		WHERE (g.display_name = ? OR g.name = ?) AND b.deleted = 0
+		AND (? = '' OR b.library = ?)
+		` + langCondition + `
 		ORDER BY b.title
 		LIMIT ? OFFSET ?
 	`
 
-	rows, err := r.db.Query(QUERY, genre, genre, limit, offset)
+	rows, err := r.db.Query(QUERY, append(filterArgs, limit, offset)...)
 	if err != nil {
 		return nil, 0, fmt.Errorf("query books by genre: %w", err)
 	}
@@ -691,6 +553,7 @@ func (r *Repo) GetBooksByGenre(genre string, limit, offset int) ([]book.Book, in
 	for rows.Next() {
 		var b book.Book
 		var author book.Author
+		var authorID sql.NullInt64
 		var firstName, middleName, lastName sql.NullString
 		var deleted bool
 		var libRate sql.NullInt64
@@ -699,9 +562,9 @@ func (r *Repo) GetBooksByGenre(genre string, limit, offset int) ([]book.Book, in
 		var seriesNo sql.NullInt64
 
 		if err := rows.Scan(
-			&b.BookID, &b.Title, &b.Lang, &b.Archive, &b.FileName,
+			&b.BookID, &b.Title, &b.Lang, &b.Archive, &b.Library, &b.FileName, &b.Format,
 			&b.FileSize, &b.DateAdded, &b.LibID, &deleted, &libRate,
-			&firstName, &middleName, &lastName,
+			&authorID, &firstName, &middleName, &lastName,
 			&seriesID, &seriesName, &seriesNo,
 		); err != nil {
 			return nil, 0, fmt.Errorf("scan book by genre: %w", err)
@@ -730,6 +593,7 @@ func (r *Repo) GetBooksByGenre(genre string, limit, offset int) ([]book.Book, in
 				}
 			}
 			if isNewAuthor && (firstName.Valid || middleName.Valid || lastName.Valid) {
+				author.ID = authorID.Int64
 				author.FirstName = firstName.String
 				author.MiddleName = middleName.String
 				author.LastName = lastName.String
@@ -740,6 +604,7 @@ func (r *Repo) GetBooksByGenre(genre string, limit, offset int) ([]book.Book, in
 			}
 		} else {
 			if firstName.Valid || middleName.Valid || lastName.Valid {
+				author.ID = authorID.Int64
 				author.FirstName = firstName.String
 				author.MiddleName = middleName.String
 				author.LastName = lastName.String
@@ -767,9 +632,8 @@ func (r *Repo) GetBooksByGenre(genre string, limit, offset int) ([]book.Book, in
 	return books, total, nil
 }
 
-// NEW: Fetch all related details for a book
-func (r *Repo) fetchBookDetails(b *book.Book) error {
-	// Fetch authors
+// fetchAuthors loads the book's authors
+func (r *Repo) fetchAuthors(b *book.Book) error {
 	authorsQuery := `
 		SELECT a.author_id, a.first_name, a.middle_name, a.last_name
 		FROM authors a
@@ -793,6 +657,14 @@ func (r *Repo) fetchBookDetails(b *book.Book) error {
 		authors = append(authors, a)
 	}
 	b.Author = authors
+	return rows.Err()
+}
+
+// NEW: Fetch all related details for a book
+func (r *Repo) fetchBookDetails(b *book.Book) error {
+	if err := r.fetchAuthors(b); err != nil {
+		return err
+	}
 
 	seriesQuery := `
 		SELECT s.series_id, s.name, bs.series_no
@@ -805,7 +677,7 @@ func (r *Repo) fetchBookDetails(b *book.Book) error {
 	var seriesName sql.NullString
 	var seriesNo sql.NullInt64
 
-	err = r.db.QueryRow(seriesQuery, b.BookID).Scan(&seriesID, &seriesName, &seriesNo)
+	err := r.db.QueryRow(seriesQuery, b.BookID).Scan(&seriesID, &seriesName, &seriesNo)
 	if err != nil && err != sql.ErrNoRows {
 		return fmt.Errorf("query series for book %d: %w", b.BookID, err)
 	}
@@ -826,7 +698,7 @@ func (r *Repo) fetchBookDetails(b *book.Book) error {
 		ORDER BY k.name
 	`
 
-	rows, err = r.db.Query(keywordsQuery, b.BookID)
+	rows, err := r.db.Query(keywordsQuery, b.BookID)
 	if err != nil {
 		return fmt.Errorf("query keywords for book %d: %w", b.BookID, err)
 	}
@@ -841,8 +713,35 @@ func (r *Repo) fetchBookDetails(b *book.Book) error {
 		keywords = append(keywords, name)
 	}
 	b.Keywords = keywords
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("iterate keywords for book %d: %w", b.BookID, err)
+	}
 
-	return nil
+	genresQuery := `
+		SELECT g.name
+		FROM genres g
+		JOIN book_genres bg ON g.genre_id = bg.genre_id
+		WHERE bg.book_id = ?
+		ORDER BY g.name
+	`
+
+	genreRows, err := r.db.Query(genresQuery, b.BookID)
+	if err != nil {
+		return fmt.Errorf("query genres for book %d: %w", b.BookID, err)
+	}
+	defer genreRows.Close()
+
+	var genres []string
+	for genreRows.Next() {
+		var name string
+		if err := genreRows.Scan(&name); err != nil {
+			return err
+		}
+		genres = append(genres, name)
+	}
+	b.Genres = genres
+
+	return genreRows.Err()
 }
 
 // GetSeries Get all series
@@ -874,15 +773,39 @@ func (r *Repo) GetSeries() ([]book.SeriesInfo, error) {
 	return series, nil
 }
 
-// GetBooksBySeriesID books by series
+// GetSeriesByID returns a series that has at least one book that is not deleted
+func (r *Repo) GetSeriesByID(id int64) (*book.SeriesInfo, error) {
+	QUERY := `
+		SELECT s.series_id, s.name
+		FROM series s
+		WHERE s.series_id = ? AND EXISTS (
+			SELECT 1 FROM book_series bs JOIN books b ON bs.book_id = b.book_id
+			WHERE bs.series_id = s.series_id AND b.deleted = 0
+		)
+	`
+
+	var s book.SeriesInfo
+	if err := r.db.QueryRow(QUERY, id).Scan(&s.ID, &s.Name); err != nil {
+		if err == sql.ErrNoRows {
+			return nil, ErrNotFound
+		}
+		return nil, fmt.Errorf("get series by ID %d: %w", id, err)
+	}
+	return &s, nil
+}
+
+// GetBooksBySeriesID returns the series' books in series order, with their
+// authors and series number
 func (r *Repo) GetBooksBySeriesID(seriesID int64) ([]book.Book, error) {
 	QUERY := `
-		SELECT b.book_id, b.title, b.lang, b.archive, b.filename,
-			   b.file_size, b.date_added, b.lib_id, b.deleted, b.lib_rate
+		SELECT b.book_id, b.title, b.lang, b.archive, IFNULL(b.library, ''), b.filename, b.format,
+			   b.file_size, b.date_added, b.lib_id, b.deleted, b.lib_rate,
+			   s.series_id, s.name, bs.series_no
 		FROM books b
 		JOIN book_series bs ON b.book_id = bs.book_id
+		JOIN series s ON bs.series_id = s.series_id
 		WHERE bs.series_id = ? AND b.deleted = 0
-		ORDER BY bs.series_no, b.title
+		ORDER BY bs.series_no, b.title COLLATE NOCASE
 	`
 
 	rows, err := r.db.Query(QUERY, seriesID)
@@ -896,10 +819,13 @@ func (r *Repo) GetBooksBySeriesID(seriesID int64) ([]book.Book, error) {
 		var b book.Book
 		var deleted bool
 		var libRate sql.NullInt64
+		var series book.SeriesInfo
+		var seriesNo sql.NullInt64
 
 		if err := rows.Scan(
-			&b.BookID, &b.Title, &b.Lang, &b.Archive, &b.FileName,
+			&b.BookID, &b.Title, &b.Lang, &b.Archive, &b.Library, &b.FileName, &b.Format,
 			&b.FileSize, &b.DateAdded, &b.LibID, &deleted, &libRate,
+			&series.ID, &series.Name, &seriesNo,
 		); err != nil {
 			return nil, fmt.Errorf("scan book: %w", err)
 		}
@@ -908,11 +834,20 @@ func (r *Repo) GetBooksBySeriesID(seriesID int64) ([]book.Book, error) {
 		if libRate.Valid {
 			b.LibRate = int(libRate.Int64)
 		}
+		series.SeriesNo = int(seriesNo.Int64)
+		b.Series = &series
 
 		books = append(books, b)
 	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("iterate books by series: %w", err)
+	}
 
-	sortBooks(books)
+	for i := range books {
+		if err := r.fetchAuthors(&books[i]); err != nil {
+			return nil, err
+		}
+	}
 
 	return books, nil
 }
@@ -3,6 +3,9 @@ package repo
 import (
 	"context"
 	"encoding/xml"
+	"errors"
+	"fmt"
+	"slices"
 	"testing"
 	"time"
 
@@ -58,7 +61,7 @@ func TestGetBooksByAuthorID_IncludesSeries(t *testing.T) {
 	authorID := authors[0].ID
 
 	// Fetch books by author
-	books, err := db.GetBooksByAuthorID(authorID)
+	books, _, err := db.GetBooksByAuthorID(authorID, "", nil, ListOptions{})
 	if err != nil {
 		t.Fatalf("GetBooksByAuthorID failed: %v", err)
 	}
@@ -80,6 +83,114 @@ func TestGetBooksByAuthorID_IncludesSeries(t *testing.T) {
 	}
 }
 
+func TestGetBooksBySeriesID(t *testing.T) {
+	db := GetStorage(":memory:")
+	defer db.Close()
+
+	author := book.Author{FirstName: "Isaac", LastName: "Asimov"}
+	for i, b := range []*book.Book{
+		{Title: "Second Foundation", FileName: "3.fb2", Series: &book.SeriesInfo{Name: "Foundation", SeriesNo: 3}},
+		{Title: "Foundation", FileName: "1.fb2", Series: &book.SeriesInfo{Name: "Foundation", SeriesNo: 1}},
+		{Title: "Foundation and Empire", FileName: "2.fb2", Series: &book.SeriesInfo{Name: "Foundation", SeriesNo: 2}, Deleted: true},
+		{Title: "Pebble in the Sky", FileName: "4.fb2", Series: &book.SeriesInfo{Name: "Galactic Empire", SeriesNo: 3}, Deleted: true},
+	} {
+		b.Author = []book.Author{author}
+		b.Archive = "books.zip"
+		b.Library = "main"
+		b.LibID = int64(i + 1)
+		if err := db.Add(b); err != nil {
+			t.Fatalf("Failed to add book: %v", err)
+		}
+	}
+
+	books, _, err := db.GetBooksByAuthorID(1, "", nil, ListOptions{})
+	if err != nil || len(books) != 2 {
+		t.Fatalf("GetBooksByAuthorID: expected 2 books, got %d (%v)", len(books), err)
+	}
+	seriesID := books[0].Series.ID
+
+	series, err := db.GetSeriesByID(seriesID)
+	if err != nil || series.Name != "Foundation" {
+		t.Fatalf("GetSeriesByID: expected Foundation, got %+v (%v)", series, err)
+	}
+	if _, err := db.GetSeriesByID(seriesID + 1); err != ErrNotFound {
+		t.Errorf("GetSeriesByID: expected ErrNotFound for a series of deleted books, got %v", err)
+	}
+
+	books, err = db.GetBooksBySeriesID(seriesID)
+	if err != nil {
+		t.Fatalf("GetBooksBySeriesID failed: %v", err)
+	}
+	var titles []string
+	for _, b := range books {
+		titles = append(titles, b.Title)
+		if b.Library != "main" || len(b.Author) != 1 || b.Author[0].LastName != "Asimov" || b.Series == nil {
+			t.Errorf("book %q is missing details: %+v", b.Title, b)
+		}
+	}
+	if len(titles) != 2 || titles[0] != "Foundation" || titles[1] != "Second Foundation" {
+		t.Errorf("expected the books in series order without deleted ones, got %v", titles)
+	}
+}
+
+func TestLanguageFilter(t *testing.T) {
+	db := GetStorage(":memory:")
+	defer db.Close()
+
+	for i, b := range []*book.Book{
+		{Title: "Piknik", Lang: "ru"},
+		{Title: "Roadside Picnic", Lang: "EN"},
+		{Title: "Zhuk"},
+		{Title: "Pikník", Lang: "uk"},
+	} {
+		b.Author = []book.Author{{FirstName: "Arkady", LastName: "Strugatsky"}}
+		b.Genres = []string{"sf"}
+		b.Archive = "books.zip"
+		b.FileName = fmt.Sprintf("%d.fb2", i)
+		b.DateAdded = fmt.Sprintf("2024-01-0%d", i+1)
+		if err := db.Add(b); err != nil {
+			t.Fatalf("Failed to add book: %v", err)
+		}
+	}
+
+	tests := []struct {
+		name      string
+		languages []string
+		expect    []string
+	}{
+		{"every language", nil, []string{"Pikník", "Zhuk", "Roadside Picnic", "Piknik"}},
+		{"russian includes books without a language", []string{"ru"}, []string{"Zhuk", "Piknik"}},
+		{"case insensitive", []string{"en"}, []string{"Roadside Picnic"}},
+		{"several languages", []string{"uk", "EN"}, []string{"Pikník", "Roadside Picnic"}},
+		{"no books", []string{"be"}, nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			titles := func(books []book.Book) []string {
+				var titles []string
+				for _, b := range books {
+					titles = append(titles, b.Title)
+				}
+				return titles
+			}
+
+			books, total, err := db.GetRecentBooks(10, 0, "", tt.languages)
+			if err != nil || total != len(tt.expect) || !slices.Equal(titles(books), tt.expect) {
+				t.Errorf("GetRecentBooks: expected %v, got %v of %d (%v)", tt.expect, titles(books), total, err)
+			}
+			books, total, err = db.GetBooksByGenre("sf", 10, 0, "", tt.languages)
+			if err != nil || total != len(tt.expect) || len(books) != len(tt.expect) {
+				t.Errorf("GetBooksByGenre: expected %d books, got %d of %d (%v)", len(tt.expect), len(books), total, err)
+			}
+			books, _, err = db.GetBooksByAuthorID(1, "", tt.languages, ListOptions{})
+			if err != nil || len(books) != len(tt.expect) {
+				t.Errorf("GetBooksByAuthorID: expected %d books, got %d (%v)", len(tt.expect), len(books), err)
+			}
+		})
+	}
+}
+
 func TestGetAuthorsByLetter_FiltersDeletedBooks(t *testing.T) {
 	dbPath := "./test_author_visibility.db"
 	cleanupTestDB(dbPath)
@@ -150,7 +261,7 @@ func TestGetAuthorsByLetter_FiltersDeletedBooks(t *testing.T) {
 
 	// 4. Test GetAuthorsWithBookCountByLetter
 	// Search for 'G' (Ghost) - should be empty
-	authorsWithCount, err := db.GetAuthorsWithBookCountByLetter("G")
+	authorsWithCount, _, err := db.GetAuthorsWithBookCountByLetter("G", "", ListOptions{})
 	if err != nil {
 		t.Fatalf("GetAuthorsWithBookCountByLetter failed: %v", err)
 	}
@@ -159,7 +270,7 @@ func TestGetAuthorsByLetter_FiltersDeletedBooks(t *testing.T) {
 	}
 
 	// Search for 'W' (Writer) - should have count 1
-	authorsWithCount, err = db.GetAuthorsWithBookCountByLetter("W")
+	authorsWithCount, _, err = db.GetAuthorsWithBookCountByLetter("W", "", ListOptions{})
 	if err != nil {
 		t.Fatalf("GetAuthorsWithBookCountByLetter failed: %v", err)
 	}
@@ -207,7 +318,7 @@ func TestGetBooksByLetter_IncludesSeries(t *testing.T) {
 	}
 
 	// Fetch books by letter 'A'
-	books, err := db.GetBooksByLetter("A")
+	books, _, err := db.GetBooksByLetter("A", "", ListOptions{})
 	if err != nil {
 		t.Fatalf("GetBooksByLetter failed: %v", err)
 	}
@@ -459,3 +570,118 @@ func TestRepo_AddBookWithManyGenres(t *testing.T) {
 		t.Errorf("Expected %d genre links, got %d", expectedCount, genreCount)
 	}
 }
+
+func TestGetPrefixes(t *testing.T) {
+	db := GetStorage(":memory:")
+	defer db.Close()
+
+	for _, b := range []*book.Book{
+		{Title: "Пикник на обочине", Author: []book.Author{{FirstName: "Аркадий", LastName: "Стругацкий"}}, Series: &book.SeriesInfo{Name: "Мир Полудня"}},
+		{Title: "пикник", Author: []book.Author{{FirstName: "Борис", LastName: "Стругацкий"}}},
+		{Title: "Стажёры", Author: []book.Author{{LastName: "Стругацкий"}, {LastName: "Ст"}}},
+		{Title: "Solaris", Author: []book.Author{{LastName: "Lem"}}, Library: "other"},
+		{Title: "100% wool", Author: []book.Author{{LastName: "Lemon"}}},
+		{Title: "100 years", Author: []book.Author{{LastName: "LEE"}}, Deleted: true},
+	} {
+		b.Archive = "books.zip"
+		b.FileName = b.Title + ".fb2"
+		if err := db.Add(b); err != nil {
+			t.Fatalf("add book: %v", err)
+		}
+	}
+
+	tests := []struct {
+		name    string
+		index   PrefixIndex
+		prefix  string
+		library string
+		expect  []book.Prefix
+	}{
+		{"authors", PrefixAuthors, "", "", []book.Prefix{{Prefix: "L", Count: 2}, {Prefix: "С", Count: 4}}},
+		{"authors by prefix", PrefixAuthors, "ст", "", []book.Prefix{{Prefix: "Ст", Count: 1}, {Prefix: "Стр", Count: 3}}},
+		{"authors of a library", PrefixAuthors, "L", "other", []book.Prefix{{Prefix: "Le", Count: 1}}},
+		{"titles folded by case", PrefixTitles, "", "", []book.Prefix{{Prefix: "1", Count: 1}, {Prefix: "S", Count: 1}, {Prefix: "П", Count: 2}, {Prefix: "С", Count: 1}}},
+		{"titles with wildcards", PrefixTitles, "100%", "", []book.Prefix{{Prefix: "100% ", Count: 1}}},
+		{"series", PrefixSeries, "", "", []book.Prefix{{Prefix: "М", Count: 1}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := db.GetPrefixes(tt.index, tt.prefix, tt.library)
+			if err != nil {
+				t.Fatalf("get prefixes: %v", err)
+			}
+			if !slices.Equal(got, tt.expect) {
+				t.Errorf("expected %v, got %v", tt.expect, got)
+			}
+		})
+	}
+
+	if _, err := db.GetPrefixes("genres", "", ""); err == nil {
+		t.Error("expected an error for an unknown index")
+	}
+
+	series, _, err := db.GetSeriesWithBookCountByLetter("м", "", ListOptions{})
+	if err != nil || len(series) != 1 || series[0].Name != "Мир Полудня" || series[0].BookCount != 1 {
+		t.Errorf("expected the series by letter, got %v (%v)", series, err)
+	}
+}
+
+func TestListOptions(t *testing.T) {
+	db := GetStorage(":memory:")
+	defer db.Close()
+
+	for _, b := range []*book.Book{
+		{Title: "Beetle in the Anthill", Author: []book.Author{{FirstName: "Arkady", LastName: "Strugatsky"}, {FirstName: "Boris", LastName: "Strugatsky"}},
+			Series: &book.SeriesInfo{Name: "Noon Universe", SeriesNo: 2}, DateAdded: "2024-03-01"},
+		{Title: "bad Luck", Author: []book.Author{{LastName: "Lem"}}, DateAdded: "2024-01-01"},
+		{Title: "Beginnings", Author: []book.Author{{LastName: "Asimov"}}, DateAdded: "2024-02-01"},
+		{Title: "Borderlands", Author: []book.Author{{FirstName: "Arkady", LastName: "Strugatsky"}},
+			Series: &book.SeriesInfo{Name: "Noon Universe", SeriesNo: 1}, DateAdded: "2024-04-01"},
+		{Title: "Burnt", Author: []book.Author{{LastName: "Asimov"}}, Deleted: true},
+	} {
+		b.Archive = "books.zip"
+		b.FileName = b.Title + ".fb2"
+		if err := db.Add(b); err != nil {
+			t.Fatalf("add book: %v", err)
+		}
+	}
+
+	tests := []struct {
+		name   string
+		opts   ListOptions
+		expect []string
+	}{
+		{"by author and series", ListOptions{}, []string{"Beginnings", "bad Luck", "Borderlands", "Beetle in the Anthill"}},
+		{"by title", ListOptions{Sort: "title"}, []string{"bad Luck", "Beetle in the Anthill", "Beginnings", "Borderlands"}},
+		{"newest first", ListOptions{Sort: "added", Desc: true}, []string{"Borderlands", "Beetle in the Anthill", "Beginnings", "bad Luck"}},
+		{"page", ListOptions{Sort: "title", Limit: 2, Offset: 1}, []string{"Beetle in the Anthill", "Beginnings"}},
+		{"past the end", ListOptions{Offset: 4}, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			books, total, err := db.GetBooksByLetter("B", "", tt.opts)
+			if err != nil {
+				t.Fatalf("GetBooksByLetter failed: %v", err)
+			}
+			var titles []string
+			for _, b := range books {
+				titles = append(titles, b.Title)
+			}
+			if !slices.Equal(titles, tt.expect) || total != 4 {
+				t.Errorf("expected %v of 4, got %v of %d", tt.expect, titles, total)
+			}
+		})
+	}
+
+	if _, _, err := db.GetBooksByLetter("B", "", ListOptions{Sort: "size"}); !errors.Is(err, ErrUnknownSort) {
+		t.Errorf("expected ErrUnknownSort, got %v", err)
+	}
+
+	authors, total, err := db.GetAuthorsWithBookCountByLetter("S", "", ListOptions{Sort: "books", Desc: true, Limit: 1})
+	if err != nil {
+		t.Fatalf("GetAuthorsWithBookCountByLetter failed: %v", err)
+	}
+	if total != 2 || len(authors) != 1 || authors[0].FirstName != "Arkady" || authors[0].BookCount != 2 {
+		t.Errorf("expected Arkady Strugatsky with 2 books of 2 authors, got %+v of %d", authors, total)
+	}
+}
@@ -16,6 +16,8 @@ type Repo struct {
 	genreCache   map[string]int64
 	seriesCache  map[string]int64
 	keywordCache map[string]int64
+
+	genreMapping genreMapping // placement of genres under categories
 }
 
 func (r *Repo) Close() error {
@@ -42,3 +44,11 @@ func (r *Repo) List() error {
 func (r *Repo) Search() error {
 	return nil
 }
+
+// Stats returns connection pool statistics for the underlying database
+func (r *Repo) Stats() sql.DBStats {
+	if r.db != nil {
+		return r.db.Stats()
+	}
+	return sql.DBStats{}
+}
@@ -4,6 +4,7 @@ import (
 	"encoding/xml"
 	"os"
 	"testing"
+	"time"
 
 	"github.com/htol/bopds/book"
 	"github.com/htol/bopds/logger"
@@ -82,3 +83,302 @@ func TestAdd(t *testing.T) {
 	}
 
 }
+
+func TestBookFormat(t *testing.T) {
+	dbPath := "./test_format.db"
+	cleanupTestDB(dbPath)
+	db := GetStorage(dbPath)
+	defer cleanupTestDB(dbPath)
+
+	fb2 := &book.Book{Title: "FB2 Book", FileName: "1.fb2"}
+	pdf := &book.Book{Title: "PDF Book", FileName: "2.pdf", Format: "pdf"}
+	if err := db.AddBatch([]*book.Book{fb2, pdf}); err != nil {
+		t.Fatalf("AddBatch failed: %v", err)
+	}
+	for _, tt := range []struct {
+		id     int64
+		expect string
+	}{{fb2.BookID, "fb2"}, {pdf.BookID, "pdf"}} {
+		got, err := db.GetBookByID(tt.id)
+		if err != nil {
+			t.Fatalf("GetBookByID failed: %v", err)
+		}
+		if got.Format != tt.expect {
+			t.Errorf("book %d: expected format %q, got %q", tt.id, tt.expect, got.Format)
+		}
+	}
+
+	// Databases from before the column take the format from the file name
+	if _, err := db.db.Exec("ALTER TABLE books DROP COLUMN format"); err != nil {
+		t.Fatalf("drop format column: %v", err)
+	}
+	db.Close()
+	db = GetStorage(dbPath)
+	defer db.Close()
+	got, err := db.GetBookByID(pdf.BookID)
+	if err != nil {
+		t.Fatalf("GetBookByID failed: %v", err)
+	}
+	if got.Format != "pdf" {
+		t.Errorf("expected the migrated format pdf, got %q", got.Format)
+	}
+}
+
+func TestRelocateArchives(t *testing.T) {
+	dbPath := "./test_relocate.db"
+	cleanupTestDB(dbPath)
+	db := GetStorage(dbPath)
+	defer func() {
+		db.Close()
+		cleanupTestDB(dbPath)
+	}()
+
+	b := &book.Book{
+		Title:    "Legacy",
+		Archive:  "/home/user/lib/fb2-000001-000100.zip",
+		FileName: "1.fb2",
+	}
+	if err := db.Add(b); err != nil {
+		t.Fatalf("Add failed: %v", err)
+	}
+	// Simulate a row written before the library column existed
+	if _, err := db.db.Exec("UPDATE books SET library = NULL WHERE book_id = ?", b.BookID); err != nil {
+		t.Fatalf("reset library: %v", err)
+	}
+
+	n, err := db.RelocateArchives("/home/user/lib/", "flibusta")
+	if err != nil {
+		t.Fatalf("RelocateArchives failed: %v", err)
+	}
+	if n != 1 {
+		t.Fatalf("expected 1 relocated row, got %d", n)
+	}
+
+	got, err := db.GetBookByID(b.BookID)
+	if err != nil {
+		t.Fatalf("GetBookByID failed: %v", err)
+	}
+	if got.Archive != "fb2-000001-000100.zip" {
+		t.Errorf("expected relative archive, got %q", got.Archive)
+	}
+	if got.Library != "flibusta" {
+		t.Errorf("expected library 'flibusta', got %q", got.Library)
+	}
+
+	// Paths outside the root are left alone
+	n, err = db.RelocateArchives("/mnt/other", "flibusta")
+	if err != nil {
+		t.Fatalf("RelocateArchives failed: %v", err)
+	}
+	if n != 0 {
+		t.Errorf("expected no rows relocated, got %d", n)
+	}
+
+	// Roots are matched by characters, not bytes
+	cyrillic := &book.Book{Title: "Пикник", Archive: "/книги/lib/fb2-000101-000200.zip", FileName: "101.fb2"}
+	if err := db.Add(cyrillic); err != nil {
+		t.Fatalf("Add failed: %v", err)
+	}
+	if _, err := db.db.Exec("UPDATE books SET library = NULL WHERE book_id = ?", cyrillic.BookID); err != nil {
+		t.Fatalf("reset library: %v", err)
+	}
+	if n, err = db.RelocateArchives("/книги/lib", "flibusta"); err != nil || n != 1 {
+		t.Fatalf("expected 1 relocated row, got %d (%v)", n, err)
+	}
+	if got, err = db.GetBookByID(cyrillic.BookID); err != nil {
+		t.Fatalf("GetBookByID failed: %v", err)
+	}
+	if got.Archive != "fb2-000101-000200.zip" {
+		t.Errorf("expected relative archive, got %q", got.Archive)
+	}
+}
+
+func TestLibraryFilterAndDelete(t *testing.T) {
+	dbPath := "./test_libraries.db"
+	cleanupTestDB(dbPath)
+	db := GetStorage(dbPath)
+	defer func() {
+		db.Close()
+		cleanupTestDB(dbPath)
+	}()
+
+	author := []book.Author{{FirstName: "Isaac", LastName: "Asimov"}}
+	for _, b := range []*book.Book{
+		{Title: "Foundation", Author: author, Archive: "a.zip", Library: "flibusta", FileName: "1.fb2"},
+		{Title: "Fantastic Voyage", Author: append(author, book.Author{FirstName: "Arthur", LastName: "Clarke"}), Archive: "b.zip",
+			Library: "personal", FileName: "2.fb2", Series: &book.SeriesInfo{Name: "Voyages"}, Keywords: []string{"submarine"}},
+	} {
+		if err := db.Add(b); err != nil {
+			t.Fatalf("Add failed: %v", err)
+		}
+	}
+
+	tests := []struct {
+		library  string
+		expected int
+	}{
+		{library: "", expected: 2},
+		{library: "flibusta", expected: 1},
+		{library: "personal", expected: 1},
+		{library: "librusec", expected: 0},
+	}
+	for _, tt := range tests {
+		books, _, err := db.GetBooksByLetter("F", tt.library, ListOptions{})
+		if err != nil {
+			t.Fatalf("GetBooksByLetter(%q) failed: %v", tt.library, err)
+		}
+		if len(books) != tt.expected {
+			t.Errorf("library %q: expected %d books, got %d", tt.library, tt.expected, len(books))
+		}
+		for _, b := range books {
+			if tt.library != "" && b.Library != tt.library {
+				t.Errorf("library %q: got book from %q", tt.library, b.Library)
+			}
+		}
+	}
+
+	n, err := db.DeleteLibraryBooks("personal")
+	if err != nil {
+		t.Fatalf("DeleteLibraryBooks failed: %v", err)
+	}
+	if n != 1 {
+		t.Errorf("expected 1 deleted book, got %d", n)
+	}
+	books, _, err := db.GetBooksByLetter("F", "", ListOptions{})
+	if err != nil {
+		t.Fatalf("GetBooksByLetter failed: %v", err)
+	}
+	if len(books) != 1 || books[0].Library != "flibusta" {
+		t.Errorf("expected only the flibusta book to remain, got %+v", books)
+	}
+
+	// Only the authors, series and keywords of the remaining book are kept
+	for _, tt := range []struct {
+		table    string
+		expected int
+	}{
+		{"authors", 1},
+		{"series", 0},
+		{"keywords", 0},
+	} {
+		var count int
+		if err := db.db.QueryRow("SELECT COUNT(*) FROM " + tt.table).Scan(&count); err != nil {
+			t.Fatalf("count %s: %v", tt.table, err)
+		}
+		if count != tt.expected {
+			t.Errorf("expected %d %s left, got %d", tt.expected, tt.table, count)
+		}
+	}
+
+	// Rescanned books get the deleted authors and series anew
+	rescanned := &book.Book{Title: "Rendezvous", Author: []book.Author{{FirstName: "Arthur", LastName: "Clarke"}}, Archive: "b.zip",
+		Library: "personal", FileName: "3.fb2", Series: &book.SeriesInfo{Name: "Voyages"}}
+	if err := db.Add(rescanned); err != nil {
+		t.Fatalf("Add failed: %v", err)
+	}
+	authors, _, err := db.GetAuthorsWithBookCountByLetter("C", "", ListOptions{})
+	if err != nil {
+		t.Fatalf("GetAuthorsWithBookCountByLetter failed: %v", err)
+	}
+	if len(authors) != 1 || authors[0].LastName != "Clarke" || authors[0].BookCount != 1 {
+		t.Errorf("expected Clarke with the rescanned book, got %+v", authors)
+	}
+	series, _, err := db.GetSeriesWithBookCountByLetter("V", "", ListOptions{})
+	if err != nil {
+		t.Fatalf("GetSeriesWithBookCountByLetter failed: %v", err)
+	}
+	if len(series) != 1 || series[0].BookCount != 1 {
+		t.Errorf("expected the series with the rescanned book, got %+v", series)
+	}
+}
+
+func TestJobs(t *testing.T) {
+	dbPath := "./test_jobs.db"
+	cleanupTestDB(dbPath)
+	db := GetStorage(dbPath)
+	defer func() {
+		db.Close()
+		cleanupTestDB(dbPath)
+	}()
+
+	queued := &book.Job{Kind: book.JobConvert, BookID: 1, Format: "epub", Status: book.JobQueued}
+	done := &book.Job{Kind: book.JobConvert, BookID: 2, Format: "mobi", Profile: "plain", Status: book.JobQueued}
+	for _, job := range []*book.Job{queued, done} {
+		if err := db.CreateJob(job); err != nil {
+			t.Fatalf("CreateJob failed: %v", err)
+		}
+	}
+
+	done.Status = book.JobDone
+	done.Progress = 100
+	done.ResultPath = "jobs/2.mobi"
+	done.FileName = "Book.mobi"
+	done.Attempts = 2
+	if err := db.UpdateJob(done); err != nil {
+		t.Fatalf("UpdateJob failed: %v", err)
+	}
+
+	got, err := db.GetJob(done.ID)
+	if err != nil {
+		t.Fatalf("GetJob failed: %v", err)
+	}
+	if got.Status != book.JobDone || got.Progress != 100 || got.ResultPath != "jobs/2.mobi" || got.FileName != "Book.mobi" || got.Attempts != 2 {
+		t.Errorf("unexpected job %+v", got)
+	}
+	if _, err := db.GetJob(999); err != ErrNotFound {
+		t.Errorf("expected ErrNotFound for unknown job, got %v", err)
+	}
+
+	for _, tt := range []struct {
+		bookID  int64
+		format  string
+		profile string
+		expect  int64
+	}{
+		{2, "mobi", "plain", done.ID},
+		{2, "mobi", "", 0},
+		{2, "epub", "plain", 0},
+		{1, "epub", "", queued.ID},
+	} {
+		found, err := db.FindJob(book.JobConvert, tt.bookID, tt.format, tt.profile)
+		switch {
+		case tt.expect == 0 && err != ErrNotFound:
+			t.Errorf("FindJob(%d, %s, %q): expected ErrNotFound, got %v", tt.bookID, tt.format, tt.profile, err)
+		case tt.expect != 0 && (err != nil || found.ID != tt.expect):
+			t.Errorf("FindJob(%d, %s, %q): expected job %d, got %+v, %v", tt.bookID, tt.format, tt.profile, tt.expect, found, err)
+		}
+	}
+
+	unfinished, err := db.GetUnfinishedJobs()
+	if err != nil {
+		t.Fatalf("GetUnfinishedJobs failed: %v", err)
+	}
+	if len(unfinished) != 1 || unfinished[0].ID != queued.ID {
+		t.Errorf("expected only the queued job to be unfinished, got %+v", unfinished)
+	}
+
+	if err := db.TouchJob(done.ID); err != nil {
+		t.Fatalf("TouchJob failed: %v", err)
+	}
+	if err := db.TouchJob(999); err != ErrNotFound {
+		t.Errorf("expected ErrNotFound touching an unknown job, got %v", err)
+	}
+	// A job handed out again is not expired with the ones last used earlier
+	if expired, err := db.ExpireJobs(time.Now().Add(-time.Minute)); err != nil || len(expired) != 0 {
+		t.Errorf("expected the touched job to be kept, got %+v, %v", expired, err)
+	}
+
+	expired, err := db.ExpireJobs(time.Now().Add(time.Hour))
+	if err != nil {
+		t.Fatalf("ExpireJobs failed: %v", err)
+	}
+	if len(expired) != 1 || expired[0].ResultPath != "jobs/2.mobi" {
+		t.Errorf("expected the finished job to expire, got %+v", expired)
+	}
+	if _, err := db.GetJob(done.ID); err != ErrNotFound {
+		t.Errorf("expected expired job to be deleted, got %v", err)
+	}
+	if _, err := db.GetJob(queued.ID); err != nil {
+		t.Errorf("expected unfinished job to be kept, got %v", err)
+	}
+}
@@ -3,6 +3,7 @@ package repo
 import (
 	"context"
 	"errors"
+	"time"
 
 	"github.com/htol/bopds/book"
 )
@@ -23,26 +24,49 @@ type Repository interface {
 	GetAuthorsByLetter(letters string) ([]book.Author, error)
 	GetAuthorByID(id int64) (*book.Author, error)
 	GetAuthorsWithBookCount() ([]book.AuthorWithBookCount, error)
-	GetAuthorsWithBookCountByLetter(letters string) ([]book.AuthorWithBookCount, error)
+	GetAuthorsWithBookCountByLetter(letters, library string, opts ListOptions) ([]book.AuthorWithBookCount, int, error)
 
 	// Books
 	GetBooks() ([]string, error)
-	GetBooksByLetter(letters string) ([]book.Book, error)
-	GetBooksByAuthorID(id int64) ([]book.Book, error)
+	// An empty library argument matches books from every library
+	GetBooksByLetter(letters, library string, opts ListOptions) ([]book.Book, int, error)
+	GetBooksByAuthorID(id int64, library string, languages []string, opts ListOptions) ([]book.Book, int, error)
 	GetBookByID(id int64) (*book.Book, error)
-	GetRecentBooks(limit, offset int) ([]book.Book, int, error)
-	GetBooksByGenre(genre string, limit, offset int) ([]book.Book, int, error)
+	GetRecentBooks(limit, offset int, library string, languages []string) ([]book.Book, int, error)
+	GetBooksByGenre(genre string, limit, offset int, library string, languages []string) ([]book.Book, int, error)
+
+	// Series
+	GetSeriesByID(id int64) (*book.SeriesInfo, error)
+	GetBooksBySeriesID(seriesID int64) ([]book.Book, error)
+	GetSeriesWithBookCountByLetter(letters, library string, opts ListOptions) ([]book.SeriesWithBookCount, int, error)
+
+	// GetPrefixes counts the names of the index starting with prefix by
+	// their prefixes one character longer
+	GetPrefixes(index PrefixIndex, prefix, library string) ([]book.Prefix, error)
 
 	// SearchBooks performs full-text search across books by title and author
-	// Returns results ranked by relevance (FTS5 rank)
-	SearchBooks(ctx context.Context, query string, limit, offset int, fields []string, languages []string) ([]book.BookSearchResult, error)
+	// Returns the page of results opts asks for and the number of results
+	SearchBooks(ctx context.Context, query string, opts ListOptions, fields []string, languages []string, libraries []string) ([]book.BookSearchResult, int, error)
 
 	// Genres
-	GetGenres() ([]book.Genre, error)
+	GetGenres(library string) ([]book.Genre, error)
+	GetGenreCategories(library string) ([]book.GenreCategory, error)
 
 	// Languages
 	GetLanguages() ([]string, error)
 
+	// Background jobs
+	CreateJob(job *book.Job) error
+	UpdateJob(job *book.Job) error
+	// TouchJob refreshes the job's last update time
+	TouchJob(id int64) error
+	GetJob(id int64) (*book.Job, error)
+	// FindJob returns the newest job that has not failed for the book, format and profile
+	FindJob(kind string, bookID int64, format, profile string) (*book.Job, error)
+	GetUnfinishedJobs() ([]book.Job, error)
+	// ExpireJobs deletes finished jobs last updated before the given time
+	ExpireJobs(before time.Time) ([]book.Job, error)
+
 	// Write operations
 	Add(record *book.Book) error
 	Search() error
@@ -2,6 +2,9 @@ package repo
 
 import (
 	"database/sql"
+	"fmt"
+	"maps"
+	"path/filepath"
 	"time"
 
 	"github.com/htol/bopds/config"
@@ -10,7 +13,7 @@ import (
 )
 
 func GetStorage(path string) *Repo {
-	return GetStorageWithConfig(path, config.Load())
+	return GetStorageWithConfig(path, config.Default())
 }
 
 func GetStorageWithConfig(path string, cfg *config.Config) *Repo {
@@ -92,8 +95,21 @@ func GetStorageWithConfig(path string, cfg *config.Config) *Repo {
 	}
 
 	r.migrateAddTranslitName()
+	r.migrateAddGenreCategory()
+	r.migrateAddLibrary()
+	r.migrateAddFormat()
+	r.migrateAddJobProfile()
+	r.migrateAddJobDelivery()
+	r.migrateRelativeArchives(cfg.Libraries)
 	r.SyncGenreDisplayNames()
 
+	mapping, err := loadGenreMapping(cfg.Genres.MappingFiles)
+	if err != nil {
+		logger.Error("Failed to load genre mapping files, using the built-in genre categories", "error", err)
+	}
+	r.genreMapping = mapping
+	r.SyncGenreCategories()
+
 	return r
 }
 
@@ -115,7 +131,9 @@ func (r *Repo) CreateIndexes() error {
                 title text,
                 lang text,
                 archive text,
+                library text,
                 filename text,
+                format text not null default 'fb2', -- fb2, epub, pdf, djvu...
                 file_size integer,
                 date_added text,
                 lib_id integer,
@@ -139,6 +157,14 @@ func (r *Repo) CreateIndexes() error {
                display_name text
            );
 
+           CREATE TABLE IF NOT EXISTS "genre_categories" (
+               category_id integer primary key autoincrement not null,
+               name text unique not null,
+               display_name text,
+               translit_name text,
+               position integer not null default 0
+           );
+
            CREATE TABLE IF NOT EXISTS "book_genres" (
                book_id INTEGER NOT NULL,
                genre_id INTEGER NOT NULL,
@@ -179,6 +205,24 @@ func (r *Repo) CreateIndexes() error {
            CREATE INDEX IF NOT EXISTS [idx_book_keywords_keyword_id] ON [book_keywords] ([keyword_id]);
 
            CREATE VIRTUAL TABLE IF NOT EXISTS books_fts USING fts5(title, author, series, genre, book_id);
+
+           CREATE TABLE IF NOT EXISTS "jobs" (
+               job_id INTEGER PRIMARY KEY AUTOINCREMENT,
+               kind TEXT NOT NULL,
+               book_id INTEGER NOT NULL,
+               format TEXT,
+               profile TEXT NOT NULL DEFAULT '',
+               status TEXT NOT NULL,
+               progress INTEGER NOT NULL DEFAULT 0,
+               error TEXT,
+               result_path TEXT,
+               filename TEXT,
+               recipient TEXT,
+               attempts INTEGER NOT NULL DEFAULT 0,
+               created_at TEXT NOT NULL,
+               updated_at TEXT NOT NULL
+           );
+           CREATE INDEX IF NOT EXISTS [idx_jobs_status] ON [jobs] ([status]);
   	    `
 	_, err := r.db.Exec(sqlStmt)
 	return err
@@ -222,3 +266,227 @@ func (r *Repo) migrateAddTranslitName() {
 		logger.Error("Failed to add 'translit_name' column", "error", err)
 	}
 }
+
+// migrateAddGenreCategory adds the 'category_id' column placing genres under
+// genre categories to 'genres'
+func (r *Repo) migrateAddGenreCategory() {
+	rows, err := r.db.Query("SELECT category_id FROM genres LIMIT 1")
+	if err == nil {
+		rows.Close()
+		return // Column exists
+	}
+
+	logger.Info("Migrating database: adding 'category_id' to 'genres' table")
+	if _, err := r.db.Exec("ALTER TABLE genres ADD COLUMN category_id INTEGER REFERENCES genre_categories(category_id)"); err != nil {
+		logger.Error("Failed to add 'category_id' column", "error", err)
+	}
+}
+
+// migrateAddLibrary adds the 'library' column to 'books' for databases created
+// before archive paths were stored relative to a named library root
+func (r *Repo) migrateAddLibrary() {
+	rows, err := r.db.Query("SELECT library FROM books LIMIT 1")
+	if err == nil {
+		rows.Close()
+		return // Column exists
+	}
+
+	logger.Info("Migrating database: adding 'library' to 'books' table")
+	if _, err := r.db.Exec("ALTER TABLE books ADD COLUMN library TEXT"); err != nil {
+		logger.Error("Failed to add 'library' column", "error", err)
+	}
+}
+
+// migrateAddFormat adds the 'format' column to 'books' for databases created
+// when every book was taken for FB2, setting it from the file extension
+func (r *Repo) migrateAddFormat() {
+	rows, err := r.db.Query("SELECT format FROM books LIMIT 1")
+	if err == nil {
+		rows.Close()
+		return // Column exists
+	}
+
+	logger.Info("Migrating database: adding 'format' to 'books' table")
+	if _, err := r.db.Exec("ALTER TABLE books ADD COLUMN format TEXT NOT NULL DEFAULT 'fb2'"); err != nil {
+		logger.Error("Failed to add 'format' column", "error", err)
+		return
+	}
+	for _, format := range []string{"epub", "pdf", "djvu"} {
+		if _, err := r.db.Exec("UPDATE books SET format = ? WHERE filename LIKE ?", format, "%."+format); err != nil {
+			logger.Error("Failed to set book formats", "format", format, "error", err)
+		}
+	}
+}
+
+// migrateAddJobProfile adds the 'profile' column to 'jobs' for databases
+// created before conversion profiles, and the index used to reuse results
+func (r *Repo) migrateAddJobProfile() {
+	rows, err := r.db.Query("SELECT profile FROM jobs LIMIT 1")
+	if err == nil {
+		rows.Close()
+	} else {
+		logger.Info("Migrating database: adding 'profile' to 'jobs' table")
+		if _, err := r.db.Exec("ALTER TABLE jobs ADD COLUMN profile TEXT NOT NULL DEFAULT ''"); err != nil {
+			logger.Error("Failed to add 'profile' column", "error", err)
+			return
+		}
+	}
+	if _, err := r.db.Exec("CREATE INDEX IF NOT EXISTS [idx_jobs_conversion] ON [jobs] ([book_id], [format], [profile])"); err != nil {
+		logger.Error("Failed to create jobs conversion index", "error", err)
+	}
+}
+
+// migrateAddJobDelivery adds the 'recipient' and 'attempts' columns of send
+// jobs to 'jobs' for databases created before books could be e-mailed
+func (r *Repo) migrateAddJobDelivery() {
+	rows, err := r.db.Query("SELECT recipient, attempts FROM jobs LIMIT 1")
+	if err == nil {
+		rows.Close()
+		return // Columns exist
+	}
+
+	logger.Info("Migrating database: adding 'recipient' and 'attempts' to 'jobs' table")
+	for _, stmt := range []string{
+		"ALTER TABLE jobs ADD COLUMN recipient TEXT",
+		"ALTER TABLE jobs ADD COLUMN attempts INTEGER NOT NULL DEFAULT 0",
+	} {
+		if _, err := r.db.Exec(stmt); err != nil {
+			logger.Error("Failed to migrate 'jobs' table", "statement", stmt, "error", err)
+		}
+	}
+}
+
+// migrateRelativeArchives rewrites legacy archive paths that were stored with
+// the library root baked in. Rows without a library whose archive lives under
+// one of the configured roots are made relative and assigned to that library.
+func (r *Repo) migrateRelativeArchives(libs []config.LibraryConfig) {
+	var legacy int64
+	if err := r.db.QueryRow("SELECT COUNT(*) FROM books WHERE library IS NULL").Scan(&legacy); err != nil {
+		logger.Error("Failed to count legacy archive paths", "error", err)
+		return
+	}
+	if legacy == 0 {
+		return
+	}
+
+	for _, lib := range libs {
+		if lib.Path == "" {
+			continue
+		}
+		n, err := r.RelocateArchives(lib.Path, lib.Name)
+		if err != nil {
+			logger.Error("Failed to migrate archive paths", "library", lib.Name, "error", err)
+			return
+		}
+		if n > 0 {
+			logger.Info("Migrated archive paths to library-relative form", "library", lib.Name, "root", lib.Path, "rows", n)
+		}
+		legacy -= n
+	}
+	if legacy > 0 {
+		logger.Warn("Some archive paths are outside every library root; run 'bopds relocate -from <old root>'", "rows", legacy)
+	}
+}
+
+// RelocateArchives strips oldRoot from archive paths of books without a library
+// (or already assigned to library) and assigns them to library. It is used to
+// move a database scanned under one mount point to another.
+func (r *Repo) RelocateArchives(oldRoot, library string) (int64, error) {
+	prefix := filepath.Clean(oldRoot) + string(filepath.Separator)
+
+	// substr and length count characters, so the prefix is measured in SQL
+	res, err := r.db.Exec(`
+		UPDATE books
+		SET archive = substr(archive, length(?1) + 1), library = ?2
+		WHERE substr(archive, 1, length(?1)) = ?1
+		AND (library IS NULL OR library = ?2)
+	`, prefix, library)
+	if err != nil {
+		return 0, fmt.Errorf("relocate archives from %s: %w", oldRoot, err)
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return 0, fmt.Errorf("relocate archives from %s: %w", oldRoot, err)
+	}
+	return n, nil
+}
+
+// DeleteLibraryBooks removes every book recorded for the named library along
+// with its author, genre, series and keyword links, and the authors, series
+// and keywords no other book has. It is used to rescan a single library
+// without touching the others.
+func (r *Repo) DeleteLibraryBooks(library string) (int64, error) {
+	tx, err := r.db.Begin()
+	if err != nil {
+		return 0, fmt.Errorf("begin transaction: %w", err)
+	}
+	defer func() {
+		if err := tx.Rollback(); err != nil && err != sql.ErrTxDone {
+			logger.Error("Failed to rollback transaction", "error", err)
+		}
+	}()
+
+	for _, table := range []string{"book_authors", "book_genres", "book_series", "book_keywords"} {
+		stmt := fmt.Sprintf("DELETE FROM %s WHERE book_id IN (SELECT book_id FROM books WHERE library = ?)", table)
+		if _, err := tx.Exec(stmt, library); err != nil {
+			return 0, fmt.Errorf("delete %s for library %s: %w", table, library, err)
+		}
+	}
+
+	res, err := tx.Exec("DELETE FROM books WHERE library = ?", library)
+	if err != nil {
+		return 0, fmt.Errorf("delete books for library %s: %w", library, err)
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return 0, fmt.Errorf("delete books for library %s: %w", library, err)
+	}
+
+	// Authors, series and keywords left without books would still be listed
+	orphans := []struct {
+		query string
+		cache map[string]int64
+		ids   map[int64]bool
+	}{
+		{"DELETE FROM authors WHERE NOT EXISTS (SELECT 1 FROM book_authors ba WHERE ba.author_id = authors.author_id) RETURNING author_id", r.authorCache, nil},
+		{"DELETE FROM series WHERE NOT EXISTS (SELECT 1 FROM book_series bs WHERE bs.series_id = series.series_id) RETURNING series_id", r.seriesCache, nil},
+		{"DELETE FROM keywords WHERE NOT EXISTS (SELECT 1 FROM book_keywords bk WHERE bk.keyword_id = keywords.keyword_id) RETURNING keyword_id", r.keywordCache, nil},
+	}
+	for i := range orphans {
+		ids, err := deleteReturningIDs(tx, orphans[i].query)
+		if err != nil {
+			return 0, fmt.Errorf("delete orphans of library %s: %w", library, err)
+		}
+		orphans[i].ids = ids
+	}
+	if err := tx.Commit(); err != nil {
+		return 0, fmt.Errorf("commit transaction: %w", err)
+	}
+
+	// Forget the deleted rows so that new books do not link to them
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, o := range orphans {
+		maps.DeleteFunc(o.cache, func(_ string, id int64) bool { return o.ids[id] })
+	}
+	return n, nil
+}
+
+// deleteReturningIDs runs a DELETE ... RETURNING statement of one ID column
+// and returns the IDs deleted
+func deleteReturningIDs(tx *sql.Tx, query string) (map[int64]bool, error) {
+	rows, err := tx.Query(query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	ids := make(map[int64]bool)
+	for rows.Next() {
+		var id int64
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		ids[id] = true
+	}
+	return ids, rows.Err()
+}
@@ -9,6 +9,7 @@ import (
 
 	"github.com/htol/bopds/book"
 	"github.com/htol/bopds/logger"
+	"github.com/htol/bopds/tracing"
 )
 
 func escapeFTS5Query(query string) string {
@@ -29,18 +30,26 @@ func escapeFTS5Query(query string) string {
 	return strings.TrimSpace(escaped)
 }
 
-// SearchBooks performs full-text search across book titles and authors
+// SearchBooks performs full-text search across book titles and authors,
+// returning the page of results opts asks for and the number of results
 // Uses FTS5 for fast, ranked search results
 // Optimized with single query including author JOIN (fixes N+1 query issue)
-func (r *Repo) SearchBooks(ctx context.Context, query string, limit, offset int, fields []string, languages []string) ([]book.BookSearchResult, error) {
+func (r *Repo) SearchBooks(ctx context.Context, query string, opts ListOptions, fields []string, languages []string, libraries []string) (_ []book.BookSearchResult, _ int, err error) {
+	ctx, span := tracing.Start(ctx, "repo.SearchBooks")
+	defer func() { tracing.End(span, err) }()
+
 	// Validate query
 	if query == "" {
-		return []book.BookSearchResult{}, nil
+		return []book.BookSearchResult{}, 0, nil
 	}
 
 	cleanQuery := strings.TrimSpace(query)
 	if cleanQuery == "" {
-		return []book.BookSearchResult{}, nil
+		return []book.BookSearchResult{}, 0, nil
+	}
+	orderBy, err := searchSorts.orderBy(opts, "b.book_id")
+	if err != nil {
+		return nil, 0, err
 	}
 
 	// Escape FTS5 special characters to prevent injection
@@ -65,6 +74,26 @@ func (r *Repo) SearchBooks(ctx context.Context, query string, limit, offset int,
 	var args []interface{}
 	args = append(args, ftsQuery)
 
+	// Language and library filter conditions
+	langCondition, langArgs := languageFilter(languages)
+	filter := langCondition
+	args = append(args, langArgs...)
+	if len(libraries) > 0 {
+		libArgs, placeholders := buildSliceArgs(libraries)
+		filter += fmt.Sprintf(" AND b.library IN (%s)", placeholders)
+		args = append(args, libArgs...)
+	}
+
+	countQuery := `
+		SELECT COUNT(*)
+		FROM books_fts fts
+		JOIN books b ON fts.book_id = b.book_id
+		WHERE books_fts MATCH ? AND b.deleted = 0 ` + filter
+	var total int
+	if err := r.db.QueryRowContext(ctx, countQuery, args...).Scan(&total); err != nil {
+		return nil, 0, fmt.Errorf("count search results: %w", err)
+	}
+
 	// Search FTS5 table and join back to books table for full details
 	// Uses book_id column for direct, accurate mapping
 	var queryBuilder strings.Builder
@@ -74,7 +103,9 @@ func (r *Repo) SearchBooks(ctx context.Context, query string, limit, offset int,
 			b.title,
 			b.lang,
 			b.archive,
+			IFNULL(b.library, ''),
 			b.filename,
+			b.format,
 			b.file_size,
 			b.deleted,
 			s.name as series_name,
@@ -91,38 +122,18 @@ func (r *Repo) SearchBooks(ctx context.Context, query string, limit, offset int,
 		LEFT JOIN book_genres bg ON b.book_id = bg.book_id
 		LEFT JOIN genres g ON bg.genre_id = g.genre_id
 		WHERE books_fts MATCH ? AND b.deleted = 0 `)
-
-	// Language filter condition
-	langCondition := ""
-	if len(languages) > 0 {
-		// Treat empty language as "ru"
-		// If "ru" is requested, also include "" (empty string) in the loop/IN clause
-		searchLangs := make([]string, 0, len(languages)+1)
-		for _, l := range languages {
-			searchLangs = append(searchLangs, l)
-			if strings.EqualFold(l, "ru") {
-				searchLangs = append(searchLangs, "")
-			}
-		}
-
-		lArgs, placeholders := buildSliceArgs(searchLangs)
-		langCondition = fmt.Sprintf("AND b.lang IN (%s)", placeholders)
-		args = append(args, lArgs...)
-	}
-	queryBuilder.WriteString(" ")
-	queryBuilder.WriteString(langCondition)
-
+	queryBuilder.WriteString(filter)
 	queryBuilder.WriteString(`
-		GROUP BY b.book_id, b.title, b.lang, b.archive, b.filename, b.file_size, b.deleted, s.name, bs.series_no, fts.rank
-		ORDER BY author, s.name, bs.series_no, b.title COLLATE NOCASE
+		GROUP BY b.book_id, b.title, b.lang, b.archive, b.filename, b.format, b.file_size, b.deleted, s.name, bs.series_no, fts.rank
+		` + orderBy + `
 		LIMIT ? OFFSET ?
 	`)
 
 	QUERY := queryBuilder.String()
-	args = append(args, limit, offset)
+	args = append(args, opts.limitArgs()...)
 	rows, err := r.db.QueryContext(ctx, QUERY, args...)
 	if err != nil {
-		return nil, fmt.Errorf("search books: %w", err)
+		return nil, 0, fmt.Errorf("search books: %w", err)
 	}
 	defer rows.Close()
 
@@ -135,12 +146,12 @@ func (r *Repo) SearchBooks(ctx context.Context, query string, limit, offset int,
 		var authorStr sql.NullString
 
 		err := rows.Scan(
-			&r.BookID, &r.Title, &r.Lang, &r.Archive, &r.FileName,
+			&r.BookID, &r.Title, &r.Lang, &r.Archive, &r.Library, &r.FileName, &r.Format,
 			&r.FileSize, &r.Deleted, &seriesName, &seriesNo,
 			&r.Rank, &authorStr, &genresStr,
 		)
 		if err != nil {
-			return nil, fmt.Errorf("scan search result: %w", err)
+			return nil, 0, fmt.Errorf("scan search result: %w", err)
 		}
 
 		if authorStr.Valid {
@@ -159,10 +170,10 @@ func (r *Repo) SearchBooks(ctx context.Context, query string, limit, offset int,
 		results = append(results, r)
 	}
 	if err := rows.Err(); err != nil {
-		return nil, fmt.Errorf("iterate search results: %w", err)
+		return nil, 0, fmt.Errorf("iterate search results: %w", err)
 	}
 
-	return results, nil
+	return results, total, nil
 }
 
 // RebuildFTSIndex rebuilds the full-text search index for all books
@@ -208,6 +219,26 @@ func (r *Repo) RebuildFTSIndex() error {
 
 // buildSliceArgs generates placeholders and converts slice to []interface{}
 // e.g. buildSliceArgs([]string{"a", "b"}) -> ([]interface{}{"a", "b"}, "?,?")
+// languageFilter returns an SQL condition, starting with AND, matching the
+// books b in any of languages, ignoring case, with its arguments. Books
+// without a language count as Russian, as GetLanguages reports them; no
+// languages match every book.
+func languageFilter(languages []string) (string, []interface{}) {
+	if len(languages) == 0 {
+		return "", nil
+	}
+	langs := make([]string, 0, len(languages)+1)
+	for _, l := range languages {
+		l = strings.ToLower(l)
+		langs = append(langs, l)
+		if l == "ru" {
+			langs = append(langs, "")
+		}
+	}
+	args, placeholders := buildSliceArgs(langs)
+	return fmt.Sprintf("AND LOWER(IFNULL(b.lang, '')) IN (%s)", placeholders), args
+}
+
 func buildSliceArgs(items []string) ([]interface{}, string) {
 	if len(items) == 0 {
 		return nil, ""
@@ -0,0 +1,110 @@
+package scanner
+
+import (
+	"context"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/htol/bopds/book"
+	"github.com/htol/bopds/converter"
+	"github.com/htol/bopds/logger"
+	"github.com/htol/bopds/metrics"
+)
+
+// isLibraryFile reports whether the scanner looks into path: an archive of
+// books, or a book stored directly
+func isLibraryFile(path string) bool {
+	return converter.IsArchive(path) || converter.IsBookFile(path)
+}
+
+// scanFiles indexes the files no INPX index lists, paths relative to basedir
+// in listed: books stored directly, and those inside archives,
+// such as a single book's .fb2.zip. Books are described by their own
+// metadata; files that are not books, or cannot be parsed, are skipped.
+func scanFiles(ctx context.Context, library, basedir string, files []string, listed map[string]bool, entries chan<- *book.Book) error {
+	archivesTotal := metrics.ScanArchivesTotal.WithLabelValues(library)
+	archivesDone := metrics.ScanArchivesDone.WithLabelValues(library)
+
+	var pending []string
+	for _, path := range files {
+		rel, err := filepath.Rel(basedir, path)
+		if err == nil && !listed[rel] {
+			pending = append(pending, path)
+		}
+	}
+	if len(pending) == 0 {
+		return nil
+	}
+	archivesTotal.Add(float64(len(pending)))
+	logger.Info("Indexing books outside INPX indexes", "library", library, "files", len(pending))
+
+	for _, path := range pending {
+		rel, _ := filepath.Rel(basedir, path)
+		n, err := scanFile(ctx, path, func(b *book.Book) error {
+			b.Archive = rel
+			b.Library = library
+			select {
+			case entries <- b:
+				return nil
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		})
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if err != nil {
+			logger.Warn("Failed to index file", "file", path, "books", n, "error", err)
+		} else if n > 0 {
+			logger.Debug("Indexed file", "file", path, "books", n)
+		}
+		archivesDone.Inc()
+	}
+	return nil
+}
+
+// scanFile describes the books of a library file and passes them to emit,
+// returning how many there were
+func scanFile(ctx context.Context, path string, emit func(*book.Book) error) (int, error) {
+	fi, err := os.Stat(path)
+	if err != nil {
+		return 0, err
+	}
+	added := fi.ModTime().Format(time.DateOnly)
+
+	if converter.IsBookFile(path) {
+		f, err := os.Open(path)
+		if err != nil {
+			return 0, err
+		}
+		defer f.Close()
+		b, err := readBookInfo(path, fi.Size(), f)
+		if err != nil {
+			return 0, err
+		}
+		b.FileName, b.FileSize, b.DateAdded = filepath.Base(path), fi.Size(), added
+		return 1, emit(b)
+	}
+
+	n := 0
+	err = converter.WalkArchive(path, func(name string, size int64, r io.Reader) error {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		b, err := readBookInfo(name, size, r)
+		if errors.Is(err, errNotABook) {
+			return nil
+		}
+		if err != nil {
+			logger.Warn("Skipping unreadable book", "archive", path, "file", name, "error", err)
+			return nil
+		}
+		b.FileName, b.FileSize, b.DateAdded = name, size, added
+		n++
+		return emit(b)
+	})
+	return n, err
+}
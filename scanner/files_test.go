@@ -0,0 +1,112 @@
+package scanner
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/htol/bopds/book"
+	"github.com/htol/bopds/logger"
+)
+
+func init() {
+	// Initialize logger for tests
+	logger.Init("info")
+}
+
+// collector stores scanned books in memory
+type collector struct {
+	mu    sync.Mutex
+	books []*book.Book
+}
+
+func (c *collector) Add(b *book.Book) error {
+	return c.AddBatch([]*book.Book{b})
+}
+
+func (c *collector) AddBatch(books []*book.Book) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.books = append(c.books, books...)
+	return nil
+}
+
+func writeTestZip(t *testing.T, path string, files map[string][]byte) {
+	t.Helper()
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	for name, content := range files {
+		w, _ := zw.Create(name)
+		w.Write(content)
+	}
+	zw.Close()
+	if err := os.WriteFile(path, buf.Bytes(), 0o644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestScanLibrary_Files(t *testing.T) {
+	dir := t.TempDir()
+	fb2 := func(title string) []byte {
+		return []byte(strings.Replace(testFB2, "Roadside Picnic", title, 1))
+	}
+
+	// An INPX-indexed archive is described by the index only
+	inp := strings.Join([]string{"Strugatsky,Arkady,:", "sf:", "Indexed", "", "", "1", "10", "1", "0", "fb2", "2024-01-01", "ru"}, "\x04")
+	writeTestZip(t, filepath.Join(dir, "lib.inpx"), map[string][]byte{"listed.inp": []byte(inp + "\n")})
+	writeTestZip(t, filepath.Join(dir, "listed.zip"), map[string][]byte{"1.fb2": fb2("Parsed")})
+
+	os.WriteFile(filepath.Join(dir, "loose.fb2"), fb2("Loose"), 0o644)
+	os.MkdirAll(filepath.Join(dir, "epub"), 0o755)
+	os.WriteFile(filepath.Join(dir, "epub", "god.epub"), testEPUB(t, `<dc:title>Hard to Be a God</dc:title>`), 0o644)
+	writeTestZip(t, filepath.Join(dir, "single.fb2.zip"), map[string][]byte{"single.fb2": fb2("Single")})
+	os.WriteFile(filepath.Join(dir, "scan.pdf"), writePDF([]string{`<< /Title (Scanned) >>`}, `<< /Size 2 /Info 1 0 R >>`), 0o644)
+
+	var tgz bytes.Buffer
+	gz := gzip.NewWriter(&tgz)
+	tw := tar.NewWriter(gz)
+	for name, content := range map[string][]byte{"a/tarred.fb2": fb2("Tarred"), "readme.txt": []byte("not a book"), "broken.fb2": []byte("<FictionBook>")} {
+		tw.WriteHeader(&tar.Header{Name: name, Mode: 0o644, Size: int64(len(content))})
+		tw.Write(content)
+	}
+	tw.Close()
+	gz.Close()
+	os.WriteFile(filepath.Join(dir, "more.tar.gz"), tgz.Bytes(), 0o644)
+
+	var c collector
+	if err := ScanLibrary("main", dir, &c, 10); err != nil {
+		t.Fatalf("scan: %v", err)
+	}
+
+	var got []string
+	for _, b := range c.books {
+		if b.Library != "main" {
+			t.Errorf("%s: expected library main, got %q", b.Title, b.Library)
+		}
+		got = append(got, b.Title+" @ "+filepath.ToSlash(b.Archive)+":"+b.FileName+" "+b.Format)
+	}
+	slices.Sort(got)
+	expect := []string{
+		"Hard to Be a God @ epub/god.epub:god.epub epub",
+		"Indexed @ listed.zip:1.fb2 fb2",
+		"Loose @ loose.fb2:loose.fb2 fb2",
+		"Scanned @ scan.pdf:scan.pdf pdf",
+		"Single @ single.fb2.zip:single.fb2 fb2",
+		"Tarred @ more.tar.gz:a/tarred.fb2 fb2",
+	}
+	if !slices.Equal(got, expect) {
+		t.Errorf("expected books\n%s\ngot\n%s", strings.Join(expect, "\n"), strings.Join(got, "\n"))
+	}
+	for _, b := range c.books {
+		if b.Title == "Loose" && (b.FileSize == 0 || b.DateAdded == "" || len(b.Author) != 2) {
+			t.Errorf("expected size, date and authors of a loose book, got %+v", b)
+		}
+	}
+}
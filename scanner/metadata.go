@@ -0,0 +1,385 @@
+package scanner
+
+import (
+	"archive/zip"
+	"bytes"
+	"cmp"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"path"
+	"strconv"
+	"strings"
+
+	"github.com/htol/bopds/book"
+	"github.com/htol/bopds/logger"
+	"golang.org/x/net/html/charset"
+)
+
+// maxBookReadSize caps EPUB and PDF books read into memory from archives
+// without random access, to index their metadata
+const maxBookReadSize = 64 << 20
+
+// errNotABook is returned by readBookInfo for files that are not books
+var errNotABook = errors.New("not a book")
+
+// readBookInfo describes the book name from its own metadata and sets its
+// format. PDF and DjVu books are served whatever their metadata says, so
+// they are titled after the file when it does not give a title.
+func readBookInfo(name string, size int64, r io.Reader) (*book.Book, error) {
+	var (
+		b   *book.Book
+		err error
+	)
+	format := strings.TrimPrefix(strings.ToLower(path.Ext(name)), ".")
+	switch format {
+	case "fb2":
+		b, err = readFB2Info(r)
+	case "epub":
+		var ra io.ReaderAt
+		if ra, size, err = readerAt(r, size); err == nil {
+			b, err = readEPUBInfo(ra, size)
+		}
+	case "pdf":
+		var ra io.ReaderAt
+		if ra, size, err = readerAt(r, size); err == nil {
+			b, err = readPDFInfo(ra, size)
+		}
+		if err != nil {
+			logger.Debug("No PDF metadata", "file", name, "error", err)
+			b, err = &book.Book{}, nil
+		}
+	case "djvu":
+		b = &book.Book{}
+	default:
+		return nil, errNotABook
+	}
+	if err != nil {
+		return nil, err
+	}
+	if b.Title == "" {
+		b.Title = strings.TrimSuffix(path.Base(name), path.Ext(name))
+	}
+	b.Format = format
+	return b, nil
+}
+
+// readerAt returns r for random access, reading books from archives that do
+// not allow it into memory
+func readerAt(r io.Reader, size int64) (io.ReaderAt, int64, error) {
+	if ra, ok := r.(io.ReaderAt); ok {
+		return ra, size, nil
+	}
+	if size > maxBookReadSize {
+		return nil, 0, fmt.Errorf("book of %d MiB is too large to index", size>>20)
+	}
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return nil, 0, fmt.Errorf("read book: %w", err)
+	}
+	return bytes.NewReader(data), int64(len(data)), nil
+}
+
+// readFB2Info reads the title-info of an FB2 document, in any encoding it
+// declares, stopping at the end of its description
+func readFB2Info(r io.Reader) (*book.Book, error) {
+	dec := xml.NewDecoder(r)
+	dec.CharsetReader = charset.NewReaderLabel
+	dec.Strict = false
+	dec.Entity = xml.HTMLEntity
+
+	b := &book.Book{}
+	var (
+		stack  []string
+		author *book.Author
+		text   strings.Builder
+	)
+	for {
+		tok, err := dec.Token()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("parse FB2: %w", err)
+		}
+		switch t := tok.(type) {
+		case xml.StartElement:
+			stack = append(stack, t.Name.Local)
+			text.Reset()
+			if !inTitleInfo(stack) {
+				continue
+			}
+			switch t.Name.Local {
+			case "author":
+				if len(stack) == 4 {
+					author = &book.Author{}
+				}
+			case "sequence":
+				if b.Series == nil {
+					b.Series = &book.SeriesInfo{}
+					for _, a := range t.Attr {
+						switch a.Name.Local {
+						case "name":
+							b.Series.Name = strings.TrimSpace(a.Value)
+						case "number":
+							b.Series.SeriesNo, _ = strconv.Atoi(strings.TrimSpace(a.Value))
+						}
+					}
+					if b.Series.Name == "" {
+						b.Series = nil
+					}
+				}
+			}
+		case xml.CharData:
+			text.Write(t)
+		case xml.EndElement:
+			if len(stack) == 0 {
+				continue
+			}
+			value := strings.TrimSpace(text.String())
+			if inTitleInfo(stack) {
+				switch stack[len(stack)-1] {
+				case "book-title":
+					b.Title = value
+				case "lang":
+					b.Lang = value
+				case "genre":
+					if value != "" {
+						b.Genres = append(b.Genres, value)
+					}
+				case "keywords":
+					b.Keywords = parseKeywords(value)
+				case "first-name", "middle-name", "last-name", "nickname":
+					if author != nil {
+						setAuthorName(author, stack[len(stack)-1], value)
+					}
+				case "author":
+					if author != nil && len(stack) == 4 {
+						if *author != (book.Author{}) {
+							b.Author = append(b.Author, *author)
+						}
+						author = nil
+					}
+				}
+			}
+			if stack[len(stack)-1] == "description" {
+				return fb2Info(b)
+			}
+			stack = stack[:len(stack)-1]
+			text.Reset()
+		}
+	}
+	return fb2Info(b)
+}
+
+// inTitleInfo reports whether the element path is inside
+// FictionBook/description/title-info
+func inTitleInfo(stack []string) bool {
+	return len(stack) >= 3 && stack[0] == "FictionBook" && stack[1] == "description" && stack[2] == "title-info"
+}
+
+func setAuthorName(a *book.Author, field, value string) {
+	switch field {
+	case "first-name":
+		a.FirstName = value
+	case "middle-name":
+		a.MiddleName = value
+	case "last-name":
+		a.LastName = value
+	case "nickname":
+		// Authors known only by a pen name
+		if a.LastName == "" {
+			a.LastName = value
+		}
+	}
+}
+
+func fb2Info(b *book.Book) (*book.Book, error) {
+	if b.Title == "" {
+		return nil, fmt.Errorf("parse FB2: no book title")
+	}
+	return b, nil
+}
+
+// EPUB container and OPF package documents; only the fields indexed are read
+type epubContainer struct {
+	Rootfiles []struct {
+		FullPath  string `xml:"full-path,attr"`
+		MediaType string `xml:"media-type,attr"`
+	} `xml:"rootfiles>rootfile"`
+}
+
+type opfPackage struct {
+	Metadata struct {
+		Titles    []string     `xml:"http://purl.org/dc/elements/1.1/ title"`
+		Creators  []opfCreator `xml:"http://purl.org/dc/elements/1.1/ creator"`
+		Languages []string     `xml:"http://purl.org/dc/elements/1.1/ language"`
+		Subjects  []string     `xml:"http://purl.org/dc/elements/1.1/ subject"`
+		Meta      []opfMeta    `xml:"meta"`
+	} `xml:"metadata"`
+}
+
+type opfCreator struct {
+	ID     string `xml:"id,attr"`
+	Role   string `xml:"role,attr"`    // EPUB 2 opf:role
+	FileAs string `xml:"file-as,attr"` // EPUB 2 opf:file-as
+	Name   string `xml:",chardata"`
+}
+
+type opfMeta struct {
+	ID       string `xml:"id,attr"`
+	Name     string `xml:"name,attr"` // EPUB 2, e.g. calibre:series
+	Content  string `xml:"content,attr"`
+	Property string `xml:"property,attr"` // EPUB 3
+	Refines  string `xml:"refines,attr"`
+	Value    string `xml:",chardata"`
+}
+
+// readEPUBInfo reads the metadata of the OPF package document of an EPUB
+func readEPUBInfo(r io.ReaderAt, size int64) (*book.Book, error) {
+	zr, err := zip.NewReader(r, size)
+	if err != nil {
+		return nil, fmt.Errorf("open EPUB: %w", err)
+	}
+
+	var container epubContainer
+	if err := decodeZipXML(zr, "META-INF/container.xml", &container); err != nil {
+		return nil, err
+	}
+	opfPath := ""
+	for _, rf := range container.Rootfiles {
+		if rf.MediaType == "" || rf.MediaType == "application/oebps-package+xml" {
+			opfPath = rf.FullPath
+			break
+		}
+	}
+	if opfPath == "" {
+		return nil, fmt.Errorf("parse EPUB: no package document")
+	}
+	var opf opfPackage
+	if err := decodeZipXML(zr, opfPath, &opf); err != nil {
+		return nil, err
+	}
+	md := &opf.Metadata
+
+	b := &book.Book{}
+	if len(md.Titles) > 0 {
+		b.Title = strings.TrimSpace(md.Titles[0])
+	}
+	if b.Title == "" {
+		return nil, fmt.Errorf("parse EPUB: no book title")
+	}
+	if len(md.Languages) > 0 {
+		// "ru-RU" is listed with the "ru" books
+		lang, _, _ := strings.Cut(strings.TrimSpace(md.Languages[0]), "-")
+		b.Lang = strings.ToLower(lang)
+	}
+	for _, s := range md.Subjects {
+		if s = strings.TrimSpace(s); s != "" {
+			b.Keywords = append(b.Keywords, s)
+		}
+	}
+
+	// EPUB 3 puts creator roles, sort names and series in refining meta
+	// elements; EPUB 2 in attributes and calibre's meta elements
+	refines := make(map[string]map[string]string)
+	for _, m := range md.Meta {
+		if m.Refines != "" {
+			id := strings.TrimPrefix(m.Refines, "#")
+			if refines[id] == nil {
+				refines[id] = make(map[string]string)
+			}
+			refines[id][m.Property] = strings.TrimSpace(m.Value)
+		}
+	}
+	for _, c := range md.Creators {
+		role, fileAs := c.Role, c.FileAs
+		if r := refines[c.ID]; r != nil {
+			role = cmp.Or(role, r["role"])
+			fileAs = cmp.Or(fileAs, r["file-as"])
+		}
+		if role != "" && role != "aut" {
+			continue
+		}
+		if a, ok := parseCreator(c.Name, fileAs); ok {
+			b.Author = append(b.Author, a)
+		}
+	}
+	for _, m := range md.Meta {
+		switch {
+		case m.Name == "calibre:series" && b.Series == nil:
+			b.Series = &book.SeriesInfo{Name: strings.TrimSpace(m.Content)}
+		case m.Property == "belongs-to-collection" && m.Refines == "" && b.Series == nil:
+			if r := refines[m.ID]; r == nil || r["collection-type"] == "" || r["collection-type"] == "series" {
+				b.Series = &book.SeriesInfo{Name: strings.TrimSpace(m.Value)}
+				if r != nil {
+					b.Series.SeriesNo = seriesNumber(r["group-position"])
+				}
+			}
+		}
+	}
+	if b.Series != nil {
+		for _, m := range md.Meta {
+			if m.Name == "calibre:series_index" && b.Series.SeriesNo == 0 {
+				b.Series.SeriesNo = seriesNumber(m.Content)
+			}
+		}
+		if b.Series.Name == "" {
+			b.Series = nil
+		}
+	}
+	return b, nil
+}
+
+// decodeZipXML decodes the XML document name of the archive into v
+func decodeZipXML(zr *zip.Reader, name string, v any) error {
+	f, err := zr.Open(name)
+	if err != nil {
+		return fmt.Errorf("parse EPUB: %w", err)
+	}
+	defer f.Close()
+	dec := xml.NewDecoder(f)
+	dec.CharsetReader = charset.NewReaderLabel
+	dec.Strict = false
+	dec.Entity = xml.HTMLEntity
+	if err := dec.Decode(v); err != nil {
+		return fmt.Errorf("parse EPUB %s: %w", name, err)
+	}
+	return nil
+}
+
+// parseCreator splits a creator into name parts, preferring the sort name,
+// "Tolstoy, Leo", over the display name, "Leo Tolstoy"
+func parseCreator(name, fileAs string) (book.Author, bool) {
+	if last, first, ok := strings.Cut(fileAs, ","); ok && strings.TrimSpace(last) != "" {
+		a := book.Author{LastName: strings.TrimSpace(last)}
+		parts := strings.Fields(first)
+		if len(parts) > 0 {
+			a.FirstName = parts[0]
+			a.MiddleName = strings.Join(parts[1:], " ")
+		}
+		return a, true
+	}
+	parts := strings.Fields(name)
+	switch len(parts) {
+	case 0:
+		return book.Author{}, false
+	case 1:
+		return book.Author{LastName: parts[0]}, true
+	}
+	return book.Author{
+		FirstName:  parts[0],
+		MiddleName: strings.Join(parts[1:len(parts)-1], " "),
+		LastName:   parts[len(parts)-1],
+	}, true
+}
+
+// seriesNumber parses a series position, "3" or calibre's "3.0"
+func seriesNumber(s string) int {
+	f, err := strconv.ParseFloat(strings.TrimSpace(s), 64)
+	if err != nil {
+		return 0
+	}
+	return int(f)
+}
@@ -0,0 +1,143 @@
+package scanner
+
+import (
+	"archive/zip"
+	"bytes"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/htol/bopds/book"
+)
+
+const testFB2 = `<?xml version="1.0" encoding="windows-1251"?>
+<FictionBook xmlns="http://www.gribuser.ru/xml/fictionbook/2.0">
+<description>
+ <title-info>
+  <genre>sf</genre><genre>adventure</genre>
+  <author><first-name>Arkady</first-name><last-name>Strugatsky</last-name></author>
+  <author><nickname>Boris</nickname></author>
+  <book-title>Roadside Picnic</book-title>
+  <keywords>zone, stalker</keywords>
+  <lang>en</lang>
+  <translator><first-name>Olena</first-name><last-name>Bormashenko</last-name></translator>
+  <sequence name="Noon Universe" number="7"/>
+ </title-info>
+ <document-info><author><nickname>scanner</nickname></author></document-info>
+</description>
+<body><p>The body is not read</body>
+</FictionBook>`
+
+func TestReadFB2Info(t *testing.T) {
+	b, err := readBookInfo("picnic.fb2", int64(len(testFB2)), strings.NewReader(testFB2))
+	if err != nil {
+		t.Fatalf("read FB2: %v", err)
+	}
+	expect := &book.Book{
+		Title:    "Roadside Picnic",
+		Lang:     "en",
+		Genres:   []string{"sf", "adventure"},
+		Keywords: []string{"zone", "stalker"},
+		Author:   []book.Author{{FirstName: "Arkady", LastName: "Strugatsky"}, {LastName: "Boris"}},
+		Series:   &book.SeriesInfo{Name: "Noon Universe", SeriesNo: 7},
+		Format:   "fb2",
+	}
+	if !reflect.DeepEqual(b, expect) {
+		t.Errorf("expected %+v, got %+v", expect, b)
+	}
+
+	if _, err := readFB2Info(strings.NewReader(`<FictionBook><description/></FictionBook>`)); err == nil {
+		t.Error("expected an error for a book without a title")
+	}
+	if _, err := readBookInfo("notes.txt", 1, strings.NewReader("x")); err != errNotABook {
+		t.Errorf("expected errNotABook, got %v", err)
+	}
+}
+
+// testEPUB returns an EPUB whose package document has the given metadata
+func testEPUB(t *testing.T, metadata string) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	for name, content := range map[string]string{
+		"mimetype": "application/epub+zip",
+		"META-INF/container.xml": `<?xml version="1.0"?>
+<container version="1.0" xmlns="urn:oasis:names:tc:opendocument:xmlns:container">
+ <rootfiles><rootfile full-path="OEBPS/content.opf" media-type="application/oebps-package+xml"/></rootfiles>
+</container>`,
+		"OEBPS/content.opf": `<?xml version="1.0"?>
+<package xmlns="http://www.idpf.org/2007/opf" xmlns:opf="http://www.idpf.org/2007/opf" version="3.0">
+ <metadata xmlns:dc="http://purl.org/dc/elements/1.1/">` + metadata + `</metadata>
+</package>`,
+	} {
+		w, _ := zw.Create(name)
+		w.Write([]byte(content))
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestReadEPUBInfo(t *testing.T) {
+	tests := []struct {
+		name     string
+		metadata string
+		expect   *book.Book
+	}{
+		{
+			name: "EPUB 2 with calibre series",
+			metadata: `<dc:title>Hard to Be a God</dc:title>
+			<dc:creator opf:role="aut" opf:file-as="Strugatsky, Arkady Natanovich">Arkady Strugatsky</dc:creator>
+			<dc:creator opf:role="trl">Someone Else</dc:creator>
+			<dc:language>ru-RU</dc:language>
+			<dc:subject>Science fiction</dc:subject>
+			<meta name="calibre:series" content="Noon Universe"/>
+			<meta name="calibre:series_index" content="3.0"/>`,
+			expect: &book.Book{
+				Title:    "Hard to Be a God",
+				Lang:     "ru",
+				Keywords: []string{"Science fiction"},
+				Author:   []book.Author{{FirstName: "Arkady", MiddleName: "Natanovich", LastName: "Strugatsky"}},
+				Series:   &book.SeriesInfo{Name: "Noon Universe", SeriesNo: 3},
+				Format:   "epub",
+			},
+		},
+		{
+			name: "EPUB 3 with refinements",
+			metadata: `<dc:title>Monday Begins on Saturday</dc:title>
+			<dc:creator id="a1">Boris Strugatsky</dc:creator>
+			<meta refines="#a1" property="role">aut</meta>
+			<dc:creator id="i1">An Illustrator</dc:creator>
+			<meta refines="#i1" property="role">ill</meta>
+			<dc:language>en</dc:language>
+			<meta property="belongs-to-collection" id="c1">NIICHAVO</meta>
+			<meta refines="#c1" property="collection-type">series</meta>
+			<meta refines="#c1" property="group-position">1</meta>`,
+			expect: &book.Book{
+				Title:  "Monday Begins on Saturday",
+				Lang:   "en",
+				Author: []book.Author{{FirstName: "Boris", LastName: "Strugatsky"}},
+				Series: &book.SeriesInfo{Name: "NIICHAVO", SeriesNo: 1},
+				Format: "epub",
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			data := testEPUB(t, tt.metadata)
+			// Read through a plain reader, as from an archive
+			b, err := readBookInfo("book.epub", int64(len(data)), struct{ *bytes.Buffer }{bytes.NewBuffer(data)})
+			if err != nil {
+				t.Fatalf("read EPUB: %v", err)
+			}
+			if !reflect.DeepEqual(b, tt.expect) {
+				t.Errorf("expected %+v, got %+v", tt.expect, b)
+			}
+		})
+	}
+
+	if _, err := readEPUBInfo(bytes.NewReader([]byte("not a zip")), 9); err == nil {
+		t.Error("expected an error for a broken EPUB")
+	}
+}
@@ -0,0 +1,801 @@
+package scanner
+
+import (
+	"bufio"
+	"bytes"
+	"compress/zlib"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"unicode/utf16"
+	"unicode/utf8"
+
+	"github.com/htol/bopds/book"
+)
+
+// A PDF describes itself in its document information dictionary, named by
+// the trailer of its newest cross-reference section. Only as much of the
+// file format is read as it takes to find that dictionary and the document
+// language: cross-reference tables and streams, and object streams, with
+// Flate compression.
+
+// pdfTailSize is how much of the end of a PDF is searched for startxref
+const pdfTailSize = 1024
+
+// maxPDFStreamSize caps decompressed cross-reference and object streams
+const maxPDFStreamSize = 16 << 20
+
+// maxPDFDepth caps how deeply arrays and dictionaries nest and how many
+// references are resolved within one another, so that crafted files fail
+// instead of exhausting the stack
+const maxPDFDepth = 64
+
+var errPDFSyntax = errors.New("malformed PDF")
+
+// PDF objects other than numbers (int64, float64) and booleans, which are
+// read as keywords
+type (
+	pdfName    string
+	pdfString  string // raw bytes of a literal or hexadecimal string
+	pdfKeyword string // also the delimiters "[", "]", "<<" and ">>"
+	pdfArray   []any
+	pdfDict    map[pdfName]any
+	pdfRef     struct{ num, gen int }
+)
+
+// pdfObjLoc locates an object: at offset in the file, or at index in the
+// object stream numbered stream
+type pdfObjLoc struct {
+	offset int64
+	stream int
+	index  int
+}
+
+type pdfFile struct {
+	r       io.ReaderAt
+	size    int64
+	xref    map[int]pdfObjLoc
+	trailer pdfDict
+
+	// resolving holds the objects being resolved, to catch references that
+	// lead back to themselves, e.g. through a stream's Length
+	resolving map[int]bool
+}
+
+// readPDFInfo reads the title, authors and keywords of the document
+// information dictionary of a PDF and the language of its catalog. The
+// title is empty for PDFs that do not give one.
+func readPDFInfo(r io.ReaderAt, size int64) (*book.Book, error) {
+	f := &pdfFile{r: r, size: size, xref: make(map[int]pdfObjLoc), resolving: make(map[int]bool)}
+	if err := f.loadXref(); err != nil {
+		return nil, fmt.Errorf("parse PDF: %w", err)
+	}
+	if f.trailer["Encrypt"] != nil {
+		return nil, fmt.Errorf("parse PDF: document is encrypted")
+	}
+
+	b := &book.Book{}
+	info, err := f.resolve(f.trailer["Info"])
+	if err != nil {
+		return nil, fmt.Errorf("parse PDF info: %w", err)
+	}
+	if info, ok := info.(pdfDict); ok {
+		b.Title = f.text(info["Title"])
+		// Authors are commonly separated by semicolons; "Tolstoy, Leo" is
+		// one author
+		for _, name := range strings.Split(f.text(info["Author"]), ";") {
+			fileAs := ""
+			if strings.Contains(name, ",") {
+				name, fileAs = "", name
+			}
+			if a, ok := parseCreator(name, fileAs); ok {
+				b.Author = append(b.Author, a)
+			}
+		}
+		if keywords := f.text(info["Keywords"]); keywords != "" {
+			b.Keywords = parseKeywords(keywords)
+		}
+	}
+	if root, err := f.resolve(f.trailer["Root"]); err == nil {
+		if root, ok := root.(pdfDict); ok {
+			lang, _, _ := strings.Cut(f.text(root["Lang"]), "-")
+			b.Lang = strings.ToLower(lang)
+		}
+	}
+	return b, nil
+}
+
+// loadXref reads the cross-reference sections from the newest, at
+// startxref, back through the older ones, keeping the newest location of
+// every object and the newest trailer
+func (f *pdfFile) loadXref() error {
+	tail := make([]byte, min(f.size, pdfTailSize))
+	if _, err := f.r.ReadAt(tail, f.size-int64(len(tail))); err != nil && err != io.EOF {
+		return err
+	}
+	i := bytes.LastIndex(tail, []byte("startxref"))
+	if i < 0 {
+		return fmt.Errorf("%w: no startxref", errPDFSyntax)
+	}
+	fields := bytes.Fields(tail[i+len("startxref"):])
+	if len(fields) == 0 {
+		return fmt.Errorf("%w: no startxref", errPDFSyntax)
+	}
+	offset, err := strconv.ParseInt(string(fields[0]), 10, 64)
+	if err != nil {
+		return fmt.Errorf("%w: bad startxref", errPDFSyntax)
+	}
+
+	seen := make(map[int64]bool)
+	for !seen[offset] {
+		seen[offset] = true
+		trailer, err := f.readXrefSection(offset)
+		if err != nil {
+			return err
+		}
+		if f.trailer == nil {
+			f.trailer = trailer
+		}
+		// Files readable by old readers keep compressed objects in a
+		// cross-reference stream named by the trailer
+		if stm, ok := trailer["XRefStm"].(int64); ok && !seen[stm] {
+			seen[stm] = true
+			if _, err := f.readXrefSection(stm); err != nil {
+				return err
+			}
+		}
+		prev, ok := trailer["Prev"].(int64)
+		if !ok {
+			break
+		}
+		offset = prev
+	}
+	return nil
+}
+
+// readXrefSection reads the cross-reference table or stream at offset and
+// returns its trailer, the stream dictionary for a stream
+func (f *pdfFile) readXrefSection(offset int64) (pdfDict, error) {
+	if offset < 0 || offset >= f.size {
+		return nil, fmt.Errorf("%w: cross-reference offset %d out of range", errPDFSyntax, offset)
+	}
+	l := newPDFLexer(io.NewSectionReader(f.r, offset, f.size-offset))
+	if t, err := l.token(); err != nil {
+		return nil, err
+	} else if t != pdfKeyword("xref") {
+		return f.readXrefStream(offset)
+	}
+
+	for {
+		t, err := l.token()
+		if err != nil {
+			return nil, err
+		}
+		if t == pdfKeyword("trailer") {
+			obj, err := l.object()
+			if err != nil {
+				return nil, err
+			}
+			trailer, ok := obj.(pdfDict)
+			if !ok {
+				return nil, fmt.Errorf("%w: bad trailer", errPDFSyntax)
+			}
+			return trailer, nil
+		}
+		start, ok := t.(int64)
+		count, err := l.int()
+		if !ok || err != nil {
+			return nil, fmt.Errorf("%w: bad cross-reference table", errPDFSyntax)
+		}
+		for i := range count {
+			off, err := l.int()
+			if err != nil {
+				return nil, err
+			}
+			if _, err := l.int(); err != nil {
+				return nil, err
+			}
+			kind, err := l.token()
+			if err != nil {
+				return nil, err
+			}
+			if kind == pdfKeyword("n") {
+				f.setXref(int(start+i), pdfObjLoc{offset: off})
+			}
+		}
+	}
+}
+
+// readXrefStream reads the cross-reference stream object at offset
+func (f *pdfFile) readXrefStream(offset int64) (pdfDict, error) {
+	obj, l, err := f.objectAt(offset)
+	if err != nil {
+		return nil, err
+	}
+	dict, ok := obj.(pdfDict)
+	if !ok || dict["Type"] != pdfName("XRef") {
+		return nil, fmt.Errorf("%w: no cross-reference at %d", errPDFSyntax, offset)
+	}
+	data, err := f.streamData(l, dict)
+	if err != nil {
+		return nil, err
+	}
+
+	var w [3]int
+	widths, _ := dict["W"].(pdfArray)
+	if len(widths) != 3 {
+		return nil, fmt.Errorf("%w: bad cross-reference stream widths", errPDFSyntax)
+	}
+	for i, v := range widths {
+		n, ok := v.(int64)
+		if !ok || n < 0 || n > 8 {
+			return nil, fmt.Errorf("%w: bad cross-reference stream widths", errPDFSyntax)
+		}
+		w[i] = int(n)
+	}
+	index, _ := dict["Index"].(pdfArray)
+	if index == nil {
+		index = pdfArray{int64(0), dict["Size"]}
+	}
+
+	field := func(b []byte) int64 {
+		var v int64
+		for _, c := range b {
+			v = v<<8 | int64(c)
+		}
+		return v
+	}
+	entry := w[0] + w[1] + w[2]
+	pos := 0
+	for i := 0; i+1 < len(index); i += 2 {
+		start, ok1 := index[i].(int64)
+		count, ok2 := index[i+1].(int64)
+		if !ok1 || !ok2 {
+			return nil, fmt.Errorf("%w: bad cross-reference stream index", errPDFSyntax)
+		}
+		for n := range count {
+			if pos+entry > len(data) {
+				return dict, nil
+			}
+			e := data[pos : pos+entry]
+			pos += entry
+			kind := int64(1) // the type field may be left out
+			if w[0] > 0 {
+				kind = field(e[:w[0]])
+			}
+			f2, f3 := field(e[w[0]:w[0]+w[1]]), field(e[w[0]+w[1]:])
+			switch kind {
+			case 1:
+				f.setXref(int(start+n), pdfObjLoc{offset: f2})
+			case 2:
+				f.setXref(int(start+n), pdfObjLoc{stream: int(f2), index: int(f3)})
+			}
+		}
+	}
+	return dict, nil
+}
+
+// setXref records where object num is unless a newer section said so
+func (f *pdfFile) setXref(num int, loc pdfObjLoc) {
+	if _, ok := f.xref[num]; !ok {
+		f.xref[num] = loc
+	}
+}
+
+// objectAt reads the indirect object "num gen obj ... " at offset. The
+// lexer returned is positioned after the object, at the stream it may have.
+func (f *pdfFile) objectAt(offset int64) (any, *pdfLexer, error) {
+	if offset < 0 || offset >= f.size {
+		return nil, nil, fmt.Errorf("%w: object offset %d out of range", errPDFSyntax, offset)
+	}
+	l := newPDFLexer(io.NewSectionReader(f.r, offset, f.size-offset))
+	if _, err := l.int(); err != nil {
+		return nil, nil, err
+	}
+	if _, err := l.int(); err != nil {
+		return nil, nil, err
+	}
+	if t, err := l.token(); err != nil || t != pdfKeyword("obj") {
+		return nil, nil, fmt.Errorf("%w: no object at %d", errPDFSyntax, offset)
+	}
+	obj, err := l.object()
+	return obj, l, err
+}
+
+// resolve returns the object v refers to, or v itself when it is not a
+// reference. Missing objects are null, returned as nil.
+func (f *pdfFile) resolve(v any) (any, error) {
+	ref, ok := v.(pdfRef)
+	if !ok {
+		return v, nil
+	}
+	loc, ok := f.xref[ref.num]
+	if !ok {
+		return nil, nil
+	}
+	if f.resolving[ref.num] {
+		return nil, fmt.Errorf("%w: object %d refers to itself", errPDFSyntax, ref.num)
+	}
+	if len(f.resolving) >= maxPDFDepth {
+		return nil, fmt.Errorf("%w: references nested too deeply", errPDFSyntax)
+	}
+	f.resolving[ref.num] = true
+	defer delete(f.resolving, ref.num)
+
+	if loc.stream == 0 {
+		obj, _, err := f.objectAt(loc.offset)
+		return obj, err
+	}
+
+	// Compressed in an object stream, itself never compressed
+	stmLoc, ok := f.xref[loc.stream]
+	if !ok || stmLoc.stream != 0 {
+		return nil, fmt.Errorf("%w: object stream %d not found", errPDFSyntax, loc.stream)
+	}
+	obj, l, err := f.objectAt(stmLoc.offset)
+	if err != nil {
+		return nil, err
+	}
+	dict, ok := obj.(pdfDict)
+	if !ok {
+		return nil, fmt.Errorf("%w: bad object stream %d", errPDFSyntax, loc.stream)
+	}
+	data, err := f.streamData(l, dict)
+	if err != nil {
+		return nil, err
+	}
+	n, _ := dict["N"].(int64)
+	first, _ := dict["First"].(int64)
+	header := newPDFLexer(bytes.NewReader(data))
+	for i := range n {
+		num, err := header.int()
+		if err != nil {
+			return nil, err
+		}
+		off, err := header.int()
+		if err != nil {
+			return nil, err
+		}
+		if i == int64(loc.index) && num == int64(ref.num) {
+			if first+off < 0 || first+off >= int64(len(data)) {
+				break
+			}
+			return newPDFLexer(bytes.NewReader(data[first+off:])).object()
+		}
+	}
+	return nil, fmt.Errorf("%w: object %d not in object stream %d", errPDFSyntax, ref.num, loc.stream)
+}
+
+// streamData reads and decodes the stream that follows dict
+func (f *pdfFile) streamData(l *pdfLexer, dict pdfDict) ([]byte, error) {
+	if t, err := l.token(); err != nil || t != pdfKeyword("stream") {
+		return nil, fmt.Errorf("%w: no stream", errPDFSyntax)
+	}
+	// The keyword ends with CRLF or LF
+	if c, err := l.br.ReadByte(); err == nil && c == '\r' {
+		c, err = l.br.ReadByte()
+		if err == nil && c != '\n' {
+			l.br.UnreadByte()
+		}
+	} else if err == nil && c != '\n' {
+		l.br.UnreadByte()
+	}
+	length, err := f.resolve(dict["Length"])
+	if err != nil {
+		return nil, err
+	}
+	n, ok := length.(int64)
+	if !ok || n < 0 || n > f.size {
+		return nil, fmt.Errorf("%w: bad stream length", errPDFSyntax)
+	}
+	data := make([]byte, n)
+	if _, err := io.ReadFull(l.br, data); err != nil {
+		return nil, fmt.Errorf("read stream: %w", err)
+	}
+
+	var filters pdfArray
+	switch filter := dict["Filter"].(type) {
+	case nil:
+	case pdfName:
+		filters = pdfArray{filter}
+	case pdfArray:
+		filters = filter
+	}
+	if len(filters) == 0 {
+		return data, nil
+	}
+	if len(filters) > 1 || filters[0] != pdfName("FlateDecode") {
+		return nil, fmt.Errorf("unsupported PDF stream filter %v", filters)
+	}
+	zr, err := zlib.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, fmt.Errorf("decompress stream: %w", err)
+	}
+	data, err = io.ReadAll(io.LimitReader(zr, maxPDFStreamSize))
+	if err != nil && !errors.Is(err, io.ErrUnexpectedEOF) {
+		return nil, fmt.Errorf("decompress stream: %w", err)
+	}
+
+	params, _ := dict["DecodeParms"].(pdfDict)
+	if predictor, _ := params["Predictor"].(int64); predictor >= 10 {
+		columns, ok := params["Columns"].(int64)
+		if !ok {
+			columns = 1
+		}
+		return pngUnpredict(data, int(columns))
+	}
+	return data, nil
+}
+
+// pngUnpredict reverses the PNG predictors applied to rows of columns
+// bytes, each prefixed with the predictor used
+func pngUnpredict(data []byte, columns int) ([]byte, error) {
+	if columns <= 0 {
+		return nil, fmt.Errorf("%w: bad predictor columns", errPDFSyntax)
+	}
+	out := make([]byte, 0, len(data)/(columns+1)*columns)
+	prev := make([]byte, columns)
+	for i := 0; i+columns+1 <= len(data); i += columns + 1 {
+		predictor, row := data[i], data[i+1:i+columns+1]
+		for j := range row {
+			var left, upLeft byte
+			if j > 0 {
+				left, upLeft = row[j-1], prev[j-1]
+			}
+			up := prev[j]
+			switch predictor {
+			case 0:
+			case 1:
+				row[j] += left
+			case 2:
+				row[j] += up
+			case 3:
+				row[j] += byte((int(left) + int(up)) / 2)
+			case 4:
+				row[j] += paeth(left, up, upLeft)
+			default:
+				return nil, fmt.Errorf("%w: unknown PNG predictor %d", errPDFSyntax, predictor)
+			}
+		}
+		out = append(out, row...)
+		prev = row
+	}
+	return out, nil
+}
+
+func paeth(a, b, c byte) byte {
+	p := int(a) + int(b) - int(c)
+	pa, pb, pc := abs(p-int(a)), abs(p-int(b)), abs(p-int(c))
+	switch {
+	case pa <= pb && pa <= pc:
+		return a
+	case pb <= pc:
+		return b
+	}
+	return c
+}
+
+func abs(x int) int {
+	if x < 0 {
+		return -x
+	}
+	return x
+}
+
+// text returns the text string v, or refers to, as UTF-8
+func (f *pdfFile) text(v any) string {
+	v, err := f.resolve(v)
+	if err != nil {
+		return ""
+	}
+	s, ok := v.(pdfString)
+	if !ok {
+		return ""
+	}
+	return strings.TrimSpace(strings.Trim(decodePDFText(string(s)), "\x00"))
+}
+
+// decodePDFText decodes a PDF text string: UTF-16BE or UTF-8 with a byte
+// order mark, else PDFDocEncoding, read as Latin-1. Producers that write
+// UTF-8 without the mark are common enough to take valid UTF-8 as such.
+func decodePDFText(s string) string {
+	switch {
+	case strings.HasPrefix(s, "\xfe\xff"):
+		u := make([]uint16, 0, len(s)/2)
+		for i := 2; i+1 < len(s); i += 2 {
+			u = append(u, uint16(s[i])<<8|uint16(s[i+1]))
+		}
+		return string(utf16.Decode(u))
+	case strings.HasPrefix(s, "\xef\xbb\xbf"):
+		return s[3:]
+	case utf8.ValidString(s):
+		return s
+	}
+	r := make([]rune, len(s))
+	for i := range len(s) {
+		r[i] = rune(s[i])
+	}
+	return string(r)
+}
+
+// pdfLexer splits PDF syntax into tokens and parses objects
+type pdfLexer struct {
+	br     *bufio.Reader
+	unread []any // tokens put back, the last one read first
+	depth  int   // arrays and dictionaries being parsed
+}
+
+func newPDFLexer(r io.Reader) *pdfLexer {
+	return &pdfLexer{br: bufio.NewReader(r)}
+}
+
+func isPDFSpace(c byte) bool {
+	switch c {
+	case 0, '\t', '\n', '\f', '\r', ' ':
+		return true
+	}
+	return false
+}
+
+func isPDFDelimiter(c byte) bool {
+	return strings.IndexByte("()<>[]{}/%", c) >= 0
+}
+
+// token returns the next number, name, string or keyword
+func (l *pdfLexer) token() (any, error) {
+	if n := len(l.unread); n > 0 {
+		t := l.unread[n-1]
+		l.unread = l.unread[:n-1]
+		return t, nil
+	}
+
+	c, err := l.br.ReadByte()
+	for err == nil && (isPDFSpace(c) || c == '%') {
+		if c == '%' {
+			// A comment runs to the end of the line
+			for err == nil && c != '\n' && c != '\r' {
+				c, err = l.br.ReadByte()
+			}
+			continue
+		}
+		c, err = l.br.ReadByte()
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	switch c {
+	case '[', ']', '{', '}':
+		return pdfKeyword([]byte{c}), nil
+	case '<':
+		if next, err := l.br.ReadByte(); err == nil && next == '<' {
+			return pdfKeyword("<<"), nil
+		} else if err == nil {
+			l.br.UnreadByte()
+		}
+		return l.hexString()
+	case '>':
+		if next, err := l.br.ReadByte(); err != nil || next != '>' {
+			return nil, fmt.Errorf("%w: stray '>'", errPDFSyntax)
+		}
+		return pdfKeyword(">>"), nil
+	case '(':
+		return l.literalString()
+	case '/':
+		// #xx escapes a character
+		name := []byte(l.regular())
+		for i := 0; i+2 < len(name); i++ {
+			if name[i] == '#' {
+				if v, err := strconv.ParseUint(string(name[i+1:i+3]), 16, 8); err == nil {
+					name = append(append(name[:i], byte(v)), name[i+3:]...)
+				}
+			}
+		}
+		return pdfName(name), nil
+	}
+	l.br.UnreadByte()
+	word := l.regular()
+	if word == "" {
+		return nil, fmt.Errorf("%w: unexpected %q", errPDFSyntax, c)
+	}
+	if n, err := strconv.ParseInt(word, 10, 64); err == nil {
+		return n, nil
+	}
+	if f, err := strconv.ParseFloat(word, 64); err == nil {
+		return f, nil
+	}
+	return pdfKeyword(word), nil
+}
+
+// regular reads a run of regular characters
+func (l *pdfLexer) regular() string {
+	var sb strings.Builder
+	for {
+		c, err := l.br.ReadByte()
+		if err != nil {
+			break
+		}
+		if isPDFSpace(c) || isPDFDelimiter(c) {
+			l.br.UnreadByte()
+			break
+		}
+		sb.WriteByte(c)
+	}
+	return sb.String()
+}
+
+// literalString reads a (string) after its opening parenthesis
+func (l *pdfLexer) literalString() (pdfString, error) {
+	var sb strings.Builder
+	depth := 1
+	for {
+		c, err := l.br.ReadByte()
+		if err != nil {
+			return "", fmt.Errorf("%w: unterminated string", errPDFSyntax)
+		}
+		switch c {
+		case '(':
+			depth++
+		case ')':
+			if depth--; depth == 0 {
+				return pdfString(sb.String()), nil
+			}
+		case '\\':
+			if c, err = l.br.ReadByte(); err != nil {
+				return "", fmt.Errorf("%w: unterminated string", errPDFSyntax)
+			}
+			switch c {
+			case 'n':
+				c = '\n'
+			case 'r':
+				c = '\r'
+			case 't':
+				c = '\t'
+			case 'b':
+				c = '\b'
+			case 'f':
+				c = '\f'
+			case '\r':
+				// A backslash at the end of a line continues the string
+				if next, err := l.br.ReadByte(); err == nil && next != '\n' {
+					l.br.UnreadByte()
+				}
+				continue
+			case '\n':
+				continue
+			default:
+				if c >= '0' && c <= '7' {
+					v := int(c - '0')
+					for range 2 {
+						next, err := l.br.ReadByte()
+						if err != nil || next < '0' || next > '7' {
+							if err == nil {
+								l.br.UnreadByte()
+							}
+							break
+						}
+						v = v*8 + int(next-'0')
+					}
+					c = byte(v)
+				}
+			}
+		}
+		sb.WriteByte(c)
+	}
+}
+
+// hexString reads a <hex string> after its opening bracket
+func (l *pdfLexer) hexString() (pdfString, error) {
+	var digits []byte
+	for {
+		c, err := l.br.ReadByte()
+		if err != nil {
+			return "", fmt.Errorf("%w: unterminated string", errPDFSyntax)
+		}
+		if c == '>' {
+			break
+		}
+		if !isPDFSpace(c) {
+			digits = append(digits, c)
+		}
+	}
+	if len(digits)%2 == 1 {
+		digits = append(digits, '0')
+	}
+	s := make([]byte, len(digits)/2)
+	for i := range s {
+		v, err := strconv.ParseUint(string(digits[2*i:2*i+2]), 16, 8)
+		if err != nil {
+			return "", fmt.Errorf("%w: bad hex string", errPDFSyntax)
+		}
+		s[i] = byte(v)
+	}
+	return pdfString(s), nil
+}
+
+// int reads an integer token
+func (l *pdfLexer) int() (int64, error) {
+	t, err := l.token()
+	if err != nil {
+		return 0, err
+	}
+	n, ok := t.(int64)
+	if !ok {
+		return 0, fmt.Errorf("%w: expected an integer, got %v", errPDFSyntax, t)
+	}
+	return n, nil
+}
+
+// object parses the next object: a dictionary, an array, a reference
+// "num gen R" or a single token
+func (l *pdfLexer) object() (any, error) {
+	t, err := l.token()
+	if err != nil {
+		return nil, err
+	}
+	switch t := t.(type) {
+	case pdfKeyword:
+		if t == "<<" || t == "[" {
+			if l.depth >= maxPDFDepth {
+				return nil, fmt.Errorf("%w: objects nested too deeply", errPDFSyntax)
+			}
+			l.depth++
+			defer func() { l.depth-- }()
+		}
+		switch t {
+		case "<<":
+			dict := make(pdfDict)
+			for {
+				key, err := l.token()
+				if err != nil {
+					return nil, err
+				}
+				if key == pdfKeyword(">>") {
+					return dict, nil
+				}
+				name, ok := key.(pdfName)
+				if !ok {
+					return nil, fmt.Errorf("%w: dictionary key %v", errPDFSyntax, key)
+				}
+				if dict[name], err = l.object(); err != nil {
+					return nil, err
+				}
+			}
+		case "[":
+			array := pdfArray{}
+			for {
+				next, err := l.token()
+				if err != nil {
+					return nil, err
+				}
+				if next == pdfKeyword("]") {
+					return array, nil
+				}
+				l.unread = append(l.unread, next)
+				v, err := l.object()
+				if err != nil {
+					return nil, err
+				}
+				array = append(array, v)
+			}
+		}
+	case int64:
+		gen, err := l.token()
+		if err != nil {
+			return t, nil
+		}
+		if g, ok := gen.(int64); ok {
+			r, err := l.token()
+			if err == nil && r == pdfKeyword("R") {
+				return pdfRef{int(t), int(g)}, nil
+			}
+			if err == nil {
+				l.unread = append(l.unread, r)
+			}
+		}
+		l.unread = append(l.unread, gen)
+	}
+	return t, nil
+}
@@ -0,0 +1,217 @@
+package scanner
+
+import (
+	"bytes"
+	"compress/zlib"
+	"errors"
+	"fmt"
+	"reflect"
+	"regexp"
+	"strings"
+	"testing"
+	"unicode/utf16"
+
+	"github.com/htol/bopds/book"
+)
+
+// writePDF returns a PDF of the objects, numbered from 1, with a
+// cross-reference table
+func writePDF(objects []string, trailer string) []byte {
+	var buf bytes.Buffer
+	buf.WriteString("%PDF-1.4\n%\xe2\xe3\xcf\xd3\n")
+	offsets := make([]int, len(objects))
+	for i, obj := range objects {
+		offsets[i] = buf.Len()
+		fmt.Fprintf(&buf, "%d 0 obj\n%s\nendobj\n", i+1, obj)
+	}
+	xref := buf.Len()
+	fmt.Fprintf(&buf, "xref\n0 %d\n0000000000 65535 f \n", len(objects)+1)
+	for _, off := range offsets {
+		fmt.Fprintf(&buf, "%010d 00000 n \n", off)
+	}
+	fmt.Fprintf(&buf, "trailer\n%s\nstartxref\n%d\n%%%%EOF\n", trailer, xref)
+	return buf.Bytes()
+}
+
+// writeCompressedPDF returns a PDF 1.5 keeping the objects, numbered from 1,
+// in an object stream, indexed by a cross-reference stream with the PNG Up
+// predictor
+func writeCompressedPDF(objects []string, trailer string) []byte {
+	var header, body bytes.Buffer
+	for i, obj := range objects {
+		fmt.Fprintf(&header, "%d %d ", i+1, body.Len())
+		body.WriteString(obj + "\n")
+	}
+	stm, xrefStm := len(objects)+1, len(objects)+2
+
+	var buf bytes.Buffer
+	buf.WriteString("%PDF-1.5\n")
+	stmOffset := buf.Len()
+	fmt.Fprintf(&buf, "%d 0 obj\n<< /Type /ObjStm /N %d /First %d /Length %d >>\nstream\n%s%s\nendstream\nendobj\n",
+		stm, len(objects), header.Len(), header.Len()+body.Len(), header.String(), body.String())
+	xrefOffset := buf.Len()
+
+	// Rows of type (1 byte), offset or object stream (2) and index (1)
+	rows := [][]byte{{0, 0, 0, 0}}
+	for i := range objects {
+		rows = append(rows, []byte{2, 0, byte(stm), byte(i)})
+	}
+	rows = append(rows,
+		[]byte{1, byte(stmOffset >> 8), byte(stmOffset), 0},
+		[]byte{1, byte(xrefOffset >> 8), byte(xrefOffset), 0},
+	)
+	var predicted bytes.Buffer
+	prev := make([]byte, 4)
+	for _, row := range rows {
+		predicted.WriteByte(2)
+		for j := range row {
+			predicted.WriteByte(row[j] - prev[j])
+		}
+		prev = row
+	}
+	var data bytes.Buffer
+	zw := zlib.NewWriter(&data)
+	zw.Write(predicted.Bytes())
+	zw.Close()
+
+	fmt.Fprintf(&buf, "%d 0 obj\n<< /Type /XRef /Size %d /W [1 2 1] %s /Filter /FlateDecode /DecodeParms << /Predictor 12 /Columns 4 >> /Length %d >>\nstream\r\n",
+		xrefStm, xrefStm+1, strings.Trim(trailer, "<> "), data.Len())
+	buf.Write(data.Bytes())
+	fmt.Fprintf(&buf, "\nendstream\nendobj\nstartxref\n%d\n%%%%EOF\n", xrefOffset)
+	return buf.Bytes()
+}
+
+// utf16Hex returns s as a hexadecimal UTF-16BE PDF text string
+func utf16Hex(s string) string {
+	var sb strings.Builder
+	sb.WriteString("<FEFF")
+	for _, u := range utf16.Encode([]rune(s)) {
+		fmt.Fprintf(&sb, "%04X", u)
+	}
+	sb.WriteString(">")
+	return sb.String()
+}
+
+func TestReadPDFInfo(t *testing.T) {
+	tests := []struct {
+		name   string
+		data   []byte
+		expect *book.Book
+	}{
+		{
+			name: "cross-reference table",
+			data: writePDF([]string{
+				`<< /Type /Catalog /Pages 2 0 R /Lang (en-US) >>`,
+				`<< /Type /Pages /Kids [] /Count 0 >>`,
+				`<< /Title (Roadside Picnic \(1972\)) /Author (Arkady Strugatsky; Boris Strugatsky) /Keywords (zone, stalker) >>`,
+			}, `<< /Size 4 /Root 1 0 R /Info 3 0 R >>`),
+			expect: &book.Book{
+				Title:    "Roadside Picnic (1972)",
+				Lang:     "en",
+				Keywords: []string{"zone", "stalker"},
+				Author:   []book.Author{{FirstName: "Arkady", LastName: "Strugatsky"}, {FirstName: "Boris", LastName: "Strugatsky"}},
+			},
+		},
+		{
+			name: "object and cross-reference streams",
+			data: writeCompressedPDF([]string{
+				`<< /Type /Catalog /Lang (ru) >>`,
+				`<< /Title ` + utf16Hex("Пикник на обочине") + ` /Author (Strugatsky, Arkady Natanovich) >>`,
+			}, `<< /Root 1 0 R /Info 2 0 R >>`),
+			expect: &book.Book{
+				Title:  "Пикник на обочине",
+				Lang:   "ru",
+				Author: []book.Author{{FirstName: "Arkady", MiddleName: "Natanovich", LastName: "Strugatsky"}},
+			},
+		},
+		{
+			name:   "no information dictionary",
+			data:   writePDF([]string{`<< /Type /Catalog >>`}, `<< /Size 2 /Root 1 0 R >>`),
+			expect: &book.Book{},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b, err := readPDFInfo(bytes.NewReader(tt.data), int64(len(tt.data)))
+			if err != nil {
+				t.Fatalf("read PDF: %v", err)
+			}
+			if !reflect.DeepEqual(b, tt.expect) {
+				t.Errorf("expected %+v, got %+v", tt.expect, b)
+			}
+		})
+	}
+
+	if _, err := readPDFInfo(strings.NewReader("%PDF-1.4 truncated"), 18); err == nil {
+		t.Error("expected an error for a PDF without startxref")
+	}
+}
+
+func TestReadBookInfo_TitleFromFileName(t *testing.T) {
+	encrypted := writePDF([]string{`<< /Type /Catalog >>`, `<< /Title (secret) >>`, `<< /Filter /Standard >>`},
+		`<< /Size 4 /Root 1 0 R /Info 2 0 R /Encrypt 3 0 R >>`)
+	tests := []struct {
+		name   string
+		data   []byte
+		expect *book.Book
+	}{
+		{"scans/Definitely Maybe.pdf", []byte("not a PDF"), &book.Book{Title: "Definitely Maybe", Format: "pdf"}},
+		{"Secret.pdf", encrypted, &book.Book{Title: "Secret", Format: "pdf"}},
+		{"The Doomed City.djvu", []byte("AT&TFORM"), &book.Book{Title: "The Doomed City", Format: "djvu"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// Read through a plain reader, as from an archive
+			b, err := readBookInfo(tt.name, int64(len(tt.data)), struct{ *bytes.Buffer }{bytes.NewBuffer(tt.data)})
+			if err != nil {
+				t.Fatalf("read book: %v", err)
+			}
+			if !reflect.DeepEqual(b, tt.expect) {
+				t.Errorf("expected %+v, got %+v", tt.expect, b)
+			}
+		})
+	}
+}
+
+func TestReadPDFInfo_Malformed(t *testing.T) {
+	// The object stream's Length refers to an object inside the stream; the
+	// padding keeps the Length four digits long, like the reference
+	selfLength := writeCompressedPDF([]string{
+		`<< /Type /Catalog >>`,
+		`<< /Title (` + strings.Repeat("x", 1000) + `) >>`,
+	}, `<< /Root 1 0 R /Info 2 0 R >>`)
+	selfLength = regexp.MustCompile(`/Length \d{4} >>`).ReplaceAll(selfLength, []byte("/Length 2 0 R>>"))
+
+	tests := []struct {
+		name string
+		data []byte
+	}{
+		{"self-referencing stream length", selfLength},
+		{"deeply nested arrays", writePDF([]string{`<< /Type /Catalog >>`, strings.Repeat("[", 100000)},
+			`<< /Size 3 /Root 1 0 R /Info 2 0 R >>`)},
+		{"deeply nested dictionaries", writePDF([]string{`<< /Type /Catalog >>`, strings.Repeat("<< /A ", 100000)},
+			`<< /Size 3 /Root 1 0 R /Info 2 0 R >>`)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := readPDFInfo(bytes.NewReader(tt.data), int64(len(tt.data))); !errors.Is(err, errPDFSyntax) {
+				t.Errorf("expected a syntax error, got %v", err)
+			}
+		})
+	}
+}
+
+func FuzzReadPDFInfo(f *testing.F) {
+	f.Add(writePDF([]string{
+		`<< /Type /Catalog /Lang (en-US) >>`,
+		`<< /Title (Roadside Picnic) /Author (Arkady Strugatsky; Boris Strugatsky) /Keywords [(zone) <7374616C6B6572>] >>`,
+	}, `<< /Size 3 /Root 1 0 R /Info 2 0 R >>`))
+	f.Add(writeCompressedPDF([]string{
+		`<< /Type /Catalog /Lang (ru) >>`,
+		`<< /Title ` + utf16Hex("Пикник на обочине") + ` /Author (Strugatsky, Arkady) >>`,
+	}, `<< /Root 1 0 R /Info 2 0 R >>`))
+	f.Fuzz(func(t *testing.T, data []byte) {
+		// Only panics and hangs fail; malformed files are expected
+		readPDFInfo(bytes.NewReader(data), int64(len(data)))
+	})
+}
@@ -15,7 +15,9 @@ import (
 	"time"
 
 	"github.com/htol/bopds/book"
+	"github.com/htol/bopds/converter"
 	"github.com/htol/bopds/logger"
+	"github.com/htol/bopds/metrics"
 	"golang.org/x/sync/errgroup"
 )
 
@@ -42,25 +44,30 @@ type Storager interface {
 	AddBatch([]*book.Book) error
 }
 
-// ScanLibrary scanning all file names in libraries directories
-func ScanLibrary(basedir string, storage Storager, batchSize int) error {
+// ScanLibrary scanning all file names in libraries directories.
+// Archive paths are recorded relative to basedir under the given library name.
+// Books in archives listed by INPX indexes are described by the index; other
+// books are described by their own metadata (see scanFiles).
+func ScanLibrary(library, basedir string, storage Storager, batchSize int) error {
 	var (
 		files []string
 		inpxs []string
 	)
 
-	exts := map[string]bool{
-		".fb2": true,
-		".zip": true,
-		".7z":  true,
-	}
+	metrics.ScanRunning.WithLabelValues(library).Set(1)
+	defer metrics.ScanRunning.WithLabelValues(library).Set(0)
+	metrics.ScanArchivesTotal.WithLabelValues(library).Set(0)
+	metrics.ScanArchivesDone.WithLabelValues(library).Set(0)
+	booksStored := metrics.ScanBooksStored.WithLabelValues(library)
+	booksStored.Set(0)
+	metrics.ScanUnreadableArchives.WithLabelValues(library).Set(0)
 
 	err := filepath.WalkDir(basedir, func(path string, d fs.DirEntry, err error) error {
 		if err != nil {
 			return err
 		}
 
-		if !d.IsDir() && exts[filepath.Ext(path)] {
+		if !d.IsDir() && isLibraryFile(path) {
 			files = append(files, path)
 		}
 		if !d.IsDir() && (filepath.Ext(path) == ".inpx") {
@@ -82,13 +89,15 @@ func ScanLibrary(basedir string, storage Storager, batchSize int) error {
 	wg.Add(1)
 	g.Go(func() error {
 		defer wg.Done()
+		defer close(entries)
+		listed := make(map[string]bool)
 		if len(inpxs) > 0 {
 			logger.Info("Present indexes", "files", inpxs)
-			if err = checkInpxFiles(ctx, basedir, inpxs, entries); err != nil {
+			if err = checkInpxFiles(ctx, library, basedir, inpxs, listed, entries); err != nil {
 				return err
 			}
 		}
-		return nil
+		return scanFiles(ctx, library, basedir, files, listed, entries)
 	})
 
 	wg.Add(1)
@@ -104,6 +113,8 @@ func ScanLibrary(basedir string, storage Storager, batchSize int) error {
 			if len(batch) >= batchSize {
 				if err := storage.AddBatch(batch); err != nil {
 					logger.Error("failed to add batch", "error", err)
+				} else {
+					booksStored.Add(float64(len(batch)))
 				}
 				// Keep capacity, reset length
 				batch = batch[:0]
@@ -112,6 +123,8 @@ func ScanLibrary(basedir string, storage Storager, batchSize int) error {
 		if len(batch) > 0 {
 			if err := storage.AddBatch(batch); err != nil {
 				logger.Error("failed to add batch", "error", err)
+			} else {
+				booksStored.Add(float64(len(batch)))
 			}
 		}
 	}()
@@ -121,8 +134,13 @@ func ScanLibrary(basedir string, storage Storager, batchSize int) error {
 	return nil
 }
 
-func checkInpxFiles(ctx context.Context, basedir string, files []string, entries chan<- *book.Book) error {
-	defer close(entries)
+// checkInpxFiles sends the books of the INPX indexes to entries, recording
+// the archives they list, relative to basedir, in listed
+func checkInpxFiles(ctx context.Context, library, basedir string, files []string, listed map[string]bool, entries chan<- *book.Book) error {
+
+	archivesTotal := metrics.ScanArchivesTotal.WithLabelValues(library)
+	archivesDone := metrics.ScanArchivesDone.WithLabelValues(library)
+	unreadable := metrics.ScanUnreadableArchives.WithLabelValues(library)
 
 	for _, file := range files {
 		arch, err := zip.OpenReader(file)
@@ -131,6 +149,12 @@ func checkInpxFiles(ctx context.Context, basedir string, files []string, entries
 		}
 		defer arch.Close()
 
+		for _, archiveEntry := range arch.File {
+			if strings.HasSuffix(archiveEntry.Name, ".inp") {
+				archivesTotal.Inc()
+			}
+		}
+
 		for _, archiveEntry := range arch.File {
 			if !strings.HasSuffix(archiveEntry.Name, ".inp") {
 				continue
@@ -139,11 +163,16 @@ func checkInpxFiles(ctx context.Context, basedir string, files []string, entries
 			// don't scan inp if library archive absent
 			// Check for both .zip and .7z archives
 			baseName := strings.TrimSuffix(archiveEntry.Name, ".inp")
-			libArchiveFile := filepath.Join(basedir, baseName+".zip")
+			listed[baseName+".zip"], listed[baseName+".7z"] = true, true
+			relArchive := baseName + ".zip"
+			libArchiveFile := filepath.Join(basedir, relArchive)
 			if _, err := os.Stat(libArchiveFile); errors.Is(err, os.ErrNotExist) {
 				// Try .7z if .zip not found
-				libArchiveFile = filepath.Join(basedir, baseName+".7z")
+				relArchive = baseName + ".7z"
+				libArchiveFile = filepath.Join(basedir, relArchive)
 				if _, err := os.Stat(libArchiveFile); errors.Is(err, os.ErrNotExist) {
+					// Missing archives count as done so progress reaches the total
+					archivesDone.Inc()
 					continue
 				}
 			}
@@ -151,9 +180,18 @@ func checkInpxFiles(ctx context.Context, basedir string, files []string, entries
 			logger.Info("Processing archive", "file", libArchiveFile)
 			startTime := time.Now()
 
+			// The books are listed either way; downloading them needs a 7z binary
+			if err := converter.CheckArchive(libArchiveFile); errors.Is(err, converter.ErrUnsupportedCompression) {
+				unreadable.Inc()
+				logger.Warn("Archive uses compression that cannot be decoded natively", "file", libArchiveFile, "error", err)
+			} else if err != nil {
+				logger.Warn("Failed to check archive", "file", libArchiveFile, "error", err)
+			}
+
 			content, err := archiveEntry.Open()
 			if err != nil {
 				logger.Error("Failed to read file in zip", "entry", archiveEntry.Name, "error", err)
+				archivesDone.Inc()
 				continue
 			}
 			defer content.Close()
@@ -167,7 +205,8 @@ func checkInpxFiles(ctx context.Context, basedir string, files []string, entries
 				}
 				inpEntry := strings.Split(line, string(fieldSeparator))
 				bookEntry := parseInpEntry(inpEntry)
-				bookEntry.Archive = libArchiveFile
+				bookEntry.Archive = relArchive
+				bookEntry.Library = library
 				if bookEntry.Title != "" {
 					select {
 					case entries <- bookEntry:
@@ -180,6 +219,7 @@ func checkInpxFiles(ctx context.Context, basedir string, files []string, entries
 				logger.Error("Scanner error", "entry", archiveEntry.Name, "error", err)
 			}
 			logger.Info("Finished processing archive", "file", libArchiveFile, "duration", time.Since(startTime))
+			archivesDone.Inc()
 		}
 	}
 	return nil
@@ -268,6 +308,7 @@ func parseInpEntry(entry []string) *book.Book {
 
 		case flExt:
 			bookEntry.FileName += "." + field
+			bookEntry.Format = strings.ToLower(field)
 
 		case flDate:
 			bookEntry.DateAdded = field
@@ -0,0 +1,117 @@
+package service
+
+import (
+	"cmp"
+	"context"
+	"fmt"
+	"slices"
+	"strings"
+
+	"github.com/htol/bopds/book"
+	"github.com/htol/bopds/repo"
+	"github.com/htol/bopds/tracing"
+	"go.opentelemetry.io/otel/attribute"
+)
+
+// AuthorBooksView selects and orders the books of an author's page
+type AuthorBooksView string
+
+const (
+	AuthorBooksAll      AuthorBooksView = "all"      // every book, by title
+	AuthorBooksNoSeries AuthorBooksView = "noseries" // books outside any series, by title
+	AuthorBooksRecent   AuthorBooksView = "new"      // every book, most recently added first
+)
+
+// GetAuthorBooks retrieves a page of the author's books in the view.
+// An empty library matches books from every library, no languages books in
+// every language.
+func (s *Service) GetAuthorBooks(ctx context.Context, id int64, library string, languages []string, view AuthorBooksView, limit, offset int) (_ []book.Book, _ int, err error) {
+	ctx, span := tracing.Start(ctx, "Service.GetAuthorBooks", attribute.Int64("author.id", id),
+		attribute.String("library", library), attribute.StringSlice("languages", languages),
+		attribute.String("view", string(view)))
+	defer func() { tracing.End(span, err) }()
+
+	books, _, err := s.GetBooksByAuthorID(ctx, id, library, languages, repo.ListOptions{})
+	if err != nil {
+		return nil, 0, err
+	}
+	switch view {
+	case AuthorBooksAll:
+		slices.SortStableFunc(books, compareTitles)
+	case AuthorBooksNoSeries:
+		books = slices.DeleteFunc(books, func(b book.Book) bool { return b.Series != nil })
+		slices.SortStableFunc(books, compareTitles)
+	case AuthorBooksRecent:
+		slices.SortStableFunc(books, func(a, b book.Book) int {
+			return cmp.Or(strings.Compare(b.DateAdded, a.DateAdded), cmp.Compare(b.BookID, a.BookID))
+		})
+	default:
+		return nil, 0, fmt.Errorf("unknown author books view %q", view)
+	}
+	return paginate(books, limit, offset), len(books), nil
+}
+
+// GetAuthorSeries retrieves the series the author's books belong to, by
+// name, with the number of the author's books in each
+func (s *Service) GetAuthorSeries(ctx context.Context, id int64, library string, languages []string) (_ []book.SeriesWithBookCount, err error) {
+	ctx, span := tracing.Start(ctx, "Service.GetAuthorSeries", attribute.Int64("author.id", id),
+		attribute.String("library", library), attribute.StringSlice("languages", languages))
+	defer func() { tracing.End(span, err) }()
+
+	books, _, err := s.GetBooksByAuthorID(ctx, id, library, languages, repo.ListOptions{})
+	if err != nil {
+		return nil, err
+	}
+	var series []book.SeriesWithBookCount
+	index := make(map[int64]int)
+	for _, b := range books {
+		if b.Series == nil {
+			continue
+		}
+		i, ok := index[b.Series.ID]
+		if !ok {
+			i = len(series)
+			index[b.Series.ID] = i
+			series = append(series, book.SeriesWithBookCount{ID: b.Series.ID, Name: b.Series.Name})
+		}
+		series[i].BookCount++
+	}
+	slices.SortFunc(series, func(a, b book.SeriesWithBookCount) int {
+		return cmp.Or(strings.Compare(strings.ToLower(a.Name), strings.ToLower(b.Name)), cmp.Compare(a.ID, b.ID))
+	})
+	return series, nil
+}
+
+// GetAuthorSeriesBooks retrieves a page of the author's books in the series,
+// in series order
+func (s *Service) GetAuthorSeriesBooks(ctx context.Context, id, seriesID int64, library string, languages []string, limit, offset int) (_ []book.Book, _ int, err error) {
+	ctx, span := tracing.Start(ctx, "Service.GetAuthorSeriesBooks", attribute.Int64("author.id", id),
+		attribute.Int64("series.id", seriesID), attribute.String("library", library),
+		attribute.StringSlice("languages", languages))
+	defer func() { tracing.End(span, err) }()
+
+	books, _, err := s.GetBooksByAuthorID(ctx, id, library, languages, repo.ListOptions{})
+	if err != nil {
+		return nil, 0, err
+	}
+	books = slices.DeleteFunc(books, func(b book.Book) bool { return b.Series == nil || b.Series.ID != seriesID })
+	slices.SortStableFunc(books, func(a, b book.Book) int {
+		return cmp.Or(cmp.Compare(a.Series.SeriesNo, b.Series.SeriesNo), compareTitles(a, b))
+	})
+	return paginate(books, limit, offset), len(books), nil
+}
+
+// compareTitles orders books by title, ignoring case
+func compareTitles(a, b book.Book) int {
+	return strings.Compare(strings.ToLower(a.Title), strings.ToLower(b.Title))
+}
+
+// paginate returns the page of books at offset, of at most limit books;
+// a limit of zero or less means 50
+func paginate(books []book.Book, limit, offset int) []book.Book {
+	if limit <= 0 {
+		limit = 50
+	}
+	offset = min(max(offset, 0), len(books))
+	return books[offset:min(offset+limit, len(books))]
+}
@@ -0,0 +1,261 @@
+package service
+
+import (
+	"archive/zip"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/htol/bopds/book"
+	"github.com/htol/bopds/converter"
+	"github.com/htol/bopds/logger"
+	"github.com/htol/bopds/repo"
+	"github.com/htol/bopds/tracing"
+	"go.opentelemetry.io/otel/attribute"
+)
+
+// ErrBundleTooLarge is returned for bulk downloads exceeding the configured size cap
+var ErrBundleTooLarge = errors.New("bulk download exceeds the size limit")
+
+// Bundle is a set of books downloaded together as one ZIP archive
+type Bundle struct {
+	Name  string // archive file name, without the .zip extension
+	Books []book.Book
+	// folders puts series books in a folder per series, for bundles
+	// spanning several series
+	folders bool
+}
+
+// Filename returns the archive's file name
+func (b *Bundle) Filename() string {
+	return b.Name + ".zip"
+}
+
+// AuthorBundle collects the author's books for a bulk download
+func (s *DownloadService) AuthorBundle(ctx context.Context, authorID int64) (_ *Bundle, err error) {
+	ctx, span := tracing.Start(ctx, "Service.AuthorBundle", attribute.Int64("author.id", authorID))
+	defer func() { tracing.End(span, err) }()
+
+	_, repoSpan := tracing.Start(ctx, "repo.GetAuthorByID")
+	author, err := s.repo.GetAuthorByID(authorID)
+	tracing.End(repoSpan, err)
+	if err != nil {
+		return nil, fmt.Errorf("get author %d: %w", authorID, err)
+	}
+
+	_, repoSpan = tracing.Start(ctx, "repo.GetBooksByAuthorID")
+	books, _, err := s.repo.GetBooksByAuthorID(authorID, "", nil, repo.ListOptions{})
+	tracing.End(repoSpan, err)
+	if err != nil {
+		return nil, fmt.Errorf("get books of author %d: %w", authorID, err)
+	}
+
+	name := converter.SanitizeFilename(converter.FormatAuthorName(*author), "")
+	if name == "" {
+		name = fmt.Sprintf("author-%d", authorID)
+	}
+	return s.newBundle(name, books, true)
+}
+
+// SeriesBundle collects the series' books for a bulk download
+func (s *DownloadService) SeriesBundle(ctx context.Context, seriesID int64) (_ *Bundle, err error) {
+	ctx, span := tracing.Start(ctx, "Service.SeriesBundle", attribute.Int64("series.id", seriesID))
+	defer func() { tracing.End(span, err) }()
+
+	_, repoSpan := tracing.Start(ctx, "repo.GetSeriesByID")
+	series, err := s.repo.GetSeriesByID(seriesID)
+	tracing.End(repoSpan, err)
+	if err != nil {
+		return nil, fmt.Errorf("get series %d: %w", seriesID, err)
+	}
+
+	_, repoSpan = tracing.Start(ctx, "repo.GetBooksBySeriesID")
+	books, err := s.repo.GetBooksBySeriesID(seriesID)
+	tracing.End(repoSpan, err)
+	if err != nil {
+		return nil, fmt.Errorf("get books of series %d: %w", seriesID, err)
+	}
+
+	name := converter.SanitizeFilename(series.Name, "")
+	if name == "" {
+		name = fmt.Sprintf("series-%d", seriesID)
+	}
+	return s.newBundle(name, books, false)
+}
+
+// newBundle refuses bundles whose source files alone exceed the size cap.
+// Converted books are rarely larger than their FB2 source.
+func (s *DownloadService) newBundle(name string, books []book.Book, folders bool) (*Bundle, error) {
+	var size int64
+	for _, b := range books {
+		size += b.FileSize
+	}
+	if limit := s.bundleLimit(); limit > 0 && size > limit {
+		return nil, fmt.Errorf("%w: %d books of %d MiB, limit is %d MiB",
+			ErrBundleTooLarge, len(books), size>>20, s.config.BulkDownload.MaxSize)
+	}
+	return &Bundle{Name: name, Books: books, folders: folders}, nil
+}
+
+// bundleLimit returns the size cap in bytes, 0 meaning unlimited
+func (s *DownloadService) bundleLimit() int64 {
+	return int64(s.config.BulkDownload.MaxSize) << 20
+}
+
+// WriteBundle streams the bundle's books in format as a ZIP archive to w,
+// returning the number of books written. Books that fail to convert, and
+// books left out once the archive reaches the size cap, are listed in a
+// missing.txt entry rather than failing the download, whose headers have
+// been sent by then. Errors are returned only when w or ctx fails.
+func (s *DownloadService) WriteBundle(ctx context.Context, w io.Writer, bundle *Bundle, format, profile string) (_ int, err error) {
+	ctx, span := tracing.Start(ctx, "Service.WriteBundle",
+		attribute.String("bundle", bundle.Name),
+		attribute.Int("books", len(bundle.Books)),
+		attribute.String("format", format),
+		attribute.String("profile", profile),
+	)
+	defer func() { tracing.End(span, err) }()
+
+	cw := &countingWriter{w: w}
+	zw := zip.NewWriter(cw)
+	names := make(entryNames)
+	limit := s.bundleLimit()
+
+	method := zip.Deflate
+	if format == "epub" || format == "fb2.zip" {
+		// Already compressed
+		method = zip.Store
+	}
+
+	var written int
+	var missing []string
+	for i := range bundle.Books {
+		b := &bundle.Books[i]
+		entry := names.unique(bundleEntryName(bundle, b, format))
+		if limit > 0 && cw.n >= limit {
+			missing = append(missing, entry+": size limit reached")
+			continue
+		}
+
+		reader, err := s.openBook(ctx, b.BookID, format, profile)
+		if err != nil {
+			if ctx.Err() != nil {
+				return written, ctx.Err()
+			}
+			if errors.Is(err, ErrFormatUnavailable) {
+				missing = append(missing, entry+": not available as "+format)
+				continue
+			}
+			logger.Warn("Skipping book in bulk download", "book_id", b.BookID, "bundle", bundle.Name, "format", format, "error", err)
+			// The error may name server paths; the log has the details
+			missing = append(missing, entry+": failed to prepare the book")
+			continue
+		}
+		err = writeZipEntry(zw, entry, method, reader)
+		reader.Close()
+		if err != nil {
+			return written, fmt.Errorf("write %s: %w", entry, err)
+		}
+		written++
+	}
+
+	if len(missing) > 0 {
+		note := "These books could not be included:\n\n" + strings.Join(missing, "\n") + "\n"
+		if err := writeZipEntry(zw, "missing.txt", zip.Deflate, strings.NewReader(note)); err != nil {
+			return written, fmt.Errorf("write missing.txt: %w", err)
+		}
+	}
+	if err := zw.Close(); err != nil {
+		return written, fmt.Errorf("close ZIP archive: %w", err)
+	}
+	return written, nil
+}
+
+// openBook returns the book in one of the download formats
+func (s *DownloadService) openBook(ctx context.Context, id int64, format, profile string) (io.ReadCloser, error) {
+	var reader io.ReadCloser
+	var err error
+	switch format {
+	case "fb2":
+		reader, _, _, err = s.DownloadBookFB2(ctx, id)
+	case "fb2.zip":
+		reader, _, _, err = s.DownloadBookFB2Zip(ctx, id)
+	default:
+		reader, _, _, err = s.DownloadBookConverted(ctx, id, format, profile)
+	}
+	return reader, err
+}
+
+// bundleEntryName names a book's file in the archive: its download name,
+// prefixed with its number in the series. Bundles with folders keep each
+// series in its own folder.
+func bundleEntryName(bundle *Bundle, b *book.Book, format string) string {
+	name := converter.FormatBookFilename(b, format)
+	if b.Series == nil {
+		return name
+	}
+	if b.Series.SeriesNo > 0 {
+		name = fmt.Sprintf("%02d - %s", b.Series.SeriesNo, name)
+	}
+	if bundle.folders {
+		if folder := converter.SanitizeFilename(b.Series.Name, ""); folder != "" {
+			name = path.Join(folder, name)
+		}
+	}
+	return name
+}
+
+func writeZipEntry(zw *zip.Writer, name string, method uint16, r io.Reader) error {
+	w, err := zw.CreateHeader(&zip.FileHeader{
+		Name:     name,
+		Method:   method,
+		Flags:    0x800, // UTF-8 names
+		Modified: time.Now(),
+	})
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(w, r)
+	return err
+}
+
+// entryNames disambiguates archive entries of books sharing a file name
+type entryNames map[string]bool
+
+// unique returns name, or name with a " (2)", " (3)"... suffix before the
+// extension when it is taken
+func (n entryNames) unique(name string) string {
+	candidate := name
+	for i := 2; n[candidate]; i++ {
+		stem, ext := splitBookExt(name)
+		candidate = stem + " (" + strconv.Itoa(i) + ")" + ext
+	}
+	n[candidate] = true
+	return candidate
+}
+
+// splitBookExt splits off the extension, keeping ".fb2.zip" whole
+func splitBookExt(name string) (string, string) {
+	if stem, ok := strings.CutSuffix(name, ".fb2.zip"); ok {
+		return stem, ".fb2.zip"
+	}
+	ext := path.Ext(name)
+	return strings.TrimSuffix(name, ext), ext
+}
+
+// countingWriter counts the bytes written through it
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
+}
@@ -3,27 +3,119 @@ package service
 import (
 	"archive/zip"
 	"context"
+	"errors"
 	"fmt"
 	"io"
 	"os"
+	"path/filepath"
+	"time"
 
 	"github.com/htol/bopds/book"
+	"github.com/htol/bopds/config"
 	"github.com/htol/bopds/converter"
+	"github.com/htol/bopds/logger"
 	"github.com/htol/bopds/repo"
+	"github.com/htol/bopds/tracing"
+	"go.opentelemetry.io/otel/attribute"
+)
+
+var (
+	// ErrUnknownProfile is returned for a conversion profile missing from the configuration
+	ErrUnknownProfile = errors.New("unknown conversion profile")
+	// ErrFormatUnavailable is returned for downloads of a book stored in a
+	// format other than FB2 in any other format
+	ErrFormatUnavailable = errors.New("book is not available in this format")
 )
 
 // DownloadService handles book download operations
 type DownloadService struct {
 	repo      repo.Repository
+	config    *config.Config
 	converter *converter.Converter
 }
 
 // NewDownloadService creates a new download service
-func NewDownloadService(r repo.Repository) *DownloadService {
+func NewDownloadService(r repo.Repository, cfg *config.Config) *DownloadService {
+	pool := converter.NewPool(cfg.Conversion.Workers, time.Duration(cfg.Conversion.Timeout)*time.Second)
+	archives := converter.NewArchives(cfg.Archives.MaxOpen,
+		time.Duration(cfg.Archives.IdleTimeout)*time.Second,
+		int64(cfg.Archives.BlockCacheSize)<<20)
 	return &DownloadService{
 		repo:      r,
-		converter: converter.New(),
+		config:    cfg,
+		converter: converter.New(pool, archives, conversionBackends(cfg.Conversion.Backends)),
+	}
+}
+
+// conversionBackends chains the configured commands of each format, in
+// order, ahead of its built-in backend. Formats with no built-in converter
+// must be registered at startup, before any service is created.
+func conversionBackends(configs []config.BackendConfig) map[string]converter.Backend {
+	chains := make(map[string][]converter.Backend)
+	var order []string
+	for _, bc := range configs {
+		if _, ok := chains[bc.Format]; !ok {
+			order = append(order, bc.Format)
+		}
+		chains[bc.Format] = append(chains[bc.Format], converter.NewCommandBackend(bc.Command))
+	}
+
+	backends := make(map[string]converter.Backend, len(order))
+	for _, format := range order {
+		chain := chains[format]
+		if f, _ := converter.LookupFormat(format); f.Backend != nil {
+			chain = append(chain, f.Backend)
+		}
+		backends[format] = converter.Chain(chain...)
+		logger.Info("Conversion backends configured", "format", format, "backends", backends[format].Name())
+	}
+	return backends
+}
+
+// archivePath resolves the book's archive against its library root.
+// Absolute paths are left untouched for databases that predate library roots.
+func (s *DownloadService) archivePath(b *book.Book) (string, error) {
+	if filepath.IsAbs(b.Archive) {
+		return b.Archive, nil
+	}
+	root, ok := s.config.LibraryRoot(b.Library)
+	if !ok {
+		return "", fmt.Errorf("library %q is not configured", b.Library)
+	}
+	return filepath.Join(root, b.Archive), nil
+}
+
+// sourceFormat returns the format the book is stored in; books that do not
+// say are FB2
+func sourceFormat(b *book.Book) string {
+	if b.Format == "" {
+		return "fb2"
+	}
+	return b.Format
+}
+
+// checkFormat reports whether the book can be downloaded in format. FB2
+// books convert to every format; other books are served only as stored.
+func checkFormat(b *book.Book, format string) error {
+	src := sourceFormat(b)
+	if format == src {
+		return nil
+	}
+	if src == "fb2" {
+		if _, ok := converter.LookupFormat(format); ok || format == "fb2.zip" {
+			return nil
+		}
 	}
+	return fmt.Errorf("%w: book %d is %s", ErrFormatUnavailable, b.BookID, src)
+}
+
+// extract opens the book's file inside its archive
+func (s *DownloadService) extract(ctx context.Context, b *book.Book) (io.ReadCloser, int64, error) {
+	archive, err := s.archivePath(b)
+	if err != nil {
+		return nil, 0, err
+	}
+	return s.converter.ExtractFromArchive(ctx, archive, b.FileName)
 }
 
 // GetBookByID retrieves a single book by ID
@@ -32,7 +124,9 @@ func (s *DownloadService) GetBookByID(ctx context.Context, id int64) (*book.Book
 		return nil, fmt.Errorf("invalid book ID: must be positive")
 	}
 
+	_, span := tracing.Start(ctx, "repo.GetBookByID", attribute.Int64("book.id", id))
 	b, err := s.repo.GetBookByID(id)
+	tracing.End(span, err)
 	if err != nil {
 		return nil, fmt.Errorf("get book by ID %d: %w", id, err)
 	}
@@ -40,16 +134,36 @@ func (s *DownloadService) GetBookByID(ctx context.Context, id int64) (*book.Book
 	return b, nil
 }
 
+// GetBookAnnotation returns the annotation read from the book's file, ""
+// for books without one
+func (s *DownloadService) GetBookAnnotation(ctx context.Context, b *book.Book) (_ string, err error) {
+	ctx, span := tracing.Start(ctx, "Service.GetBookAnnotation", attribute.Int64("book.id", b.BookID))
+	defer func() { tracing.End(span, err) }()
+
+	reader, _, err := s.extract(ctx, b)
+	if err != nil {
+		return "", fmt.Errorf("extract book from archive: %w", err)
+	}
+	defer reader.Close()
+	return converter.ReadAnnotation(reader, sourceFormat(b))
+}
+
 // DownloadBookFB2 returns an unpacked FB2 file stream
-func (s *DownloadService) DownloadBookFB2(ctx context.Context, id int64) (io.ReadCloser, string, int64, error) {
+func (s *DownloadService) DownloadBookFB2(ctx context.Context, id int64) (_ io.ReadCloser, _ string, _ int64, err error) {
+	ctx, span := tracing.Start(ctx, "Service.DownloadBookFB2", attribute.Int64("book.id", id))
+	defer func() { tracing.End(span, err) }()
+
 	// Get book info
 	b, err := s.GetBookByID(ctx, id)
 	if err != nil {
 		return nil, "", 0, err
 	}
+	if err := checkFormat(b, "fb2"); err != nil {
+		return nil, "", 0, err
+	}
 
 	// Extract FB2 from archive (ZIP or 7z)
-	reader, size, err := s.converter.ExtractFromArchive(b.Archive, b.FileName)
+	reader, size, err := s.extract(ctx, b)
 	if err != nil {
 		return nil, "", 0, fmt.Errorf("extract FB2 from archive: %w", err)
 	}
@@ -60,161 +174,120 @@ func (s *DownloadService) DownloadBookFB2(ctx context.Context, id int64) (io.Rea
 	return reader, filename, size, nil
 }
 
-// DownloadBookFB2Zip returns an FB2 file packed in ZIP archive
-func (s *DownloadService) DownloadBookFB2Zip(ctx context.Context, id int64) (io.ReadCloser, string, int64, error) {
+// DownloadBookFB2Zip returns the FB2 file packed in a ZIP archive. The
+// archive is compressed as it is read, so its size is not known up front and
+// -1 is returned for it.
+func (s *DownloadService) DownloadBookFB2Zip(ctx context.Context, id int64) (_ io.ReadCloser, _ string, _ int64, err error) {
+	ctx, span := tracing.Start(ctx, "Service.DownloadBookFB2Zip", attribute.Int64("book.id", id))
+	defer func() { tracing.End(span, err) }()
+
 	// Get book info
 	b, err := s.GetBookByID(ctx, id)
 	if err != nil {
 		return nil, "", 0, err
 	}
+	if err := checkFormat(b, "fb2.zip"); err != nil {
+		return nil, "", 0, err
+	}
 
 	// Extract FB2 from archive (ZIP or 7z)
-	fb2Reader, _, err := s.converter.ExtractFromArchive(b.Archive, b.FileName)
+	fb2Reader, _, err := s.extract(ctx, b)
 	if err != nil {
 		return nil, "", 0, fmt.Errorf("extract FB2 from archive: %w", err)
 	}
-	defer fb2Reader.Close()
-
-	// Read FB2 content
-	fb2Data, err := io.ReadAll(fb2Reader)
-	if err != nil {
-		return nil, "", 0, fmt.Errorf("read FB2 content: %w", err)
-	}
 
-	// Create a temporary file for the ZIP archive
-	tempFile, err := os.CreateTemp("", "fb2-*.zip")
-	if err != nil {
-		return nil, "", 0, fmt.Errorf("create temp file: %w", err)
-	}
-	tempPath := tempFile.Name()
-
-	// Generate filename for archive: "Author - Title.fb2"
-	archiveFilename := converter.FormatBookFilename(b, "fb2")
-
-	// Create ZIP archive
-	zipWriter := zip.NewWriter(tempFile)
+	// The entry inside the archive is named like the archive, without .zip.
+	// Closing the returned reader early fails the writer's next write, which
+	// ends the goroutine.
+	entryName := converter.FormatBookFilename(b, "fb2")
+	pr, pw := io.Pipe()
+	go func() {
+		defer fb2Reader.Close()
+		pw.CloseWithError(writeFB2Zip(pw, entryName, fb2Reader))
+	}()
+
+	return pr, converter.FormatBookFilename(b, "fb2.zip"), -1, nil
+}
 
-	// Create ZIP entry with the same name as archive (without .zip extension)
-	writer, err := zipWriter.CreateHeader(&zip.FileHeader{
-		Name:   archiveFilename, // Filename inside archive matches archive name
-		Method: zip.Deflate,     // Standard compression
-		Flags:  0x800,           // UTF-8 flag for proper encoding
-	})
-	if err != nil {
-		zipWriter.Close()
-		tempFile.Close()
-		os.Remove(tempPath)
-		return nil, "", 0, fmt.Errorf("create ZIP entry: %w", err)
+// writeFB2Zip writes a ZIP archive holding fb2 as its only entry
+func writeFB2Zip(w io.Writer, name string, fb2 io.Reader) error {
+	zw := zip.NewWriter(w)
+	if err := writeZipEntry(zw, name, zip.Deflate, fb2); err != nil {
+		return fmt.Errorf("write FB2 to ZIP: %w", err)
 	}
-
-	// Write FB2 content to ZIP
-	if _, err := writer.Write(fb2Data); err != nil {
-		zipWriter.Close()
-		tempFile.Close()
-		os.Remove(tempPath)
-		return nil, "", 0, fmt.Errorf("write FB2 to ZIP: %w", err)
+	if err := zw.Close(); err != nil {
+		return fmt.Errorf("close ZIP writer: %w", err)
 	}
+	return nil
+}
 
-	// Close ZIP writer
-	if err := zipWriter.Close(); err != nil {
-		tempFile.Close()
-		os.Remove(tempPath)
-		return nil, "", 0, fmt.Errorf("close ZIP writer: %w", err)
+// ResolveProfile returns the name of the conversion profile to use: the
+// requested one, else the user's default, else the configured default. An
+// empty name converts without a profile.
+func (s *DownloadService) ResolveProfile(requested, user string) (string, error) {
+	name := requested
+	if name == "" && user != "" {
+		name = s.config.Conversion.UserProfiles[user]
 	}
-
-	// Reopen temp file for reading
-	if _, err := tempFile.Seek(0, 0); err != nil {
-		tempFile.Close()
-		os.Remove(tempPath)
-		return nil, "", 0, fmt.Errorf("seek temp file: %w", err)
+	if name == "" {
+		name = s.config.Conversion.DefaultProfile
 	}
-
-	// Get file info for size
-	fi, err := tempFile.Stat()
-	if err != nil {
-		tempFile.Close()
-		os.Remove(tempPath)
-		return nil, "", 0, fmt.Errorf("stat temp file: %w", err)
+	if _, err := s.conversionProfile(name); err != nil {
+		return "", err
 	}
-
-	// Return with .fb2.zip extension
-	filename := converter.FormatBookFilename(b, "fb2.zip")
-
-	// Return cleanupReadCloser that removes temp file when done
-	return &cleanupReadCloser{
-		ReadCloser: tempFile,
-		cleanup: func() {
-			os.Remove(tempPath)
-		},
-	}, filename, fi.Size(), nil
+	return name, nil
 }
 
-// DownloadBookEPUB returns an EPUB file stream (converts on-the-fly)
-func (s *DownloadService) DownloadBookEPUB(ctx context.Context, id int64) (io.ReadCloser, string, int64, error) {
-	// Get book info
-	b, err := s.GetBookByID(ctx, id)
-	if err != nil {
-		return nil, "", 0, err
-	}
-
-	// Extract FB2 to temporary file
-	tempFile, err := os.CreateTemp("", "fb2-*.fb2")
-	if err != nil {
-		return nil, "", 0, fmt.Errorf("create temp file: %w", err)
+// conversionProfile returns the converter options of the named profile
+func (s *DownloadService) conversionProfile(name string) (converter.Profile, error) {
+	if name == "" {
+		return converter.Profile{}, nil
 	}
-	tempPath := tempFile.Name()
-
-	// Extract from archive and write to temp file
-	reader, _, err := s.converter.ExtractFromArchive(b.Archive, b.FileName)
-	if err != nil {
-		tempFile.Close()
-		os.Remove(tempPath)
-		return nil, "", 0, fmt.Errorf("extract FB2 from archive: %w", err)
+	p, ok := s.config.Profile(name)
+	if !ok {
+		return converter.Profile{}, fmt.Errorf("%w: %q", ErrUnknownProfile, name)
 	}
+	return converter.Profile{
+		Name:        p.Name,
+		NoCover:     p.NoCover,
+		InlineNotes: p.InlineNotes,
+		Hyphenation: p.Hyphenation,
+		Fonts:       p.Fonts,
+	}, nil
+}
 
-	// Copy FB2 content to temp file
-	if _, err := io.Copy(tempFile, reader); err != nil {
-		reader.Close()
-		tempFile.Close()
-		os.Remove(tempPath)
-		return nil, "", 0, fmt.Errorf("write FB2 to temp file: %w", err)
-	}
-	reader.Close()
-	tempFile.Close()
-
-	// Reopen temp file for reading
-	epubReader, _, err := s.converter.ConvertFB2ToEPUB(ctx, tempPath)
+// DownloadBookConverted returns the book converted on the fly to one of the
+// registered output formats with the named conversion profile. Books stored
+// in the requested format, such as PDF, are served as they are.
+func (s *DownloadService) DownloadBookConverted(ctx context.Context, id int64, format, profile string) (_ io.ReadCloser, _ string, _ int64, err error) {
+	ctx, span := tracing.Start(ctx, "Service.DownloadBookConverted",
+		attribute.Int64("book.id", id),
+		attribute.String("format", format),
+		attribute.String("profile", profile),
+	)
+	defer func() { tracing.End(span, err) }()
+
+	options, err := s.conversionProfile(profile)
 	if err != nil {
-		os.Remove(tempPath)
-		return nil, "", 0, fmt.Errorf("convert FB2 to EPUB: %w", err)
-	}
-
-	// Clean up temp FB2 file
-	os.Remove(tempPath)
-
-	// Generate filename as "Author - Title.epub"
-	filename := converter.FormatBookFilename(b, "epub")
-
-	// We need size, so we might need to stat the file if ConvertFB2ToEPUB returned a file reader
-	var size int64 = -1
-	if f, ok := epubReader.(*cleanupReadCloser); ok {
-		if file, ok := f.ReadCloser.(*os.File); ok {
-			if fi, err := file.Stat(); err == nil {
-				size = fi.Size()
-			}
-		}
+		return nil, "", 0, err
 	}
 
-	return epubReader, filename, size, nil
-}
-
-// DownloadBookMOBI returns a MOBI file stream (converts on-the-fly)
-func (s *DownloadService) DownloadBookMOBI(ctx context.Context, id int64) (io.ReadCloser, string, int64, error) {
 	// Get book info
 	b, err := s.GetBookByID(ctx, id)
 	if err != nil {
 		return nil, "", 0, err
 	}
+	if err := checkFormat(b, format); err != nil {
+		return nil, "", 0, err
+	}
+	if sourceFormat(b) == format {
+		// Stored in the requested format; profiles apply to conversions only
+		reader, size, err := s.extract(ctx, b)
+		if err != nil {
+			return nil, "", 0, fmt.Errorf("extract %s from archive: %w", format, err)
+		}
+		return reader, converter.FormatBookFilename(b, format), size, nil
+	}
 
 	// Extract FB2 to temporary file
 	tempFile, err := os.CreateTemp("", "fb2-*.fb2")
@@ -222,12 +295,12 @@ func (s *DownloadService) DownloadBookMOBI(ctx context.Context, id int64) (io.Re
 		return nil, "", 0, fmt.Errorf("create temp file: %w", err)
 	}
 	tempPath := tempFile.Name()
+	defer os.Remove(tempPath)
 
 	// Extract from archive and write to temp file
-	reader, _, err := s.converter.ExtractFromArchive(b.Archive, b.FileName)
+	reader, _, err := s.extract(ctx, b)
 	if err != nil {
 		tempFile.Close()
-		os.Remove(tempPath)
 		return nil, "", 0, fmt.Errorf("extract FB2 from archive: %w", err)
 	}
 
@@ -235,51 +308,33 @@ func (s *DownloadService) DownloadBookMOBI(ctx context.Context, id int64) (io.Re
 	if _, err := io.Copy(tempFile, reader); err != nil {
 		reader.Close()
 		tempFile.Close()
-		os.Remove(tempPath)
 		return nil, "", 0, fmt.Errorf("write FB2 to temp file: %w", err)
 	}
 	reader.Close()
 	tempFile.Close()
 
-	// Convert to MOBI
-	mobiReader, _, err := s.converter.ConvertFB2ToMOBI(ctx, tempPath)
+	converted, convertedPath, err := s.converter.ConvertFB2(ctx, tempPath, format, options)
 	if err != nil {
-		os.Remove(tempPath)
-		return nil, "", 0, fmt.Errorf("convert FB2 to MOBI: %w", err)
+		return nil, "", 0, fmt.Errorf("convert FB2 to %s: %w", format, err)
 	}
 
-	// Clean up temp FB2 file
-	os.Remove(tempPath)
-
-	// Generate filename as "Author - Title.mobi"
-	filename := converter.FormatBookFilename(b, "mobi")
+	// Generate filename as "Author - Title.<format>"
+	filename := converter.FormatBookFilename(b, format)
 
-	// Get size
 	var size int64 = -1
-	if f, ok := mobiReader.(*cleanupReadCloser); ok {
-		if file, ok := f.ReadCloser.(*os.File); ok {
-			if fi, err := file.Stat(); err == nil {
-				size = fi.Size()
-			}
-		}
+	if fi, err := os.Stat(convertedPath); err == nil {
+		size = fi.Size()
 	}
 
-	return mobiReader, filename, size, nil
+	return converted, filename, size, nil
 }
 
-// cleanupReadCloser wraps a ReadCloser and calls cleanup on close
-type cleanupReadCloser struct {
-	io.ReadCloser
-	cleanup func()
+// DownloadBookEPUB returns an EPUB file stream (converts on-the-fly)
+func (s *DownloadService) DownloadBookEPUB(ctx context.Context, id int64) (io.ReadCloser, string, int64, error) {
+	return s.DownloadBookConverted(ctx, id, "epub", "")
 }
 
-func (rc *cleanupReadCloser) Close() error {
-	var err1 error
-	if rc.ReadCloser != nil {
-		err1 = rc.ReadCloser.Close()
-	}
-	if rc.cleanup != nil {
-		rc.cleanup()
-	}
-	return err1
+// DownloadBookMOBI returns a MOBI file stream (converts on-the-fly)
+func (s *DownloadService) DownloadBookMOBI(ctx context.Context, id int64) (io.ReadCloser, string, int64, error) {
+	return s.DownloadBookConverted(ctx, id, "mobi", "")
 }
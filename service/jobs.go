@@ -0,0 +1,390 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sync"
+	"time"
+
+	"github.com/htol/bopds/book"
+	"github.com/htol/bopds/config"
+	"github.com/htol/bopds/converter"
+	"github.com/htol/bopds/logger"
+	"github.com/htol/bopds/mailer"
+	"github.com/htol/bopds/repo"
+	"github.com/htol/bopds/tracing"
+	"go.opentelemetry.io/otel/attribute"
+)
+
+var (
+	// ErrJobNotReady is returned when the result of an unfinished or failed job is requested
+	ErrJobNotReady = errors.New("job has no result yet")
+	// ErrUnsupportedFormat is returned for conversions to a format the converter cannot produce
+	ErrUnsupportedFormat = errors.New("unsupported format")
+)
+
+// expireInterval is how often finished jobs are checked for expiry
+const expireInterval = time.Hour
+
+// JobService runs conversion and delivery jobs in the background, on as
+// many workers as the conversion pool has. Jobs are stored in the repository
+// so that work queued or running when the server stops is resumed on the
+// next start.
+type JobService struct {
+	repo      repo.Repository
+	config    *config.Config
+	downloads *DownloadService
+	mailer    *mailer.Mailer
+
+	mu      sync.Mutex
+	ctx     context.Context // set by Start; nil until then
+	pending []book.Job      // jobs waiting for a worker, oldest first
+	wake    chan struct{}   // signals a worker that a job is pending
+	running sync.WaitGroup
+}
+
+// NewJobService creates a job service converting books with downloads
+func NewJobService(r repo.Repository, cfg *config.Config, downloads *DownloadService) *JobService {
+	return &JobService{
+		repo:      r,
+		config:    cfg,
+		downloads: downloads,
+		mailer:    mailer.New(cfg.Mail),
+		wake:      make(chan struct{}, 1),
+	}
+}
+
+// Start resumes unfinished jobs and begins running new ones until ctx is
+// cancelled. Jobs interrupted by cancellation are resumed on the next start.
+func (s *JobService) Start(ctx context.Context) error {
+	if err := os.MkdirAll(s.config.Conversion.JobsDir, 0o755); err != nil {
+		return fmt.Errorf("create jobs directory: %w", err)
+	}
+
+	jobs, err := s.repo.GetUnfinishedJobs()
+	if err != nil {
+		return fmt.Errorf("load unfinished jobs: %w", err)
+	}
+
+	s.mu.Lock()
+	s.ctx = ctx
+	s.mu.Unlock()
+
+	workers := s.config.Conversion.Workers
+	if workers <= 0 {
+		workers = runtime.NumCPU()
+	}
+	for range workers {
+		s.running.Add(1)
+		go s.work(ctx)
+	}
+
+	if len(jobs) > 0 {
+		logger.Info("Resuming conversion jobs", "count", len(jobs))
+	}
+	for _, job := range jobs {
+		s.enqueue(job)
+	}
+
+	s.running.Add(1)
+	go s.expire(ctx)
+	return nil
+}
+
+// Wait blocks until every job goroutine has returned after Start's context
+// was cancelled
+func (s *JobService) Wait() {
+	s.running.Wait()
+}
+
+// EnqueueConversion creates a job converting the book to format with the
+// named profile and starts it. Book, format and profile are the key of a
+// conversion cache: a pending job or a finished one whose result is still
+// kept is returned instead of converting again.
+func (s *JobService) EnqueueConversion(ctx context.Context, bookID int64, format, profile string) (_ *book.Job, err error) {
+	ctx, span := tracing.Start(ctx, "Service.EnqueueConversion",
+		attribute.Int64("book.id", bookID),
+		attribute.String("format", format),
+		attribute.String("profile", profile),
+	)
+	defer func() { tracing.End(span, err) }()
+
+	if _, ok := converter.LookupFormat(format); !ok {
+		return nil, fmt.Errorf("%w: %q", ErrUnsupportedFormat, format)
+	}
+	if _, err := s.downloads.conversionProfile(profile); err != nil {
+		return nil, err
+	}
+	b, err := s.downloads.GetBookByID(ctx, bookID)
+	if err != nil {
+		return nil, err
+	}
+	if err := checkFormat(b, format); err != nil {
+		return nil, err
+	}
+
+	_, repoSpan := tracing.Start(ctx, "repo.FindJob")
+	existing, findErr := s.repo.FindJob(book.JobConvert, bookID, format, profile)
+	if errors.Is(findErr, repo.ErrNotFound) {
+		tracing.End(repoSpan, nil)
+	} else {
+		tracing.End(repoSpan, findErr)
+	}
+	if findErr == nil && resultAvailable(existing) {
+		// Touch the job so that expiry does not delete what was just handed out
+		_, repoSpan = tracing.Start(ctx, "repo.TouchJob")
+		touchErr := s.repo.TouchJob(existing.ID)
+		tracing.End(repoSpan, touchErr)
+		if touchErr == nil {
+			logger.Info("Reusing conversion job", "job_id", existing.ID, "book_id", bookID, "format", format, "profile", profile)
+			return existing, nil
+		}
+		if !errors.Is(touchErr, repo.ErrNotFound) {
+			return nil, fmt.Errorf("reuse conversion job: %w", touchErr)
+		}
+		// Expired in the meantime; convert again
+	}
+
+	job := &book.Job{
+		Kind:    book.JobConvert,
+		BookID:  bookID,
+		Format:  format,
+		Profile: profile,
+		Status:  book.JobQueued,
+	}
+	_, repoSpan = tracing.Start(ctx, "repo.CreateJob")
+	err = s.repo.CreateJob(job)
+	tracing.End(repoSpan, err)
+	if err != nil {
+		return nil, fmt.Errorf("enqueue conversion: %w", err)
+	}
+	s.enqueue(*job)
+	return job, nil
+}
+
+// GetJob returns the job with the given ID
+func (s *JobService) GetJob(ctx context.Context, id int64) (_ *book.Job, err error) {
+	ctx, span := tracing.Start(ctx, "Service.GetJob", attribute.Int64("job.id", id))
+	defer func() { tracing.End(span, err) }()
+
+	if id <= 0 {
+		return nil, fmt.Errorf("invalid job ID: must be positive")
+	}
+	_, repoSpan := tracing.Start(ctx, "repo.GetJob")
+	job, err := s.repo.GetJob(id)
+	tracing.End(repoSpan, err)
+	if err != nil {
+		return nil, fmt.Errorf("get job %d: %w", id, err)
+	}
+	return job, nil
+}
+
+// OpenJobResult returns the converted file of a finished job
+func (s *JobService) OpenJobResult(ctx context.Context, id int64) (io.ReadCloser, *book.Job, int64, error) {
+	job, err := s.GetJob(ctx, id)
+	if err != nil {
+		return nil, nil, 0, err
+	}
+	if job.Status != book.JobDone {
+		return nil, job, 0, fmt.Errorf("job %d is %s: %w", id, job.Status, ErrJobNotReady)
+	}
+	if job.ResultPath == "" {
+		return nil, job, 0, fmt.Errorf("job %d has no result file: %w", id, repo.ErrNotFound)
+	}
+
+	f, err := os.Open(job.ResultPath)
+	if err != nil {
+		return nil, job, 0, fmt.Errorf("open result of job %d: %w", id, err)
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, job, 0, fmt.Errorf("stat result of job %d: %w", id, err)
+	}
+	return f, job, fi.Size(), nil
+}
+
+// resultAvailable reports whether an earlier job can stand in for a new one:
+// it is still pending, or it is done and its result file was not removed
+func resultAvailable(job *book.Job) bool {
+	if job.Status != book.JobDone {
+		return true
+	}
+	_, err := os.Stat(job.ResultPath)
+	return err == nil
+}
+
+// enqueue queues the job for the next free worker. Jobs created before Start
+// or after shutdown are left to be resumed by the next Start.
+func (s *JobService) enqueue(job book.Job) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.ctx == nil || s.ctx.Err() != nil {
+		return
+	}
+	s.pending = append(s.pending, job)
+	s.signal()
+}
+
+// signal wakes a waiting worker, if none was woken already
+func (s *JobService) signal() {
+	select {
+	case s.wake <- struct{}{}:
+	default:
+	}
+}
+
+// next takes the oldest pending job
+func (s *JobService) next() (book.Job, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.pending) == 0 {
+		return book.Job{}, false
+	}
+	job := s.pending[0]
+	s.pending = s.pending[1:]
+	if len(s.pending) > 0 {
+		// Pass the wake-up on to another worker
+		s.signal()
+	}
+	return job, true
+}
+
+// work runs pending jobs one at a time until ctx is cancelled
+func (s *JobService) work(ctx context.Context) {
+	defer s.running.Done()
+	for ctx.Err() == nil {
+		job, ok := s.next()
+		if !ok {
+			select {
+			case <-ctx.Done():
+			case <-s.wake:
+			}
+			continue
+		}
+		s.run(ctx, &job)
+	}
+}
+
+func (s *JobService) run(ctx context.Context, job *book.Job) {
+	switch job.Kind {
+	case book.JobSend:
+		s.runSend(ctx, job)
+	default:
+		s.runConvert(ctx, job)
+	}
+}
+
+// runConvert converts the job's book and stores the result. Progress is
+// coarse: fb2c reports none, so it only marks the stages of the job.
+func (s *JobService) runConvert(ctx context.Context, job *book.Job) {
+	logger.Info("Conversion job started", "job_id", job.ID, "book_id", job.BookID, "format", job.Format, "profile", job.Profile)
+	job.Status = book.JobRunning
+	job.Progress = 10
+	s.save(job)
+
+	reader, filename, _, err := s.downloads.DownloadBookConverted(ctx, job.BookID, job.Format, job.Profile)
+	for errors.Is(err, converter.ErrBusy) {
+		// Background jobs keep waiting for a worker
+		reader, filename, _, err = s.downloads.DownloadBookConverted(ctx, job.BookID, job.Format, job.Profile)
+	}
+	if err != nil {
+		if ctx.Err() != nil {
+			// Shutting down; the job stays running and is resumed on restart
+			return
+		}
+		s.fail(job, err)
+		return
+	}
+	defer reader.Close()
+
+	job.Progress = 90
+	s.save(job)
+
+	path := filepath.Join(s.config.Conversion.JobsDir, fmt.Sprintf("%d.%s", job.ID, job.Format))
+	if err := writeFile(path, reader); err != nil {
+		s.fail(job, err)
+		return
+	}
+
+	job.Status = book.JobDone
+	job.Progress = 100
+	job.ResultPath = path
+	job.FileName = filename
+	s.save(job)
+	logger.Info("Conversion job finished", "job_id", job.ID, "book_id", job.BookID, "format", job.Format)
+}
+
+func (s *JobService) fail(job *book.Job, err error) {
+	logger.Error("Job failed", "job_id", job.ID, "kind", job.Kind, "book_id", job.BookID, "format", job.Format, "error", err)
+	job.Status = book.JobFailed
+	job.Error = err.Error()
+	s.save(job)
+}
+
+func (s *JobService) save(job *book.Job) {
+	if err := s.repo.UpdateJob(job); err != nil {
+		logger.Error("Failed to save job", "job_id", job.ID, "error", err)
+	}
+}
+
+// expire periodically deletes finished jobs older than the configured TTL
+// together with their result files
+func (s *JobService) expire(ctx context.Context) {
+	defer s.running.Done()
+
+	ticker := time.NewTicker(expireInterval)
+	defer ticker.Stop()
+	for {
+		ttl := time.Duration(s.config.Conversion.JobTTL) * time.Second
+		jobs, err := s.repo.ExpireJobs(time.Now().Add(-ttl))
+		if err != nil {
+			logger.Error("Failed to expire jobs", "error", err)
+		}
+		for _, job := range jobs {
+			if job.ResultPath == "" {
+				continue
+			}
+			if err := os.Remove(job.ResultPath); err != nil && !errors.Is(err, os.ErrNotExist) {
+				logger.Warn("Failed to remove job result", "job_id", job.ID, "path", job.ResultPath, "error", err)
+			}
+		}
+		if len(jobs) > 0 {
+			logger.Info("Expired conversion jobs", "count", len(jobs))
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// writeFile stores r at path, leaving no partial file behind on failure
+func writeFile(path string, r io.Reader) error {
+	tmp := path + ".part"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return fmt.Errorf("create result file: %w", err)
+	}
+	if _, err := io.Copy(f, r); err != nil {
+		f.Close()
+		os.Remove(tmp)
+		return fmt.Errorf("write result file: %w", err)
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(tmp)
+		return fmt.Errorf("close result file: %w", err)
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		os.Remove(tmp)
+		return fmt.Errorf("store result file: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,157 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/htol/bopds/book"
+	"github.com/htol/bopds/converter"
+	"github.com/htol/bopds/logger"
+	"github.com/htol/bopds/mailer"
+	"github.com/htol/bopds/repo"
+	"github.com/htol/bopds/tracing"
+	"go.opentelemetry.io/otel/attribute"
+)
+
+var (
+	// ErrMailDisabled is returned for deliveries while no SMTP server is configured
+	ErrMailDisabled = errors.New("mail delivery is not configured")
+	// ErrNoRecipient is returned for deliveries to a user without a configured address
+	ErrNoRecipient = errors.New("no delivery address configured")
+)
+
+// defaultSendFormat is delivered to recipients that do not choose a format;
+// Send to Kindle accepts EPUB
+const defaultSendFormat = "epub"
+
+// EnqueueSend creates a job converting the book with the named profile and
+// e-mailing it to the user's configured address, and starts it
+func (s *JobService) EnqueueSend(ctx context.Context, bookID int64, user, profile string) (_ *book.Job, err error) {
+	ctx, span := tracing.Start(ctx, "Service.EnqueueSend",
+		attribute.Int64("book.id", bookID),
+		attribute.String("profile", profile),
+	)
+	defer func() { tracing.End(span, err) }()
+
+	if !s.mailer.Enabled() {
+		return nil, ErrMailDisabled
+	}
+	// Without a configured user header anyone could claim a recipient's name
+	if s.config.RateLimit.UserHeader == "" {
+		return nil, fmt.Errorf("%w: no user header is configured", ErrNoRecipient)
+	}
+	rcpt, ok := s.config.Mail.Recipients[user]
+	if user == "" || !ok {
+		return nil, fmt.Errorf("%w for user %q", ErrNoRecipient, user)
+	}
+	format := rcpt.Format
+	if format == "" {
+		format = defaultSendFormat
+	}
+	if _, ok := converter.LookupFormat(format); !ok {
+		return nil, fmt.Errorf("%w: %q", ErrUnsupportedFormat, format)
+	}
+	if _, err := s.downloads.conversionProfile(profile); err != nil {
+		return nil, err
+	}
+	b, err := s.downloads.GetBookByID(ctx, bookID)
+	if err != nil {
+		return nil, err
+	}
+	if err := checkFormat(b, format); err != nil {
+		return nil, err
+	}
+
+	job := &book.Job{
+		Kind:      book.JobSend,
+		BookID:    bookID,
+		Format:    format,
+		Profile:   profile,
+		Recipient: rcpt.Address,
+		Status:    book.JobQueued,
+	}
+	_, repoSpan := tracing.Start(ctx, "repo.CreateJob")
+	err = s.repo.CreateJob(job)
+	tracing.End(repoSpan, err)
+	if err != nil {
+		return nil, fmt.Errorf("enqueue send: %w", err)
+	}
+	s.enqueue(*job)
+	return job, nil
+}
+
+// runSend delivers the job's book once. Transient failures are retried with
+// exponential backoff: the job is queued again after the delay, without
+// holding a worker meanwhile, and a restart resumes it right away.
+func (s *JobService) runSend(ctx context.Context, job *book.Job) {
+	err := s.deliver(ctx, job)
+	if err == nil {
+		logger.Info("Send job finished", "job_id", job.ID, "book_id", job.BookID, "format", job.Format, "attempts", job.Attempts+1)
+		return
+	}
+	if ctx.Err() != nil {
+		// Shutting down; the job is resumed on restart
+		return
+	}
+
+	var delay time.Duration
+	if errors.Is(err, converter.ErrBusy) {
+		// Waiting for a conversion worker is not a failed attempt
+		logger.Info("Send job waiting for a conversion worker", "job_id", job.ID)
+	} else {
+		job.Attempts++
+		if mailer.IsPermanent(err) || errors.Is(err, repo.ErrNotFound) || job.Attempts >= s.config.Mail.MaxAttempts {
+			s.fail(job, err)
+			return
+		}
+		delay = time.Duration(s.config.Mail.RetryDelay) * time.Second << (job.Attempts - 1)
+		logger.Warn("Send job failed, retrying", "job_id", job.ID, "attempt", job.Attempts, "retry_in", delay.String(), "error", err)
+		job.Error = err.Error()
+	}
+	job.Status = book.JobQueued
+	job.Progress = 0
+	s.save(job)
+
+	retry := *job
+	time.AfterFunc(delay, func() { s.enqueue(retry) })
+}
+
+// deliver converts the book and e-mails it once
+func (s *JobService) deliver(ctx context.Context, job *book.Job) error {
+	logger.Info("Send job started", "job_id", job.ID, "book_id", job.BookID, "format", job.Format, "profile", job.Profile, "attempt", job.Attempts+1)
+	job.Status = book.JobRunning
+	job.Progress = 10
+	s.save(job)
+
+	reader, filename, _, err := s.downloads.DownloadBookConverted(ctx, job.BookID, job.Format, job.Profile)
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
+
+	job.Progress = 50
+	s.save(job)
+
+	format, _ := converter.LookupFormat(job.Format)
+	title := filename[:len(filename)-len(job.Format)-1]
+	err = s.mailer.Send(ctx, mailer.Message{
+		To:          job.Recipient,
+		Subject:     title,
+		Body:        fmt.Sprintf("%s is attached.\n", title),
+		FileName:    filename,
+		ContentType: format.ContentType,
+		Attachment:  reader,
+	})
+	if err != nil {
+		return fmt.Errorf("send to %s: %w", job.Recipient, err)
+	}
+
+	job.Status = book.JobDone
+	job.Progress = 100
+	job.FileName = filename
+	job.Error = ""
+	s.save(job)
+	return nil
+}
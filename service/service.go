@@ -3,56 +3,173 @@ package service
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"io"
+	"slices"
+	"strings"
+	"unicode/utf8"
 
 	"github.com/htol/bopds/book"
+	"github.com/htol/bopds/config"
 	"github.com/htol/bopds/repo"
+	"github.com/htol/bopds/tracing"
+	"go.opentelemetry.io/otel/attribute"
 )
 
+// ErrUnknownLibrary is returned when a request names a library that is not configured
+var ErrUnknownLibrary = errors.New("unknown library")
+
 // Service provides business logic for the application
 type Service struct {
 	repo            repo.Repository
+	config          *config.Config
 	downloadService *DownloadService
+	jobService      *JobService
 }
 
-// New creates a new Service with the given repository
+// New creates a new Service with the given repository and the default configuration
 func New(repo repo.Repository) *Service {
+	return NewWithConfig(repo, config.Default())
+}
+
+// NewWithConfig creates a new Service with the given repository and configuration
+func NewWithConfig(repo repo.Repository, cfg *config.Config) *Service {
+	downloads := NewDownloadService(repo, cfg)
 	return &Service{
 		repo:            repo,
-		downloadService: NewDownloadService(repo),
+		config:          cfg,
+		downloadService: downloads,
+		jobService:      NewJobService(repo, cfg, downloads),
+	}
+}
+
+// Config returns the configuration the service was created with
+func (s *Service) Config() *config.Config {
+	return s.config
+}
+
+// Libraries
+
+// GetLibraries returns the names of all configured libraries
+func (s *Service) GetLibraries(ctx context.Context) []string {
+	return s.config.LibraryNames()
+}
+
+// checkLibrary validates a library filter. An empty name means all libraries.
+func (s *Service) checkLibrary(library string) error {
+	if library == "" {
+		return nil
+	}
+	if _, ok := s.config.FindLibrary(library); !ok {
+		return fmt.Errorf("%w: %q", ErrUnknownLibrary, library)
 	}
+	return nil
 }
 
 // Authors
 
 // GetAuthors retrieves all authors from the repository
-func (s *Service) GetAuthors(ctx context.Context) ([]book.Author, error) {
+func (s *Service) GetAuthors(ctx context.Context) (_ []book.Author, err error) {
+	ctx, span := tracing.Start(ctx, "Service.GetAuthors")
+	defer func() { tracing.End(span, err) }()
+
+	_, repoSpan := tracing.Start(ctx, "repo.GetAuthors")
 	authors, err := s.repo.GetAuthors()
+	tracing.End(repoSpan, err)
 	if err != nil {
 		return nil, fmt.Errorf("get authors: %w", err)
 	}
 	return authors, nil
 }
 
-// GetAuthorsByLetter retrieves authors whose last name starts with the given letter(s)
-func (s *Service) GetAuthorsByLetter(ctx context.Context, letters string) ([]book.AuthorWithBookCount, error) {
+// GetAuthorsByLetter retrieves the page of authors whose last name starts
+// with the given letter(s) and their number, optionally restricted to
+// authors with books in one library
+func (s *Service) GetAuthorsByLetter(ctx context.Context, letters, library string, opts repo.ListOptions) (_ []book.AuthorWithBookCount, _ int, err error) {
+	ctx, span := tracing.Start(ctx, "Service.GetAuthorsByLetter", append(listAttributes(opts),
+		attribute.String("letters", letters), attribute.String("library", library))...)
+	defer func() { tracing.End(span, err) }()
+
 	if letters == "" {
-		return nil, fmt.Errorf("letters parameter cannot be empty")
+		return nil, 0, fmt.Errorf("letters parameter cannot be empty")
+	}
+	if err := s.checkLibrary(library); err != nil {
+		return nil, 0, err
 	}
-	authors, err := s.repo.GetAuthorsWithBookCountByLetter(letters)
+	_, repoSpan := tracing.Start(ctx, "repo.GetAuthorsWithBookCountByLetter")
+	authors, total, err := s.repo.GetAuthorsWithBookCountByLetter(letters, library, opts)
+	tracing.End(repoSpan, err)
 	if err != nil {
-		return nil, fmt.Errorf("get authors by letter %q: %w", letters, err)
+		return nil, 0, fmt.Errorf("get authors by letter %q: %w", letters, err)
 	}
-	return authors, nil
+	return authors, total, nil
+}
+
+// listAttributes describes the page of a list a span retrieves
+func listAttributes(opts repo.ListOptions) []attribute.KeyValue {
+	return []attribute.KeyValue{
+		attribute.Int("limit", opts.Limit),
+		attribute.Int("offset", opts.Offset),
+		attribute.String("sort", opts.Sort),
+		attribute.Bool("desc", opts.Desc),
+	}
+}
+
+// Prefix navigation drills into a prefix while more than MaxPrefixListSize
+// names start with it, up to prefixes of MaxPrefixLength characters
+const (
+	MaxPrefixListSize = 100
+	MaxPrefixLength   = 3
+)
+
+// PrefixIsLeaf reports whether the count names starting with prefix are
+// listed rather than drilled into by longer prefixes
+func PrefixIsLeaf(prefix string, count int) bool {
+	return count <= MaxPrefixListSize || utf8.RuneCountInString(prefix) >= MaxPrefixLength
+}
+
+// GetPrefixes counts the names of the index (authors, titles or series)
+// starting with prefix by their prefixes one character longer, marking
+// those to be listed rather than drilled into. An empty library matches
+// books from every library.
+func (s *Service) GetPrefixes(ctx context.Context, index repo.PrefixIndex, prefix, library string) (_ []book.Prefix, err error) {
+	ctx, span := tracing.Start(ctx, "Service.GetPrefixes", attribute.String("index", string(index)),
+		attribute.String("prefix", prefix), attribute.String("library", library))
+	defer func() { tracing.End(span, err) }()
+
+	if utf8.RuneCountInString(prefix) >= MaxPrefixLength {
+		return nil, fmt.Errorf("prefix %q is longer than %d characters", prefix, MaxPrefixLength-1)
+	}
+	if err := s.checkLibrary(library); err != nil {
+		return nil, err
+	}
+	_, repoSpan := tracing.Start(ctx, "repo.GetPrefixes")
+	prefixes, err := s.repo.GetPrefixes(index, prefix, library)
+	tracing.End(repoSpan, err)
+	if err != nil {
+		return nil, fmt.Errorf("get %s prefixes %q: %w", index, prefix, err)
+	}
+	for i := range prefixes {
+		// Names no longer than prefix are counted under it and cannot be
+		// told apart by longer prefixes
+		prefixes[i].Leaf = PrefixIsLeaf(prefixes[i].Prefix, prefixes[i].Count) ||
+			strings.EqualFold(prefixes[i].Prefix, prefix)
+	}
+	return prefixes, nil
 }
 
 // GetAuthorByID retrieves a single author by ID
-func (s *Service) GetAuthorByID(ctx context.Context, id int64) (*book.Author, error) {
+func (s *Service) GetAuthorByID(ctx context.Context, id int64) (_ *book.Author, err error) {
+	ctx, span := tracing.Start(ctx, "Service.GetAuthorByID", attribute.Int64("author.id", id))
+	defer func() { tracing.End(span, err) }()
+
 	if id <= 0 {
 		return nil, fmt.Errorf("invalid author ID: %d", id)
 	}
+	_, repoSpan := tracing.Start(ctx, "repo.GetAuthorByID")
 	author, err := s.repo.GetAuthorByID(id)
+	tracing.End(repoSpan, err)
 	if err != nil {
 		return nil, fmt.Errorf("get author by ID %d: %w", id, err)
 	}
@@ -62,8 +179,13 @@ func (s *Service) GetAuthorByID(ctx context.Context, id int64) (*book.Author, er
 // Books
 
 // GetBooks retrieves all books from the repository
-func (s *Service) GetBooks(ctx context.Context) ([]string, error) {
+func (s *Service) GetBooks(ctx context.Context) (_ []string, err error) {
+	ctx, span := tracing.Start(ctx, "Service.GetBooks")
+	defer func() { tracing.End(span, err) }()
+
+	_, repoSpan := tracing.Start(ctx, "repo.GetBooks")
 	books, err := s.repo.GetBooks()
+	tracing.End(repoSpan, err)
 	if err != nil {
 		return nil, fmt.Errorf("get books: %w", err)
 	}
@@ -71,51 +193,119 @@ func (s *Service) GetBooks(ctx context.Context) ([]string, error) {
 }
 
 // GetLanguages returns all available languages
-func (s *Service) GetLanguages(ctx context.Context) ([]string, error) {
-	return s.repo.GetLanguages()
+func (s *Service) GetLanguages(ctx context.Context) (_ []string, err error) {
+	ctx, span := tracing.Start(ctx, "Service.GetLanguages")
+	defer func() { tracing.End(span, err) }()
+
+	_, repoSpan := tracing.Start(ctx, "repo.GetLanguages")
+	languages, err := s.repo.GetLanguages()
+	tracing.End(repoSpan, err)
+	return languages, err
 }
 
-// GetBooksByLetter retrieves books whose title starts with the given letter(s)
-func (s *Service) GetBooksByLetter(ctx context.Context, letters string) ([]book.Book, error) {
+// AllLanguages asks ResolveBookLanguages for books in every language
+const AllLanguages = "all"
+
+// ResolveBookLanguages returns the languages to filter catalog books by: the
+// requested comma-separated codes, else the user's configured languages,
+// else the configured default. No languages, or AllLanguages requested,
+// match books in every language.
+func (s *Service) ResolveBookLanguages(requested, user string) []string {
+	if requested == AllLanguages {
+		return nil
+	}
+	var languages []string
+	for lang := range strings.SplitSeq(requested, ",") {
+		if lang = strings.ToLower(strings.TrimSpace(lang)); lang != "" {
+			languages = append(languages, lang)
+		}
+	}
+	if len(languages) > 0 {
+		return languages
+	}
+	if userLanguages, ok := s.config.Catalog.UserBookLanguages[user]; ok && user != "" {
+		return userLanguages
+	}
+	return s.config.Catalog.BookLanguages
+}
+
+// GetBooksByLetter retrieves the page of books whose title starts with the
+// given letter(s) and their number
+func (s *Service) GetBooksByLetter(ctx context.Context, letters, library string, opts repo.ListOptions) (_ []book.Book, _ int, err error) {
+	ctx, span := tracing.Start(ctx, "Service.GetBooksByLetter", append(listAttributes(opts),
+		attribute.String("letters", letters), attribute.String("library", library))...)
+	defer func() { tracing.End(span, err) }()
+
 	if letters == "" {
-		return nil, fmt.Errorf("letters parameter cannot be empty")
+		return nil, 0, fmt.Errorf("letters parameter cannot be empty")
 	}
-	books, err := s.repo.GetBooksByLetter(letters)
+	if err := s.checkLibrary(library); err != nil {
+		return nil, 0, err
+	}
+	_, repoSpan := tracing.Start(ctx, "repo.GetBooksByLetter")
+	books, total, err := s.repo.GetBooksByLetter(letters, library, opts)
+	tracing.End(repoSpan, err)
 	if err != nil {
-		return nil, fmt.Errorf("get books by letter %q: %w", letters, err)
+		return nil, 0, fmt.Errorf("get books by letter %q: %w", letters, err)
 	}
-	return books, nil
+	return books, total, nil
 }
 
-// GetBooksByAuthorID retrieves books by the given author ID
-func (s *Service) GetBooksByAuthorID(ctx context.Context, id int64) ([]book.Book, error) {
+// GetBooksByAuthorID retrieves the page of books by the given author ID in
+// any of languages and their number; no languages match books in every
+// language
+func (s *Service) GetBooksByAuthorID(ctx context.Context, id int64, library string, languages []string, opts repo.ListOptions) (_ []book.Book, _ int, err error) {
+	ctx, span := tracing.Start(ctx, "Service.GetBooksByAuthorID", append(listAttributes(opts), attribute.Int64("author.id", id),
+		attribute.String("library", library), attribute.StringSlice("languages", languages))...)
+	defer func() { tracing.End(span, err) }()
+
 	if id <= 0 {
-		return nil, fmt.Errorf("invalid author ID: %d", id)
+		return nil, 0, fmt.Errorf("invalid author ID: %d", id)
 	}
-	books, err := s.repo.GetBooksByAuthorID(id)
+	if err := s.checkLibrary(library); err != nil {
+		return nil, 0, err
+	}
+	_, repoSpan := tracing.Start(ctx, "repo.GetBooksByAuthorID")
+	books, total, err := s.repo.GetBooksByAuthorID(id, library, languages, opts)
+	tracing.End(repoSpan, err)
 	if err != nil {
-		return nil, fmt.Errorf("get books by author ID %d: %w", id, err)
+		return nil, 0, fmt.Errorf("get books by author ID %d: %w", id, err)
 	}
-	return books, nil
+	return books, total, nil
 }
 
-// GetRecentBooks retrieves recently added books with pagination
-func (s *Service) GetRecentBooks(ctx context.Context, limit, offset int) ([]book.Book, int, error) {
+// GetRecentBooks retrieves recently added books in any of languages with
+// pagination
+func (s *Service) GetRecentBooks(ctx context.Context, limit, offset int, library string, languages []string) (_ []book.Book, _ int, err error) {
+	ctx, span := tracing.Start(ctx, "Service.GetRecentBooks",
+		attribute.String("library", library), attribute.StringSlice("languages", languages))
+	defer func() { tracing.End(span, err) }()
+
 	if limit <= 0 {
 		limit = 50
 	}
 	if offset < 0 {
 		offset = 0
 	}
-	books, total, err := s.repo.GetRecentBooks(limit, offset)
+	if err := s.checkLibrary(library); err != nil {
+		return nil, 0, err
+	}
+	_, repoSpan := tracing.Start(ctx, "repo.GetRecentBooks")
+	books, total, err := s.repo.GetRecentBooks(limit, offset, library, languages)
+	tracing.End(repoSpan, err)
 	if err != nil {
 		return nil, 0, fmt.Errorf("get recent books: %w", err)
 	}
 	return books, total, nil
 }
 
-// GetBooksByGenre retrieves books by genre with pagination
-func (s *Service) GetBooksByGenre(ctx context.Context, genre string, limit, offset int) ([]book.Book, int, error) {
+// GetBooksByGenre retrieves books by genre in any of languages with
+// pagination
+func (s *Service) GetBooksByGenre(ctx context.Context, genre string, limit, offset int, library string, languages []string) (_ []book.Book, _ int, err error) {
+	ctx, span := tracing.Start(ctx, "Service.GetBooksByGenre", attribute.String("genre", genre),
+		attribute.String("library", library), attribute.StringSlice("languages", languages))
+	defer func() { tracing.End(span, err) }()
+
 	if genre == "" {
 		return nil, 0, fmt.Errorf("genre parameter cannot be empty")
 	}
@@ -125,24 +315,135 @@ func (s *Service) GetBooksByGenre(ctx context.Context, genre string, limit, offs
 	if offset < 0 {
 		offset = 0
 	}
-	books, total, err := s.repo.GetBooksByGenre(genre, limit, offset)
+	if err := s.checkLibrary(library); err != nil {
+		return nil, 0, err
+	}
+	_, repoSpan := tracing.Start(ctx, "repo.GetBooksByGenre")
+	books, total, err := s.repo.GetBooksByGenre(genre, limit, offset, library, languages)
+	tracing.End(repoSpan, err)
 	if err != nil {
 		return nil, 0, fmt.Errorf("get books by genre %q: %w", genre, err)
 	}
 	return books, total, nil
 }
 
+// GetSeriesByID retrieves a single series by ID
+func (s *Service) GetSeriesByID(ctx context.Context, id int64) (_ *book.SeriesInfo, err error) {
+	ctx, span := tracing.Start(ctx, "Service.GetSeriesByID", attribute.Int64("series.id", id))
+	defer func() { tracing.End(span, err) }()
+
+	if id <= 0 {
+		return nil, fmt.Errorf("invalid series ID: %d", id)
+	}
+	_, repoSpan := tracing.Start(ctx, "repo.GetSeriesByID")
+	series, err := s.repo.GetSeriesByID(id)
+	tracing.End(repoSpan, err)
+	if err != nil {
+		return nil, fmt.Errorf("get series by ID %d: %w", id, err)
+	}
+	return series, nil
+}
+
+// GetSeriesByLetter retrieves the page of series whose names start with the
+// given letter(s), with their number of books, and the number of such
+// series. An empty library matches books from every library.
+func (s *Service) GetSeriesByLetter(ctx context.Context, letters, library string, opts repo.ListOptions) (_ []book.SeriesWithBookCount, _ int, err error) {
+	ctx, span := tracing.Start(ctx, "Service.GetSeriesByLetter", append(listAttributes(opts),
+		attribute.String("letters", letters), attribute.String("library", library))...)
+	defer func() { tracing.End(span, err) }()
+
+	if letters == "" {
+		return nil, 0, fmt.Errorf("letters parameter cannot be empty")
+	}
+	if err := s.checkLibrary(library); err != nil {
+		return nil, 0, err
+	}
+	_, repoSpan := tracing.Start(ctx, "repo.GetSeriesWithBookCountByLetter")
+	series, total, err := s.repo.GetSeriesWithBookCountByLetter(letters, library, opts)
+	tracing.End(repoSpan, err)
+	if err != nil {
+		return nil, 0, fmt.Errorf("get series by letter %q: %w", letters, err)
+	}
+	return series, total, nil
+}
+
+// GetBooksBySeriesID retrieves the books of a series in series order.
+// An empty library matches books from every library.
+func (s *Service) GetBooksBySeriesID(ctx context.Context, id int64, library string) (_ []book.Book, err error) {
+	ctx, span := tracing.Start(ctx, "Service.GetBooksBySeriesID",
+		attribute.Int64("series.id", id), attribute.String("library", library))
+	defer func() { tracing.End(span, err) }()
+
+	if id <= 0 {
+		return nil, fmt.Errorf("invalid series ID: %d", id)
+	}
+	if err := s.checkLibrary(library); err != nil {
+		return nil, err
+	}
+	_, repoSpan := tracing.Start(ctx, "repo.GetBooksBySeriesID")
+	books, err := s.repo.GetBooksBySeriesID(id)
+	tracing.End(repoSpan, err)
+	if err != nil {
+		return nil, fmt.Errorf("get books by series ID %d: %w", id, err)
+	}
+	// Series are short; they are filtered by library here
+	if library != "" {
+		books = slices.DeleteFunc(books, func(b book.Book) bool { return b.Library != library })
+	}
+	return books, nil
+}
+
 // Genres
 
 // GetGenres retrieves all genres from the repository
-func (s *Service) GetGenres(ctx context.Context) ([]book.Genre, error) {
-	genres, err := s.repo.GetGenres()
+func (s *Service) GetGenres(ctx context.Context, library string) (_ []book.Genre, err error) {
+	ctx, span := tracing.Start(ctx, "Service.GetGenres", attribute.String("library", library))
+	defer func() { tracing.End(span, err) }()
+
+	if err := s.checkLibrary(library); err != nil {
+		return nil, err
+	}
+	_, repoSpan := tracing.Start(ctx, "repo.GetGenres")
+	genres, err := s.repo.GetGenres(library)
+	tracing.End(repoSpan, err)
 	if err != nil {
 		return nil, fmt.Errorf("get genres: %w", err)
 	}
 	return genres, nil
 }
 
+// GetGenreCategories retrieves the top-level genre categories with books in
+// the library, with their genre and book counts
+func (s *Service) GetGenreCategories(ctx context.Context, library string) (_ []book.GenreCategory, err error) {
+	ctx, span := tracing.Start(ctx, "Service.GetGenreCategories", attribute.String("library", library))
+	defer func() { tracing.End(span, err) }()
+
+	if err := s.checkLibrary(library); err != nil {
+		return nil, err
+	}
+	_, repoSpan := tracing.Start(ctx, "repo.GetGenreCategories")
+	categories, err := s.repo.GetGenreCategories(library)
+	tracing.End(repoSpan, err)
+	if err != nil {
+		return nil, fmt.Errorf("get genre categories: %w", err)
+	}
+	return categories, nil
+}
+
+// GetGenresByCategory retrieves the genres of a category with books in the
+// library
+func (s *Service) GetGenresByCategory(ctx context.Context, category, library string) (_ []book.Genre, err error) {
+	ctx, span := tracing.Start(ctx, "Service.GetGenresByCategory",
+		attribute.String("category", category), attribute.String("library", library))
+	defer func() { tracing.End(span, err) }()
+
+	genres, err := s.GetGenres(ctx, library)
+	if err != nil {
+		return nil, err
+	}
+	return slices.DeleteFunc(genres, func(g book.Genre) bool { return g.Category != category }), nil
+}
+
 // Write operations
 
 // AddBook adds a new book to the repository
@@ -170,6 +471,11 @@ func (s *Service) GetBookByID(ctx context.Context, id int64) (*book.Book, error)
 	return s.downloadService.GetBookByID(ctx, id)
 }
 
+// GetBookAnnotation returns the annotation read from the book's file
+func (s *Service) GetBookAnnotation(ctx context.Context, b *book.Book) (string, error) {
+	return s.downloadService.GetBookAnnotation(ctx, b)
+}
+
 // DownloadBookFB2 returns an FB2 file stream for download
 func (s *Service) DownloadBookFB2(ctx context.Context, id int64) (io.ReadCloser, string, int64, error) {
 	return s.downloadService.DownloadBookFB2(ctx, id)
@@ -190,15 +496,86 @@ func (s *Service) DownloadBookMOBI(ctx context.Context, id int64) (io.ReadCloser
 	return s.downloadService.DownloadBookMOBI(ctx, id)
 }
 
-// SearchBooks performs full-text search across books by title and/or author
-func (s *Service) SearchBooks(ctx context.Context, query string, limit, offset int, fields []string, languages []string) ([]book.BookSearchResult, error) {
+// DownloadBookConverted returns the book converted to one of the registered
+// output formats with the named conversion profile
+func (s *Service) DownloadBookConverted(ctx context.Context, id int64, format, profile string) (io.ReadCloser, string, int64, error) {
+	return s.downloadService.DownloadBookConverted(ctx, id, format, profile)
+}
+
+// AuthorBundle collects the author's books for a bulk download
+func (s *Service) AuthorBundle(ctx context.Context, authorID int64) (*Bundle, error) {
+	return s.downloadService.AuthorBundle(ctx, authorID)
+}
+
+// SeriesBundle collects the series' books for a bulk download
+func (s *Service) SeriesBundle(ctx context.Context, seriesID int64) (*Bundle, error) {
+	return s.downloadService.SeriesBundle(ctx, seriesID)
+}
+
+// WriteBundle streams the bundle's books in format as a ZIP archive to w
+func (s *Service) WriteBundle(ctx context.Context, w io.Writer, bundle *Bundle, format, profile string) (int, error) {
+	return s.downloadService.WriteBundle(ctx, w, bundle, format, profile)
+}
+
+// ResolveProfile returns the conversion profile for a request naming
+// requested, falling back to the user's and the configured default
+func (s *Service) ResolveProfile(requested, user string) (string, error) {
+	return s.downloadService.ResolveProfile(requested, user)
+}
+
+// Conversion jobs
+
+// StartJobs resumes unfinished conversion jobs and runs new ones until ctx is cancelled
+func (s *Service) StartJobs(ctx context.Context) error {
+	return s.jobService.Start(ctx)
+}
+
+// WaitJobs waits for running jobs to stop after StartJobs' context is cancelled
+func (s *Service) WaitJobs() {
+	s.jobService.Wait()
+}
+
+// EnqueueConversion queues a background conversion of the book to format
+// with the named profile, or returns an earlier job for the same conversion
+func (s *Service) EnqueueConversion(ctx context.Context, bookID int64, format, profile string) (*book.Job, error) {
+	return s.jobService.EnqueueConversion(ctx, bookID, format, profile)
+}
+
+// EnqueueSend queues converting the book with the named profile and
+// e-mailing it to the user's configured address
+func (s *Service) EnqueueSend(ctx context.Context, bookID int64, user, profile string) (*book.Job, error) {
+	return s.jobService.EnqueueSend(ctx, bookID, user, profile)
+}
+
+// GetJob returns a conversion job by ID
+func (s *Service) GetJob(ctx context.Context, id int64) (*book.Job, error) {
+	return s.jobService.GetJob(ctx, id)
+}
+
+// OpenJobResult returns the converted file of a finished job
+func (s *Service) OpenJobResult(ctx context.Context, id int64) (io.ReadCloser, *book.Job, int64, error) {
+	return s.jobService.OpenJobResult(ctx, id)
+}
+
+// SearchBooks performs full-text search across books by title and/or
+// author, returning the page of results and their number
+func (s *Service) SearchBooks(ctx context.Context, query string, opts repo.ListOptions, fields []string, languages []string, libraries []string) (_ []book.BookSearchResult, _ int, err error) {
+	ctx, span := tracing.Start(ctx, "Service.SearchBooks", append(listAttributes(opts),
+		attribute.String("query", query), attribute.StringSlice("languages", languages))...)
+	defer func() { tracing.End(span, err) }()
+
 	if query == "" {
-		return []book.BookSearchResult{}, nil
+		return []book.BookSearchResult{}, 0, nil
+	}
+	for _, library := range libraries {
+		if err := s.checkLibrary(library); err != nil {
+			return nil, 0, err
+		}
 	}
 
-	books, err := s.repo.SearchBooks(ctx, query, limit, offset, fields, languages)
+	books, total, err := s.repo.SearchBooks(ctx, query, opts, fields, languages, libraries)
 	if err != nil {
-		return nil, fmt.Errorf("search books: %w", err)
+		return nil, 0, fmt.Errorf("search books: %w", err)
 	}
-	return books, nil
+	return books, total, nil
 }
@@ -1,11 +1,20 @@
 package service
 
 import (
+	"archive/zip"
+	"bytes"
 	"context"
+	"io"
+	"path/filepath"
+	"slices"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/htol/bopds/book"
+	"github.com/htol/bopds/config"
 	"github.com/htol/bopds/logger"
+	"github.com/htol/bopds/repo"
 )
 
 func init() {
@@ -19,7 +28,10 @@ type mockRepository struct {
 	authorsError error
 	books        []string
 	booksError   error
+	authorBooks  []book.Book
+	prefixes     []book.Prefix
 	genres       []book.Genre
+	categories   []book.GenreCategory
 	genresError  error
 	pingError    error
 }
@@ -84,9 +96,9 @@ func (m *mockRepository) GetAuthorsWithBookCount() ([]book.AuthorWithBookCount,
 	return result, nil
 }
 
-func (m *mockRepository) GetAuthorsWithBookCountByLetter(letters string) ([]book.AuthorWithBookCount, error) {
+func (m *mockRepository) GetAuthorsWithBookCountByLetter(letters, library string, opts repo.ListOptions) ([]book.AuthorWithBookCount, int, error) {
 	if m.authorsError != nil {
-		return nil, m.authorsError
+		return nil, 0, m.authorsError
 	}
 	var result []book.AuthorWithBookCount
 	for _, author := range m.authors {
@@ -102,7 +114,7 @@ func (m *mockRepository) GetAuthorsWithBookCountByLetter(letters string) ([]book
 			}
 		}
 	}
-	return result, nil
+	return result, len(result), nil
 }
 
 func (m *mockRepository) GetBooks() ([]string, error) {
@@ -112,18 +124,18 @@ func (m *mockRepository) GetBooks() ([]string, error) {
 	return m.books, nil
 }
 
-func (m *mockRepository) GetBooksByLetter(letters string) ([]book.Book, error) {
+func (m *mockRepository) GetBooksByLetter(letters, library string, opts repo.ListOptions) ([]book.Book, int, error) {
 	if m.booksError != nil {
-		return nil, m.booksError
+		return nil, 0, m.booksError
 	}
-	return []book.Book{}, nil
+	return []book.Book{}, 0, nil
 }
 
-func (m *mockRepository) GetBooksByAuthorID(id int64) ([]book.Book, error) {
+func (m *mockRepository) GetBooksByAuthorID(id int64, library string, languages []string, opts repo.ListOptions) ([]book.Book, int, error) {
 	if m.booksError != nil {
-		return nil, m.booksError
+		return nil, 0, m.booksError
 	}
-	return []book.Book{}, nil
+	return slices.Clone(m.authorBooks), len(m.authorBooks), nil
 }
 
 func (m *mockRepository) GetBookByID(id int64) (*book.Book, error) {
@@ -133,27 +145,53 @@ func (m *mockRepository) GetBookByID(id int64) (*book.Book, error) {
 	return nil, &testError{msg: "book not found"}
 }
 
-func (m *mockRepository) GetRecentBooks(limit, offset int) ([]book.Book, int, error) {
+func (m *mockRepository) GetRecentBooks(limit, offset int, library string, languages []string) ([]book.Book, int, error) {
 	if m.booksError != nil {
 		return nil, 0, m.booksError
 	}
 	return []book.Book{}, 0, nil
 }
 
-func (m *mockRepository) GetBooksByGenre(genre string, limit, offset int) ([]book.Book, int, error) {
+func (m *mockRepository) GetBooksByGenre(genre string, limit, offset int, library string, languages []string) ([]book.Book, int, error) {
 	if m.booksError != nil {
 		return nil, 0, m.booksError
 	}
 	return []book.Book{}, 0, nil
 }
 
-func (m *mockRepository) GetGenres() ([]book.Genre, error) {
+func (m *mockRepository) GetSeriesByID(id int64) (*book.SeriesInfo, error) {
+	return nil, repo.ErrNotFound
+}
+
+func (m *mockRepository) GetSeriesWithBookCountByLetter(letters, library string, opts repo.ListOptions) ([]book.SeriesWithBookCount, int, error) {
+	return []book.SeriesWithBookCount{}, 0, nil
+}
+
+func (m *mockRepository) GetPrefixes(index repo.PrefixIndex, prefix, library string) ([]book.Prefix, error) {
+	return slices.Clone(m.prefixes), nil
+}
+
+func (m *mockRepository) GetBooksBySeriesID(seriesID int64) ([]book.Book, error) {
+	if m.booksError != nil {
+		return nil, m.booksError
+	}
+	return []book.Book{}, nil
+}
+
+func (m *mockRepository) GetGenres(library string) ([]book.Genre, error) {
 	if m.genresError != nil {
 		return nil, m.genresError
 	}
 	return m.genres, nil
 }
 
+func (m *mockRepository) GetGenreCategories(library string) ([]book.GenreCategory, error) {
+	if m.genresError != nil {
+		return nil, m.genresError
+	}
+	return m.categories, nil
+}
+
 func (m *mockRepository) Add(b *book.Book) error {
 	return nil
 }
@@ -166,8 +204,8 @@ func (m *mockRepository) List() error {
 	return nil
 }
 
-func (m *mockRepository) SearchBooks(ctx context.Context, query string, limit, offset int, fields []string, languages []string) ([]book.BookSearchResult, error) {
-	return []book.BookSearchResult{}, nil
+func (m *mockRepository) SearchBooks(ctx context.Context, query string, opts repo.ListOptions, fields []string, languages []string, libraries []string) ([]book.BookSearchResult, int, error) {
+	return []book.BookSearchResult{}, 0, nil
 }
 
 func (m *mockRepository) GetLanguages() ([]string, error) {
@@ -202,6 +240,34 @@ func (m *mockRepository) CheckpointWAL() error {
 	return nil
 }
 
+func (m *mockRepository) CreateJob(job *book.Job) error {
+	return nil
+}
+
+func (m *mockRepository) UpdateJob(job *book.Job) error {
+	return nil
+}
+
+func (m *mockRepository) TouchJob(id int64) error {
+	return nil
+}
+
+func (m *mockRepository) GetJob(id int64) (*book.Job, error) {
+	return nil, repo.ErrNotFound
+}
+
+func (m *mockRepository) FindJob(kind string, bookID int64, format, profile string) (*book.Job, error) {
+	return nil, repo.ErrNotFound
+}
+
+func (m *mockRepository) GetUnfinishedJobs() ([]book.Job, error) {
+	return nil, nil
+}
+
+func (m *mockRepository) ExpireJobs(before time.Time) ([]book.Job, error) {
+	return nil, nil
+}
+
 func TestService_GetAuthors(t *testing.T) {
 	tests := []struct {
 		name        string
@@ -275,7 +341,7 @@ func TestService_GetAuthorsByLetter_EmptyString(t *testing.T) {
 	svc := New(mockRepo)
 
 	ctx := context.Background()
-	_, err := svc.GetAuthorsByLetter(ctx, "")
+	_, _, err := svc.GetAuthorsByLetter(ctx, "", "", repo.ListOptions{})
 
 	if err == nil {
 		t.Errorf("Expected error for empty letters parameter")
@@ -286,6 +352,66 @@ func TestService_GetAuthorsByLetter_EmptyString(t *testing.T) {
 	}
 }
 
+func TestService_GetAuthorBooks(t *testing.T) {
+	svc := New(&mockRepository{authorBooks: []book.Book{
+		{BookID: 1, Title: "Hard to Be a God", DateAdded: "2024-01-02", Series: &book.SeriesInfo{ID: 1, Name: "Noon Universe", SeriesNo: 3}},
+		{BookID: 2, Title: "roadside Picnic", DateAdded: "2024-03-01"},
+		{BookID: 3, Title: "Noon: 22nd Century", DateAdded: "2024-01-02", Series: &book.SeriesInfo{ID: 1, Name: "Noon Universe", SeriesNo: 1}},
+		{BookID: 4, Title: "Monday Begins on Saturday", DateAdded: "2023-12-31", Series: &book.SeriesInfo{ID: 2, Name: "NIICHAVO"}},
+	}})
+	ctx := context.Background()
+
+	ids := func(books []book.Book) []int64 {
+		var ids []int64
+		for _, b := range books {
+			ids = append(ids, b.BookID)
+		}
+		return ids
+	}
+
+	tests := []struct {
+		view          AuthorBooksView
+		limit, offset int
+		expect        []int64
+		expectTotal   int
+	}{
+		{AuthorBooksAll, 0, 0, []int64{1, 4, 3, 2}, 4},
+		{AuthorBooksAll, 2, 2, []int64{3, 2}, 4},
+		{AuthorBooksAll, 2, 10, nil, 4},
+		{AuthorBooksNoSeries, 10, 0, []int64{2}, 1},
+		{AuthorBooksRecent, 10, 0, []int64{2, 3, 1, 4}, 4},
+	}
+	for _, tt := range tests {
+		books, total, err := svc.GetAuthorBooks(ctx, 7, "", nil, tt.view, tt.limit, tt.offset)
+		if err != nil {
+			t.Fatalf("%s: %v", tt.view, err)
+		}
+		if got := ids(books); !slices.Equal(got, tt.expect) || total != tt.expectTotal {
+			t.Errorf("%s %d+%d: expected %v of %d, got %v of %d", tt.view, tt.offset, tt.limit, tt.expect, tt.expectTotal, got, total)
+		}
+	}
+	if _, _, err := svc.GetAuthorBooks(ctx, 7, "", nil, "bogus", 10, 0); err == nil {
+		t.Error("expected an error for an unknown view")
+	}
+
+	series, err := svc.GetAuthorSeries(ctx, 7, "", nil)
+	if err != nil {
+		t.Fatalf("get author series: %v", err)
+	}
+	expectSeries := []book.SeriesWithBookCount{{ID: 2, Name: "NIICHAVO", BookCount: 1}, {ID: 1, Name: "Noon Universe", BookCount: 2}}
+	if !slices.Equal(series, expectSeries) {
+		t.Errorf("expected series %v, got %v", expectSeries, series)
+	}
+
+	books, total, err := svc.GetAuthorSeriesBooks(ctx, 7, 1, "", nil, 10, 0)
+	if err != nil {
+		t.Fatalf("get author series books: %v", err)
+	}
+	if got := ids(books); !slices.Equal(got, []int64{3, 1}) || total != 2 {
+		t.Errorf("expected books [3 1] in series order, got %v of %d", got, total)
+	}
+}
+
 func TestService_GetGenres(t *testing.T) {
 	tests := []struct {
 		name        string
@@ -330,7 +456,7 @@ func TestService_GetGenres(t *testing.T) {
 			svc := New(mockRepo)
 
 			ctx := context.Background()
-			genres, err := svc.GetGenres(ctx)
+			genres, err := svc.GetGenres(ctx, "")
 
 			if tt.expectError {
 				if err == nil {
@@ -351,6 +477,69 @@ func TestService_GetGenres(t *testing.T) {
 	}
 }
 
+func TestService_GetGenresByCategory(t *testing.T) {
+	tests := []struct {
+		name     string
+		category string
+		expected []string
+	}{
+		{"category with genres", "sf", []string{"sf_space", "sf_fantasy"}},
+		{"single genre", "detective", []string{"det_police"}},
+		{"unknown category", "cooking", []string{}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			svc := New(&mockRepository{genres: []book.Genre{
+				{Name: "sf_space", Category: "sf"},
+				{Name: "det_police", Category: "detective"},
+				{Name: "sf_fantasy", Category: "sf"},
+			}})
+
+			genres, err := svc.GetGenresByCategory(context.Background(), tt.category, "")
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			names := make([]string, 0, len(genres))
+			for _, g := range genres {
+				names = append(names, g.Name)
+			}
+			if !slices.Equal(names, tt.expected) {
+				t.Errorf("Expected genres %v, got %v", tt.expected, names)
+			}
+		})
+	}
+}
+
+func TestService_ResolveBookLanguages(t *testing.T) {
+	cfg := config.Default()
+	cfg.Catalog.BookLanguages = []string{"ru"}
+	cfg.Catalog.UserBookLanguages = map[string][]string{"alice": {"en", "uk"}, "bob": {}}
+	svc := NewWithConfig(&mockRepository{}, cfg)
+
+	tests := []struct {
+		name      string
+		requested string
+		user      string
+		expected  []string
+	}{
+		{"configured default", "", "", []string{"ru"}},
+		{"user languages", "", "alice", []string{"en", "uk"}},
+		{"user without limit", "", "bob", nil},
+		{"unknown user", "", "carol", []string{"ru"}},
+		{"requested", "BE, uk", "alice", []string{"be", "uk"}},
+		{"all requested", AllLanguages, "alice", nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := svc.ResolveBookLanguages(tt.requested, tt.user); !slices.Equal(got, tt.expected) {
+				t.Errorf("expected %v, got %v", tt.expected, got)
+			}
+		})
+	}
+}
+
 func TestService_Ping(t *testing.T) {
 	tests := []struct {
 		name        string
@@ -417,3 +606,88 @@ type testError struct {
 func (e *testError) Error() string {
 	return e.msg
 }
+
+func TestDownloadService_ArchivePath(t *testing.T) {
+	cfg := &config.Config{
+		Libraries: []config.LibraryConfig{
+			{Name: "flibusta", Path: "/library"},
+			{Name: "personal", Path: "/home/user/books"},
+		},
+	}
+	ds := NewDownloadService(&mockRepository{}, cfg)
+
+	tests := []struct {
+		name        string
+		book        book.Book
+		expected    string
+		expectError bool
+	}{
+		{
+			name:     "relative path in named library",
+			book:     book.Book{Archive: "fb2-000001.zip", Library: "flibusta"},
+			expected: filepath.Join("/library", "fb2-000001.zip"),
+		},
+		{
+			name:     "relative path without library uses default root",
+			book:     book.Book{Archive: "fb2-000001.zip"},
+			expected: filepath.Join("/library", "fb2-000001.zip"),
+		},
+		{
+			name:     "legacy absolute path",
+			book:     book.Book{Archive: "/home/user/lib/fb2-000001.zip"},
+			expected: "/home/user/lib/fb2-000001.zip",
+		},
+		{
+			name:     "relative path in second library",
+			book:     book.Book{Archive: "sub/books.zip", Library: "personal"},
+			expected: filepath.Join("/home/user/books", "sub/books.zip"),
+		},
+		{
+			name:        "unknown library",
+			book:        book.Book{Archive: "fb2-000001.zip", Library: "librusec"},
+			expectError: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ds.archivePath(&tt.book)
+			if tt.expectError {
+				if err == nil {
+					t.Errorf("Expected error but got none")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			if got != tt.expected {
+				t.Errorf("Expected %q, got %q", tt.expected, got)
+			}
+		})
+	}
+}
+
+func TestWriteFB2Zip(t *testing.T) {
+	fb2 := strings.Repeat("<p>Глава</p>\n", 1000)
+	var buf bytes.Buffer
+	if err := writeFB2Zip(&buf, "Толстой Лев - Война и мир.fb2", strings.NewReader(fb2)); err != nil {
+		t.Fatalf("writeFB2Zip failed: %v", err)
+	}
+
+	zr, err := zip.NewReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+	if err != nil {
+		t.Fatalf("output is not a ZIP archive: %v", err)
+	}
+	if len(zr.File) != 1 || zr.File[0].Name != "Толстой Лев - Война и мир.fb2" || zr.File[0].Flags&0x800 == 0 {
+		t.Fatalf("expected a single UTF-8 named entry, got %+v", zr.File)
+	}
+	if zr.File[0].Method != zip.Deflate || buf.Len() >= len(fb2) {
+		t.Errorf("expected a compressed entry, archive is %d bytes for %d", buf.Len(), len(fb2))
+	}
+	r, _ := zr.File[0].Open()
+	defer r.Close()
+	if got, _ := io.ReadAll(r); string(got) != fb2 {
+		t.Error("entry does not round-trip")
+	}
+}